@@ -36,6 +36,8 @@ func backupTree(c *cli.Context) error {
 		return err
 	}
 
+	defer store.Close()
+
 	ctx := context.Background()
 
 	rawTree, err := store.RGet(ctx, path)
@@ -6,13 +6,30 @@ import (
 	"os"
 	"os/user"
 	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/nethack42/gokv"
 
+	_ "github.com/nethack42/gokv/providers/bolt"
+	_ "github.com/nethack42/gokv/providers/consul"
+	_ "github.com/nethack42/gokv/providers/document"
+	_ "github.com/nethack42/gokv/providers/env"
 	_ "github.com/nethack42/gokv/providers/etcd"
+	_ "github.com/nethack42/gokv/providers/etcd3"
+	_ "github.com/nethack42/gokv/providers/file"
+	_ "github.com/nethack42/gokv/providers/git"
+	_ "github.com/nethack42/gokv/providers/memcache"
 	_ "github.com/nethack42/gokv/providers/memory"
+	_ "github.com/nethack42/gokv/providers/redis"
+	_ "github.com/nethack42/gokv/providers/s3"
+	_ "github.com/nethack42/gokv/providers/sql"
+	_ "github.com/nethack42/gokv/providers/vault"
+	_ "github.com/nethack42/gokv/providers/zookeeper"
+
+	// pure-Go SQLite driver used by the sql provider
+	_ "github.com/glebarez/go-sqlite"
 
 	"gopkg.in/urfave/cli.v2"
 )
@@ -130,6 +147,8 @@ func main() {
 					return err
 				}
 
+				defer k.Close()
+
 				key := c.Args().Get(0)
 				if key == "" {
 					key = "/"
@@ -171,6 +190,8 @@ func main() {
 					return err
 				}
 
+				defer kv.Close()
+
 				key := c.Args().Get(0)
 				if key == "" {
 					key = "/"
@@ -210,6 +231,8 @@ func main() {
 					return err
 				}
 
+				defer kv.Close()
+
 				key := c.Args().Get(0)
 				if key == "" {
 					key = "/"
@@ -271,8 +294,47 @@ func main() {
 		},
 
 		&cli.Command{
-			Name:  "proxy",
-			Usage: "Launch HTTP API proxy with integrated WebUI",
+			Name:   "proxy",
+			Usage:  "Launch HTTP API proxy with integrated WebUI",
+			Action: runProxy,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "listen",
+					Aliases: []string{"l"},
+					Usage:   "Address to listen on",
+					Value:   "127.0.0.1:8080",
+				},
+				&cli.DurationFlag{
+					Name:  "heartbeat",
+					Usage: "Interval of heartbeats sent on idle watch streams",
+					Value: 15 * time.Second,
+				},
+				&cli.IntFlag{
+					Name:  "watch-buffer",
+					Usage: "Number of events queued per watch stream before disconnecting slow clients",
+					Value: 256,
+				},
+				&cli.BoolFlag{
+					Name:  "etcd-v2",
+					Usage: "Serve the etcd v2 keys API below /v2/keys for tools written for etcd",
+				},
+				&cli.StringFlag{
+					Name:  "policy",
+					Usage: "Policy file defining identities and their access; without a policy all requests are allowed",
+				},
+				&cli.StringFlag{
+					Name:  "tls-cert",
+					Usage: "Certificate file to serve HTTPS",
+				},
+				&cli.StringFlag{
+					Name:  "tls-key",
+					Usage: "Private key file of the certificate",
+				},
+				&cli.StringFlag{
+					Name:  "tls-client-ca",
+					Usage: "CA file to verify client certificates against; enables authentication using client certificates",
+				},
+			},
 		},
 
 		&cli.Command{
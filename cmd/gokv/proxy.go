@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nethack42/gokv/proxy"
+	"golang.org/x/net/context"
+	"gopkg.in/urfave/cli.v2"
+)
+
+func runProxy(c *cli.Context) error {
+	if c.Duration("heartbeat") <= 0 || c.Int("watch-buffer") <= 0 {
+		return fmt.Errorf("heartbeat and watch-buffer must be positive")
+	}
+
+	store, err := getKV(c)
+	if err != nil {
+		return err
+	}
+
+	defer store.Close()
+
+	handler := proxy.New(store)
+	handler.Heartbeat = c.Duration("heartbeat")
+	handler.WatchBuffer = c.Int("watch-buffer")
+	handler.EtcdV2 = c.Bool("etcd-v2")
+
+	if p := c.String("policy"); p != "" {
+		if handler.Policy, err = proxy.LoadPolicy(p); err != nil {
+			return err
+		}
+	}
+
+	// watch streams are never idle and WebSocket connections are hijacked,
+	// so Shutdown does not wait for them. Cancelling the base context of all
+	// requests ends them once the server shuts down
+	base, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	srv := &http.Server{
+		Addr:    c.String("listen"),
+		Handler: handler,
+		BaseContext: func(net.Listener) context.Context {
+			return base
+		},
+	}
+
+	srv.RegisterOnShutdown(stop)
+
+	if srv.TLSConfig, err = proxyTLSConfig(c); err != nil {
+		return err
+	}
+
+	if srv.TLSConfig == nil && handler.Policy != nil {
+		fmt.Fprintf(os.Stderr, "warning: tokens are sent unencrypted, use --tls-cert to enable HTTPS\n")
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errs <- srv.ListenAndServeTLS(c.String("tls-cert"), c.String("tls-key"))
+		} else {
+			errs <- srv.ListenAndServe()
+		}
+	}()
+
+	fmt.Fprintf(os.Stderr, "serving HTTP API on %s\n", srv.Addr)
+
+	// shut down gracefully so the store is closed properly
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	select {
+	case err := <-errs:
+		return err
+	case <-sig:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return srv.Shutdown(ctx)
+}
+
+// proxyTLSConfig returns the TLS configuration of the proxy or nil if HTTPS
+// has not been enabled. Client certificates are verified if a CA is given
+func proxyTLSConfig(c *cli.Context) (*tls.Config, error) {
+	if c.String("tls-cert") == "" {
+		if c.String("tls-key") != "" || c.String("tls-client-ca") != "" {
+			return nil, fmt.Errorf("--tls-key and --tls-client-ca require --tls-cert")
+		}
+
+		return nil, nil
+	}
+
+	if c.String("tls-key") == "" {
+		return nil, fmt.Errorf("--tls-cert requires --tls-key")
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if ca := c.String("tls-client-ca"); ca != "" {
+		data, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", ca)
+		}
+
+		// clients may still authenticate using tokens
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
@@ -54,6 +54,8 @@ func restoreTree(c *cli.Context) error {
 		return err
 	}
 
+	defer store.Close()
+
 	saveNode(store, tree)
 
 	return nil
@@ -0,0 +1,25 @@
+package kv
+
+import "errors"
+
+var (
+	// ErrNotFound is returned (possibly wrapped) by providers if a key does not
+	// exist
+	ErrNotFound = errors.New("key does not exist")
+
+	// ErrCompareFailed is returned by CAS if the current value of a key does
+	// not match the expected one
+	ErrCompareFailed = errors.New("compare failed")
+
+	// ErrReadOnly is returned (possibly wrapped) by read-only providers for all
+	// modifying operations
+	ErrReadOnly = errors.New("provider is read-only")
+
+	// ErrCompacted is returned (possibly wrapped) by WatchEvents if a watch
+	// cannot be resumed because the requested revision is no longer available
+	ErrCompacted = errors.New("revision has been compacted")
+
+	// ErrNotSupported is returned (possibly wrapped) by KV stores if the
+	// provider does not implement an operation
+	ErrNotSupported = errors.New("not supported by provider")
+)
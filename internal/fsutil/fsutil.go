@@ -0,0 +1,3 @@
+// Package fsutil implements file locking and change notifications shared by
+// the providers storing data in the local file system.
+package fsutil
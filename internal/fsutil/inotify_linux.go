@@ -0,0 +1,97 @@
+//go:build linux
+// +build linux
+
+package fsutil
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/context"
+)
+
+// Inotify reports changes of watched files and directories
+type Inotify struct {
+	fd   int
+	file *os.File
+	buf  []byte
+}
+
+// Event is a single change reported by Inotify
+type Event struct {
+	// Wd identifies the watch that reported the event
+	Wd int
+
+	// Mask holds the inotify flags describing the event
+	Mask uint32
+
+	// Name holds the name of the changed entry within a watched directory
+	Name string
+}
+
+// NewInotify creates a new inotify instance without any watches
+func NewInotify() (*Inotify, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Inotify{
+		fd: fd,
+		// using a non-blocking file descriptor allows to interrupt pending
+		// reads by closing the file
+		file: os.NewFile(uintptr(fd), "inotify"),
+		buf:  make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)),
+	}, nil
+}
+
+// Add watches p for the events in mask and returns the watch descriptor
+func (i *Inotify) Add(p string, mask uint32) (int, error) {
+	return syscall.InotifyAddWatch(i.fd, p, mask)
+}
+
+// Read blocks until events are available or ctx is done. The instance is
+// closed once ctx is done
+func (i *Inotify) Read(ctx context.Context) ([]Event, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			i.file.Close()
+		case <-done:
+		}
+	}()
+
+	n, err := i.file.Read(i.buf)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	var events []Event
+
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+		ev := (*syscall.InotifyEvent)(unsafe.Pointer(&i.buf[offset]))
+		start := offset + syscall.SizeofInotifyEvent
+		offset = start + int(ev.Len)
+
+		events = append(events, Event{
+			Wd:   int(ev.Wd),
+			Mask: ev.Mask,
+			Name: strings.TrimRight(string(i.buf[start:offset]), "\x00"),
+		})
+	}
+
+	return events, nil
+}
+
+// Close stops all watches
+func (i *Inotify) Close() error {
+	return i.file.Close()
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package fsutil
+
+import "sync"
+
+// processLock is used on platforms without flock support. It only serializes
+// writers within the current process
+var processLock sync.Mutex
+
+// Lock acquires an exclusive lock. The returned function must be called to
+// release the lock
+func Lock(p string) (func(), error) {
+	processLock.Lock()
+
+	return processLock.Unlock, nil
+}
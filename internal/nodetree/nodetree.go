@@ -0,0 +1,90 @@
+// Package nodetree builds kv.Node hierarchies from flat lists of keys as
+// returned by providers without native directories.
+package nodetree
+
+import (
+	"sort"
+
+	"github.com/nethack42/gokv"
+)
+
+// Tree is a single level of a node hierarchy
+type Tree struct {
+	// Node holds the node of this level without its children
+	Node kv.Node
+
+	children map[string]*Tree
+}
+
+// New creates the directory node key as root of a hierarchy
+func New(key string) *Tree {
+	return &Tree{
+		Node: kv.Node{
+			Key:   key,
+			IsDir: true,
+		},
+		children: make(map[string]*Tree),
+	}
+}
+
+// Child returns the child called name, creating it if it does not exist yet.
+// Once requested as directory, the child stays a directory
+func (t *Tree) Child(name string, isDir bool) *Tree {
+	if c, ok := t.children[name]; ok {
+		if isDir {
+			c.Node.IsDir = true
+		}
+		return c
+	}
+
+	key := name
+	if t.Node.Key != "" {
+		key = t.Node.Key + "/" + name
+	}
+
+	c := &Tree{
+		Node: kv.Node{
+			Key:   key,
+			IsDir: isDir,
+		},
+		children: make(map[string]*Tree),
+	}
+
+	t.children[name] = c
+	return c
+}
+
+// Lookup returns the existing child called name
+func (t *Tree) Lookup(name string) (*Tree, bool) {
+	c, ok := t.children[name]
+	return c, ok
+}
+
+// Convert returns the node including its children, sorted by name, up to
+// depth levels (-1 means unlimited). Values shadowed by directories are not
+// exposed
+func (t *Tree) Convert(depth int) kv.Node {
+	node := t.Node
+
+	if !node.IsDir {
+		return node
+	}
+
+	node.Value = nil
+
+	if depth == 0 {
+		return node
+	}
+
+	names := make([]string, 0, len(t.children))
+	for name := range t.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		node.Children = append(node.Children, t.children[name].Convert(depth-1))
+	}
+
+	return node
+}
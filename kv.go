@@ -4,6 +4,7 @@ package kv
 
 import (
 	"fmt"
+	"io"
 	"sync"
 	"time"
 
@@ -32,6 +33,79 @@ type Node struct {
 	// Value holds the value of the node, if any. This field is only valid if
 	// IsDir is set to false
 	Value []byte `json:"value,omitempty"`
+
+	// Revision holds the revision at which the node has been modified last.
+	// This field is optional and only set by providers supporting revisions
+	Revision uint64 `json:"revision,omitempty"`
+}
+
+// EventType describes the kind of change reported by an Event
+type EventType string
+
+const (
+	// EventSet is reported when a value has been created or updated
+	EventSet EventType = "set"
+
+	// EventDelete is reported when a node has been deleted
+	EventDelete EventType = "delete"
+
+	// EventExpire is reported when a value has been deleted because its TTL
+	// expired
+	EventExpire EventType = "expire"
+
+	// EventCompareAndSwap is reported when a value has been updated using CAS
+	EventCompareAndSwap EventType = "compareAndSwap"
+)
+
+// Event describes a change of a node
+type Event struct {
+	// Type holds the kind of change
+	Type EventType `json:"type"`
+
+	// Node holds the node after the change. For delete and expire events only
+	// the Key is set
+	Node Node `json:"node"`
+
+	// Revision holds the revision of the change. It may be passed as
+	// WatchOptions.AfterRevision to resume a watch. This field is optional
+	Revision uint64 `json:"revision,omitempty"`
+}
+
+// WatchOptions configures a watch started using EventWatcher
+type WatchOptions struct {
+	// Recursive also reports changes of all nodes below the watched key
+	Recursive bool
+
+	// AfterRevision only reports changes that happened after the given
+	// revision. If zero, only changes after starting the watch are reported
+	AfterRevision uint64
+}
+
+// OpType describes the kind of an operation within a transaction
+type OpType string
+
+const (
+	// OpSet sets the value of a key
+	OpSet OpType = "set"
+
+	// OpDelete deletes a key
+	OpDelete OpType = "delete"
+
+	// OpCompare aborts the transaction if the value of a key does not match.
+	// A nil value requires the key to not exist
+	OpCompare OpType = "compare"
+)
+
+// Op describes a single operation within a transaction
+type Op struct {
+	// Type holds the kind of operation
+	Type OpType `json:"type"`
+
+	// Key holds the key of the operation
+	Key string `json:"key"`
+
+	// Value holds the value to set or compare
+	Value []byte `json:"value,omitempty"`
 }
 
 // Provider wraps databases providing basic KV operations. Users developing new
@@ -64,8 +138,29 @@ type KV interface {
 	// KeyWatcher allows to watch a key for changes
 	KeyWatcher
 
+	// EventWatcher allows to stream changes of keys
+	EventWatcher
+
+	// Transactor allows to execute multiple operations atomically
+	Transactor
+
 	// FileOps provides some file-like functionality like Copy or Move
 	FileOps
+
+	// TTLSetter allows to set values that expire after a given duration
+	TTLSetter
+
+	// TTLSwapper allows to CAS values that expire after a given duration
+	TTLSwapper
+
+	// Locker allows to acquire exclusive locks
+	Locker
+
+	// Versioner allows to access previous versions of keys
+	Versioner
+
+	// Closer releases all resources held by the provider
+	io.Closer
 }
 
 // RecursiveGetter allows to retrieve nodes recursively
@@ -78,6 +173,79 @@ type KeyWatcher interface {
 	Watch(context.Context, string) (*Node, error)
 }
 
+// EventWatcher allows to stream changes of keys
+type EventWatcher interface {
+	// WatchEvents streams changes of the given key until the context is done.
+	// The returned channel is closed once the context is done or the watch
+	// failed
+	WatchEvents(context.Context, string, WatchOptions) (<-chan Event, error)
+}
+
+// Transactor allows to execute multiple operations atomically
+type Transactor interface {
+	// Txn executes all operations atomically. If any OpCompare does not match,
+	// no operation is executed and ErrCompareFailed is returned
+	Txn(context.Context, []Op) error
+}
+
+// TTLSetter allows to set values that expire after a given duration
+type TTLSetter interface {
+	SetTTL(context.Context, string, []byte, time.Duration) error
+}
+
+// TTLSwapper allows to CAS values that expire after a given duration
+type TTLSwapper interface {
+	// CASTTL behaves like CAS but removes the key once the duration elapsed
+	CASTTL(context.Context, string, []byte, []byte, time.Duration) error
+}
+
+// Locker allows to acquire exclusive locks
+type Locker interface {
+	// Lock blocks until the lock identified by key has been acquired or the
+	// context is done
+	Lock(context.Context, string) (Lock, error)
+}
+
+// Lock represents an acquired lock
+type Lock interface {
+	// Lost returns a channel that is closed if the lock has been lost before
+	// calling Unlock (e.g. because the underlying session expired)
+	Lost() <-chan struct{}
+
+	// Unlock releases the lock
+	Unlock(context.Context) error
+}
+
+// Version describes a single version of a key
+type Version struct {
+	// ID identifies the version within the history of the key, e.g. a version
+	// number or a commit hash
+	ID string `json:"id"`
+
+	// Created holds the time the version has been created
+	Created time.Time `json:"created"`
+
+	// Author and Message describe the change if recorded by the provider
+	Author  string `json:"author,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// Deleted is true if the key does not exist in this version
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// Versioner allows to access previous versions of keys
+type Versioner interface {
+	// Versions returns all versions of a key, starting with the most recent
+	// one
+	Versions(context.Context, string) ([]Version, error)
+
+	// GetVersion retrieves a key as it was in the given version
+	GetVersion(context.Context, string, string) (*Node, error)
+
+	// RestoreVersion sets a key to its value in the given version
+	RestoreVersion(context.Context, string, string) error
+}
+
 // Mover supports moving a key or sub-tree to a different location
 type Mover interface {
 	Move(context.Context, string, string) error
@@ -0,0 +1,361 @@
+// Package bolt implements an embedded, persistent gokv provider on top of
+// bbolt. Directories are stored as nested buckets and values as bucket keys.
+package bolt
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/nethack42/gokv"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/net/context"
+)
+
+// defaultBucket is the name of the top-level bucket holding the KV tree
+const defaultBucket = "gokv"
+
+type KV struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+func sanatizePath(key string) string {
+	return strings.Trim(key, "/")
+}
+
+func splitPath(key string) []string {
+	key = sanatizePath(key)
+	if key == "" {
+		return nil
+	}
+
+	return strings.Split(key, "/")
+}
+
+// walk returns the bucket for the directory described by parts. If create is
+// true, missing buckets are created
+func (b *KV) walk(tx *bolt.Tx, parts []string, create bool) (*bolt.Bucket, error) {
+	root := tx.Bucket(b.bucket)
+	if root == nil {
+		return nil, fmt.Errorf("bucket %q does not exist", b.bucket)
+	}
+
+	bucket := root
+	for i, part := range parts {
+		next := bucket.Bucket([]byte(part))
+
+		if next == nil && create {
+			var err error
+			if next, err = bucket.CreateBucket([]byte(part)); err != nil {
+				return nil, fmt.Errorf("cannot create %q: %s", strings.Join(parts[:i+1], "/"), err)
+			}
+		}
+
+		if next == nil {
+			return nil, fmt.Errorf("%q: %w", strings.Join(parts[:i+1], "/"), kv.ErrNotFound)
+		}
+
+		bucket = next
+	}
+
+	return bucket, nil
+}
+
+// readBucket converts bucket into a directory node. depth limits the number of
+// levels to include (-1 means unlimited)
+func readBucket(key string, bucket *bolt.Bucket, depth int) *kv.Node {
+	node := &kv.Node{
+		Key:   key,
+		IsDir: true,
+	}
+
+	if depth == 0 {
+		return node
+	}
+
+	c := bucket.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		childKey := path.Join(key, string(k))
+
+		if v == nil {
+			if child := bucket.Bucket(k); child != nil {
+				node.Children = append(node.Children, *readBucket(childKey, child, depth-1))
+				continue
+			}
+		}
+
+		node.Children = append(node.Children, *readValue(childKey, v))
+	}
+
+	return node
+}
+
+func readValue(key string, value []byte) *kv.Node {
+	node := &kv.Node{
+		Key: key,
+	}
+
+	if len(value) > 0 {
+		node.Value = append([]byte(nil), value...)
+	}
+
+	return node
+}
+
+// lookup returns the parent bucket and the name of the entry for key
+func (b *KV) lookup(tx *bolt.Tx, key string, create bool) (*bolt.Bucket, []byte, error) {
+	parts := splitPath(key)
+	if len(parts) == 0 {
+		return nil, nil, fmt.Errorf("invalid operation on root directory")
+	}
+
+	parent, err := b.walk(tx, parts[:len(parts)-1], create)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return parent, []byte(parts[len(parts)-1]), nil
+}
+
+// exists checks if name exists as a value within bucket
+func exists(bucket *bolt.Bucket, name []byte) bool {
+	k, _ := bucket.Cursor().Seek(name)
+
+	return k != nil && bytes.Equal(k, name)
+}
+
+func (b *KV) get(ctx context.Context, key string, depth int) (*kv.Node, error) {
+	var node *kv.Node
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		key = sanatizePath(key)
+
+		if key == "" {
+			root, err := b.walk(tx, nil, false)
+			if err != nil {
+				return err
+			}
+
+			node = readBucket(key, root, depth)
+			return nil
+		}
+
+		parent, name, err := b.lookup(tx, key, false)
+		if err != nil {
+			return err
+		}
+
+		if bucket := parent.Bucket(name); bucket != nil {
+			node = readBucket(key, bucket, depth)
+			return nil
+		}
+
+		if !exists(parent, name) {
+			return fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+		}
+
+		node = readValue(key, parent.Get(name))
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+func (b *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
+	return b.get(ctx, key, 1)
+}
+
+func (b *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	return b.get(ctx, key, -1)
+}
+
+func put(parent *bolt.Bucket, name, value []byte) error {
+	if parent.Bucket(name) != nil {
+		return fmt.Errorf("cannot set %q: is a directory", name)
+	}
+
+	if value == nil {
+		value = []byte{}
+	}
+
+	return parent.Put(name, value)
+}
+
+func (b *KV) Set(ctx context.Context, key string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		parent, name, err := b.lookup(tx, key, true)
+		if err != nil {
+			return err
+		}
+
+		return put(parent, name, value)
+	})
+}
+
+func (b *KV) Delete(ctx context.Context, key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		parent, name, err := b.lookup(tx, key, false)
+		if err != nil {
+			return err
+		}
+
+		if parent.Bucket(name) != nil {
+			return parent.DeleteBucket(name)
+		}
+
+		if !exists(parent, name) {
+			return fmt.Errorf("%q: %w", sanatizePath(key), kv.ErrNotFound)
+		}
+
+		return parent.Delete(name)
+	})
+}
+
+// CAS sets key to value if its current value matches compare. If compare is
+// nil the key must not exist
+func (b *KV) CAS(ctx context.Context, key string, compare, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		parent, name, err := b.lookup(tx, key, true)
+		if err != nil {
+			return err
+		}
+
+		if parent.Bucket(name) != nil {
+			return fmt.Errorf("cannot set %q: is a directory", sanatizePath(key))
+		}
+
+		found := exists(parent, name)
+
+		if compare == nil && found ||
+			compare != nil && (!found || !bytes.Equal(parent.Get(name), compare)) {
+			return fmt.Errorf("%q: %w", sanatizePath(key), kv.ErrCompareFailed)
+		}
+
+		return put(parent, name, value)
+	})
+}
+
+func copyBucket(dst, src *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			if child := src.Bucket(k); child != nil {
+				next, err := dst.CreateBucket(k)
+				if err != nil {
+					return err
+				}
+
+				return copyBucket(next, child)
+			}
+		}
+
+		return dst.Put(k, v)
+	})
+}
+
+// copy copies keyOld to keyNew within tx and returns the parent bucket and
+// name of keyOld
+func (b *KV) copy(tx *bolt.Tx, keyOld, keyNew string) (*bolt.Bucket, []byte, error) {
+	keyOld = sanatizePath(keyOld)
+	keyNew = sanatizePath(keyNew)
+
+	if keyNew == keyOld || strings.HasPrefix(keyNew, keyOld+"/") {
+		return nil, nil, fmt.Errorf("cannot copy %q into itself", keyOld)
+	}
+
+	srcParent, srcName, err := b.lookup(tx, keyOld, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dstParent, dstName, err := b.lookup(tx, keyNew, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if dstParent.Bucket(dstName) != nil || exists(dstParent, dstName) {
+		return nil, nil, fmt.Errorf("%q already exists", keyNew)
+	}
+
+	if src := srcParent.Bucket(srcName); src != nil {
+		dst, err := dstParent.CreateBucket(dstName)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return srcParent, srcName, copyBucket(dst, src)
+	}
+
+	if !exists(srcParent, srcName) {
+		return nil, nil, fmt.Errorf("%q: %w", keyOld, kv.ErrNotFound)
+	}
+
+	return srcParent, srcName, put(dstParent, dstName, srcParent.Get(srcName))
+}
+
+func (b *KV) Copy(ctx context.Context, keyOld, keyNew string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		_, _, err := b.copy(tx, keyOld, keyNew)
+		return err
+	})
+}
+
+func (b *KV) Move(ctx context.Context, keyOld, keyNew string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		parent, name, err := b.copy(tx, keyOld, keyNew)
+		if err != nil {
+			return err
+		}
+
+		if parent.Bucket(name) != nil {
+			return parent.DeleteBucket(name)
+		}
+
+		return parent.Delete(name)
+	})
+}
+
+// Close closes the underlying database file
+func (b *KV) Close() error {
+	return b.db.Close()
+}
+
+func New(params map[string]string) (kv.Provider, error) {
+	bucket := params["bucket"]
+	if bucket == "" {
+		bucket = defaultBucket
+	}
+
+	db, err := bolt.Open(params["path"], 0600, &bolt.Options{
+		Timeout: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &KV{
+		db:     db,
+		bucket: []byte(bucket),
+	}, nil
+}
+
+func init() {
+	if err := kv.Register("bolt", New, []string{"path"}, []string{"bucket"}); err != nil {
+		panic("failed to register bolt KV driver")
+	}
+}
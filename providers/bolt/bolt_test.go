@@ -0,0 +1,73 @@
+package bolt
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+func newTestKV(t *testing.T) (*KV, func()) {
+	dir, err := ioutil.TempDir("", "gokv-bolt")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+
+	k, err := New(map[string]string{
+		"path": filepath.Join(dir, "test.db"),
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to create bolt KV: %s", err)
+	}
+
+	return k.(*KV), func() {
+		k.(*KV).Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_Bolt(t *testing.T) {
+	k, cleanup := newTestKV(t)
+	defer cleanup()
+
+	kv.RunProviderTests(t, k)
+}
+
+func Test_BoltMoveCopy(t *testing.T) {
+	k, cleanup := newTestKV(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	k.Set(ctx, "/src/a", []byte("1"))
+	k.Set(ctx, "/src/b/c", []byte("2"))
+
+	if err := k.Copy(ctx, "/src", "/copy"); err != nil {
+		t.Errorf("Copy() returned error: %s", err)
+	}
+
+	if err := k.Copy(ctx, "/src", "/src/nested"); err == nil {
+		t.Errorf("Copy() into itself should fail")
+	}
+
+	if err := k.Move(ctx, "/src", "/dst/moved"); err != nil {
+		t.Errorf("Move() returned error: %s", err)
+	}
+
+	if _, err := k.Get(ctx, "/src"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get() of moved key should fail with ErrNotFound: %v", err)
+	}
+
+	if node, err := k.RGet(ctx, "/"); err != nil {
+		t.Errorf("RGet() returned error: %s", err)
+	} else if len(node.Children) != 2 {
+		t.Errorf("RGet() returned invalid number of children: %v", node.Children)
+	} else if c := node.Children[0].Children[1].Children[0]; c.Key != "copy/b/c" || string(c.Value) != "2" {
+		t.Errorf("RGet() returned invalid node: %v", c)
+	}
+}
@@ -1,74 +1,450 @@
 package consul
 
 import (
-	"errors"
+	"bytes"
 	"fmt"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/nethack42/gokv"
+	"github.com/nethack42/gokv/internal/nodetree"
 )
 
+// defaultSessionTTL is used for lock sessions if no session-ttl is configured
+const defaultSessionTTL = "15s"
+
+// minSessionTTL is the smallest session TTL accepted by consul
+const minSessionTTL = 10 * time.Second
+
+// lockWaitTime limits the duration of blocking queries while waiting for a
+// lock. Cancellation of the context passed to Lock is only detected between
+// two queries
+const lockWaitTime = time.Second
+
 type KV struct {
 	kv  *api.KV
 	cli *api.Client
+
+	stale      bool
+	consistent bool
+	sessionTTL string
+}
+
+func (consul *KV) queryOptions(ctx context.Context) *api.QueryOptions {
+	q := &api.QueryOptions{
+		AllowStale:        consul.stale,
+		RequireConsistent: consul.consistent,
+	}
+
+	return q.WithContext(ctx)
+}
+
+func (consul *KV) writeOptions(ctx context.Context) *api.WriteOptions {
+	return (&api.WriteOptions{}).WithContext(ctx)
+}
+
+// checkParents ensures none of the parent directories of key is a value
+func (consul *KV) checkParents(ctx context.Context, key string) error {
+	parts := strings.Split(key, "/")
+
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], "/")
+
+		pair, _, err := consul.kv.Get(parent, consul.queryOptions(ctx))
+		if err != nil {
+			return err
+		}
+
+		if pair != nil {
+			return fmt.Errorf("cannot create %q: %q is not a directory", key, parent)
+		}
+	}
+
+	return nil
+}
+
+// isDir checks if there are any keys below key
+func (consul *KV) isDir(ctx context.Context, key string) (bool, error) {
+	keys, _, err := consul.kv.Keys(key+"/", "/", consul.queryOptions(ctx))
+	if err != nil {
+		return false, err
+	}
+
+	return len(keys) > 0, nil
 }
 
 func (consul *KV) Set(ctx context.Context, key string, value []byte) error {
+	key = sanatizeKey(key)
+	if key == "" {
+		return fmt.Errorf("cannot set root directory")
+	}
+
+	if err := consul.checkParents(ctx, key); err != nil {
+		return err
+	}
+
+	if dir, err := consul.isDir(ctx, key); err != nil {
+		return err
+	} else if dir {
+		return fmt.Errorf("cannot set %q: is a directory", key)
+	}
+
 	v := &api.KVPair{
 		Key:   key,
 		Value: value,
 	}
 
-	if _, err := consul.kv.Put(v, nil); err != nil {
+	if _, err := consul.kv.Put(v, consul.writeOptions(ctx)); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (consul *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
-	pairs, _, err := consul.kv.List(key, nil)
-	if err != nil {
-		return nil, err
+// buildTree creates a directory node for key from the list of pairs stored
+// below it. depth limits the number of levels to include (-1 means unlimited)
+func buildTree(key string, pairs api.KVPairs, depth int) *kv.Node {
+	root := nodetree.New(key)
+
+	prefix := ""
+	if key != "" {
+		prefix = key + "/"
 	}
 
-	fmt.Printf("%q: %#v %#v \n", key, pairs, err)
+	for _, pair := range pairs {
+		rel := strings.TrimPrefix(pair.Key, prefix)
+
+		// keys with a trailing slash are folders created by other consul
+		// clients (e.g. the WebUI)
+		folder := strings.HasSuffix(rel, "/")
+
+		rel = strings.Trim(rel, "/")
+		if rel == "" {
+			continue
+		}
 
-	if pairs == nil {
-		return nil, errors.New("no such key")
+		parts := strings.Split(rel, "/")
+		cur := root
+
+		for i, part := range parts {
+			last := i == len(parts)-1
+			cur = cur.Child(part, !last || folder)
+
+			if last && !folder && len(pair.Value) > 0 {
+				cur.Node.Value = pair.Value
+			}
+		}
 	}
 
-	var node kv.Node
+	node := root.Convert(depth)
+	return &node
+}
 
-	node.Key = key
+func (consul *KV) get(ctx context.Context, key string, depth int) (*kv.Node, error) {
+	key = sanatizeKey(key)
 
-	for _, pair := range pairs {
-		var child kv.Node
+	prefix := ""
 
-		child.Key = pair.Key
-		child.Value = pair.Value
+	if key != "" {
+		pair, _, err := consul.kv.Get(key, consul.queryOptions(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		if pair != nil {
+			node := &kv.Node{
+				Key: key,
+			}
+
+			if len(pair.Value) > 0 {
+				node.Value = pair.Value
+			}
+
+			return node, nil
+		}
+
+		prefix = key + "/"
+	}
 
-		node.Children = append(node.Children, child)
+	pairs, _, err := consul.kv.List(prefix, consul.queryOptions(ctx))
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, nil
+	if key != "" && len(pairs) == 0 {
+		return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	}
+
+	return buildTree(key, pairs, depth), nil
+}
+
+func (consul *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
+	return consul.get(ctx, key, 1)
+}
+
+func (consul *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	return consul.get(ctx, key, -1)
 }
 
 func (consul *KV) Delete(ctx context.Context, key string) error {
-	if _, err := consul.kv.Delete(key, nil); err != nil {
+	key = sanatizeKey(key)
+	if key == "" {
+		return fmt.Errorf("cannot delete root directory")
+	}
+
+	pair, _, err := consul.kv.Get(key, consul.queryOptions(ctx))
+	if err != nil {
+		return err
+	}
+
+	dir, err := consul.isDir(ctx, key)
+	if err != nil {
 		return err
 	}
+
+	if pair == nil && !dir {
+		return fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	}
+
+	if pair != nil {
+		if _, err := consul.kv.Delete(key, consul.writeOptions(ctx)); err != nil {
+			return err
+		}
+	}
+
+	if dir {
+		if _, err := consul.kv.DeleteTree(key+"/", consul.writeOptions(ctx)); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// CAS sets key to value if its current value matches compare. If compare is
+// nil the key must not exist. The check-and-set is performed using the
+// ModifyIndex of the key
 func (consul *KV) CAS(ctx context.Context, key string, compare, value []byte) error {
+	key = sanatizeKey(key)
+	if key == "" {
+		return fmt.Errorf("cannot set root directory")
+	}
+
+	v := &api.KVPair{
+		Key:   key,
+		Value: value,
+	}
+
+	if compare == nil {
+		if err := consul.checkParents(ctx, key); err != nil {
+			return err
+		}
+
+		if dir, err := consul.isDir(ctx, key); err != nil {
+			return err
+		} else if dir {
+			return fmt.Errorf("cannot set %q: is a directory", key)
+		}
+	} else {
+		pair, _, err := consul.kv.Get(key, consul.queryOptions(ctx))
+		if err != nil {
+			return err
+		}
+
+		if pair == nil || !bytes.Equal(pair.Value, compare) {
+			return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+		}
+
+		v.ModifyIndex = pair.ModifyIndex
+	}
+
+	ok, _, err := consul.kv.CAS(v, consul.writeOptions(ctx))
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+	}
+
+	return nil
+}
+
+// CASTTL behaves like CAS but lets consul delete key once ttl elapsed. Consul
+// does not support TTLs for keys, so key is acquired by a session using the
+// delete behavior that is never renewed. Consul invalidates sessions between
+// ttl and twice ttl; TTLs below 10s are rounded up. Setting key afterwards
+// does not remove the TTL
+func (consul *KV) CASTTL(ctx context.Context, key string, compare, value []byte, ttl time.Duration) error {
+	key = sanatizeKey(key)
+	if key == "" {
+		return fmt.Errorf("cannot set root directory")
+	}
+
+	if ttl <= 0 {
+		return fmt.Errorf("invalid TTL %s", ttl)
+	}
+
+	if ttl < minSessionTTL {
+		ttl = minSessionTTL
+	}
+
+	var check *api.KVTxnOp
+
+	if compare == nil {
+		if err := consul.checkParents(ctx, key); err != nil {
+			return err
+		}
+
+		if dir, err := consul.isDir(ctx, key); err != nil {
+			return err
+		} else if dir {
+			return fmt.Errorf("cannot set %q: is a directory", key)
+		}
+
+		check = &api.KVTxnOp{Verb: api.KVCheckNotExists, Key: key}
+	} else {
+		pair, _, err := consul.kv.Get(key, consul.queryOptions(ctx))
+		if err != nil {
+			return err
+		}
+
+		if pair == nil || !bytes.Equal(pair.Value, compare) {
+			return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+		}
+
+		check = &api.KVTxnOp{Verb: api.KVCheckIndex, Key: key, Index: pair.ModifyIndex}
+	}
+
+	session, _, err := consul.cli.Session().Create(&api.SessionEntry{
+		Name:     "gokv-ttl",
+		Behavior: api.SessionBehaviorDelete,
+		TTL:      ttl.String(),
+
+		// the key may be created again right after it expired
+		LockDelay: time.Millisecond,
+	}, consul.writeOptions(ctx))
+	if err != nil {
+		return err
+	}
+
+	// the key is deleted first as it may still be held by the session of a
+	// previous CASTTL
+	ok, _, _, err := consul.cli.Txn().Txn(api.TxnOps{
+		{KV: check},
+		{KV: &api.KVTxnOp{Verb: api.KVDelete, Key: key}},
+		{KV: &api.KVTxnOp{Verb: api.KVLock, Key: key, Value: value, Session: session}},
+	}, consul.queryOptions(ctx))
+
+	if err == nil && !ok {
+		err = fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+	}
+
+	if err != nil {
+		consul.cli.Session().Destroy(session, consul.writeOptions(ctx))
+		return err
+	}
+
 	return nil
 }
 
+// watchState returns a string describing the state of key and all keys below
+// it
+func watchState(key string, pairs api.KVPairs) string {
+	var state []string
+
+	for _, pair := range pairs {
+		if key == "" || pair.Key == key || strings.HasPrefix(pair.Key, key+"/") {
+			state = append(state, pair.Key+"@"+strconv.FormatUint(pair.ModifyIndex, 10))
+		}
+	}
+
+	sort.Strings(state)
+
+	return strings.Join(state, ",")
+}
+
+// Watch blocks until key or any key below it changes and returns the updated
+// node. If key has been deleted an error wrapping kv.ErrNotFound is returned.
+// Changes are detected using consul blocking queries
+func (consul *KV) Watch(ctx context.Context, key string) (*kv.Node, error) {
+	key = sanatizeKey(key)
+
+	var index uint64
+	var last string
+
+	for first := true; ; first = false {
+		q := consul.queryOptions(ctx)
+		q.WaitIndex = index
+
+		pairs, meta, err := consul.kv.List(key, q)
+		if err != nil {
+			return nil, err
+		}
+
+		state := watchState(key, pairs)
+		if !first && state != last {
+			return consul.Get(ctx, key)
+		}
+
+		last = state
+
+		// consul may reset the index, in which case we need to start over
+		if meta.LastIndex < index {
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+	}
+}
+
+type lock struct {
+	l    *api.Lock
+	lost <-chan struct{}
+}
+
+func (l *lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+func (l *lock) Unlock(ctx context.Context) error {
+	return l.l.Unlock()
+}
+
+// Lock acquires a lock on key using a consul session. The session is renewed
+// until the lock is released. The lock is lost if the session gets
+// invalidated
+func (consul *KV) Lock(ctx context.Context, key string) (kv.Lock, error) {
+	l, err := consul.cli.LockOpts(&api.LockOptions{
+		Key:          sanatizeKey(key),
+		SessionTTL:   consul.sessionTTL,
+		LockWaitTime: lockWaitTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lost, err := l.Lock(ctx.Done())
+	if err != nil {
+		return nil, err
+	}
+
+	if lost == nil {
+		return nil, ctx.Err()
+	}
+
+	return &lock{
+		l:    l,
+		lost: lost,
+	}, nil
+}
+
 func sanatizeKey(key string) string {
 	return strings.Trim(key, "/ ")
 }
@@ -85,6 +461,29 @@ func New(params map[string]string) (kv.Provider, error) {
 		config.Scheme = url.Scheme
 	}
 
+	config.Token = params["token"]
+	config.Datacenter = params["datacenter"]
+	config.Namespace = params["namespace"]
+
+	var stale, consistent bool
+
+	switch params["consistency"] {
+	case "", "default":
+	case "stale":
+		stale = true
+	case "consistent":
+		consistent = true
+	default:
+		return nil, fmt.Errorf("invalid consistency mode %q", params["consistency"])
+	}
+
+	sessionTTL := params["session-ttl"]
+	if sessionTTL == "" {
+		sessionTTL = defaultSessionTTL
+	} else if _, err := time.ParseDuration(sessionTTL); err != nil {
+		return nil, fmt.Errorf("invalid session-ttl %q: %s", sessionTTL, err)
+	}
+
 	client, err := api.NewClient(config)
 	if err != nil {
 		return nil, err
@@ -93,13 +492,18 @@ func New(params map[string]string) (kv.Provider, error) {
 	kvapi := client.KV()
 
 	return &KV{
-		kv:  kvapi,
-		cli: client,
+		kv:         kvapi,
+		cli:        client,
+		stale:      stale,
+		consistent: consistent,
+		sessionTTL: sessionTTL,
 	}, nil
 }
 
 func init() {
-	if err := kv.Register("consul", New, nil, []string{"endpoint"}); err != nil {
+	optional := []string{"endpoint", "token", "datacenter", "namespace", "consistency", "session-ttl"}
+
+	if err := kv.Register("consul", New, nil, optional); err != nil {
 		panic("failed to register consul KV driver")
 	}
 }
@@ -1,13 +1,22 @@
 package consul
 
 import (
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/consul/api"
 	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
 )
 
 func Test_Consul(t *testing.T) {
-	k, err := New(map[string]string{})
+	_, srv := newFakeConsul()
+	defer srv.Close()
+
+	k, err := New(map[string]string{
+		"endpoint": srv.URL,
+	})
 
 	if err != nil {
 		t.Errorf("failed to create consul KV")
@@ -16,3 +25,238 @@ func Test_Consul(t *testing.T) {
 
 	kv.KVTester(t, k)
 }
+
+func Test_ConsulRGet(t *testing.T) {
+	_, srv := newFakeConsul()
+	defer srv.Close()
+
+	k, err := New(map[string]string{
+		"endpoint": srv.URL,
+	})
+
+	if err != nil {
+		t.Errorf("failed to create consul KV")
+		t.FailNow()
+	}
+
+	ctx := context.Background()
+
+	k.Set(ctx, "/app/config/db", []byte("postgres"))
+	k.Set(ctx, "/app/users/paz", []byte("1"))
+
+	// folders created by other clients use a trailing slash
+	k.(*KV).kv.Put(&api.KVPair{Key: "app/empty/"}, nil)
+
+	node, err := k.(*KV).RGet(ctx, "/app")
+	if err != nil {
+		t.Errorf("RGet() returned error: %s", err)
+		t.FailNow()
+	}
+
+	if !node.IsDir || len(node.Children) != 3 {
+		t.Errorf("RGet() returned invalid node: %v", node)
+		t.FailNow()
+	}
+
+	if c := node.Children[0]; c.Key != "app/config" || !c.IsDir || len(c.Children) != 1 || string(c.Children[0].Value) != "postgres" {
+		t.Errorf("RGet() returned invalid child: %v", c)
+	}
+
+	if c := node.Children[1]; c.Key != "app/empty" || !c.IsDir || len(c.Children) != 0 {
+		t.Errorf("RGet() returned invalid child: %v", c)
+	}
+
+	if node, err := k.Get(ctx, "/app"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	} else if len(node.Children[0].Children) != 0 {
+		t.Errorf("Get() should not return grandchildren: %v", node.Children[0])
+	}
+
+	if err := k.Set(ctx, "/app/config/db/host", []byte("x")); err == nil {
+		t.Errorf("Set() below a value should fail")
+	}
+
+	if err := k.Set(ctx, "/app/config", []byte("x")); err == nil {
+		t.Errorf("Set() of a directory should fail")
+	}
+}
+
+func Test_ConsulConsistency(t *testing.T) {
+	_, srv := newFakeConsul()
+	defer srv.Close()
+
+	k, err := New(map[string]string{
+		"endpoint":    srv.URL,
+		"consistency": "consistent",
+	})
+
+	if err != nil {
+		t.Errorf("failed to create consul KV")
+		t.FailNow()
+	}
+
+	kv.RunProviderTests(t, k)
+
+	if _, err := New(map[string]string{"consistency": "eventual"}); err == nil {
+		t.Errorf("New() should fail for invalid consistency modes")
+	}
+}
+
+func Test_ConsulWatch(t *testing.T) {
+	_, srv := newFakeConsul()
+	defer srv.Close()
+
+	k, err := New(map[string]string{
+		"endpoint": srv.URL,
+	})
+
+	if err != nil {
+		t.Errorf("failed to create consul KV")
+		t.FailNow()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	k.Set(ctx, "/watch/a", []byte("1"))
+	k.Set(ctx, "/watchother", []byte("1"))
+
+	result := make(chan *kv.Node, 1)
+	go func() {
+		node, err := k.(*KV).Watch(ctx, "/watch")
+		if err != nil {
+			t.Errorf("Watch() returned error: %s", err)
+		}
+		result <- node
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// changes to keys sharing the same prefix must not trigger the watch
+	k.Set(ctx, "/watchother", []byte("2"))
+	time.Sleep(100 * time.Millisecond)
+
+	k.Set(ctx, "/watch/b", []byte("2"))
+
+	if node := <-result; node != nil && len(node.Children) != 2 {
+		t.Errorf("Watch() returned invalid node: %v", node)
+	}
+}
+
+func Test_ConsulCASTTL(t *testing.T) {
+	f, srv := newFakeConsul()
+	defer srv.Close()
+
+	k, err := New(map[string]string{
+		"endpoint": srv.URL,
+	})
+
+	if err != nil {
+		t.Errorf("failed to create consul KV")
+		t.FailNow()
+	}
+
+	ctx := context.Background()
+	store := k.(*KV)
+
+	if err := store.CASTTL(ctx, "/leader", nil, []byte("a"), time.Second); err != nil {
+		t.Errorf("CASTTL() returned error: %s", err)
+	}
+
+	if err := store.CASTTL(ctx, "/leader", nil, []byte("b"), time.Second); !errors.Is(err, kv.ErrCompareFailed) {
+		t.Errorf("CASTTL() of existing key should fail with ErrCompareFailed: %v", err)
+	}
+
+	if err := store.CASTTL(ctx, "/leader", []byte("b"), []byte("c"), time.Second); !errors.Is(err, kv.ErrCompareFailed) {
+		t.Errorf("CASTTL() with wrong compare value should fail with ErrCompareFailed: %v", err)
+	}
+
+	// refreshing replaces the session holding the key
+	if err := store.CASTTL(ctx, "/leader", []byte("a"), []byte("a"), time.Minute); err != nil {
+		t.Errorf("CASTTL() returned error: %s", err)
+	}
+
+	f.lock.Lock()
+	pair := f.pairs["leader"]
+	ttl := f.ttls[pair.Session]
+	sessions := len(f.ttls)
+	f.lock.Unlock()
+
+	if ttl != "1m0s" || sessions != 2 {
+		t.Errorf("CASTTL() created invalid session: %q (%d sessions)", ttl, sessions)
+	}
+
+	f.expire()
+
+	if _, err := store.Get(ctx, "/leader"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get() of expired key should fail with ErrNotFound: %v", err)
+	}
+
+	if err := store.CASTTL(ctx, "/leader", nil, []byte("b"), time.Second); err != nil {
+		t.Errorf("CASTTL() of expired key returned error: %s", err)
+	}
+
+	f.lock.Lock()
+	ttl = f.ttls[f.pairs["leader"].Session]
+	f.lock.Unlock()
+
+	if ttl != minSessionTTL.String() {
+		t.Errorf("CASTTL() did not round the TTL up: %q", ttl)
+	}
+}
+
+func Test_ConsulLock(t *testing.T) {
+	_, srv := newFakeConsul()
+	defer srv.Close()
+
+	k, err := New(map[string]string{
+		"endpoint": srv.URL,
+	})
+
+	if err != nil {
+		t.Errorf("failed to create consul KV")
+		t.FailNow()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	l, err := k.(*KV).Lock(ctx, "/locks/a")
+	if err != nil {
+		t.Errorf("Lock() returned error: %s", err)
+		t.FailNow()
+	}
+
+	acquired := make(chan kv.Lock, 1)
+	go func() {
+		l, err := k.(*KV).Lock(ctx, "/locks/a")
+		if err != nil {
+			t.Errorf("Lock() returned error: %s", err)
+		}
+		acquired <- l
+	}()
+
+	select {
+	case <-acquired:
+		t.Errorf("Lock() acquired a lock that is still held")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := l.Unlock(ctx); err != nil {
+		t.Errorf("Unlock() returned error: %s", err)
+	}
+
+	l = <-acquired
+	if l == nil {
+		t.Errorf("Lock() did not acquire the released lock")
+		t.FailNow()
+	}
+	defer l.Unlock(ctx)
+
+	timeout, cancelTimeout := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelTimeout()
+
+	if _, err := k.(*KV).Lock(timeout, "/locks/a"); err == nil {
+		t.Errorf("Lock() of a held lock should fail once the context is done")
+	}
+}
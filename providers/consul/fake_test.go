@@ -0,0 +1,381 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// fakeConsul implements the parts of the consul KV and session HTTP API used
+// by the provider
+type fakeConsul struct {
+	lock     sync.Mutex
+	pairs    map[string]*api.KVPair
+	sessions map[string]bool
+	index    uint64
+
+	// ttls holds the TTL of sessions using the delete behavior
+	ttls map[string]string
+
+	// changed is closed and replaced whenever index is incremented
+	changed chan struct{}
+}
+
+func newFakeConsul() (*fakeConsul, *httptest.Server) {
+	f := &fakeConsul{
+		pairs:    make(map[string]*api.KVPair),
+		sessions: make(map[string]bool),
+		ttls:     make(map[string]string),
+		index:    1,
+		changed:  make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/kv/", f.handleKV)
+	mux.HandleFunc("/v1/session/", f.handleSession)
+	mux.HandleFunc("/v1/txn", f.handleTxn)
+
+	return f, httptest.NewServer(mux)
+}
+
+// modified increments the index and wakes up blocking queries. The lock must
+// be held
+func (f *fakeConsul) modified() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// block implements consul blocking queries by waiting until the index is
+// greater than the one requested. The lock must be held
+func (f *fakeConsul) block(r *http.Request) {
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	if index == 0 {
+		return
+	}
+
+	wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+	if err != nil || wait == 0 {
+		wait = 5 * time.Minute
+	}
+
+	timeout := time.After(wait)
+
+	for f.index <= index {
+		changed := f.changed
+
+		f.lock.Unlock()
+		select {
+		case <-changed:
+			f.lock.Lock()
+		case <-timeout:
+			f.lock.Lock()
+			return
+		case <-r.Context().Done():
+			f.lock.Lock()
+			return
+		}
+	}
+}
+
+func (f *fakeConsul) sortedKeys(prefix string) []string {
+	var keys []string
+
+	for key := range f.pairs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (f *fakeConsul) reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeConsul) handleKV(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	query := r.URL.Query()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch r.Method {
+	case "GET":
+		f.block(r)
+
+		var res interface{}
+
+		switch {
+		case query["keys"] != nil:
+			var keys []string
+
+			sep := query.Get("separator")
+			seen := make(map[string]bool)
+
+			for _, k := range f.sortedKeys(key) {
+				rest := k[len(key):]
+				if idx := strings.Index(rest, sep); sep != "" && idx >= 0 {
+					k = key + rest[:idx+len(sep)]
+				}
+
+				if !seen[k] {
+					seen[k] = true
+					keys = append(keys, k)
+				}
+			}
+
+			if len(keys) > 0 {
+				res = keys
+			}
+
+		case query["recurse"] != nil:
+			var pairs []api.KVPair
+
+			for _, k := range f.sortedKeys(key) {
+				pairs = append(pairs, *f.pairs[k])
+			}
+
+			if len(pairs) > 0 {
+				res = pairs
+			}
+
+		default:
+			if pair, ok := f.pairs[key]; ok {
+				res = []api.KVPair{*pair}
+			}
+		}
+
+		if res == nil {
+			w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		f.reply(w, res)
+
+	case "PUT":
+		value, _ := ioutil.ReadAll(r.Body)
+		flags, _ := strconv.ParseUint(query.Get("flags"), 10, 64)
+
+		pair, ok := f.pairs[key]
+
+		if v := query.Get("cas"); v != "" {
+			index, _ := strconv.ParseUint(v, 10, 64)
+
+			if (index == 0 && ok) || (index != 0 && (!ok || pair.ModifyIndex != index)) {
+				f.reply(w, false)
+				return
+			}
+		}
+
+		session := query.Get("acquire")
+		if session != "" && (!f.sessions[session] || ok && pair.Session != "" && pair.Session != session) {
+			f.reply(w, false)
+			return
+		}
+
+		if release := query.Get("release"); release != "" {
+			if !ok || pair.Session != release {
+				f.reply(w, false)
+				return
+			}
+
+			f.modified()
+			pair.Session = ""
+			pair.ModifyIndex = f.index
+			f.reply(w, true)
+			return
+		}
+
+		f.modified()
+
+		if !ok {
+			pair = &api.KVPair{
+				Key:         key,
+				CreateIndex: f.index,
+			}
+			f.pairs[key] = pair
+		}
+
+		if session != "" {
+			pair.Session = session
+			pair.LockIndex++
+		}
+
+		pair.Value = value
+		pair.Flags = flags
+		pair.ModifyIndex = f.index
+
+		f.reply(w, true)
+
+	case "DELETE":
+		f.modified()
+
+		if query["recurse"] != nil {
+			for _, k := range f.sortedKeys(key) {
+				delete(f.pairs, k)
+			}
+		} else {
+			delete(f.pairs, key)
+		}
+
+		f.reply(w, true)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeConsul) handleSession(w http.ResponseWriter, r *http.Request) {
+	op := strings.TrimPrefix(r.URL.Path, "/v1/session/")
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch {
+	case op == "create":
+		var entry struct {
+			Behavior string
+			TTL      string
+		}
+		json.NewDecoder(r.Body).Decode(&entry)
+
+		id := fmt.Sprintf("session-%d", f.index)
+		f.sessions[id] = true
+		if entry.Behavior == api.SessionBehaviorDelete {
+			f.ttls[id] = entry.TTL
+		}
+		f.modified()
+
+		f.reply(w, map[string]string{"ID": id})
+
+	case strings.HasPrefix(op, "renew/"):
+		id := strings.TrimPrefix(op, "renew/")
+		if !f.sessions[id] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		f.reply(w, []api.SessionEntry{{ID: id, TTL: "15s"}})
+
+	case strings.HasPrefix(op, "destroy/"):
+		f.invalidate(strings.TrimPrefix(op, "destroy/"))
+		f.reply(w, true)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// invalidate destroys a session as if its TTL expired. Keys held by the
+// session are released or deleted, depending on its behavior. The lock must
+// be held
+func (f *fakeConsul) invalidate(id string) {
+	for key, pair := range f.pairs {
+		if pair.Session != id {
+			continue
+		}
+
+		if _, ok := f.ttls[id]; ok {
+			delete(f.pairs, key)
+		} else {
+			pair.Session = ""
+		}
+	}
+
+	delete(f.sessions, id)
+	delete(f.ttls, id)
+	f.modified()
+}
+
+// expire invalidates all sessions using the delete behavior
+func (f *fakeConsul) expire() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for id := range f.ttls {
+		f.invalidate(id)
+	}
+}
+
+// handleTxn implements the KV verbs of transactions used by the provider
+func (f *fakeConsul) handleTxn(w http.ResponseWriter, r *http.Request) {
+	var ops api.TxnOps
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	fail := func(i int, what string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(api.TxnResponse{Errors: api.TxnErrors{{OpIndex: i, What: what}}})
+	}
+
+	// check all conditions before applying any change
+	for i, op := range ops {
+		pair, ok := f.pairs[op.KV.Key]
+
+		switch op.KV.Verb {
+		case api.KVCheckNotExists:
+			if ok {
+				fail(i, "key exists")
+				return
+			}
+		case api.KVCheckIndex:
+			if !ok || pair.ModifyIndex != op.KV.Index {
+				fail(i, "index mismatch")
+				return
+			}
+		case api.KVLock:
+			if !f.sessions[op.KV.Session] {
+				fail(i, "invalid session")
+				return
+			}
+		case api.KVDelete:
+		default:
+			fail(i, "unsupported verb "+string(op.KV.Verb))
+			return
+		}
+	}
+
+	f.modified()
+
+	for _, op := range ops {
+		switch op.KV.Verb {
+		case api.KVDelete:
+			delete(f.pairs, op.KV.Key)
+		case api.KVLock:
+			pair, ok := f.pairs[op.KV.Key]
+			if !ok {
+				pair = &api.KVPair{Key: op.KV.Key, CreateIndex: f.index}
+				f.pairs[op.KV.Key] = pair
+			}
+
+			pair.Value = op.KV.Value
+			pair.Session = op.KV.Session
+			pair.LockIndex++
+			pair.ModifyIndex = f.index
+		}
+	}
+
+	f.reply(w, api.TxnResponse{})
+}
@@ -0,0 +1,655 @@
+// Package document implements a gokv provider backed by a single JSON or YAML
+// document. Nested objects are mapped to directory nodes and all other values
+// (strings, numbers, booleans and arrays) to values.
+package document
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nethack42/gokv"
+	"github.com/nethack42/gokv/internal/fsutil"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+)
+
+type KV struct {
+	path   string
+	format string
+
+	// lock protects the cached document
+	lock sync.Mutex
+
+	// info holds the file info of the document when it has been loaded. It is
+	// used to detect changes made by other processes
+	info   os.FileInfo
+	loaded bool
+	root   map[string]interface{}
+}
+
+func sanatizePath(key string) string {
+	return strings.Trim(key, "/")
+}
+
+func splitKey(key string) []string {
+	if key == "" {
+		return nil
+	}
+
+	return strings.Split(key, "/")
+}
+
+// changed checks if the document has been replaced or modified since it has
+// been loaded
+func (d *KV) changed(info os.FileInfo) bool {
+	if !d.loaded {
+		return true
+	}
+
+	if info == nil || d.info == nil {
+		return info != d.info
+	}
+
+	return !os.SameFile(info, d.info) || !info.ModTime().Equal(d.info.ModTime()) || info.Size() != d.info.Size()
+}
+
+// load (re-)loads the document if it has not been loaded yet or the file has
+// changed. A missing file is treated as an empty document. The lock must be
+// held
+func (d *KV) load() error {
+	info, err := os.Stat(d.path)
+	if os.IsNotExist(err) {
+		info = nil
+	} else if err != nil {
+		return err
+	}
+
+	if !d.changed(info) {
+		return nil
+	}
+
+	root := make(map[string]interface{})
+
+	if info != nil {
+		data, err := ioutil.ReadFile(d.path)
+		if err != nil {
+			return err
+		}
+
+		if root, err = d.decode(data); err != nil {
+			return fmt.Errorf("failed to parse %s: %s", d.path, err)
+		}
+	}
+
+	d.root = root
+	d.info = info
+	d.loaded = true
+
+	return nil
+}
+
+func (d *KV) decode(data []byte) (map[string]interface{}, error) {
+	var doc interface{}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return make(map[string]interface{}), nil
+	}
+
+	if d.format == formatYAML {
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		doc = normalize(doc)
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+
+		if err := dec.Decode(&doc); err != nil {
+			return nil, err
+		}
+	}
+
+	if doc == nil {
+		return make(map[string]interface{}), nil
+	}
+
+	root, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("document root must be an object")
+	}
+
+	return root, nil
+}
+
+// normalize converts YAML mappings with non-string keys into
+// map[string]interface{}
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = normalize(child)
+		}
+		return v
+
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			m[fmt.Sprint(k)] = normalize(child)
+		}
+		return m
+
+	case []interface{}:
+		for i, child := range v {
+			v[i] = normalize(child)
+		}
+		return v
+	}
+
+	return v
+}
+
+func (d *KV) encode() ([]byte, error) {
+	if d.format == formatYAML {
+		var buf bytes.Buffer
+
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+
+		if err := enc.Encode(d.root); err != nil {
+			return nil, err
+		}
+
+		if err := enc.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	data, err := json.MarshalIndent(d.root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, '\n'), nil
+}
+
+// write atomically replaces the document by writing to a temporary file first
+// and renaming it afterwards. The lock must be held
+func (d *KV) write() error {
+	data, err := d.encode()
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	if d.info != nil {
+		mode = d.info.Mode().Perm()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(d.path), "."+filepath.Base(d.path)+".tmp-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), d.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	d.info, err = os.Stat(d.path)
+	return err
+}
+
+// update loads the latest version of the document, applies fn and writes the
+// result. Concurrent writers are serialized using a lock file
+func (d *KV) update(fn func() error) error {
+	unlock, err := fsutil.Lock(d.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := d.load(); err != nil {
+		return err
+	}
+
+	err = fn()
+	if err == nil {
+		err = d.write()
+	}
+
+	if err != nil {
+		// the cached document may have been modified, force a reload
+		d.loaded = false
+	}
+
+	return err
+}
+
+// lookup returns the value stored at parts
+func lookup(root map[string]interface{}, parts []string) (interface{}, bool) {
+	var cur interface{} = root
+
+	for _, part := range parts {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		if cur, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+
+	return cur, true
+}
+
+// parent returns the object holding the last element of parts. If create is
+// set, missing objects are created
+func parent(root map[string]interface{}, key string, parts []string, create bool) (map[string]interface{}, error) {
+	cur := root
+
+	for i, part := range parts[:len(parts)-1] {
+		child, ok := cur[part]
+		if !ok {
+			if !create {
+				return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+			}
+
+			child = make(map[string]interface{})
+			cur[part] = child
+		}
+
+		m, ok := child.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot create %q: %q is not a directory", key, strings.Join(parts[:i+1], "/"))
+		}
+
+		cur = m
+	}
+
+	return cur, nil
+}
+
+// valueOf returns the value representation of v. Strings are returned as-is
+// while all other values are JSON encoded
+func valueOf(v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []byte(v)
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return []byte(fmt.Sprint(v))
+	}
+
+	return data
+}
+
+// kindOf classifies non-string values
+func kindOf(v interface{}) string {
+	switch v.(type) {
+	case bool:
+		return "bool"
+	case json.Number, int, int64, uint64, float64:
+		return "number"
+	case []interface{}:
+		return "array"
+	}
+
+	return ""
+}
+
+// typed returns the document representation of value. If the key currently
+// holds a number, boolean or array and value can be parsed as the same kind,
+// the parsed value is stored to preserve the type. Otherwise value is stored
+// as string
+func (d *KV) typed(current interface{}, value []byte) interface{} {
+	kind := kindOf(current)
+	if kind == "" {
+		return string(value)
+	}
+
+	var parsed interface{}
+
+	if d.format == formatYAML {
+		if err := yaml.Unmarshal(value, &parsed); err != nil {
+			return string(value)
+		}
+		parsed = normalize(parsed)
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(value))
+		dec.UseNumber()
+
+		if err := dec.Decode(&parsed); err != nil || dec.More() {
+			return string(value)
+		}
+	}
+
+	if kindOf(parsed) != kind {
+		return string(value)
+	}
+
+	return parsed
+}
+
+func convert(key string, v interface{}, depth int) kv.Node {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return kv.Node{
+			Key:   key,
+			Value: valueOf(v),
+		}
+	}
+
+	node := kv.Node{
+		Key:   key,
+		IsDir: true,
+	}
+
+	if depth == 0 {
+		return node
+	}
+
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		node.Children = append(node.Children, convert(path.Join(key, name), m[name], depth-1))
+	}
+
+	return node
+}
+
+func (d *KV) get(ctx context.Context, key string, depth int) (*kv.Node, error) {
+	key = sanatizePath(key)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
+	v, ok := lookup(d.root, splitKey(key))
+	if !ok {
+		return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	}
+
+	node := convert(key, v, depth)
+	return &node, nil
+}
+
+func (d *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
+	return d.get(ctx, key, 1)
+}
+
+func (d *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	return d.get(ctx, key, -1)
+}
+
+// set stores value at key. The lock must be held
+func (d *KV) set(key string, value []byte) error {
+	parts := splitKey(key)
+	if len(parts) == 0 {
+		return fmt.Errorf("cannot set root directory")
+	}
+
+	m, err := parent(d.root, key, parts, true)
+	if err != nil {
+		return err
+	}
+
+	name := parts[len(parts)-1]
+	current := m[name]
+
+	if _, ok := current.(map[string]interface{}); ok {
+		return fmt.Errorf("cannot set %q: is a directory", key)
+	}
+
+	m[name] = d.typed(current, value)
+	return nil
+}
+
+func (d *KV) Set(ctx context.Context, key string, value []byte) error {
+	key = sanatizePath(key)
+
+	return d.update(func() error {
+		return d.set(key, value)
+	})
+}
+
+func (d *KV) Delete(ctx context.Context, key string) error {
+	key = sanatizePath(key)
+
+	parts := splitKey(key)
+	if len(parts) == 0 {
+		return fmt.Errorf("cannot delete root directory")
+	}
+
+	return d.update(func() error {
+		m, err := parent(d.root, key, parts, false)
+		if err != nil {
+			return fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+		}
+
+		name := parts[len(parts)-1]
+		if _, ok := m[name]; !ok {
+			return fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+		}
+
+		delete(m, name)
+		return nil
+	})
+}
+
+// CAS sets key to value if its current value matches compare. If compare is
+// nil the key must not exist
+func (d *KV) CAS(ctx context.Context, key string, compare, value []byte) error {
+	key = sanatizePath(key)
+
+	return d.update(func() error {
+		current, ok := lookup(d.root, splitKey(key))
+
+		switch {
+		case !ok:
+			if compare != nil {
+				return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+			}
+		case compare == nil:
+			return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+		default:
+			if _, dir := current.(map[string]interface{}); dir || !bytes.Equal(valueOf(current), compare) {
+				return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+			}
+		}
+
+		return d.set(key, value)
+	})
+}
+
+// deepCopy returns a copy of v that does not share objects or arrays with v
+func deepCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			m[k] = deepCopy(child)
+		}
+		return m
+
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, child := range v {
+			s[i] = deepCopy(child)
+		}
+		return s
+	}
+
+	return v
+}
+
+// transfer copies keyOld to keyNew and optionally removes keyOld afterwards
+func (d *KV) transfer(keyOld, keyNew string, move bool) error {
+	keyOld, keyNew = sanatizePath(keyOld), sanatizePath(keyNew)
+
+	src, dst := splitKey(keyOld), splitKey(keyNew)
+	if len(src) == 0 || len(dst) == 0 {
+		return fmt.Errorf("cannot copy root directory")
+	}
+
+	if keyNew == keyOld || strings.HasPrefix(keyNew, keyOld+"/") {
+		return fmt.Errorf("cannot copy %q into itself", keyOld)
+	}
+
+	return d.update(func() error {
+		v, ok := lookup(d.root, src)
+		if !ok {
+			return fmt.Errorf("%q: %w", keyOld, kv.ErrNotFound)
+		}
+
+		if _, ok := lookup(d.root, dst); ok {
+			return fmt.Errorf("%q already exists", keyNew)
+		}
+
+		m, err := parent(d.root, keyNew, dst, true)
+		if err != nil {
+			return err
+		}
+
+		m[dst[len(dst)-1]] = deepCopy(v)
+
+		if move {
+			m, _ := parent(d.root, keyOld, src, false)
+			delete(m, src[len(src)-1])
+		}
+
+		return nil
+	})
+}
+
+func (d *KV) Move(ctx context.Context, keyOld, keyNew string) error {
+	return d.transfer(keyOld, keyNew, true)
+}
+
+func (d *KV) Copy(ctx context.Context, keyOld, keyNew string) error {
+	return d.transfer(keyOld, keyNew, false)
+}
+
+// Watch blocks until key or any node below it changes and returns the updated
+// node. If key has been deleted an error wrapping kv.ErrNotFound is returned.
+// Changes are detected by observing the document file
+func (d *KV) Watch(ctx context.Context, key string) (*kv.Node, error) {
+	w, err := newFileWatcher(d.path)
+	if err != nil {
+		return nil, err
+	}
+	defer w.close()
+
+	prev, err := d.get(ctx, key, -1)
+	if err != nil && !errors.Is(err, kv.ErrNotFound) {
+		return nil, err
+	}
+
+	for {
+		if err := w.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		node, err := d.get(ctx, key, -1)
+
+		switch {
+		case errors.Is(err, kv.ErrNotFound):
+			if prev != nil {
+				return nil, err
+			}
+		case err != nil:
+			return nil, err
+		case !reflect.DeepEqual(prev, node):
+			return d.Get(ctx, key)
+		}
+	}
+}
+
+func New(params map[string]string) (kv.Provider, error) {
+	p, err := filepath.Abs(params["path"])
+	if err != nil {
+		return nil, err
+	}
+
+	format := params["format"]
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".yaml", ".yml":
+			format = formatYAML
+		default:
+			format = formatJSON
+		}
+	}
+
+	if format != formatJSON && format != formatYAML {
+		return nil, fmt.Errorf("invalid format %q", format)
+	}
+
+	// the document is loaded on first access
+	return &KV{
+		path:   p,
+		format: format,
+	}, nil
+}
+
+func init() {
+	if err := kv.Register("document", New, []string{"path"}, []string{"format"}); err != nil {
+		panic("failed to register document KV driver")
+	}
+}
@@ -0,0 +1,222 @@
+package document
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gokv-document")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func newTestKV(t *testing.T, p string) *KV {
+	k, err := New(map[string]string{
+		"path": p,
+	})
+	if err != nil {
+		t.Fatalf("failed to create document KV: %s", err)
+	}
+
+	return k.(*KV)
+}
+
+func Test_DocumentJSON(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	kv.KVTester(t, newTestKV(t, filepath.Join(dir, "config.json")))
+}
+
+func Test_DocumentYAML(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	kv.KVTester(t, newTestKV(t, filepath.Join(dir, "config.yaml")))
+}
+
+func Test_DocumentTypes(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	p := filepath.Join(dir, "config.yaml")
+	ioutil.WriteFile(p, []byte(`
+db:
+  host: localhost
+  port: 5432
+  tls: false
+  replicas: [a, b]
+`), 0600)
+
+	d := newTestKV(t, p)
+	ctx := context.Background()
+
+	node, err := d.RGet(ctx, "/db")
+	if err != nil {
+		t.Fatalf("RGet() returned error: %s", err)
+	}
+
+	expected := map[string]string{
+		"db/host":     "localhost",
+		"db/port":     "5432",
+		"db/replicas": `["a","b"]`,
+		"db/tls":      "false",
+	}
+
+	if len(node.Children) != len(expected) {
+		t.Errorf("RGet() returned invalid node: %v", node)
+	}
+
+	for _, c := range node.Children {
+		if string(c.Value) != expected[c.Key] {
+			t.Errorf("RGet() returned invalid value for %s: %q", c.Key, c.Value)
+		}
+	}
+
+	d.Set(ctx, "/db/port", []byte("6432"))
+	d.Set(ctx, "/db/tls", []byte("yes please"))
+	d.Set(ctx, "/app/name", []byte("gokv"))
+
+	data, _ := ioutil.ReadFile(p)
+	if string(data) != `app:
+  name: gokv
+db:
+  host: localhost
+  port: 6432
+  replicas:
+    - a
+    - b
+  tls: yes please
+` {
+		t.Errorf("Set() wrote unexpected document:\n%s", data)
+	}
+
+	if info, _ := os.Stat(p); info.Mode().Perm() != 0600 {
+		t.Errorf("Set() did not preserve the file mode: %s", info.Mode())
+	}
+
+	if err := d.Move(ctx, "/db", "/app/db"); err != nil {
+		t.Errorf("Move() returned error: %s", err)
+	}
+
+	if node, err := d.Get(ctx, "/app/db/port"); err != nil || string(node.Value) != "6432" {
+		t.Errorf("Get() returned invalid node after Move(): %v, %v", node, err)
+	}
+}
+
+func Test_DocumentShared(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	p := filepath.Join(dir, "config.json")
+
+	// the document is loaded lazily, so New succeeds for invalid documents
+	ioutil.WriteFile(p, []byte("[1, 2]"), 0644)
+
+	a := newTestKV(t, p)
+	b := newTestKV(t, p)
+	ctx := context.Background()
+
+	if _, err := a.Get(ctx, "/"); err == nil {
+		t.Errorf("Get() of an invalid document should fail")
+	}
+
+	os.Remove(p)
+
+	// concurrent CAS increments must not lose updates
+	a.Set(ctx, "/counter", []byte("0"))
+
+	var wg sync.WaitGroup
+
+	for _, d := range []*KV{a, b} {
+		wg.Add(1)
+		go func(d *KV) {
+			defer wg.Done()
+
+			for i := 0; i < 20; {
+				node, err := d.Get(ctx, "/counter")
+				if err != nil {
+					t.Errorf("Get() returned error: %s", err)
+					return
+				}
+
+				n, _ := strconv.Atoi(string(node.Value))
+
+				if err := d.CAS(ctx, "/counter", node.Value, []byte(strconv.Itoa(n+1))); err == nil {
+					i++
+				} else if !errors.Is(err, kv.ErrCompareFailed) {
+					t.Errorf("CAS() returned error: %s", err)
+					return
+				}
+			}
+		}(d)
+	}
+
+	wg.Wait()
+
+	if node, err := b.Get(ctx, "/counter"); err != nil || string(node.Value) != "40" {
+		t.Errorf("concurrent CAS lost updates: %v, %v", node, err)
+	}
+}
+
+func Test_DocumentWatch(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	p := filepath.Join(dir, "config.json")
+	a := newTestKV(t, p)
+	b := newTestKV(t, p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a.Set(ctx, "/app/name", []byte("gokv"))
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+
+		// changes of other keys do not wake up the watcher
+		b.Set(ctx, "/other", []byte("1"))
+
+		time.Sleep(100 * time.Millisecond)
+		b.Set(ctx, "/app/version", []byte("1"))
+	}()
+
+	node, err := a.Watch(ctx, "/app")
+	if err != nil {
+		t.Fatalf("Watch() returned error: %s", err)
+	}
+
+	if len(node.Children) != 2 {
+		t.Errorf("Watch() returned invalid node: %v", node)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		b.Delete(ctx, "/app")
+	}()
+
+	if _, err := a.Watch(ctx, "/app"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Watch() of deleted key should fail: %v", err)
+	}
+
+	cctx, ccancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer ccancel()
+
+	if _, err := a.Watch(cctx, "/app"); err != context.DeadlineExceeded {
+		t.Errorf("Watch() did not return after the context is done: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package document
+
+import (
+	"path/filepath"
+	"syscall"
+
+	"github.com/nethack42/gokv/internal/fsutil"
+	"golang.org/x/net/context"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE
+
+// fileWatcher reports changes of a single file using inotify
+type fileWatcher struct {
+	inotify *fsutil.Inotify
+	name    string
+}
+
+// newFileWatcher starts watching p. As the document is replaced by renaming
+// temporary files, the parent directory is watched instead of the file itself
+func newFileWatcher(p string) (*fileWatcher, error) {
+	inotify, err := fsutil.NewInotify()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := inotify.Add(filepath.Dir(p), watchMask); err != nil {
+		inotify.Close()
+		return nil, err
+	}
+
+	return &fileWatcher{
+		inotify: inotify,
+		name:    filepath.Base(p),
+	}, nil
+}
+
+// wait blocks until the file has been changed or the context is done
+func (w *fileWatcher) wait(ctx context.Context) error {
+	for {
+		events, err := w.inotify.Read(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, ev := range events {
+			if ev.Name == w.name {
+				return nil
+			}
+		}
+	}
+}
+
+func (w *fileWatcher) close() {
+	w.inotify.Close()
+}
@@ -0,0 +1,59 @@
+//go:build !linux
+// +build !linux
+
+package document
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// pollInterval defines how often the document is checked for changes
+const pollInterval = time.Second
+
+// fileWatcher reports changes of a single file by polling its file info
+type fileWatcher struct {
+	path string
+	info os.FileInfo
+}
+
+func newFileWatcher(p string) (*fileWatcher, error) {
+	info, _ := os.Stat(p)
+
+	return &fileWatcher{
+		path: p,
+		info: info,
+	}, nil
+}
+
+func (w *fileWatcher) changed(info os.FileInfo) bool {
+	if info == nil || w.info == nil {
+		return info != w.info
+	}
+
+	return !os.SameFile(info, w.info) || !info.ModTime().Equal(w.info.ModTime()) || info.Size() != w.info.Size()
+}
+
+// wait blocks until the file has been changed or the context is done
+func (w *fileWatcher) wait(ctx context.Context) error {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		info, _ := os.Stat(w.path)
+		if w.changed(info) {
+			w.info = info
+			return nil
+		}
+	}
+}
+
+func (w *fileWatcher) close() {}
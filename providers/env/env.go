@@ -0,0 +1,130 @@
+// Package env implements a read-only gokv provider exposing process
+// environment variables as a tree. Variable names are split into path
+// segments using a separator, e.g. APP__DB__HOST becomes /db/host.
+package env
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nethack42/gokv"
+	"github.com/nethack42/gokv/internal/nodetree"
+	"golang.org/x/net/context"
+)
+
+const defaultSeparator = "__"
+
+type KV struct {
+	prefix    string
+	separator string
+}
+
+func sanatizePath(key string) string {
+	return strings.Trim(key, "/")
+}
+
+// load builds the tree of all matching environment variables
+func (e *KV) load() *nodetree.Tree {
+	root := nodetree.New("")
+
+	for _, v := range os.Environ() {
+		idx := strings.Index(v, "=")
+		if idx <= 0 {
+			continue
+		}
+
+		name, value := v[:idx], v[idx+1:]
+
+		if e.prefix != "" {
+			if !strings.HasPrefix(name, e.prefix+e.separator) {
+				continue
+			}
+			name = name[len(e.prefix)+len(e.separator):]
+		}
+
+		var parts []string
+		for _, part := range strings.Split(name, e.separator) {
+			if part != "" {
+				parts = append(parts, strings.ToLower(part))
+			}
+		}
+
+		cur := root
+
+		for i, part := range parts {
+			cur = cur.Child(part, i < len(parts)-1)
+		}
+
+		if cur != root && value != "" {
+			cur.Node.Value = []byte(value)
+		}
+	}
+
+	return root
+}
+
+func (e *KV) get(ctx context.Context, key string, depth int) (*kv.Node, error) {
+	key = sanatizePath(key)
+
+	cur := e.load()
+
+	if key != "" {
+		for _, part := range strings.Split(key, "/") {
+			c, ok := cur.Lookup(strings.ToLower(part))
+			if !ok {
+				return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+			}
+			cur = c
+		}
+	}
+
+	node := cur.Convert(depth)
+	return &node, nil
+}
+
+func (e *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
+	return e.get(ctx, key, 1)
+}
+
+func (e *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	return e.get(ctx, key, -1)
+}
+
+func (e *KV) Set(ctx context.Context, key string, value []byte) error {
+	return fmt.Errorf("%q: %w", sanatizePath(key), kv.ErrReadOnly)
+}
+
+func (e *KV) Delete(ctx context.Context, key string) error {
+	return fmt.Errorf("%q: %w", sanatizePath(key), kv.ErrReadOnly)
+}
+
+func (e *KV) CAS(ctx context.Context, key string, compare, value []byte) error {
+	return fmt.Errorf("%q: %w", sanatizePath(key), kv.ErrReadOnly)
+}
+
+func (e *KV) Move(ctx context.Context, keyOld, keyNew string) error {
+	return fmt.Errorf("%q: %w", sanatizePath(keyOld), kv.ErrReadOnly)
+}
+
+func (e *KV) Copy(ctx context.Context, keyOld, keyNew string) error {
+	return fmt.Errorf("%q: %w", sanatizePath(keyNew), kv.ErrReadOnly)
+}
+
+func New(params map[string]string) (kv.Provider, error) {
+	separator := params["separator"]
+	if separator == "" {
+		separator = defaultSeparator
+	}
+
+	return &KV{
+		prefix:    params["prefix"],
+		separator: separator,
+	}, nil
+}
+
+func init() {
+	if err := kv.Register("env", New, nil, []string{"prefix", "separator"}); err != nil {
+		panic("failed to register env KV driver")
+	}
+}
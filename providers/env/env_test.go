@@ -0,0 +1,107 @@
+package env
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+func setenv(t *testing.T, vars map[string]string) func() {
+	for k, v := range vars {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatalf("failed to set %s: %s", k, err)
+		}
+	}
+
+	return func() {
+		for k := range vars {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func Test_Env(t *testing.T) {
+	defer setenv(t, map[string]string{
+		"GOKVTEST__DB__HOST":        "localhost",
+		"GOKVTEST__DB__PORT":        "5432",
+		"GOKVTEST__DB__REPLICA__A":  "a",
+		"GOKVTEST__Name":            "gokv",
+		"GOKVTEST__NAME__SHADOWED":  "x",
+		"GOKVTEST__EMPTY":           "",
+		"GOKVTESTOTHER__DB__HOST":   "other",
+		"GOKVTEST_SINGLE__UNDERSCR": "ignored",
+	})()
+
+	k, err := New(map[string]string{
+		"prefix": "GOKVTEST",
+	})
+	if err != nil {
+		t.Fatalf("failed to create env KV: %s", err)
+	}
+
+	ctx := context.Background()
+
+	if node, err := k.Get(ctx, "/db/host"); err != nil || string(node.Value) != "localhost" {
+		t.Errorf("Get() returned invalid node: %v, %v", node, err)
+	}
+
+	if node, err := k.Get(ctx, "/DB/Port"); err != nil || string(node.Value) != "5432" {
+		t.Errorf("Get() should be case-insensitive: %v, %v", node, err)
+	}
+
+	root, err := k.(*KV).RGet(ctx, "/")
+	if err != nil {
+		t.Fatalf("RGet() returned error: %s", err)
+	}
+
+	if len(root.Children) != 3 {
+		t.Fatalf("RGet() returned invalid node: %v", root)
+	}
+
+	if c := root.Children[0]; c.Key != "db" || !c.IsDir || len(c.Children) != 3 || c.Children[2].Key != "db/replica" || len(c.Children[2].Children) != 1 {
+		t.Errorf("RGet() returned invalid child: %v", c)
+	}
+
+	if c := root.Children[1]; c.Key != "empty" || c.IsDir || c.Value != nil {
+		t.Errorf("RGet() returned invalid child: %v", c)
+	}
+
+	// variables shadowed by directories are not exposed
+	if c := root.Children[2]; c.Key != "name" || !c.IsDir || c.Value != nil {
+		t.Errorf("RGet() returned invalid child: %v", c)
+	}
+
+	if _, err := k.Get(ctx, "/does/not/exist"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get() of non-existent key should fail: %v", err)
+	}
+
+	if err := k.Set(ctx, "/db/host", []byte("x")); !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("Set() should fail with ErrReadOnly: %v", err)
+	}
+
+	if err := k.Delete(ctx, "/db/host"); !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("Delete() should fail with ErrReadOnly: %v", err)
+	}
+
+	if err := k.CAS(ctx, "/db/host", nil, []byte("x")); !errors.Is(err, kv.ErrReadOnly) {
+		t.Errorf("CAS() should fail with ErrReadOnly: %v", err)
+	}
+}
+
+func Test_EnvSeparator(t *testing.T) {
+	defer setenv(t, map[string]string{
+		"GOKVSEP_DB_HOST": "localhost",
+	})()
+
+	k, _ := New(map[string]string{
+		"prefix":    "GOKVSEP",
+		"separator": "_",
+	})
+
+	if node, err := k.Get(context.Background(), "/db/host"); err != nil || string(node.Value) != "localhost" {
+		t.Errorf("Get() returned invalid node: %v, %v", node, err)
+	}
+}
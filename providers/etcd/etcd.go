@@ -1,6 +1,14 @@
 package etcd
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,7 +35,7 @@ func (e *KV) get(ctx context.Context, key string, recursive bool) (*kv.Node, err
 		Recursive: recursive,
 	})
 	if err != nil {
-		return nil, err
+		return nil, convertError(key, err)
 	}
 
 	res := convertNode(node.Node)
@@ -45,8 +53,9 @@ func (e *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
 
 func convertNode(n *client.Node) *kv.Node {
 	node := &kv.Node{
-		Key:   sanatizePath(n.Key),
-		IsDir: n.Dir,
+		Key:      sanatizePath(n.Key),
+		IsDir:    n.Dir,
+		Revision: n.ModifiedIndex,
 	}
 
 	if n.Dir {
@@ -77,18 +86,282 @@ func (e *KV) Delete(ctx context.Context, key string) error {
 		Dir:       node.IsDir,
 		Recursive: true,
 	})
-	return err
+	return convertError(key, err)
 }
 
+// CAS sets key to value if its current value equals compar. A nil compar
+// requires key to not exist
 func (e *KV) CAS(ctx context.Context, key string, compar, value []byte) error {
-	return nil
+	return e.cas(ctx, key, compar, value, 0)
+}
+
+// CASTTL behaves like CAS but lets etcd remove key once ttl elapsed. etcd
+// only supports TTLs in whole seconds, so shorter TTLs are rounded up
+func (e *KV) CASTTL(ctx context.Context, key string, compar, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid TTL %s", ttl)
+	}
+
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+
+	return e.cas(ctx, key, compar, value, ttl)
+}
+
+// cas implements CAS and CASTTL. A zero ttl keeps the value forever
+func (e *KV) cas(ctx context.Context, key string, compar, value []byte, ttl time.Duration) error {
+	key = sanatizePath(key)
+
+	opts := &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+		TTL:       ttl,
+	}
+
+	if compar != nil {
+		opts.PrevExist = client.PrevExist
+		opts.PrevValue = string(compar)
+
+		// etcd ignores an empty prevValue so compare the index instead
+		if len(compar) == 0 {
+			node, err := e.Get(ctx, key)
+			if errors.Is(err, kv.ErrNotFound) {
+				return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+			} else if err != nil {
+				return err
+			}
+
+			if len(node.Value) != 0 || node.IsDir {
+				return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+			}
+
+			opts.PrevIndex = node.Revision
+		}
+	}
+
+	_, err := e.store.Set(ctx, key, string(value), opts)
+
+	err = convertError(key, err)
+	if errors.Is(err, kv.ErrNotFound) {
+		return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+	}
+
+	return err
+}
+
+// convertError wraps etcd errors with the matching gokv sentinel errors
+func convertError(key string, err error) error {
+	etcdErr, ok := err.(client.Error)
+	if !ok {
+		return err
+	}
+
+	switch etcdErr.Code {
+	case client.ErrorCodeKeyNotFound:
+		return fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	case client.ErrorCodeTestFailed, client.ErrorCodeNodeExist:
+		return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+	}
+
+	return err
+}
+
+// eventTypes maps etcd actions to gokv event types
+var eventTypes = map[string]kv.EventType{
+	"set":              kv.EventSet,
+	"create":           kv.EventSet,
+	"update":           kv.EventSet,
+	"delete":           kv.EventDelete,
+	"compareAndDelete": kv.EventDelete,
+	"expire":           kv.EventExpire,
+	"compareAndSwap":   kv.EventCompareAndSwap,
+}
+
+// Watch blocks until key or any key below it changes and returns the updated
+// node. If key has been deleted an error wrapping kv.ErrNotFound is returned
+func (e *KV) Watch(ctx context.Context, key string) (*kv.Node, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events, err := e.WatchEvents(ctx, key, kv.WatchOptions{Recursive: true})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := <-events; !ok {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("watch on %q failed", sanatizePath(key))
+	}
+
+	return e.Get(ctx, key)
+}
+
+// WatchEvents streams changes of key using an etcd watcher. Event revisions
+// are etcd modified indexes. If the requested index has already been cleared
+// from the etcd event history, the watch is restarted at the current index;
+// events in between are lost
+func (e *KV) WatchEvents(ctx context.Context, key string, opts kv.WatchOptions) (<-chan kv.Event, error) {
+	key = sanatizePath(key)
+
+	after := opts.AfterRevision
+
+	// start at the current index so no change made after WatchEvents returns
+	// is missed
+	if after == 0 {
+		resp, err := e.store.Get(ctx, key, nil)
+		if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeKeyNotFound {
+			after = etcdErr.Index
+		} else if err != nil {
+			return nil, err
+		} else {
+			after = resp.Index
+		}
+	}
+
+	ch := make(chan kv.Event)
+
+	go func() {
+		defer close(ch)
+
+		for {
+			w := e.store.Watcher(key, &client.WatcherOptions{
+				AfterIndex: after,
+				Recursive:  opts.Recursive,
+			})
+
+			for {
+				resp, err := w.Next(ctx)
+				if err != nil {
+					if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == client.ErrorCodeEventIndexCleared {
+						after = etcdErr.Index
+						break
+					}
+
+					return
+				}
+
+				after = resp.Node.ModifiedIndex
+
+				typ, ok := eventTypes[resp.Action]
+				if !ok {
+					continue
+				}
+
+				event := kv.Event{
+					Type:     typ,
+					Revision: resp.Node.ModifiedIndex,
+				}
+
+				if typ == kv.EventDelete || typ == kv.EventExpire {
+					event.Node = kv.Node{
+						Key:      sanatizePath(resp.Node.Key),
+						IsDir:    resp.Node.Dir,
+						Revision: resp.Node.ModifiedIndex,
+					}
+				} else {
+					event.Node = *convertNode(resp.Node)
+				}
+
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// defaultTimeout is used as per-request timeout if none is configured
+const defaultTimeout = time.Second
+
+// tlsConfig creates the TLS configuration for connecting to etcd. It returns
+// nil if no TLS related parameter is set
+func tlsConfig(params map[string]string) (*tls.Config, error) {
+	ca, cert, key := params["ca"], params["cert"], params["key"]
+
+	insecure := false
+	if v := params["insecure-skip-verify"]; v != "" {
+		var err error
+		if insecure, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid insecure-skip-verify %q: %s", v, err)
+		}
+	}
+
+	if ca == "" && cert == "" && key == "" && !insecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", ca)
+		}
+	}
+
+	if (cert == "") != (key == "") {
+		return nil, fmt.Errorf("cert and key must be set together")
+	}
+
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	return config, nil
 }
 
 func New(params map[string]string) (kv.Provider, error) {
+	timeout := defaultTimeout
+
+	if v := params["timeout"]; v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %s", v, err)
+		}
+	}
+
+	tlsConf, err := tlsConfig(params)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := client.DefaultTransport
+	if tlsConf != nil {
+		transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).Dial,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     tlsConf,
+		}
+	}
+
 	cli, err := client.New(client.Config{
 		Endpoints:               strings.Split(params["endpoints"], ","),
-		Transport:               client.DefaultTransport,
-		HeaderTimeoutPerRequest: time.Second,
+		Transport:               transport,
+		Username:                params["username"],
+		Password:                params["password"],
+		HeaderTimeoutPerRequest: timeout,
 	})
 
 	if err != nil {
@@ -104,5 +377,7 @@ func New(params map[string]string) (kv.Provider, error) {
 }
 
 func init() {
-	kv.Register("etcd", New, []string{"endpoints"}, nil)
+	optional := []string{"ca", "cert", "key", "insecure-skip-verify", "username", "password", "timeout"}
+
+	kv.Register("etcd", New, []string{"endpoints"}, optional)
 }
@@ -1,9 +1,15 @@
 package etcd
 
 import (
+	"crypto/tls"
+	"errors"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/coreos/etcd/client"
 	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
 )
 
 func Test_Etcd(t *testing.T) {
@@ -18,3 +24,360 @@ func Test_Etcd(t *testing.T) {
 
 	kv.KVTester(t, e)
 }
+
+func Test_EtcdTLS(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	f := newFakeEtcd()
+	f.username = "gokv"
+	f.password = "secret"
+
+	srv := httptest.NewUnstartedServer(f)
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	ca := writeCA(t, dir, srv)
+	cert, key := writeClientCert(t, dir)
+
+	ctx := context.Background()
+
+	e, err := New(map[string]string{
+		"endpoints": srv.URL,
+		"ca":        ca,
+		"cert":      cert,
+		"key":       key,
+		"username":  "gokv",
+		"password":  "secret",
+	})
+	if err != nil {
+		t.Fatalf("failed to create etcd: %s", err)
+	}
+
+	if err := e.Set(ctx, "/tls", []byte("value")); err != nil {
+		t.Errorf("Set() returned error: %s", err)
+	}
+
+	if node, err := e.Get(ctx, "/tls"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	} else if string(node.Value) != "value" {
+		t.Errorf("Get() returned invalid value: %q", node.Value)
+	}
+
+	// wrong credentials must be rejected
+	e, _ = New(map[string]string{
+		"endpoints": srv.URL,
+		"ca":        ca,
+		"cert":      cert,
+		"key":       key,
+		"username":  "gokv",
+		"password":  "wrong",
+	})
+
+	if _, err := e.Get(ctx, "/tls"); err == nil {
+		t.Errorf("Get() with invalid password should fail")
+	}
+
+	// the server certificate is not trusted without ca
+	e, _ = New(map[string]string{
+		"endpoints": srv.URL,
+		"cert":      cert,
+		"key":       key,
+		"username":  "gokv",
+		"password":  "secret",
+	})
+
+	if _, err := e.Get(ctx, "/tls"); err == nil {
+		t.Errorf("Get() with untrusted server certificate should fail")
+	}
+
+	e, _ = New(map[string]string{
+		"endpoints":            srv.URL,
+		"cert":                 cert,
+		"key":                  key,
+		"insecure-skip-verify": "true",
+		"username":             "gokv",
+		"password":             "secret",
+	})
+
+	if _, err := e.Get(ctx, "/tls"); err != nil {
+		t.Errorf("Get() with insecure-skip-verify returned error: %s", err)
+	}
+
+	// the server requires a client certificate
+	e, _ = New(map[string]string{
+		"endpoints": srv.URL,
+		"ca":        ca,
+		"username":  "gokv",
+		"password":  "secret",
+	})
+
+	if _, err := e.Get(ctx, "/tls"); err == nil {
+		t.Errorf("Get() without client certificate should fail")
+	}
+}
+
+func Test_EtcdTimeout(t *testing.T) {
+	f := newFakeEtcd()
+	f.delay = 200 * time.Millisecond
+
+	srv := httptest.NewTLSServer(f)
+	defer srv.Close()
+
+	ctx := context.Background()
+
+	e, err := New(map[string]string{
+		"endpoints":            srv.URL,
+		"insecure-skip-verify": "true",
+		"timeout":              "50ms",
+	})
+	if err != nil {
+		t.Fatalf("failed to create etcd: %s", err)
+	}
+
+	if err := e.Set(ctx, "/slow", []byte("value")); err == nil {
+		t.Errorf("Set() should fail if the request exceeds the timeout")
+	}
+
+	e, _ = New(map[string]string{
+		"endpoints":            srv.URL,
+		"insecure-skip-verify": "true",
+		"timeout":              "2s",
+	})
+
+	if err := e.Set(ctx, "/slow", []byte("value")); err != nil {
+		t.Errorf("Set() returned error: %s", err)
+	}
+}
+
+func Test_EtcdCAS(t *testing.T) {
+	f := newFakeEtcd()
+
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	e, err := New(map[string]string{"endpoints": srv.URL})
+	if err != nil {
+		t.Fatalf("failed to create etcd: %s", err)
+	}
+
+	ctx := context.Background()
+
+	if _, err := e.Get(ctx, "/cas"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get() of missing key should return kv.ErrNotFound: %v", err)
+	}
+
+	if err := e.CAS(ctx, "/cas", []byte("1"), []byte("2")); !errors.Is(err, kv.ErrCompareFailed) {
+		t.Errorf("CAS() of missing key should return kv.ErrCompareFailed: %v", err)
+	}
+
+	if err := e.CAS(ctx, "/cas", nil, []byte("1")); err != nil {
+		t.Errorf("CAS() returned error: %s", err)
+	}
+
+	if err := e.CAS(ctx, "/cas", nil, []byte("2")); !errors.Is(err, kv.ErrCompareFailed) {
+		t.Errorf("CAS() of existing key should return kv.ErrCompareFailed: %v", err)
+	}
+
+	if err := e.CAS(ctx, "/cas", []byte("2"), []byte("3")); !errors.Is(err, kv.ErrCompareFailed) {
+		t.Errorf("CAS() with wrong value should return kv.ErrCompareFailed: %v", err)
+	}
+
+	if err := e.CAS(ctx, "/cas", []byte("1"), []byte("3")); err != nil {
+		t.Errorf("CAS() returned error: %s", err)
+	}
+
+	if err := e.Delete(ctx, "/cas"); err != nil {
+		t.Errorf("Delete() returned error: %s", err)
+	}
+
+	if err := e.Delete(ctx, "/cas"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Delete() of missing key should return kv.ErrNotFound: %v", err)
+	}
+}
+
+func Test_EtcdCASTTL(t *testing.T) {
+	f := newFakeEtcd()
+
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	e, err := New(map[string]string{"endpoints": srv.URL})
+	if err != nil {
+		t.Fatalf("failed to create etcd: %s", err)
+	}
+
+	ctx := context.Background()
+	store := e.(*KV)
+
+	if err := store.CASTTL(ctx, "/lock", nil, []byte("a"), 10*time.Second); err != nil {
+		t.Errorf("CASTTL() returned error: %s", err)
+	}
+
+	if err := store.CASTTL(ctx, "/lock", nil, []byte("b"), 10*time.Second); !errors.Is(err, kv.ErrCompareFailed) {
+		t.Errorf("CASTTL() of existing key should return kv.ErrCompareFailed: %v", err)
+	}
+
+	if err := store.CASTTL(ctx, "/lock", []byte("a"), []byte("a"), 100*time.Millisecond); err != nil {
+		t.Errorf("CASTTL() returned error: %s", err)
+	}
+
+	f.lock.Lock()
+	ttl := f.ttls["/lock"]
+	f.lock.Unlock()
+
+	if ttl != "1" {
+		t.Errorf("CASTTL() did not round the TTL up to a second: %q", ttl)
+	}
+
+	if err := store.CASTTL(ctx, "/lock", []byte("a"), []byte("b"), 0); err == nil {
+		t.Errorf("CASTTL() with invalid TTL should fail")
+	}
+}
+
+func Test_EtcdInvalidOptions(t *testing.T) {
+	invalid := []map[string]string{
+		{"endpoints": "https://localhost:2379", "timeout": "soon"},
+		{"endpoints": "https://localhost:2379", "insecure-skip-verify": "maybe"},
+		{"endpoints": "https://localhost:2379", "ca": "/does/not/exist"},
+		{"endpoints": "https://localhost:2379", "cert": "/tmp/cert.pem"},
+	}
+
+	for _, params := range invalid {
+		if _, err := New(params); err == nil {
+			t.Errorf("New() should fail for %v", params)
+		}
+	}
+}
+
+func Test_EtcdWatchEvents(t *testing.T) {
+	f := newFakeEtcd()
+
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	e, err := New(map[string]string{
+		"endpoints": srv.URL,
+	})
+	if err != nil {
+		t.Fatalf("failed to create etcd: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	store := e.(*KV)
+
+	events, err := store.WatchEvents(ctx, "/watch", kv.WatchOptions{Recursive: true})
+	if err != nil {
+		t.Fatalf("WatchEvents() returned error: %s", err)
+	}
+
+	store.Set(ctx, "/watchother", []byte("1"))
+	store.Set(ctx, "/watch/a", []byte("1"))
+	store.store.Set(ctx, "/watch/a", "2", &client.SetOptions{PrevValue: "1"})
+	store.Delete(ctx, "/watch/a")
+	store.Set(ctx, "/watch/b", []byte("1"))
+	f.expire("/watch/b")
+
+	expected := []kv.Event{
+		{Type: kv.EventSet, Node: kv.Node{Key: "watch/a", Value: []byte("1")}},
+		{Type: kv.EventCompareAndSwap, Node: kv.Node{Key: "watch/a", Value: []byte("2")}},
+		{Type: kv.EventDelete, Node: kv.Node{Key: "watch/a"}},
+		{Type: kv.EventSet, Node: kv.Node{Key: "watch/b", Value: []byte("1")}},
+		{Type: kv.EventExpire, Node: kv.Node{Key: "watch/b"}},
+	}
+
+	var first uint64
+
+	for i, exp := range expected {
+		ev, ok := <-events
+		if !ok {
+			t.Fatalf("WatchEvents() closed the channel")
+		}
+
+		if ev.Type != exp.Type || ev.Node.Key != exp.Node.Key || string(ev.Node.Value) != string(exp.Node.Value) || ev.Revision == 0 {
+			t.Errorf("WatchEvents() returned invalid event %v, expected %v", ev, exp)
+		}
+
+		if i == 0 {
+			first = ev.Revision
+		}
+	}
+
+	// resume after the first event
+	resumed, err := store.WatchEvents(ctx, "/watch/a", kv.WatchOptions{AfterRevision: first})
+	if err != nil {
+		t.Fatalf("WatchEvents() returned error: %s", err)
+	}
+
+	if ev := <-resumed; ev.Type != kv.EventCompareAndSwap {
+		t.Errorf("resumed WatchEvents() returned invalid event %v", ev)
+	}
+
+	// resuming from a cleared index restarts at the current index
+	f.clearHistory()
+
+	cleared, err := store.WatchEvents(ctx, "/watch", kv.WatchOptions{Recursive: true, AfterRevision: first})
+	if err != nil {
+		t.Fatalf("WatchEvents() returned error: %s", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	store.Set(ctx, "/watch/c", []byte("1"))
+
+	if ev := <-cleared; ev.Type != kv.EventSet || ev.Node.Key != "watch/c" {
+		t.Errorf("WatchEvents() did not recover from a cleared index: %v", ev)
+	}
+}
+
+func Test_EtcdWatch(t *testing.T) {
+	f := newFakeEtcd()
+
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	e, err := New(map[string]string{
+		"endpoints": srv.URL,
+	})
+	if err != nil {
+		t.Fatalf("failed to create etcd: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	store := e.(*KV)
+	store.Set(ctx, "/key", []byte("1"))
+
+	result := make(chan error, 1)
+	go func() {
+		node, err := store.Watch(ctx, "/key")
+		if err == nil && string(node.Value) != "2" {
+			t.Errorf("Watch() returned invalid node: %v", node)
+		}
+		result <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	store.Set(ctx, "/key", []byte("2"))
+
+	if err := <-result; err != nil {
+		t.Errorf("Watch() returned error: %s", err)
+	}
+
+	go func() {
+		_, err := store.Watch(ctx, "/key")
+		result <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	store.Delete(ctx, "/key")
+
+	if err := <-result; !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Watch() of a deleted key should return ErrNotFound: %v", err)
+	}
+}
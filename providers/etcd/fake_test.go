@@ -0,0 +1,330 @@
+package etcd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd implements a minimal flat subset of the etcd v2 keys API used to
+// test transport related options and watches
+type fakeEtcd struct {
+	lock   sync.Mutex
+	values map[string]string
+	index  uint64
+
+	// ttls holds the ttl passed when setting a key, if any
+	ttls map[string]string
+
+	// history holds all events with an index of at least cleared
+	history []fakeEvent
+	cleared uint64
+
+	// changed is closed and replaced whenever an event is recorded
+	changed chan struct{}
+
+	// username and password are required if set
+	username string
+	password string
+
+	// delay is applied to every request before responding
+	delay time.Duration
+}
+
+type fakeEvent struct {
+	Action string   `json:"action"`
+	Node   fakeNode `json:"node"`
+}
+
+type fakeNode struct {
+	Key           string `json:"key"`
+	Value         string `json:"value"`
+	ModifiedIndex uint64 `json:"modifiedIndex"`
+	CreatedIndex  uint64 `json:"createdIndex"`
+}
+
+func (f *fakeEtcd) reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(f.index, 10))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// record increments the index and records an event. The lock must be held
+func (f *fakeEtcd) record(action, key, value string) fakeEvent {
+	f.index++
+
+	ev := fakeEvent{
+		Action: action,
+		Node:   fakeNode{Key: key, Value: value, ModifiedIndex: f.index, CreatedIndex: f.index},
+	}
+
+	f.history = append(f.history, ev)
+	close(f.changed)
+	f.changed = make(chan struct{})
+
+	return ev
+}
+
+// expire deletes key as if its TTL expired
+func (f *fakeEtcd) expire(key string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.values, key)
+	f.record("expire", key, "")
+}
+
+// clearHistory drops all recorded events
+func (f *fakeEtcd) clearHistory() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.history = nil
+	f.cleared = f.index + 1
+}
+
+// wait implements etcd v2 watches. The lock must be held
+func (f *fakeEtcd) wait(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+	recursive := query.Get("recursive") == "true"
+
+	index, _ := strconv.ParseUint(query.Get("waitIndex"), 10, 64)
+	if index == 0 {
+		index = f.index + 1
+	}
+
+	if index < f.cleared {
+		f.reply(w, http.StatusBadRequest, map[string]interface{}{
+			"errorCode": 401,
+			"message":   "The event in requested index is outdated and cleared",
+			"cause":     "the requested history has been cleared",
+			"index":     f.index,
+		})
+		return
+	}
+
+	for {
+		for _, ev := range f.history {
+			k := ev.Node.Key
+			if ev.Node.ModifiedIndex >= index && (k == key || recursive && strings.HasPrefix(k, key+"/")) {
+				f.reply(w, http.StatusOK, ev)
+				return
+			}
+		}
+
+		changed := f.changed
+
+		f.lock.Unlock()
+		select {
+		case <-changed:
+			f.lock.Lock()
+		case <-r.Context().Done():
+			f.lock.Lock()
+			return
+		}
+	}
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(f.delay)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.username != "" {
+		if u, p, ok := r.BasicAuth(); !ok || u != f.username || p != f.password {
+			f.reply(w, http.StatusUnauthorized, map[string]interface{}{
+				"errorCode": 110,
+				"message":   "The request requires user authentication",
+			})
+			return
+		}
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/v2/keys/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/v2/keys")
+
+	switch r.Method {
+	case "GET":
+		if r.URL.Query().Get("wait") == "true" {
+			f.wait(w, r, key)
+			return
+		}
+
+		value, ok := f.values[key]
+		if !ok {
+			f.reply(w, http.StatusNotFound, map[string]interface{}{
+				"errorCode": 100,
+				"message":   "Key not found",
+				"cause":     key,
+				"index":     f.index,
+			})
+			return
+		}
+
+		f.reply(w, http.StatusOK, map[string]interface{}{
+			"action": "get",
+			"node":   fakeNode{Key: key, Value: value, ModifiedIndex: f.index, CreatedIndex: f.index},
+		})
+
+	case "PUT":
+		r.ParseForm()
+
+		action := "set"
+
+		_, exists := f.values[key]
+
+		switch r.URL.Query().Get("prevExist") {
+		case "false":
+			if exists {
+				f.reply(w, http.StatusPreconditionFailed, map[string]interface{}{
+					"errorCode": 105,
+					"message":   "Key already exists",
+					"cause":     key,
+					"index":     f.index,
+				})
+				return
+			}
+
+			action = "create"
+
+		case "true":
+			if !exists {
+				f.reply(w, http.StatusNotFound, map[string]interface{}{
+					"errorCode": 100,
+					"message":   "Key not found",
+					"cause":     key,
+					"index":     f.index,
+				})
+				return
+			}
+		}
+
+		if prev := r.URL.Query().Get("prevValue"); prev != "" {
+			if f.values[key] != prev {
+				f.reply(w, http.StatusPreconditionFailed, map[string]interface{}{
+					"errorCode": 101,
+					"message":   "Compare failed",
+					"cause":     "[" + prev + " != " + f.values[key] + "]",
+					"index":     f.index,
+				})
+				return
+			}
+
+			action = "compareAndSwap"
+		}
+
+		f.values[key] = r.PostForm.Get("value")
+
+		if ttl := r.PostForm.Get("ttl"); ttl != "" {
+			f.ttls[key] = ttl
+		} else {
+			delete(f.ttls, key)
+		}
+
+		f.reply(w, http.StatusCreated, f.record(action, key, f.values[key]))
+
+	case "DELETE":
+		if _, ok := f.values[key]; !ok {
+			f.reply(w, http.StatusNotFound, map[string]interface{}{
+				"errorCode": 100,
+				"message":   "Key not found",
+				"cause":     key,
+				"index":     f.index,
+			})
+			return
+		}
+
+		delete(f.values, key)
+
+		f.reply(w, http.StatusOK, f.record("delete", key, ""))
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{
+		values:  make(map[string]string),
+		ttls:    make(map[string]string),
+		index:   1,
+		changed: make(chan struct{}),
+	}
+}
+
+// writePEM writes a PEM block of the given type to a new file within dir
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	path := filepath.Join(dir, name)
+
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", name, err)
+	}
+
+	return path
+}
+
+// writeCA writes the certificate of srv to a file usable as ca parameter
+func writeCA(t *testing.T, dir string, srv *httptest.Server) string {
+	return writePEM(t, dir, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+}
+
+// writeClientCert generates a self-signed client certificate and returns the
+// paths of the certificate and key files
+func writeClientCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gokv"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+
+	return writePEM(t, dir, "client.pem", "CERTIFICATE", der), writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", keyDer)
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gokv-etcd-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,420 @@
+// Package etcd3 implements a gokv provider for the etcd v3 API. As etcd v3
+// uses a flat keyspace, directories are emulated using key prefixes.
+package etcd3
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nethack42/gokv"
+	"github.com/nethack42/gokv/internal/nodetree"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/context"
+)
+
+// defaultPrefix is used to namespace all keys if no prefix is configured
+const defaultPrefix = "/gokv"
+
+type KV struct {
+	cli    *clientv3.Client
+	prefix string
+}
+
+func sanatizePath(path string) string {
+	return strings.Trim(path, "/")
+}
+
+// valueKey returns the etcd key used to store the value of p
+func (e *KV) valueKey(p string) string {
+	return e.prefix + "/" + p
+}
+
+// dirKey returns the etcd key prefix of all keys stored below p
+func (e *KV) dirKey(p string) string {
+	if p == "" {
+		return e.prefix + "/"
+	}
+
+	return e.prefix + "/" + p + "/"
+}
+
+// path returns the gokv path for the etcd key k
+func (e *KV) path(k []byte) string {
+	return strings.TrimPrefix(string(k), e.prefix+"/")
+}
+
+// buildTree creates a directory node for key from all key-value pairs stored
+// below it. depth limits the number of levels to include (-1 means unlimited)
+func (e *KV) buildTree(key string, kvs []*mvccpb.KeyValue, depth int) *kv.Node {
+	root := nodetree.New(key)
+
+	prefix := e.dirKey(key)
+
+	for _, pair := range kvs {
+		parts := strings.Split(strings.TrimPrefix(string(pair.Key), prefix), "/")
+		cur := root
+
+		for i, part := range parts {
+			cur = cur.Child(part, i < len(parts)-1)
+		}
+
+		if len(pair.Value) > 0 {
+			cur.Node.Value = pair.Value
+		}
+		cur.Node.Revision = uint64(pair.ModRevision)
+	}
+
+	node := root.Convert(depth)
+	return &node
+}
+
+func (e *KV) get(ctx context.Context, key string, depth int) (*kv.Node, error) {
+	key = sanatizePath(key)
+
+	// query the value and all keys below within the same revision
+	resp, err := e.cli.Txn(ctx).Then(
+		clientv3.OpGet(e.valueKey(key)),
+		clientv3.OpGet(e.dirKey(key), clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	if key != "" {
+		if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+			node := &kv.Node{
+				Key:      key,
+				Revision: uint64(kvs[0].ModRevision),
+			}
+
+			if len(kvs[0].Value) > 0 {
+				node.Value = kvs[0].Value
+			}
+
+			return node, nil
+		}
+	}
+
+	kvs := resp.Responses[1].GetResponseRange().Kvs
+	if key != "" && len(kvs) == 0 {
+		return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	}
+
+	return e.buildTree(key, kvs, depth), nil
+}
+
+func (e *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
+	return e.get(ctx, key, 1)
+}
+
+func (e *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	return e.get(ctx, key, -1)
+}
+
+// hierarchy returns comparisons ensuring that no parent of key is a value and
+// key itself is not a directory
+func (e *KV) hierarchy(key string) []clientv3.Cmp {
+	var cmps []clientv3.Cmp
+
+	parts := strings.Split(key, "/")
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], "/")
+		cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(e.valueKey(parent)), "=", 0))
+	}
+
+	cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(e.dirKey(key)), "=", 0).WithPrefix())
+
+	return cmps
+}
+
+// compare returns a comparison ensuring that the value of key matches value.
+// If value is nil, key must not exist
+func (e *KV) compare(key string, value []byte) clientv3.Cmp {
+	if value == nil {
+		return clientv3.Compare(clientv3.CreateRevision(e.valueKey(key)), "=", 0)
+	}
+
+	return clientv3.Compare(clientv3.Value(e.valueKey(key)), "=", string(value))
+}
+
+// commit executes a transaction guarded by the hierarchy checks for all keys
+// in keys and the additional comparisons in cmps. It distinguishes between
+// hierarchy violations and failed comparisons
+func (e *KV) commit(ctx context.Context, keys []string, cmps []clientv3.Cmp, ops ...clientv3.Op) error {
+	var hierarchy []clientv3.Cmp
+
+	for _, key := range keys {
+		if key == "" {
+			return fmt.Errorf("cannot set root directory")
+		}
+
+		hierarchy = append(hierarchy, e.hierarchy(key)...)
+	}
+
+	resp, err := e.cli.Txn(ctx).If(append(hierarchy, cmps...)...).Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+
+	if resp.Succeeded {
+		return nil
+	}
+
+	check, err := e.cli.Txn(ctx).If(hierarchy...).Commit()
+	if err != nil {
+		return err
+	}
+
+	if !check.Succeeded {
+		return fmt.Errorf("cannot set %s: parent is not a directory or key is a directory", strings.Join(keys, ", "))
+	}
+
+	return fmt.Errorf("%s: %w", strings.Join(keys, ", "), kv.ErrCompareFailed)
+}
+
+func (e *KV) Set(ctx context.Context, key string, value []byte) error {
+	key = sanatizePath(key)
+
+	return e.commit(ctx, []string{key}, nil, clientv3.OpPut(e.valueKey(key), string(value)))
+}
+
+// SetTTL sets key to value and attaches it to a new lease expiring after ttl.
+// etcd leases have a granularity of one second
+func (e *KV) SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	key = sanatizePath(key)
+
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return fmt.Errorf("invalid TTL %s", ttl)
+	}
+
+	lease, err := e.cli.Grant(ctx, seconds)
+	if err != nil {
+		return err
+	}
+
+	err = e.commit(ctx, []string{key}, nil, clientv3.OpPut(e.valueKey(key), string(value), clientv3.WithLease(lease.ID)))
+	if err != nil {
+		e.cli.Revoke(ctx, lease.ID)
+		return err
+	}
+
+	return nil
+}
+
+// CAS sets key to value if its current value matches compare. If compare is
+// nil the key must not exist
+func (e *KV) CAS(ctx context.Context, key string, compare, value []byte) error {
+	key = sanatizePath(key)
+
+	return e.commit(ctx, []string{key}, []clientv3.Cmp{e.compare(key, compare)}, clientv3.OpPut(e.valueKey(key), string(value)))
+}
+
+func (e *KV) Delete(ctx context.Context, key string) error {
+	key = sanatizePath(key)
+	if key == "" {
+		return fmt.Errorf("cannot delete root directory")
+	}
+
+	resp, err := e.cli.Txn(ctx).Then(
+		clientv3.OpDelete(e.valueKey(key)),
+		clientv3.OpDelete(e.dirKey(key), clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return err
+	}
+
+	deleted := resp.Responses[0].GetResponseDeleteRange().Deleted +
+		resp.Responses[1].GetResponseDeleteRange().Deleted
+
+	if deleted == 0 {
+		return fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	}
+
+	return nil
+}
+
+// Txn executes all operations within a single etcd transaction
+func (e *KV) Txn(ctx context.Context, ops []kv.Op) error {
+	var keys []string
+	var cmps []clientv3.Cmp
+	var then []clientv3.Op
+
+	for _, op := range ops {
+		key := sanatizePath(op.Key)
+
+		switch op.Type {
+		case kv.OpSet:
+			keys = append(keys, key)
+			then = append(then, clientv3.OpPut(e.valueKey(key), string(op.Value)))
+		case kv.OpDelete:
+			if key == "" {
+				return fmt.Errorf("cannot delete root directory")
+			}
+			then = append(then,
+				clientv3.OpDelete(e.valueKey(key)),
+				clientv3.OpDelete(e.dirKey(key), clientv3.WithPrefix()))
+		case kv.OpCompare:
+			cmps = append(cmps, e.compare(key, op.Value))
+		default:
+			return fmt.Errorf("unsupported operation %q", op.Type)
+		}
+	}
+
+	return e.commit(ctx, keys, cmps, then...)
+}
+
+// Watch blocks until key or any key below it changes and returns the updated
+// node. If key has been deleted an error wrapping kv.ErrNotFound is returned
+func (e *KV) Watch(ctx context.Context, key string) (*kv.Node, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events, err := e.WatchEvents(ctx, key, kv.WatchOptions{Recursive: true})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := <-events; !ok {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("watch on %q failed", sanatizePath(key))
+	}
+
+	return e.Get(ctx, key)
+}
+
+// WatchEvents streams changes of key using an etcd watch. Event revisions are
+// etcd revisions and can be used to resume a watch as long as they have not
+// been compacted. Note that etcd does not distinguish between deleted and
+// expired keys so EventExpire is never reported
+func (e *KV) WatchEvents(ctx context.Context, key string, opts kv.WatchOptions) (<-chan kv.Event, error) {
+	key = sanatizePath(key)
+
+	watchOpts := []clientv3.OpOption{
+		clientv3.WithPrefix(),
+		clientv3.WithCreatedNotify(),
+	}
+
+	if opts.AfterRevision > 0 {
+		watchOpts = append(watchOpts, clientv3.WithRev(int64(opts.AfterRevision)+1))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	// watching the value key as a prefix includes all keys below it but also
+	// siblings sharing the same prefix which are filtered below
+	wch := e.cli.Watch(clientv3.WithRequireLeader(ctx), e.valueKey(key), watchOpts...)
+
+	// wait until the watch has been established so no change made after
+	// WatchEvents returns is missed
+	created, ok := <-wch
+	if !ok {
+		cancel()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("watch on %q failed", key)
+	}
+
+	if created.CompactRevision != 0 {
+		cancel()
+		return nil, fmt.Errorf("revision %d: %w", opts.AfterRevision, kv.ErrCompacted)
+	}
+
+	if err := created.Err(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ch := make(chan kv.Event)
+
+	go func() {
+		defer cancel()
+		defer close(ch)
+
+		for resp := range wch {
+			if resp.Err() != nil {
+				return
+			}
+
+			for _, ev := range resp.Events {
+				p := e.path(ev.Kv.Key)
+
+				if p != key && !(opts.Recursive && (key == "" || strings.HasPrefix(p, key+"/"))) {
+					continue
+				}
+
+				event := kv.Event{
+					Type: kv.EventSet,
+					Node: kv.Node{
+						Key:      p,
+						Revision: uint64(ev.Kv.ModRevision),
+					},
+					Revision: uint64(ev.Kv.ModRevision),
+				}
+
+				if ev.Type == mvccpb.DELETE {
+					event.Type = kv.EventDelete
+				} else if len(ev.Kv.Value) > 0 {
+					event.Node.Value = ev.Kv.Value
+				}
+
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// Close closes the connection to etcd
+func (e *KV) Close() error {
+	return e.cli.Close()
+}
+
+func New(params map[string]string) (kv.Provider, error) {
+	timeout := 5 * time.Second
+
+	if v := params["dial-timeout"]; v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid dial-timeout %q: %s", v, err)
+		}
+	}
+
+	prefix := params["prefix"]
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(params["endpoints"], ","),
+		DialTimeout: timeout,
+		Username:    params["username"],
+		Password:    params["password"],
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &KV{
+		cli:    cli,
+		prefix: "/" + strings.Trim(prefix, "/"),
+	}, nil
+}
+
+func init() {
+	optional := []string{"prefix", "username", "password", "dial-timeout"}
+
+	if err := kv.Register("etcd3", New, []string{"endpoints"}, optional); err != nil {
+		panic("failed to register etcd3 KV driver")
+	}
+}
@@ -0,0 +1,264 @@
+package etcd3
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nethack42/gokv"
+	"go.etcd.io/etcd/server/v3/embed"
+	"golang.org/x/net/context"
+)
+
+// freeAddr returns a local address that is currently not in use
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %s", err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+// startEtcd starts an embedded etcd server listening on random local ports
+func startEtcd(t *testing.T) (*embed.Etcd, func()) {
+	dir, err := ioutil.TempDir("", "gokv-etcd3-")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+
+	client, _ := url.Parse("http://" + freeAddr(t))
+	peer, _ := url.Parse("http://" + freeAddr(t))
+
+	cfg.ListenClientUrls = []url.URL{*client}
+	cfg.AdvertiseClientUrls = []url.URL{*client}
+	cfg.ListenPeerUrls = []url.URL{*peer}
+	cfg.AdvertisePeerUrls = []url.URL{*peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to start etcd: %s", err)
+	}
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		os.RemoveAll(dir)
+		t.Fatalf("etcd did not become ready")
+	}
+
+	return e, func() {
+		e.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func newKV(t *testing.T) (*KV, func()) {
+	e, stop := startEtcd(t)
+
+	k, err := New(map[string]string{
+		"endpoints": e.Clients[0].Addr().String(),
+	})
+	if err != nil {
+		stop()
+		t.Fatalf("failed to create etcd3 KV: %s", err)
+	}
+
+	return k.(*KV), func() {
+		k.(*KV).Close()
+		stop()
+	}
+}
+
+func Test_Etcd3(t *testing.T) {
+	k, stop := newKV(t)
+	defer stop()
+
+	kv.KVTester(t, k)
+}
+
+func Test_Etcd3RGet(t *testing.T) {
+	k, stop := newKV(t)
+	defer stop()
+
+	ctx := context.Background()
+
+	k.Set(ctx, "/app/config/db", []byte("postgres"))
+	k.Set(ctx, "/app/users/paz", []byte("1"))
+	k.Set(ctx, "/application", []byte("x"))
+
+	node, err := k.RGet(ctx, "/app")
+	if err != nil {
+		t.Fatalf("RGet() returned error: %s", err)
+	}
+
+	if !node.IsDir || len(node.Children) != 2 {
+		t.Fatalf("RGet() returned invalid node: %v", node)
+	}
+
+	if c := node.Children[0]; c.Key != "app/config" || !c.IsDir || len(c.Children) != 1 || string(c.Children[0].Value) != "postgres" {
+		t.Errorf("RGet() returned invalid child: %v", c)
+	}
+
+	if c := node.Children[0].Children[0]; c.Revision == 0 {
+		t.Errorf("RGet() did not set the revision: %v", c)
+	}
+
+	if node, err := k.Get(ctx, "/app"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	} else if len(node.Children[0].Children) != 0 {
+		t.Errorf("Get() should not return grandchildren: %v", node.Children[0])
+	}
+
+	if err := k.Set(ctx, "/app/config/db/host", []byte("x")); err == nil {
+		t.Errorf("Set() below a value should fail")
+	}
+
+	if err := k.Set(ctx, "/app/config", []byte("x")); err == nil {
+		t.Errorf("Set() of a directory should fail")
+	}
+
+	if err := k.Delete(ctx, "/app"); err != nil {
+		t.Errorf("Delete() returned error: %s", err)
+	}
+
+	if _, err := k.Get(ctx, "/application"); err != nil {
+		t.Errorf("Delete() removed a key sharing the same prefix: %s", err)
+	}
+}
+
+func Test_Etcd3Txn(t *testing.T) {
+	k, stop := newKV(t)
+	defer stop()
+
+	ctx := context.Background()
+
+	if err := k.Set(ctx, "/cas", []byte("3")); err != nil {
+		t.Errorf("Set() returned error: %s", err)
+	}
+
+	if err := k.CAS(ctx, "/cas/x", nil, []byte("1")); err == nil || errors.Is(err, kv.ErrCompareFailed) {
+		t.Errorf("CAS() below a value should fail with a hierarchy error: %v", err)
+	}
+
+	err := k.Txn(ctx, []kv.Op{
+		{Type: kv.OpCompare, Key: "/cas", Value: []byte("3")},
+		{Type: kv.OpSet, Key: "/txn/a", Value: []byte("a")},
+		{Type: kv.OpDelete, Key: "/cas"},
+	})
+	if err != nil {
+		t.Errorf("Txn() returned error: %s", err)
+	}
+
+	if _, err := k.Get(ctx, "/cas"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Txn() did not delete /cas: %v", err)
+	}
+
+	err = k.Txn(ctx, []kv.Op{
+		{Type: kv.OpCompare, Key: "/txn/a", Value: []byte("b")},
+		{Type: kv.OpSet, Key: "/txn/b", Value: []byte("b")},
+	})
+	if !errors.Is(err, kv.ErrCompareFailed) {
+		t.Errorf("Txn() with failing compare should fail: %v", err)
+	}
+
+	if _, err := k.Get(ctx, "/txn/b"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("failed Txn() must not apply any operation: %v", err)
+	}
+}
+
+func Test_Etcd3TTL(t *testing.T) {
+	k, stop := newKV(t)
+	defer stop()
+
+	ctx := context.Background()
+
+	if err := k.SetTTL(ctx, "/ttl", []byte("1"), time.Second); err != nil {
+		t.Fatalf("SetTTL() returned error: %s", err)
+	}
+
+	if _, err := k.Get(ctx, "/ttl"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := k.Get(ctx, "/ttl"); errors.Is(err, kv.ErrNotFound) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("key did not expire")
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func Test_Etcd3Watch(t *testing.T) {
+	k, stop := newKV(t)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	k.Set(ctx, "/watch/a", []byte("1"))
+	node, _ := k.Get(ctx, "/watch/a")
+
+	events, err := k.WatchEvents(ctx, "/watch", kv.WatchOptions{Recursive: true})
+	if err != nil {
+		t.Fatalf("WatchEvents() returned error: %s", err)
+	}
+
+	// changes to keys sharing the same prefix must not be reported
+	k.Set(ctx, "/watchother", []byte("1"))
+	k.Set(ctx, "/watch/b", []byte("2"))
+	k.Delete(ctx, "/watch/a")
+
+	expected := []kv.Event{
+		{Type: kv.EventSet, Node: kv.Node{Key: "watch/b", Value: []byte("2")}},
+		{Type: kv.EventDelete, Node: kv.Node{Key: "watch/a"}},
+	}
+
+	var last uint64
+
+	for _, exp := range expected {
+		ev, ok := <-events
+		if !ok {
+			t.Fatalf("WatchEvents() closed the channel")
+		}
+
+		if ev.Type != exp.Type || ev.Node.Key != exp.Node.Key || string(ev.Node.Value) != string(exp.Node.Value) || ev.Revision <= last {
+			t.Errorf("WatchEvents() returned invalid event %v, expected %v", ev, exp)
+		}
+
+		last = ev.Revision
+	}
+
+	// resuming after the initial revision must replay both changes
+	resumed, err := k.WatchEvents(ctx, "/watch", kv.WatchOptions{
+		Recursive:     true,
+		AfterRevision: node.Revision,
+	})
+	if err != nil {
+		t.Fatalf("WatchEvents() returned error: %s", err)
+	}
+
+	for _, exp := range expected {
+		if ev := <-resumed; ev.Type != exp.Type || ev.Node.Key != exp.Node.Key {
+			t.Errorf("resumed WatchEvents() returned invalid event %v, expected %v", ev, exp)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+// Package file implements a gokv provider on top of a plain directory tree.
+// Directories are mapped to directory nodes and regular files to values.
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/nethack42/gokv"
+	"github.com/nethack42/gokv/internal/fsutil"
+	"golang.org/x/net/context"
+)
+
+// tempPrefix is used for temporary files created during atomic writes. Files
+// and directories using this prefix are hidden from the KV tree
+const tempPrefix = ".gokv-"
+
+// lockFile is the name of the lock file created within the root directory
+const lockFile = tempPrefix + "lock"
+
+type KV struct {
+	root string
+}
+
+func sanatizePath(key string) string {
+	return strings.Trim(key, "/")
+}
+
+// filePath returns the absolute file path for key
+func (f *KV) filePath(key string) (string, error) {
+	key = sanatizePath(key)
+
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." || part == "." || strings.HasPrefix(part, tempPrefix) {
+			return "", fmt.Errorf("invalid key %q", key)
+		}
+	}
+
+	return filepath.Join(f.root, filepath.FromSlash(key)), nil
+}
+
+// lock acquires an exclusive lock on the lock file within the root directory.
+// The returned function must be called to release the lock
+func (f *KV) lock() (func(), error) {
+	return fsutil.Lock(filepath.Join(f.root, lockFile))
+}
+
+func (f *KV) readNode(key, p string, info os.FileInfo, depth int) (*kv.Node, error) {
+	node := &kv.Node{
+		Key:   key,
+		IsDir: info.IsDir(),
+	}
+
+	setTimes(node, p, info)
+
+	if !node.IsDir {
+		value, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(value) > 0 {
+			node.Value = value
+		}
+
+		return node, nil
+	}
+
+	if depth == 0 {
+		return node, nil
+	}
+
+	entries, err := ioutil.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tempPrefix) {
+			continue
+		}
+
+		child, err := f.readNode(path.Join(key, entry.Name()), filepath.Join(p, entry.Name()), entry, depth-1)
+		if err != nil {
+			return nil, err
+		}
+
+		node.Children = append(node.Children, *child)
+	}
+
+	return node, nil
+}
+
+func (f *KV) get(ctx context.Context, key string, depth int) (*kv.Node, error) {
+	p, err := f.filePath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%q: %w", sanatizePath(key), kv.ErrNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return f.readNode(sanatizePath(key), p, info, depth)
+}
+
+func (f *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
+	return f.get(ctx, key, 1)
+}
+
+func (f *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	return f.get(ctx, key, -1)
+}
+
+// writeFile atomically replaces the content of p by writing to a temporary
+// file first and renaming it afterwards
+func writeFile(p string, value []byte) error {
+	if info, err := os.Stat(p); err == nil && info.IsDir() {
+		return fmt.Errorf("cannot set %q: is a directory", p)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), tempPrefix)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+func (f *KV) Set(ctx context.Context, key string, value []byte) error {
+	p, err := f.filePath(key)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return writeFile(p, value)
+}
+
+func (f *KV) Delete(ctx context.Context, key string) error {
+	p, err := f.filePath(key)
+	if err != nil {
+		return err
+	}
+
+	if p == f.root {
+		return fmt.Errorf("cannot delete root directory")
+	}
+
+	unlock, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := os.Lstat(p); os.IsNotExist(err) {
+		return fmt.Errorf("%q: %w", sanatizePath(key), kv.ErrNotFound)
+	} else if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(p)
+}
+
+// CAS sets key to value if its current value matches compare. If compare is
+// nil the key must not exist. Concurrent writers are serialized using a lock
+// file within the root directory
+func (f *KV) CAS(ctx context.Context, key string, compare, value []byte) error {
+	p, err := f.filePath(key)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := ioutil.ReadFile(p)
+	switch {
+	case os.IsNotExist(err):
+		if compare != nil {
+			return fmt.Errorf("%q: %w", sanatizePath(key), kv.ErrCompareFailed)
+		}
+	case err != nil:
+		return err
+	case compare == nil || !bytes.Equal(current, compare):
+		return fmt.Errorf("%q: %w", sanatizePath(key), kv.ErrCompareFailed)
+	}
+
+	return writeFile(p, value)
+}
+
+func (f *KV) Move(ctx context.Context, keyOld, keyNew string) error {
+	src, err := f.filePath(keyOld)
+	if err != nil {
+		return err
+	}
+
+	dst, err := f.filePath(keyNew)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := checkCopy(src, dst); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(src, dst)
+}
+
+func (f *KV) Copy(ctx context.Context, keyOld, keyNew string) error {
+	src, err := f.filePath(keyOld)
+	if err != nil {
+		return err
+	}
+
+	dst, err := f.filePath(keyNew)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := checkCopy(src, dst); err != nil {
+		return err
+	}
+
+	return copyTree(src, dst)
+}
+
+// checkCopy ensures src exists, dst does not and dst is not located within src
+func checkCopy(src, dst string) error {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return fmt.Errorf("%q: %w", src, kv.ErrNotFound)
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%q already exists", dst)
+	}
+
+	if dst == src || strings.HasPrefix(dst, src+string(filepath.Separator)) {
+		return fmt.Errorf("cannot copy %q into itself", src)
+	}
+
+	return nil
+}
+
+func copyTree(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		value, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+
+		return writeFile(dst, value)
+	}
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tempPrefix) {
+			continue
+		}
+
+		if err := copyTree(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func New(params map[string]string) (kv.Provider, error) {
+	root, err := filepath.Abs(params["root"])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	return &KV{
+		root: root,
+	}, nil
+}
+
+func init() {
+	if err := kv.Register("file", New, []string{"root"}, nil); err != nil {
+		panic("failed to register file KV driver")
+	}
+}
@@ -0,0 +1,134 @@
+package file
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+func newTestKV(t *testing.T) (*KV, func()) {
+	dir, err := ioutil.TempDir("", "gokv-file")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+
+	k, err := New(map[string]string{
+		"root": dir,
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to create file KV: %s", err)
+	}
+
+	return k.(*KV), func() { os.RemoveAll(dir) }
+}
+
+func Test_File(t *testing.T) {
+	k, cleanup := newTestKV(t)
+	defer cleanup()
+
+	kv.KVTester(t, k)
+}
+
+func Test_FileCASUpdated(t *testing.T) {
+	k, cleanup := newTestKV(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	k.Set(ctx, "/cas", []byte("1"))
+
+	if err := k.CAS(ctx, "/cas", []byte("1"), []byte("3")); err != nil {
+		t.Errorf("CAS() returned error: %s", err)
+	}
+
+	if node, err := k.Get(ctx, "/cas"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	} else if node.Updated == nil {
+		t.Errorf("Get() did not set the update time")
+	}
+}
+
+func Test_FileMoveCopy(t *testing.T) {
+	k, cleanup := newTestKV(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	k.Set(ctx, "/src/a", []byte("1"))
+	k.Set(ctx, "/src/b/c", []byte("2"))
+
+	if err := k.Copy(ctx, "/src", "/copy"); err != nil {
+		t.Errorf("Copy() returned error: %s", err)
+	}
+
+	if err := k.Copy(ctx, "/src", "/src/nested"); err == nil {
+		t.Errorf("Copy() into itself should fail")
+	}
+
+	if err := k.Move(ctx, "/src", "/dst/moved"); err != nil {
+		t.Errorf("Move() returned error: %s", err)
+	}
+
+	if _, err := k.Get(ctx, "/src"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get() of moved key should fail with ErrNotFound: %v", err)
+	}
+
+	for _, key := range []string{"/copy/b/c", "/dst/moved/b/c"} {
+		if node, err := k.Get(ctx, key); err != nil {
+			t.Errorf("Get(%q) returned error: %s", key, err)
+		} else if string(node.Value) != "2" {
+			t.Errorf("Get(%q) returned invalid value: %q", key, node.Value)
+		}
+	}
+
+	if node, err := k.RGet(ctx, "/copy"); err != nil {
+		t.Errorf("RGet() returned error: %s", err)
+	} else if len(node.Children) != 2 {
+		t.Errorf("RGet() returned invalid number of children: %v", node.Children)
+	}
+}
+
+func Test_FileWatch(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Watch is only supported on linux")
+	}
+
+	k, cleanup := newTestKV(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	k.Set(ctx, "/watch", []byte("1"))
+
+	result := make(chan *kv.Node, 1)
+	go func() {
+		node, err := k.Watch(ctx, "/watch")
+		if err != nil {
+			t.Errorf("Watch() returned error: %s", err)
+		}
+		result <- node
+	}()
+
+	// give the watcher some time to setup inotify
+	time.Sleep(100 * time.Millisecond)
+	k.Set(ctx, "/watch", []byte("2"))
+
+	if node := <-result; node != nil && string(node.Value) != "2" {
+		t.Errorf("Watch() returned invalid value: %q", node.Value)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := k.Watch(ctx, "/watch"); err != context.DeadlineExceeded {
+		t.Errorf("Watch() should return after the context is done: %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package file
+
+import (
+	"os"
+	"time"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/sys/unix"
+)
+
+// setTimes sets the Created and Updated fields of node. The creation time is
+// only available if the underlying filesystem supports it
+func setTimes(node *kv.Node, p string, info os.FileInfo) {
+	updated := info.ModTime()
+	node.Updated = &updated
+
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, p, 0, unix.STATX_BTIME, &stx); err != nil {
+		return
+	}
+
+	if stx.Mask&unix.STATX_BTIME != 0 {
+		created := time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec))
+		node.Created = &created
+	}
+}
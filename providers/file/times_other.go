@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package file
+
+import (
+	"os"
+
+	"github.com/nethack42/gokv"
+)
+
+// setTimes sets the Updated field of node. Creation times are not supported
+// on this platform
+func setTimes(node *kv.Node, p string, info os.FileInfo) {
+	updated := info.ModTime()
+	node.Updated = &updated
+}
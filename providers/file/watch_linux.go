@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/nethack42/gokv"
+	"github.com/nethack42/gokv/internal/fsutil"
+	"golang.org/x/net/context"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE |
+	syscall.IN_ATTRIB | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// Watch blocks until key or one of its direct children changes and returns
+// the updated node. If key has been deleted an error wrapping kv.ErrNotFound
+// is returned. Changes are detected using inotify
+func (f *KV) Watch(ctx context.Context, key string) (*kv.Node, error) {
+	p, err := f.filePath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	inotify, err := fsutil.NewInotify()
+	if err != nil {
+		return nil, err
+	}
+	defer inotify.Close()
+
+	parentWd, dirWd := -1, -1
+	name := filepath.Base(p)
+
+	if p != f.root {
+		// values are replaced by renaming temporary files so we need to watch
+		// the parent directory instead of the file itself
+		if parentWd, err = inotify.Add(filepath.Dir(p), watchMask); err != nil {
+			return nil, err
+		}
+	}
+
+	if info, err := os.Stat(p); err == nil && info.IsDir() {
+		if dirWd, err = inotify.Add(p, watchMask); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		events, err := inotify.Read(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		changed := false
+
+		for _, ev := range events {
+			switch {
+			case ev.Mask&syscall.IN_IGNORED != 0:
+			case ev.Wd == parentWd && ev.Name == name:
+				changed = true
+			case ev.Wd == dirWd && !strings.HasPrefix(ev.Name, tempPrefix):
+				changed = true
+			}
+		}
+
+		if changed {
+			return f.Get(ctx, key)
+		}
+	}
+}
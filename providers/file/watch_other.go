@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package file
+
+import (
+	"fmt"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+// Watch is only supported on Linux
+func (f *KV) Watch(ctx context.Context, key string) (*kv.Node, error) {
+	return nil, fmt.Errorf("Watch not supported on this platform")
+}
@@ -0,0 +1,816 @@
+// Package git implements a gokv provider storing the KV tree as files within
+// a local git repository. Every change is recorded as a commit so the history
+// of each key can be reviewed and restored.
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultAuthorName  = "gokv"
+	defaultAuthorEmail = "gokv@localhost"
+	defaultMessage     = "{{.Op}} {{.Key}}{{with .Target}} to {{.}}{{end}}"
+)
+
+type KV struct {
+	root string
+	repo *gogit.Repository
+	wt   *gogit.Worktree
+
+	name    string
+	email   string
+	message *template.Template
+
+	// lock serializes all changes to the worktree
+	lock sync.Mutex
+}
+
+// change describes a single change and is passed to the message template
+type change struct {
+	// Op holds the name of the operation (set, delete, move, copy or restore)
+	Op string
+
+	// Key holds the absolute key changed by the operation
+	Key string
+
+	// Target holds the destination key of move and copy operations and the
+	// commit hash for restore operations
+	Target string
+}
+
+type contextKey int
+
+const (
+	authorKey contextKey = iota
+	messageKey
+)
+
+type author struct {
+	name, email string
+}
+
+// WithAuthor returns a context that overwrites the commit author configured
+// for the provider for all changes made using it
+func WithAuthor(ctx context.Context, name, email string) context.Context {
+	return context.WithValue(ctx, authorKey, author{name, email})
+}
+
+// WithMessage returns a context that overwrites the commit message template
+// configured for the provider for all changes made using it
+func WithMessage(ctx context.Context, message string) context.Context {
+	return context.WithValue(ctx, messageKey, message)
+}
+
+func sanatizePath(key string) string {
+	return strings.Trim(key, "/")
+}
+
+// filePath validates key and returns the absolute file path for it
+func (g *KV) filePath(key string) (string, error) {
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." || part == "." || part == ".git" {
+			return "", fmt.Errorf("invalid key %q", key)
+		}
+	}
+
+	return filepath.Join(g.root, filepath.FromSlash(key)), nil
+}
+
+// head returns the tree of the current HEAD commit
+func (g *KV) head() (*object.Tree, error) {
+	ref, err := g.repo.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := g.repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	return commit.Tree()
+}
+
+// isNotFound checks if err is returned by go-git for missing tree entries
+func isNotFound(err error) bool {
+	return errors.Is(err, object.ErrEntryNotFound) ||
+		errors.Is(err, object.ErrDirectoryNotFound) ||
+		errors.Is(err, object.ErrFileNotFound)
+}
+
+func (g *KV) readBlob(hash plumbing.Hash) ([]byte, error) {
+	blob, err := g.repo.BlobObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+func (g *KV) readNode(key string, tree *object.Tree, entry *object.TreeEntry, depth int) (*kv.Node, error) {
+	node := &kv.Node{
+		Key:   key,
+		IsDir: entry == nil || entry.Mode == filemode.Dir,
+	}
+
+	if !node.IsDir {
+		value, err := g.readBlob(entry.Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(value) > 0 {
+			node.Value = value
+		}
+
+		return node, nil
+	}
+
+	if depth == 0 {
+		return node, nil
+	}
+
+	if entry != nil {
+		var err error
+		if tree, err = g.repo.TreeObject(entry.Hash); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range tree.Entries {
+		child, err := g.readNode(path.Join(key, tree.Entries[i].Name), nil, &tree.Entries[i], depth-1)
+		if err != nil {
+			return nil, err
+		}
+
+		node.Children = append(node.Children, *child)
+	}
+
+	return node, nil
+}
+
+func (g *KV) get(ctx context.Context, key string, depth int) (*kv.Node, error) {
+	key = sanatizePath(key)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	tree, err := g.head()
+	if err != nil {
+		return nil, err
+	}
+
+	return g.lookup(tree, key, depth)
+}
+
+// lookup reads key from tree including depth levels of children (-1 means
+// unlimited)
+func (g *KV) lookup(tree *object.Tree, key string, depth int) (*kv.Node, error) {
+	if key == "" {
+		return g.readNode(key, tree, nil, depth)
+	}
+
+	entry, err := tree.FindEntry(key)
+	if isNotFound(err) {
+		return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return g.readNode(key, nil, entry, depth)
+}
+
+func (g *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
+	return g.get(ctx, key, 1)
+}
+
+func (g *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	return g.get(ctx, key, -1)
+}
+
+// commit applies fn to the worktree and records the changes of keys as a
+// single commit. If fn or the commit fails, keys are restored from HEAD;
+// other changes of the worktree are neither committed nor discarded. The
+// lock must be held
+func (g *KV) commit(ctx context.Context, c change, keys []string, fn func() error) error {
+	if err := fn(); err != nil {
+		g.restore(keys)
+		return err
+	}
+
+	if err := g.stage(keys); err != nil {
+		g.restore(keys)
+		return err
+	}
+
+	msg, err := g.commitMessage(ctx, c)
+	if err != nil {
+		g.restore(keys)
+		return err
+	}
+
+	sig := &object.Signature{
+		Name:  g.name,
+		Email: g.email,
+		When:  time.Now(),
+	}
+
+	if a, ok := ctx.Value(authorKey).(author); ok {
+		sig.Name, sig.Email = a.name, a.email
+	}
+
+	_, err = g.wt.Commit(msg, &gogit.CommitOptions{
+		Author: sig,
+	})
+
+	// setting a key to its current value does not change the tree
+	if errors.Is(err, gogit.ErrEmptyCommit) {
+		return nil
+	}
+
+	if err != nil {
+		g.restore(keys)
+	}
+
+	return err
+}
+
+// within returns true if name is one of keys or located below one of them
+func within(name string, keys []string) bool {
+	for _, key := range keys {
+		if name == key || strings.HasPrefix(name, key+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stage replaces the index entries of keys, and all keys below them, with
+// the files currently found in the worktree
+func (g *KV) stage(keys []string) error {
+	idx, err := g.repo.Storer.Index()
+	if err != nil {
+		return err
+	}
+
+	entries := idx.Entries[:0]
+	for _, e := range idx.Entries {
+		if !within(e.Name, keys) {
+			entries = append(entries, e)
+		}
+	}
+	idx.Entries = entries
+
+	if err := g.repo.Storer.SetIndex(idx); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err := filepath.Walk(filepath.Join(g.root, filepath.FromSlash(key)), func(p string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			name, err := filepath.Rel(g.root, p)
+			if err != nil {
+				return err
+			}
+
+			return g.wt.AddWithOptions(&gogit.AddOptions{
+				Path:       filepath.ToSlash(name),
+				SkipStatus: true,
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restore resets keys, and all keys below them, to their state in HEAD
+func (g *KV) restore(keys []string) error {
+	tree, err := g.head()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		p := filepath.Join(g.root, filepath.FromSlash(key))
+
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+
+		g.removeEmptyParents(p)
+
+		err := tree.Files().ForEach(func(f *object.File) error {
+			if !within(f.Name, []string{key}) {
+				return nil
+			}
+
+			value, err := g.readBlob(f.Hash)
+			if err != nil {
+				return err
+			}
+
+			return writeFile(filepath.Join(g.root, filepath.FromSlash(f.Name)), value)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return g.stage(keys)
+}
+
+func (g *KV) commitMessage(ctx context.Context, c change) (string, error) {
+	tmpl := g.message
+
+	if msg, ok := ctx.Value(messageKey).(string); ok {
+		var err error
+		if tmpl, err = template.New("message").Parse(msg); err != nil {
+			return "", err
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, c); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// removeEmptyParents removes all empty parent directories of p as git does
+// not track directories
+func (g *KV) removeEmptyParents(p string) {
+	for dir := filepath.Dir(p); dir != g.root; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// writeFile replaces the content of p creating all parent directories
+func writeFile(p string, value []byte) error {
+	if info, err := os.Stat(p); err == nil && info.IsDir() {
+		return fmt.Errorf("cannot set %q: is a directory", p)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(p, value, 0644)
+}
+
+func (g *KV) Set(ctx context.Context, key string, value []byte) error {
+	key = sanatizePath(key)
+
+	p, err := g.filePath(key)
+	if err != nil {
+		return err
+	}
+
+	if key == "" {
+		return fmt.Errorf("cannot set root directory")
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.commit(ctx, change{Op: "set", Key: "/" + key}, []string{key}, func() error {
+		return writeFile(p, value)
+	})
+}
+
+func (g *KV) Delete(ctx context.Context, key string) error {
+	key = sanatizePath(key)
+
+	p, err := g.filePath(key)
+	if err != nil {
+		return err
+	}
+
+	if key == "" {
+		return fmt.Errorf("cannot delete root directory")
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if _, err := os.Lstat(p); os.IsNotExist(err) {
+		return fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	} else if err != nil {
+		return err
+	}
+
+	return g.commit(ctx, change{Op: "delete", Key: "/" + key}, []string{key}, func() error {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+
+		g.removeEmptyParents(p)
+		return nil
+	})
+}
+
+// CAS sets key to value if its current value matches compare. If compare is
+// nil the key must not exist. The comparison is done using the blob hash of
+// the key within the HEAD commit
+func (g *KV) CAS(ctx context.Context, key string, compare, value []byte) error {
+	key = sanatizePath(key)
+
+	p, err := g.filePath(key)
+	if err != nil {
+		return err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	tree, err := g.head()
+	if err != nil {
+		return err
+	}
+
+	entry, err := tree.FindEntry(key)
+	switch {
+	case isNotFound(err):
+		if compare != nil {
+			return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+		}
+	case err != nil:
+		return err
+	case compare == nil || entry.Hash != plumbing.ComputeHash(plumbing.BlobObject, compare):
+		return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+	}
+
+	return g.commit(ctx, change{Op: "set", Key: "/" + key}, []string{key}, func() error {
+		return writeFile(p, value)
+	})
+}
+
+// checkCopy ensures src exists, dst does not and dst is not located within src
+func (g *KV) checkCopy(keyOld, keyNew string) (string, string, error) {
+	src, err := g.filePath(keyOld)
+	if err != nil {
+		return "", "", err
+	}
+
+	dst, err := g.filePath(keyNew)
+	if err != nil {
+		return "", "", err
+	}
+
+	if keyOld == "" || keyNew == "" {
+		return "", "", fmt.Errorf("cannot copy root directory")
+	}
+
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return "", "", fmt.Errorf("%q: %w", keyOld, kv.ErrNotFound)
+	} else if err != nil {
+		return "", "", err
+	}
+
+	if _, err := os.Lstat(dst); err == nil {
+		return "", "", fmt.Errorf("%q already exists", keyNew)
+	}
+
+	if keyNew == keyOld || strings.HasPrefix(keyNew, keyOld+"/") {
+		return "", "", fmt.Errorf("cannot copy %q into itself", keyOld)
+	}
+
+	return src, dst, nil
+}
+
+// Move moves a key or directory to keyNew using a single commit
+func (g *KV) Move(ctx context.Context, keyOld, keyNew string) error {
+	keyOld, keyNew = sanatizePath(keyOld), sanatizePath(keyNew)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	src, dst, err := g.checkCopy(keyOld, keyNew)
+	if err != nil {
+		return err
+	}
+
+	return g.commit(ctx, change{Op: "move", Key: "/" + keyOld, Target: "/" + keyNew}, []string{keyOld, keyNew}, func() error {
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+
+		g.removeEmptyParents(src)
+		return nil
+	})
+}
+
+// Copy copies a key or directory to keyNew using a single commit
+func (g *KV) Copy(ctx context.Context, keyOld, keyNew string) error {
+	keyOld, keyNew = sanatizePath(keyOld), sanatizePath(keyNew)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	src, dst, err := g.checkCopy(keyOld, keyNew)
+	if err != nil {
+		return err
+	}
+
+	return g.commit(ctx, change{Op: "copy", Key: "/" + keyOld, Target: "/" + keyNew}, []string{keyNew}, func() error {
+		return copyTree(src, dst)
+	})
+}
+
+func copyTree(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		value, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+
+		return writeFile(dst, value)
+	}
+
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := copyTree(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// commitObject returns the commit identified by hash
+func (g *KV) commitObject(hash string) (*object.Commit, error) {
+	c, err := g.repo.CommitObject(plumbing.NewHash(hash))
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return nil, fmt.Errorf("commit %q: %w", hash, kv.ErrNotFound)
+	} else if err != nil {
+		return nil, fmt.Errorf("commit %q: %w", hash, err)
+	}
+
+	return c, nil
+}
+
+// Versions returns all commits that changed the value of key, starting with
+// the most recent one. Version IDs are commit hashes
+func (g *KV) Versions(ctx context.Context, key string) ([]kv.Version, error) {
+	key = sanatizePath(key)
+
+	if _, err := g.filePath(key); err != nil {
+		return nil, err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	iter, err := g.repo.Log(&gogit.LogOptions{
+		FileName: &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var versions []kv.Version
+
+	err = iter.ForEach(func(c *object.Commit) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		_, err := c.File(key)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+
+		versions = append(versions, kv.Version{
+			ID:      c.Hash.String(),
+			Created: c.Author.When,
+			Author:  fmt.Sprintf("%s <%s>", c.Author.Name, c.Author.Email),
+			Message: c.Message,
+			Deleted: err != nil,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	}
+
+	return versions, nil
+}
+
+// GetVersion returns key as it was after the given commit
+func (g *KV) GetVersion(ctx context.Context, key, version string) (*kv.Node, error) {
+	key = sanatizePath(key)
+
+	if _, err := g.filePath(key); err != nil {
+		return nil, err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	c, err := g.commitObject(version)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	return g.lookup(tree, key, 1)
+}
+
+// RestoreVersion sets key to the value it had after the given commit. If the
+// key did not exist at that commit, it is deleted. The change is recorded as
+// a new commit
+func (g *KV) RestoreVersion(ctx context.Context, key, version string) error {
+	key = sanatizePath(key)
+
+	p, err := g.filePath(key)
+	if err != nil {
+		return err
+	}
+
+	if key == "" {
+		return fmt.Errorf("cannot restore root directory")
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	c, err := g.commitObject(version)
+	if err != nil {
+		return err
+	}
+
+	restore := change{Op: "restore", Key: "/" + key, Target: c.Hash.String()}
+
+	f, err := c.File(key)
+	if isNotFound(err) {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			return nil
+		}
+
+		return g.commit(ctx, restore, []string{key}, func() error {
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+
+			g.removeEmptyParents(p)
+			return nil
+		})
+	} else if err != nil {
+		return err
+	}
+
+	value, err := g.readBlob(f.Hash)
+	if err != nil {
+		return err
+	}
+
+	return g.commit(ctx, restore, []string{key}, func() error {
+		return writeFile(p, value)
+	})
+}
+
+// open opens the repository at root or creates it if it does not exist. An
+// empty initial commit is created for new repositories so HEAD is always valid
+func open(root, name, email string) (*gogit.Repository, error) {
+	repo, err := gogit.PlainOpen(root)
+	if errors.Is(err, gogit.ErrRepositoryNotExists) {
+		repo, err = gogit.PlainInit(root, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := repo.Head(); !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return repo, err
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = wt.Commit("initialize gokv repository", &gogit.CommitOptions{
+		Author: &object.Signature{
+			Name:  name,
+			Email: email,
+			When:  time.Now(),
+		},
+		AllowEmptyCommits: true,
+	})
+
+	return repo, err
+}
+
+func New(params map[string]string) (kv.Provider, error) {
+	root, err := filepath.Abs(params["path"])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	name := params["author-name"]
+	if name == "" {
+		name = defaultAuthorName
+	}
+
+	email := params["author-email"]
+	if email == "" {
+		email = defaultAuthorEmail
+	}
+
+	msg := params["message"]
+	if msg == "" {
+		msg = defaultMessage
+	}
+
+	tmpl, err := template.New("message").Parse(msg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %s", err)
+	}
+
+	repo, err := open(root, name, email)
+	if err != nil {
+		return nil, err
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+
+	return &KV{
+		root:    root,
+		repo:    repo,
+		wt:      wt,
+		name:    name,
+		email:   email,
+		message: tmpl,
+	}, nil
+}
+
+func init() {
+	if err := kv.Register("git", New, []string{"path"}, []string{"author-name", "author-email", "message"}); err != nil {
+		panic("failed to register git KV driver")
+	}
+}
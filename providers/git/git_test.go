@@ -0,0 +1,280 @@
+package git
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+func newTestKV(t *testing.T, params map[string]string) (*KV, string, func()) {
+	dir, err := ioutil.TempDir("", "gokv-git")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+
+	p := map[string]string{
+		"path": dir,
+	}
+
+	for k, v := range params {
+		p[k] = v
+	}
+
+	k, err := New(p)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to create git KV: %s", err)
+	}
+
+	return k.(*KV), dir, func() { os.RemoveAll(dir) }
+}
+
+// commits returns the messages of all commits reachable from HEAD
+func commits(t *testing.T, g *KV) []string {
+	iter, err := g.repo.Log(&gogit.LogOptions{})
+	if err != nil {
+		t.Fatalf("failed to read log: %s", err)
+	}
+
+	var msgs []string
+	for c, err := iter.Next(); err == nil; c, err = iter.Next() {
+		msgs = append(msgs, c.Message)
+	}
+
+	return msgs
+}
+
+func Test_Git(t *testing.T) {
+	g, _, cleanup := newTestKV(t, nil)
+	defer cleanup()
+
+	kv.KVTester(t, g)
+}
+
+func Test_GitCommits(t *testing.T) {
+	g, dir, cleanup := newTestKV(t, map[string]string{
+		"author-name":  "config-bot",
+		"author-email": "bot@example.com",
+	})
+	defer cleanup()
+
+	ctx := context.Background()
+
+	g.Set(ctx, "/app/config/db", []byte("postgres"))
+	g.Set(ctx, "/app/config/db", []byte("postgres"))
+	g.Set(ctx, "/app/config/pool", []byte("10"))
+
+	if err := g.Move(ctx, "/app/config", "/app/settings"); err != nil {
+		t.Errorf("Move() returned error: %s", err)
+	}
+
+	g.Delete(ctx, "/app/settings/pool")
+
+	msgs := commits(t, g)
+	expected := []string{
+		"delete /app/settings/pool",
+		"move /app/config to /app/settings",
+		"set /app/config/pool",
+		"set /app/config/db",
+		"initialize gokv repository",
+	}
+
+	if strings.Join(msgs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected commits: %q", msgs)
+	}
+
+	if _, err := os.Stat(dir + "/app/config"); !os.IsNotExist(err) {
+		t.Errorf("Move() did not remove the source directory: %v", err)
+	}
+
+	if node, err := g.RGet(ctx, "/app"); err != nil {
+		t.Errorf("RGet() returned error: %s", err)
+	} else if len(node.Children) != 1 || node.Children[0].Key != "app/settings" || string(node.Children[0].Children[0].Value) != "postgres" {
+		t.Errorf("RGet() returned invalid node: %v", node)
+	}
+
+	// author and message may be overwritten per operation
+	ctx = WithMessage(WithAuthor(ctx, "Jane", "jane@example.com"), "Bump pool size for {{.Key}}")
+
+	if err := g.Set(ctx, "/app/settings/pool", []byte("20")); err != nil {
+		t.Errorf("Set() returned error: %s", err)
+	}
+
+	store, err := kv.Open("git", map[string]string{"path": dir})
+	if err != nil {
+		t.Fatalf("failed to open git KV: %s", err)
+	}
+
+	// versions are accessible through kv.Open
+	versions, err := store.Versions(context.Background(), "/app/settings/pool")
+	if err != nil {
+		t.Errorf("Versions() returned error: %s", err)
+		t.FailNow()
+	}
+
+	if len(versions) != 3 {
+		t.Fatalf("Versions() returned invalid number of commits: %v", versions)
+	}
+
+	if v := versions[0]; v.Author != "Jane <jane@example.com>" || v.Message != "Bump pool size for /app/settings/pool" || v.Deleted {
+		t.Errorf("Versions() returned invalid version: %+v", v)
+	}
+
+	if v := versions[1]; v.Author != "config-bot <bot@example.com>" || !v.Deleted {
+		t.Errorf("Versions() returned invalid version: %+v", v)
+	}
+
+	if v := versions[2]; v.Message != "move /app/config to /app/settings" || v.Deleted {
+		t.Errorf("Versions() returned invalid version: %+v", v)
+	}
+
+	if node, err := store.GetVersion(ctx, "/app/settings/pool", versions[2].ID); err != nil || string(node.Value) != "10" {
+		t.Errorf("GetVersion() returned invalid node: %v, %v", node, err)
+	}
+
+	if _, err := store.GetVersion(ctx, "/app/settings/pool", versions[1].ID); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("GetVersion() of a deleted version should fail: %v", err)
+	}
+
+	if _, err := store.Versions(ctx, "/does/not/exist"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Versions() of non-existent key should fail: %v", err)
+	}
+}
+
+func Test_GitRestore(t *testing.T) {
+	g, _, cleanup := newTestKV(t, nil)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	g.Set(ctx, "/db/host", []byte("a"))
+	g.Set(ctx, "/db/host", []byte("b"))
+	g.Delete(ctx, "/db/host")
+
+	versions, err := g.Versions(ctx, "/db/host")
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("Versions() returned invalid versions: %v, %v", versions, err)
+	}
+
+	if err := g.RestoreVersion(ctx, "/db/host", versions[2].ID); err != nil {
+		t.Errorf("RestoreVersion() returned error: %s", err)
+	}
+
+	if node, err := g.Get(ctx, "/db/host"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	} else if string(node.Value) != "a" {
+		t.Errorf("RestoreVersion() did not restore the value: %q", node.Value)
+	}
+
+	if msgs := commits(t, g); msgs[0] != "restore /db/host to "+versions[2].ID {
+		t.Errorf("RestoreVersion() created invalid commit: %q", msgs[0])
+	}
+
+	// restoring a commit where the key has been deleted deletes it
+	if err := g.RestoreVersion(ctx, "/db/host", versions[0].ID); err != nil {
+		t.Errorf("RestoreVersion() returned error: %s", err)
+	}
+
+	if _, err := g.Get(ctx, "/db/host"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("RestoreVersion() did not delete the key: %v", err)
+	}
+
+	if err := g.RestoreVersion(ctx, "/db/host", "0123456789012345678901234567890123456789"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("RestoreVersion() of unknown commit should fail: %v", err)
+	}
+}
+
+func Test_GitUnrelatedChanges(t *testing.T) {
+	g, dir, cleanup := newTestKV(t, nil)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	g.Set(ctx, "/db/host", []byte("a"))
+
+	// local changes outside of the keys being modified are left alone
+	if err := ioutil.WriteFile(filepath.Join(dir, "local"), []byte("local"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	if err := g.Set(ctx, "/db/port", []byte("5432")); err != nil {
+		t.Errorf("Set() returned error: %s", err)
+	}
+
+	if _, err := g.Get(ctx, "/local"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Set() committed unrelated file: %v", err)
+	}
+
+	// a failing change restores the key only
+	if err := g.Set(WithMessage(ctx, "{{.Missing"), "/db/host", []byte("b")); err == nil {
+		t.Errorf("Set() with invalid message should fail")
+	}
+
+	if value, err := ioutil.ReadFile(filepath.Join(dir, "db", "host")); err != nil || string(value) != "a" {
+		t.Errorf("failed Set() did not restore the key: %q, %v", value, err)
+	}
+
+	if value, err := ioutil.ReadFile(filepath.Join(dir, "local")); err != nil || string(value) != "local" {
+		t.Errorf("failed Set() discarded unrelated file: %q, %v", value, err)
+	}
+
+	if err := g.Delete(WithMessage(ctx, "{{.Missing"), "/db"); err == nil {
+		t.Errorf("Delete() with invalid message should fail")
+	}
+
+	if value, err := ioutil.ReadFile(filepath.Join(dir, "db", "port")); err != nil || string(value) != "5432" {
+		t.Errorf("failed Delete() did not restore the directory: %q, %v", value, err)
+	}
+
+	if err := g.Set(ctx, "/db/host", []byte("c")); err != nil {
+		t.Errorf("Set() returned error: %s", err)
+	}
+
+	if node, err := g.RGet(ctx, "/"); err != nil || len(node.Children) != 1 {
+		t.Errorf("RGet() returned unexpected tree: %v, %v", node, err)
+	}
+}
+
+func Test_GitReserved(t *testing.T) {
+	g, _, cleanup := newTestKV(t, nil)
+	defer cleanup()
+
+	if err := g.Set(context.Background(), "/.git/config", []byte("x")); err == nil {
+		t.Errorf("Set() within .git should fail")
+	}
+}
+
+func Test_GitReopen(t *testing.T) {
+	g, dir, cleanup := newTestKV(t, nil)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	g.Set(ctx, "/a/b", []byte("1"))
+
+	k, err := New(map[string]string{
+		"path": dir,
+	})
+	if err != nil {
+		t.Fatalf("New() of existing repository returned error: %s", err)
+	}
+
+	if node, err := k.Get(ctx, "/a/b"); err != nil || string(node.Value) != "1" {
+		t.Errorf("Get() returned invalid node: %v, %v", node, err)
+	}
+
+	if msgs := commits(t, k.(*KV)); len(msgs) != 2 {
+		t.Errorf("New() of existing repository created commits: %q", msgs)
+	}
+
+	if _, err := New(map[string]string{"path": dir, "message": "{{.Op"}); err == nil {
+		t.Errorf("New() with invalid message template should fail")
+	}
+}
@@ -0,0 +1,284 @@
+package memcache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeItem is a single item stored by fakeMemcache
+type fakeItem struct {
+	value   []byte
+	flags   uint32
+	cas     uint64
+	expires time.Time
+}
+
+// fakeMemcache is a minimal in-process memcache server speaking the text
+// protocol. It supports all commands used by the provider and allows to fast
+// forward time for testing expiration
+type fakeMemcache struct {
+	l net.Listener
+
+	lock   sync.Mutex
+	items  map[string]*fakeItem
+	cas    uint64
+	offset time.Duration
+}
+
+func newFakeMemcache(t *testing.T) *fakeMemcache {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	f := &fakeMemcache{
+		l:     l,
+		items: make(map[string]*fakeItem),
+	}
+
+	go f.serve()
+
+	return f
+}
+
+func (f *fakeMemcache) Addr() string {
+	return f.l.Addr().String()
+}
+
+func (f *fakeMemcache) Close() {
+	f.l.Close()
+}
+
+// FastForward moves the clock of the server by d
+func (f *fakeMemcache) FastForward(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.offset += d
+}
+
+// Keys returns the number of items that did not expire yet
+func (f *fakeMemcache) Keys() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var n int
+	for key := range f.items {
+		if f.item(key) != nil {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (f *fakeMemcache) now() time.Time {
+	return time.Now().Add(f.offset)
+}
+
+// item returns the item stored under key unless it expired. The lock must be
+// held
+func (f *fakeMemcache) item(key string) *fakeItem {
+	item, ok := f.items[key]
+	if !ok {
+		return nil
+	}
+
+	if !item.expires.IsZero() && !f.now().Before(item.expires) {
+		delete(f.items, key)
+		return nil
+	}
+
+	return item
+}
+
+func (f *fakeMemcache) expires(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return f.now()
+	case exptime <= int64(maxRelativeExpiration/time.Second):
+		return f.now().Add(time.Duration(exptime) * time.Second)
+	}
+
+	return time.Unix(exptime, 0)
+}
+
+func (f *fakeMemcache) serve() {
+	for {
+		conn, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeMemcache) handle(conn net.Conn) {
+	defer conn.Close()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		if err := f.command(rw, args); err != nil {
+			return
+		}
+
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeMemcache) command(rw *bufio.ReadWriter, args []string) error {
+	switch args[0] {
+	case "get", "gets":
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		for _, key := range args[1:] {
+			item := f.item(key)
+			if item == nil {
+				continue
+			}
+
+			if args[0] == "gets" {
+				fmt.Fprintf(rw, "VALUE %s %d %d %d\r\n", key, item.flags, len(item.value), item.cas)
+			} else {
+				fmt.Fprintf(rw, "VALUE %s %d %d\r\n", key, item.flags, len(item.value))
+			}
+			rw.Write(item.value)
+			rw.WriteString("\r\n")
+		}
+
+		_, err := rw.WriteString("END\r\n")
+		return err
+
+	case "set", "add", "replace", "cas":
+		if len(args) < 5 || (args[0] == "cas" && len(args) < 6) {
+			_, err := rw.WriteString("ERROR\r\n")
+			return err
+		}
+
+		flags, _ := strconv.ParseUint(args[2], 10, 32)
+		exptime, _ := strconv.ParseInt(args[3], 10, 64)
+		size, err := strconv.Atoi(args[4])
+		if err != nil {
+			return err
+		}
+
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rw, data); err != nil {
+			return err
+		}
+
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		key := args[1]
+		existing := f.item(key)
+
+		switch args[0] {
+		case "add":
+			if existing != nil {
+				_, err := rw.WriteString("NOT_STORED\r\n")
+				return err
+			}
+		case "replace":
+			if existing == nil {
+				_, err := rw.WriteString("NOT_STORED\r\n")
+				return err
+			}
+		case "cas":
+			if existing == nil {
+				_, err := rw.WriteString("NOT_FOUND\r\n")
+				return err
+			}
+
+			if cas, _ := strconv.ParseUint(args[5], 10, 64); cas != existing.cas {
+				_, err := rw.WriteString("EXISTS\r\n")
+				return err
+			}
+		}
+
+		f.cas++
+		f.items[key] = &fakeItem{
+			value:   data[:size],
+			flags:   uint32(flags),
+			cas:     f.cas,
+			expires: f.expires(exptime),
+		}
+
+		_, err = rw.WriteString("STORED\r\n")
+		return err
+
+	case "delete":
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		if len(args) < 2 || f.item(args[1]) == nil {
+			_, err := rw.WriteString("NOT_FOUND\r\n")
+			return err
+		}
+
+		delete(f.items, args[1])
+
+		_, err := rw.WriteString("DELETED\r\n")
+		return err
+
+	case "touch":
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		var item *fakeItem
+		if len(args) == 3 {
+			item = f.item(args[1])
+		}
+
+		if item == nil {
+			_, err := rw.WriteString("NOT_FOUND\r\n")
+			return err
+		}
+
+		exptime, _ := strconv.ParseInt(args[2], 10, 64)
+		item.expires = f.expires(exptime)
+
+		_, err := rw.WriteString("TOUCHED\r\n")
+		return err
+
+	case "flush_all":
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		f.items = make(map[string]*fakeItem)
+
+		_, err := rw.WriteString("OK\r\n")
+		return err
+
+	case "version":
+		_, err := rw.WriteString("VERSION 1.6.0-fake\r\n")
+		return err
+	}
+
+	_, err := rw.WriteString("ERROR\r\n")
+	return err
+}
@@ -0,0 +1,507 @@
+// Package memcache implements a gokv provider for Memcache. As Memcache uses a
+// flat keyspace, directories are emulated using per-directory child indexes
+// stored next to the values.
+//
+// Memcache is a cache, not a database, and the provider inherits its
+// limitations:
+//
+//   - Items may be evicted at any time when the server runs out of memory.
+//     An evicted value silently disappears; an evicted directory index hides
+//     all children of the directory from Get and RGet although the values
+//     themselves are still readable by their full key.
+//   - Memcache has no multi-key transactions. Values are updated atomically
+//     using native cas tokens, but a Set touches the child indexes of all
+//     parent directories one after another and a recursive Delete removes
+//     items one by one. Concurrent readers may observe intermediate states
+//     and an interrupted operation can leave stale index entries behind.
+//     Stale entries are skipped when listing directories.
+//   - Keys are limited to 250 bytes (including the prefix) and must not
+//     contain whitespace or control characters. Each directory index is a
+//     single item and therefore limited by the server's item size (1MB by
+//     default).
+//   - Memcache does not provide change notifications, so Watch is not
+//     supported.
+package memcache
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+// defaultPrefix is used to namespace all keys if no prefix is configured
+const defaultPrefix = "gokv"
+
+// maxRelativeExpiration is the largest expiration memcache interprets as
+// relative to the current time. Larger values are treated as unix timestamps
+const maxRelativeExpiration = 30 * 24 * time.Hour
+
+type KV struct {
+	cli    *memcache.Client
+	prefix string
+}
+
+func sanatizePath(key string) string {
+	return strings.Trim(key, "/")
+}
+
+func (m *KV) valueKey(p string) string {
+	return m.prefix + ":v:" + p
+}
+
+func (m *KV) dirKey(p string) string {
+	return m.prefix + ":d:" + p
+}
+
+// parseIndex returns the sorted child names stored in a directory index
+func parseIndex(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+
+	return strings.Split(string(data), "\n")
+}
+
+func formatIndex(names []string) []byte {
+	return []byte(strings.Join(names, "\n"))
+}
+
+// parent splits p into its parent directory and base name
+func parent(p string) (string, string) {
+	dir, name := path.Split(p)
+	return strings.TrimSuffix(dir, "/"), name
+}
+
+// updateIndex applies fn to the child names of directory p. The index is
+// updated using cas tokens and fn is called again if the index has been
+// modified concurrently. fn returns false if the index should not be touched
+func (m *KV) updateIndex(ctx context.Context, p string, fn func([]string) ([]string, bool)) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		item, err := m.cli.Get(m.dirKey(p))
+		if err == memcache.ErrCacheMiss {
+			item = nil
+		} else if err != nil {
+			return err
+		}
+
+		var names []string
+		if item != nil {
+			names = parseIndex(item.Value)
+		}
+
+		names, ok := fn(names)
+		if !ok {
+			return nil
+		}
+
+		if item == nil {
+			err = m.cli.Add(&memcache.Item{
+				Key:   m.dirKey(p),
+				Value: formatIndex(names),
+			})
+		} else {
+			item.Value = formatIndex(names)
+			err = m.cli.CompareAndSwap(item)
+		}
+
+		switch err {
+		case nil:
+			return nil
+		case memcache.ErrNotStored, memcache.ErrCASConflict:
+			// the index has been created, modified or evicted concurrently
+			continue
+		default:
+			return err
+		}
+	}
+}
+
+// addChild adds name to the index of directory p
+func (m *KV) addChild(ctx context.Context, p, name string) error {
+	return m.updateIndex(ctx, p, func(names []string) ([]string, bool) {
+		idx := sort.SearchStrings(names, name)
+		if idx < len(names) && names[idx] == name {
+			return nil, false
+		}
+
+		names = append(names, "")
+		copy(names[idx+1:], names[idx:])
+		names[idx] = name
+
+		return names, true
+	})
+}
+
+// removeChild removes name from the index of directory p. The directory
+// itself is kept even if it becomes empty
+func (m *KV) removeChild(ctx context.Context, p, name string) error {
+	return m.updateIndex(ctx, p, func(names []string) ([]string, bool) {
+		idx := sort.SearchStrings(names, name)
+		if idx == len(names) || names[idx] != name {
+			return nil, false
+		}
+
+		return append(names[:idx], names[idx+1:]...), true
+	})
+}
+
+// isDir returns true if p is an existing directory
+func (m *KV) isDir(p string) (bool, error) {
+	if p == "" {
+		return true, nil
+	}
+
+	_, err := m.cli.Get(m.dirKey(p))
+	switch err {
+	case nil:
+		return true, nil
+	case memcache.ErrCacheMiss:
+		return false, nil
+	}
+
+	return false, err
+}
+
+// createParents makes sure all parent directories of key exist and contain
+// their child. It fails if one of the parents is a value
+func (m *KV) createParents(ctx context.Context, key string) error {
+	parts := strings.Split(key, "/")
+
+	// all parents are checked with a single round trip first
+	var keys []string
+	for i := 1; i < len(parts); i++ {
+		keys = append(keys, m.valueKey(strings.Join(parts[:i], "/")))
+	}
+
+	if len(keys) > 0 {
+		items, err := m.cli.GetMulti(keys)
+		if err != nil {
+			return err
+		}
+
+		for i := 1; i < len(parts); i++ {
+			dir := strings.Join(parts[:i], "/")
+			if _, ok := items[m.valueKey(dir)]; ok {
+				return fmt.Errorf("cannot create %q: %q is not a directory", key, dir)
+			}
+		}
+	}
+
+	for i := range parts {
+		if err := m.addChild(ctx, strings.Join(parts[:i], "/"), parts[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func valueNode(key string, item *memcache.Item) *kv.Node {
+	node := &kv.Node{
+		Key:      key,
+		Revision: item.CasID,
+	}
+
+	if len(item.Value) > 0 {
+		node.Value = item.Value
+	}
+
+	return node
+}
+
+// readDir returns a directory node for p including its children. depth limits
+// the number of levels to include (-1 means unlimited). Children that expired
+// or have been evicted but are still listed in the index are skipped
+func (m *KV) readDir(p string, index []byte, depth int) (*kv.Node, error) {
+	node := &kv.Node{
+		Key:   p,
+		IsDir: true,
+	}
+
+	names := parseIndex(index)
+	if depth == 0 || len(names) == 0 {
+		return node, nil
+	}
+
+	keys := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		childPath := path.Join(p, name)
+		keys = append(keys, m.valueKey(childPath), m.dirKey(childPath))
+	}
+
+	items, err := m.cli.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		childPath := path.Join(p, name)
+
+		if item, ok := items[m.valueKey(childPath)]; ok {
+			node.Children = append(node.Children, *valueNode(childPath, item))
+			continue
+		}
+
+		item, ok := items[m.dirKey(childPath)]
+		if !ok {
+			// stale index entry
+			continue
+		}
+
+		child, err := m.readDir(childPath, item.Value, depth-1)
+		if err != nil {
+			return nil, err
+		}
+
+		node.Children = append(node.Children, *child)
+	}
+
+	return node, nil
+}
+
+func (m *KV) get(ctx context.Context, key string, depth int) (*kv.Node, error) {
+	key = sanatizePath(key)
+
+	keys := []string{m.dirKey(key)}
+	if key != "" {
+		keys = append(keys, m.valueKey(key))
+	}
+
+	items, err := m.cli.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	if item, ok := items[m.valueKey(key)]; ok && key != "" {
+		return valueNode(key, item), nil
+	}
+
+	item, ok := items[m.dirKey(key)]
+	if !ok {
+		if key != "" {
+			return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+		}
+
+		// the root directory always exists
+		item = &memcache.Item{}
+	}
+
+	return m.readDir(key, item.Value, depth)
+}
+
+func (m *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
+	return m.get(ctx, key, 1)
+}
+
+func (m *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	return m.get(ctx, key, -1)
+}
+
+// expiration converts ttl to a memcache expiration
+func expiration(ttl time.Duration) int32 {
+	if ttl > maxRelativeExpiration {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+
+	// memcache expires items with a resolution of one second
+	return int32((ttl + time.Second - 1) / time.Second)
+}
+
+// prepare validates key for writing a value and creates its parents
+func (m *KV) prepare(ctx context.Context, key string) (string, error) {
+	key = sanatizePath(key)
+	if key == "" {
+		return "", fmt.Errorf("cannot set root directory")
+	}
+
+	dir, err := m.isDir(key)
+	if err != nil {
+		return "", err
+	}
+
+	if dir {
+		return "", fmt.Errorf("cannot set %q: is a directory", key)
+	}
+
+	return key, m.createParents(ctx, key)
+}
+
+func (m *KV) set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	key, err := m.prepare(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return m.cli.Set(&memcache.Item{
+		Key:        m.valueKey(key),
+		Value:      value,
+		Expiration: expiration(ttl),
+	})
+}
+
+func (m *KV) Set(ctx context.Context, key string, value []byte) error {
+	return m.set(ctx, key, value, 0)
+}
+
+// SetTTL sets key to value and lets Memcache expire it after ttl. The TTL is
+// rounded up to full seconds. Expired values are removed from their directory
+// index lazily
+func (m *KV) SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid TTL %s", ttl)
+	}
+
+	return m.set(ctx, key, value, ttl)
+}
+
+// CAS sets key to value if its current value matches compare. If compare is
+// nil the key must not exist. The value is replaced using the item's cas token
+// so concurrent modifications between reading and writing are detected
+func (m *KV) CAS(ctx context.Context, key string, compare, value []byte) error {
+	key = sanatizePath(key)
+
+	if compare == nil {
+		var err error
+		if key, err = m.prepare(ctx, key); err != nil {
+			return err
+		}
+
+		err = m.cli.Add(&memcache.Item{
+			Key:   m.valueKey(key),
+			Value: value,
+		})
+		if err == memcache.ErrNotStored {
+			return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+		}
+
+		return err
+	}
+
+	item, err := m.cli.Get(m.valueKey(key))
+	if err == memcache.ErrCacheMiss {
+		return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+	} else if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(item.Value, compare) {
+		return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+	}
+
+	item.Value = value
+	item.Expiration = 0
+
+	switch err := m.cli.CompareAndSwap(item); err {
+	case memcache.ErrCASConflict, memcache.ErrNotStored:
+		return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+	default:
+		return err
+	}
+}
+
+// deleteDir deletes all items below directory p and its index
+func (m *KV) deleteDir(ctx context.Context, p string, index []byte) error {
+	for _, name := range parseIndex(index) {
+		childPath := path.Join(p, name)
+
+		if err := m.cli.Delete(m.valueKey(childPath)); err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+
+		item, err := m.cli.Get(m.dirKey(childPath))
+		if err == memcache.ErrCacheMiss {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := m.deleteDir(ctx, childPath, item.Value); err != nil {
+			return err
+		}
+	}
+
+	if err := m.cli.Delete(m.dirKey(p)); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+
+	return nil
+}
+
+func (m *KV) Delete(ctx context.Context, key string) error {
+	key = sanatizePath(key)
+	if key == "" {
+		return fmt.Errorf("cannot delete root directory")
+	}
+
+	err := m.cli.Delete(m.valueKey(key))
+	if err == memcache.ErrCacheMiss {
+		item, err := m.cli.Get(m.dirKey(key))
+		if err == memcache.ErrCacheMiss {
+			return fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+		} else if err != nil {
+			return err
+		}
+
+		if err := m.deleteDir(ctx, key, item.Value); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	dir, name := parent(key)
+
+	return m.removeChild(ctx, dir, name)
+}
+
+// Close closes all idle connections to Memcache
+func (m *KV) Close() error {
+	return m.cli.Close()
+}
+
+func New(params map[string]string) (kv.Provider, error) {
+	prefix := params["prefix"]
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+
+	var servers []string
+	for _, s := range strings.Split(params["endpoint"], ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			servers = append(servers, s)
+		}
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no memcache endpoint configured")
+	}
+
+	cli := memcache.New(servers...)
+
+	if err := cli.Ping(); err != nil {
+		cli.Close()
+		return nil, err
+	}
+
+	return &KV{
+		cli:    cli,
+		prefix: prefix,
+	}, nil
+}
+
+func init() {
+	if err := kv.Register("memcache", New, []string{"endpoint"}, []string{"prefix"}); err != nil {
+		panic("failed to register memcache KV driver")
+	}
+}
@@ -0,0 +1,166 @@
+package memcache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+func newTestKV(t *testing.T) (*KV, *fakeMemcache) {
+	f := newFakeMemcache(t)
+
+	k, err := New(map[string]string{
+		"endpoint": f.Addr(),
+	})
+	if err != nil {
+		f.Close()
+		t.Fatalf("failed to create memcache KV: %s", err)
+	}
+
+	return k.(*KV), f
+}
+
+func Test_Memcache(t *testing.T) {
+	k, f := newTestKV(t)
+	defer f.Close()
+	defer k.Close()
+
+	kv.KVTester(t, k)
+}
+
+func Test_MemcacheIndex(t *testing.T) {
+	k, f := newTestKV(t)
+	defer f.Close()
+	defer k.Close()
+
+	ctx := context.Background()
+
+	k.Set(ctx, "/app/config/db", []byte("postgres"))
+	k.Set(ctx, "/app/config/pool", []byte("10"))
+	k.Set(ctx, "/app/users/paz", []byte("1"))
+
+	node, err := k.RGet(ctx, "/app")
+	if err != nil {
+		t.Fatalf("RGet() returned error: %s", err)
+	}
+
+	if len(node.Children) != 2 || node.Children[0].Key != "app/config" || len(node.Children[0].Children) != 2 {
+		t.Errorf("RGet() returned invalid node: %v", node)
+	}
+
+	if c := node.Children[0].Children[0]; c.Key != "app/config/db" || string(c.Value) != "postgres" || c.Revision == 0 {
+		t.Errorf("RGet() returned invalid child: %v", c)
+	}
+
+	if err := k.Set(ctx, "/app/config", []byte("x")); err == nil {
+		t.Errorf("Set() of a directory should fail")
+	}
+
+	// values removed behind our back leave stale index entries which must
+	// be skipped
+	k.cli.Delete(k.valueKey("app/users/paz"))
+
+	if node, err := k.Get(ctx, "/app/users"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	} else if !node.IsDir || len(node.Children) != 0 {
+		t.Errorf("Get() returned stale children: %v", node)
+	}
+
+	if err := k.Delete(ctx, "/app"); err != nil {
+		t.Errorf("Delete() returned error: %s", err)
+	}
+
+	if _, err := k.Get(ctx, "/app/config/db"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Delete() did not delete all nodes below /app: %v", err)
+	}
+
+	// only the (now empty) root index is left
+	if n := f.Keys(); n != 1 {
+		t.Errorf("Delete() left %d items behind", n)
+	}
+
+	if err := k.Set(ctx, "/with space", []byte("x")); err != memcache.ErrMalformedKey {
+		t.Errorf("Set() of a key with whitespace should fail: %v", err)
+	}
+}
+
+func Test_MemcacheCAS(t *testing.T) {
+	k, f := newTestKV(t)
+	defer f.Close()
+	defer k.Close()
+
+	ctx := context.Background()
+
+	k.Set(ctx, "/cas", []byte("1"))
+	before, _ := k.Get(ctx, "/cas")
+
+	if err := k.CAS(ctx, "/cas", []byte("1"), []byte("3")); err != nil {
+		t.Errorf("CAS() returned error: %s", err)
+	}
+
+	if node, err := k.Get(ctx, "/cas"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	} else if node.Revision <= before.Revision {
+		t.Errorf("CAS() did not increase the revision: %v", node)
+	}
+
+	// modifications between reading and swapping are detected by the cas
+	// token even if the value is the same
+	item, _ := k.cli.Get(k.valueKey("cas"))
+	k.Set(ctx, "/cas", []byte("3"))
+
+	item.Value = []byte("4")
+	if err := k.cli.CompareAndSwap(item); err != memcache.ErrCASConflict {
+		t.Errorf("CompareAndSwap() with outdated token should fail: %v", err)
+	}
+}
+
+func Test_MemcacheTTL(t *testing.T) {
+	k, f := newTestKV(t)
+	defer f.Close()
+	defer k.Close()
+
+	ctx := context.Background()
+
+	if err := k.SetTTL(ctx, "/ttl/a", []byte("1"), time.Minute); err != nil {
+		t.Errorf("SetTTL() returned error: %s", err)
+	}
+
+	if err := k.SetTTL(ctx, "/ttl/c", []byte("3"), 60*24*time.Hour); err != nil {
+		t.Errorf("SetTTL() returned error: %s", err)
+	}
+
+	if err := k.SetTTL(ctx, "/ttl/d", []byte("4"), 0); err == nil {
+		t.Errorf("SetTTL() with invalid TTL should fail")
+	}
+
+	k.Set(ctx, "/ttl/b", []byte("2"))
+
+	f.FastForward(2 * time.Minute)
+
+	if _, err := k.Get(ctx, "/ttl/a"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get() of expired key should fail with ErrNotFound: %v", err)
+	}
+
+	if node, err := k.Get(ctx, "/ttl"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	} else if len(node.Children) != 2 || node.Children[0].Key != "ttl/b" || node.Children[1].Key != "ttl/c" {
+		t.Errorf("Get() returned expired children: %v", node.Children)
+	}
+
+	f.FastForward(60 * 24 * time.Hour)
+
+	if _, err := k.Get(ctx, "/ttl/c"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get() of expired key with absolute expiration should fail: %v", err)
+	}
+}
+
+func Test_MemcacheInvalidOptions(t *testing.T) {
+	if _, err := New(map[string]string{"endpoint": " , "}); err == nil {
+		t.Errorf("New() without endpoint should fail")
+	}
+}
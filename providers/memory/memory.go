@@ -1,186 +1,667 @@
+// Package memory implements an in-memory gokv provider. Directories index
+// their children by name so lookups do not depend on the number of siblings.
+//
+// All operations are serialized by a single lock, so Move, Copy and CAS are
+// atomic. Every modification increments the revision of the store which is
+// reported for values and events.
 package memory
 
 import (
+	"bytes"
 	"fmt"
+	"path"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/nethack42/gokv"
 	"golang.org/x/net/context"
 )
 
+// Node is a single entry of the in-memory tree
 type Node struct {
 	kv.Node
 
-	m []*Node
+	// children holds the children of a directory indexed by name
+	children map[string]*Node
+
+	// expires holds the time a value expires, if set using SetTTL
+	expires time.Time
+	timer   *time.Timer
 }
 
-type KV struct {
-	lock sync.RWMutex
+func newNode(key string, dir bool) *Node {
+	n := &Node{
+		Node: kv.Node{
+			Key:   key,
+			IsDir: dir,
+		},
+	}
+
+	if dir {
+		n.children = make(map[string]*Node)
+	}
+
+	return n
+}
+
+// sortedChildren returns the children of n ordered by name
+func (n *Node) sortedChildren() []*Node {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
 
-	base Node
+	res := make([]*Node, len(names))
+	for i, name := range names {
+		res[i] = n.children[name]
+	}
+
+	return res
 }
 
-func (kv *KV) Set(ctx context.Context, key string, value []byte) error {
-	kv.lock.Lock()
-	defer kv.lock.Unlock()
+// convert returns a copy of n including depth levels of children (-1 means
+// unlimited)
+func (n *Node) convert(depth int) kv.Node {
+	res := n.Node
 
-	node, err := kv.resolvePath(key, true)
-	if err != nil {
+	if n.IsDir && depth != 0 {
+		for _, child := range n.sortedChildren() {
+			res.Children = append(res.Children, child.convert(depth-1))
+		}
+	}
+
+	return res
+}
+
+// walk calls fn for n and every node below it in sorted order
+func (n *Node) walk(fn func(*Node) error) error {
+	if err := fn(n); err != nil {
 		return err
 	}
 
-	node.Value = value
+	for _, child := range n.sortedChildren() {
+		if err := child.walk(fn); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func sanatizePath(path string) string {
-	return strings.Trim(path, "/")
+// stop stops the expiration timer of n
+func (n *Node) stop() {
+	if n.timer != nil {
+		n.timer.Stop()
+		n.timer = nil
+	}
 }
 
-func (k *KV) resolvePath(path string, create bool) (*Node, error) {
-	path = sanatizePath(path)
+// expireRetry is the delay before retrying to expire a value whose deletion
+// could not be logged
+const expireRetry = time.Second
 
-	parts := strings.Split(path, "/")
+type KV struct {
+	lock sync.RWMutex
 
-	k.base.IsDir = true
+	root *Node
 
-	node := &k.base
+	// revision is incremented by every modification
+	revision uint64
 
-L:
-	for i := range parts {
-		key := strings.Join(parts[:i+1], "/")
-		for _, child := range node.m {
-			if child.Key == key {
-				node = child
-				continue L
-			}
-		}
+	// watchers holds all active watches. history keeps the most recent events
+	// so watches can be resumed; events up to revision compacted are gone
+	watchers  map[*watcher]struct{}
+	history   []kv.Event
+	compacted uint64
 
-		if !create {
-			// we did not find this one
-			return nil, fmt.Errorf("%q does not exist", key)
-		}
+	// snapshot persists the tree if the snapshot parameter is set
+	snapshot *snapshot
 
-		if create && !node.IsDir {
-			return nil, fmt.Errorf("cannot create %q: %q is not a directory", key, node.Key)
+	// closed stops expirations still pending when closing
+	closed bool
+}
+
+func sanatizePath(key string) string {
+	return strings.Trim(key, "/")
+}
+
+// lookup returns the node stored under key
+func (k *KV) lookup(key string) (*Node, error) {
+	key = sanatizePath(key)
+
+	node := k.root
+	if key == "" {
+		return node, nil
+	}
+
+	for _, name := range strings.Split(key, "/") {
+		child, ok := node.children[name]
+		if !ok {
+			return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
 		}
 
-		newNode := &Node{
-			Node: kv.Node{
-				Key:   key,
-				IsDir: i != len(parts)-1,
-			},
+		node = child
+	}
+
+	return node, nil
+}
+
+// create returns the node for key, creating it and all missing parent
+// directories. dir selects whether a missing node is created as directory.
+// An existing node of the other kind is returned unchanged, so callers must
+// check IsDir
+func (k *KV) create(key string, dir bool) (*Node, error) {
+	key = sanatizePath(key)
+	if key == "" {
+		return k.root, nil
+	}
+
+	parts := strings.Split(key, "/")
+	node := k.root
+
+	for i, name := range parts {
+		last := i == len(parts)-1
+
+		child, ok := node.children[name]
+		if !ok {
+			child = newNode(path.Join(node.Key, name), dir || !last)
+			node.children[name] = child
+		} else if !last && !child.IsDir {
+			return nil, fmt.Errorf("cannot create %q: %q is not a directory", key, child.Key)
 		}
 
-		node.m = append(node.m, newNode)
-		node = newNode
-		fmt.Printf("%s: created (dir=%v value=%dBytes)\n", node.Key, node.IsDir, len(node.Value))
+		node = child
+	}
+
+	return node, nil
+}
+
+// set sets the value of key at revision rev. A zero expires keeps the value
+// forever. The expiration timer has to be started by the caller
+func (k *KV) set(key string, value []byte, rev uint64, expires time.Time) (*Node, error) {
+	node, err := k.create(key, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.IsDir {
+		return nil, fmt.Errorf("cannot set %q: is a directory", sanatizePath(key))
+	}
+
+	if len(value) == 0 {
+		value = nil
 	}
 
+	node.stop()
+	node.Value = value
+	node.Revision = rev
+	node.expires = expires
+
 	return node, nil
 }
 
-func convertNode(n *Node) *kv.Node {
-	var res kv.Node
+// write logs r before applying it using fn, so a modification is neither
+// visible nor reported to watchers unless it has been persisted. The log
+// record is reverted if fn fails. The lock must be held
+func (k *KV) write(r record, fn func(rev uint64) error) error {
+	r.Seq = k.revision + 1
+
+	if err := k.snapshot.append(r); err != nil {
+		return err
+	}
+
+	if err := fn(r.Seq); err != nil {
+		if rerr := k.snapshot.revert(); rerr != nil {
+			return fmt.Errorf("%s (%s)", err, rerr)
+		}
+
+		return err
+	}
+
+	k.revision = r.Seq
+	return nil
+}
+
+// update sets key to value and reports an event of type typ. The lock must be
+// held
+func (k *KV) update(typ kv.EventType, key string, value []byte, ttl time.Duration) error {
+	r := record{
+		Op:    opSet,
+		Key:   sanatizePath(key),
+		Value: value,
+	}
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+		r.Expires = &expires
+	}
+
+	var node *Node
+
+	err := k.write(r, func(rev uint64) (err error) {
+		node, err = k.set(key, value, rev, expires)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if ttl > 0 {
+		k.schedule(node)
+	}
+
+	k.notify(kv.Event{
+		Type: typ,
+		Node: node.convert(0),
+	})
+
+	return nil
+}
+
+func (k *KV) Set(ctx context.Context, key string, value []byte) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return k.update(kv.EventSet, key, value, 0)
+}
+
+// SetTTL sets key to value and removes it once ttl elapsed. Watchers are
+// notified with an EventExpire
+func (k *KV) SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid TTL %s", ttl)
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return k.update(kv.EventSet, key, value, ttl)
+}
+
+// schedule starts the expiration timers of n and all nodes below it. The lock
+// must be held
+func (k *KV) schedule(n *Node) {
+	n.walk(func(n *Node) error {
+		if !n.expires.IsZero() && n.timer == nil {
+			n.timer = time.AfterFunc(time.Until(n.expires), func() {
+				k.expire(n)
+			})
+		}
+
+		return nil
+	})
+}
+
+// expire deletes n if it is still stored and its TTL elapsed
+func (k *KV) expire(n *Node) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.closed {
+		return
+	}
 
-	res = n.Node
-	for _, child := range n.m {
-		res.Children = append(res.Children, *convertNode(child))
+	// n may have been deleted, replaced or updated in the meantime
+	if cur, err := k.lookup(n.Key); err != nil || cur != n || n.expires.IsZero() || time.Now().Before(n.expires) {
+		return
+	}
+
+	err := k.write(record{Op: opDelete, Key: n.Key}, func(uint64) error {
+		_, err := k.delete(n.Key)
+		return err
+	})
+	if err != nil {
+		// there is no caller to report a failed log write to, so expiring is
+		// retried until the log is writable again
+		n.timer = time.AfterFunc(expireRetry, func() {
+			k.expire(n)
+		})
+		return
 	}
 
-	return &res
+	k.notify(kv.Event{
+		Type: kv.EventExpire,
+		Node: kv.Node{Key: n.Key},
+	})
 }
 
-func (k *KV) get(ctx context.Context, key string, recurse bool) (*kv.Node, error) {
+func (k *KV) get(ctx context.Context, key string, depth int) (*kv.Node, error) {
 	k.lock.RLock()
 	defer k.lock.RUnlock()
 
-	node, err := k.resolvePath(key, false)
+	node, err := k.lookup(key)
 	if err != nil {
 		return nil, err
 	}
 
-	if !recurse {
-		// If we should have searched without recursion, simulate it by removing
-		// references from childs
-		var childs []kv.Node
+	res := node.convert(depth)
+	return &res, nil
+}
 
-		for _, c := range node.Children {
-			c.Children = nil
+func (k *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
+	return k.get(ctx, key, 1)
+}
 
-			childs = append(childs, c)
-		}
+func (k *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	return k.get(ctx, key, -1)
+}
 
-		node.Children = childs
+// detach removes the node stored under key from its parent and returns it
+func (k *KV) detach(key string) (*Node, error) {
+	key = sanatizePath(key)
+	if key == "" {
+		return nil, fmt.Errorf("cannot delete root directory")
 	}
 
-	return convertNode(node), nil
+	dir, name := path.Split(key)
+
+	parent, err := k.lookup(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	}
+
+	node, ok := parent.children[name]
+	if !ok {
+		return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	}
+
+	delete(parent.children, name)
+
+	return node, nil
+}
+
+// delete removes key and stops all expiration timers below it
+func (k *KV) delete(key string) (*Node, error) {
+	node, err := k.detach(key)
+	if err != nil {
+		return nil, err
+	}
+
+	node.walk(func(n *Node) error {
+		n.stop()
+		return nil
+	})
+
+	return node, nil
 }
 
-func (kv *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
-	return kv.get(ctx, key, false)
+func (k *KV) Delete(ctx context.Context, key string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	err := k.write(record{Op: opDelete, Key: sanatizePath(key)}, func(uint64) error {
+		_, err := k.delete(key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	k.notify(kv.Event{
+		Type: kv.EventDelete,
+		Node: kv.Node{Key: sanatizePath(key)},
+	})
+
+	return nil
 }
 
-func (kv *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
-	return kv.get(ctx, key, true)
+// CAS sets key to value if its current value matches compare. If compare is
+// nil the key must not exist
+func (k *KV) CAS(ctx context.Context, key string, compare, value []byte) error {
+	return k.cas(key, compare, value, 0)
 }
 
-func clear(node *Node) {
-	for _, child := range node.m {
-		clear(child)
+// CASTTL behaves like CAS but removes key once ttl elapsed. Watchers are
+// notified with an EventExpire
+func (k *KV) CASTTL(ctx context.Context, key string, compare, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid TTL %s", ttl)
 	}
 
-	node.m = nil
-	node.Children = nil
+	return k.cas(key, compare, value, ttl)
 }
 
-func (kv *KV) Delete(ctx context.Context, key string) error {
-	kv.lock.Lock()
-	defer kv.lock.Unlock()
+// cas implements CAS and CASTTL. A zero ttl keeps the value forever
+func (k *KV) cas(key string, compare, value []byte, ttl time.Duration) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
 
-	key = sanatizePath(key)
-	path := strings.Split(key, "/")
-	parent := path[:len(path)-1]
+	node, err := k.lookup(key)
 
-	var node *Node
-	var err error
+	if compare == nil {
+		if err == nil {
+			return fmt.Errorf("%q: %w", sanatizePath(key), kv.ErrCompareFailed)
+		}
+	} else if err != nil || node.IsDir || !bytes.Equal(node.Value, compare) {
+		return fmt.Errorf("%q: %w", sanatizePath(key), kv.ErrCompareFailed)
+	}
+
+	return k.update(kv.EventCompareAndSwap, key, value, ttl)
+}
+
+// prepareTransfer validates moving or copying keyOld to keyNew and returns
+// the source node and the directory to attach the target to
+func (k *KV) prepareTransfer(keyOld, keyNew string) (*Node, *Node, error) {
+	keyOld = sanatizePath(keyOld)
+	keyNew = sanatizePath(keyNew)
+
+	if keyOld == "" || keyNew == "" {
+		return nil, nil, fmt.Errorf("cannot move or copy the root directory")
+	}
 
-	if len(parent) > 0 {
-		node, err = kv.resolvePath(strings.Join(parent, "/"), false)
-	} else {
-		node = &kv.base
+	if keyNew == keyOld || strings.HasPrefix(keyNew, keyOld+"/") {
+		return nil, nil, fmt.Errorf("cannot copy %q into itself", keyOld)
 	}
 
+	src, err := k.lookup(keyOld)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	if _, err := k.lookup(keyNew); err == nil {
+		return nil, nil, fmt.Errorf("%q already exists", keyNew)
+	}
+
+	dir, _ := path.Split(keyNew)
+
+	parent, err := k.create(dir, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !parent.IsDir {
+		return nil, nil, fmt.Errorf("cannot create %q: %q is not a directory", keyNew, parent.Key)
+	}
+
+	return src, parent, nil
+}
+
+// rekey updates the keys and revisions of n and all nodes below it after it
+// has been attached under key
+func rekey(n *Node, key string, rev uint64) {
+	n.Key = key
+
+	if !n.IsDir {
+		n.Revision = rev
+	}
+
+	for name, child := range n.children {
+		rekey(child, key+"/"+name, rev)
+	}
+}
+
+// clone returns a deep copy of n. Expiration timers are not started
+func clone(n *Node) *Node {
+	c := newNode(n.Key, n.IsDir)
+	c.Value = n.Value
+	c.expires = n.expires
+
+	for name, child := range n.children {
+		c.children[name] = clone(child)
 	}
 
-	for i, child := range node.m {
-		if child.Key == key {
-			node.m = append(node.m[:i], node.m[i+1:]...)
-			clear(child)
-			return nil
+	return c
+}
+
+func (k *KV) move(keyOld, keyNew string, rev uint64) (*Node, error) {
+	src, parent, err := k.prepareTransfer(keyOld, keyNew)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := k.detach(keyOld); err != nil {
+		return nil, err
+	}
+
+	keyNew = sanatizePath(keyNew)
+	parent.children[path.Base(keyNew)] = src
+	rekey(src, keyNew, rev)
+
+	return src, nil
+}
+
+func (k *KV) copy(keyOld, keyNew string, rev uint64) (*Node, error) {
+	src, parent, err := k.prepareTransfer(keyOld, keyNew)
+	if err != nil {
+		return nil, err
+	}
+
+	keyNew = sanatizePath(keyNew)
+	dst := clone(src)
+	parent.children[path.Base(keyNew)] = dst
+	rekey(dst, keyNew, rev)
+
+	return dst, nil
+}
+
+// setEvents returns set events for all values below n
+func setEvents(n *Node) []kv.Event {
+	var events []kv.Event
+
+	n.walk(func(n *Node) error {
+		if !n.IsDir {
+			events = append(events, kv.Event{
+				Type: kv.EventSet,
+				Node: n.convert(0),
+			})
 		}
+
+		return nil
+	})
+
+	return events
+}
+
+// Move atomically moves keyOld and all nodes below it to keyNew. Watchers of
+// keyOld are notified with an EventDelete, watchers of keyNew with an
+// EventSet for every moved value
+func (k *KV) Move(ctx context.Context, keyOld, keyNew string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	var node *Node
+
+	err := k.write(record{Op: opMove, Key: sanatizePath(keyOld), Target: sanatizePath(keyNew)}, func(rev uint64) (err error) {
+		node, err = k.move(keyOld, keyNew, rev)
+		return err
+	})
+	if err != nil {
+		return err
 	}
 
-	return fmt.Errorf("%q does not exist", key)
+	k.notify(append([]kv.Event{{
+		Type: kv.EventDelete,
+		Node: kv.Node{Key: sanatizePath(keyOld)},
+	}}, setEvents(node)...)...)
+
+	return nil
 }
 
-func (kv *KV) CAS(ctx context.Context, key string, compare, value []byte) error {
-	kv.lock.Lock()
-	defer kv.lock.Unlock()
+// Copy atomically copies keyOld and all nodes below it to keyNew. Copied
+// values keep their expiration time
+func (k *KV) Copy(ctx context.Context, keyOld, keyNew string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	var node *Node
+
+	err := k.write(record{Op: opCopy, Key: sanatizePath(keyOld), Target: sanatizePath(keyNew)}, func(rev uint64) (err error) {
+		node, err = k.copy(keyOld, keyNew, rev)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	k.schedule(node)
+	k.notify(setEvents(node)...)
 
 	return nil
 }
 
+// Close stops all watches and expiration timers and writes a final snapshot if
+// snapshots are enabled
+func (k *KV) Close() error {
+	k.lock.Lock()
+
+	k.closed = true
+
+	for w := range k.watchers {
+		k.unwatch(w)
+	}
+
+	k.root.walk(func(n *Node) error {
+		n.stop()
+		return nil
+	})
+
+	k.lock.Unlock()
+
+	return k.snapshot.close(k)
+}
+
 func New(params map[string]string) (kv.Provider, error) {
-	return &KV{}, nil
+	k := &KV{
+		root:     newNode("", true),
+		watchers: make(map[*watcher]struct{}),
+	}
+
+	if p := params["snapshot"]; p != "" {
+		interval := defaultSnapshotInterval
+
+		if v := params["snapshot-interval"]; v != "" {
+			var err error
+			if interval, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("invalid snapshot-interval %q: %s", v, err)
+			}
+		}
+
+		s, err := openSnapshot(k, p, interval)
+		if err != nil {
+			return nil, err
+		}
+
+		// revisions continue where the snapshot left off but the events
+		// before are lost
+		k.revision = s.seq
+		k.compacted = s.seq
+		k.snapshot = s
+	}
+
+	k.lock.Lock()
+	k.schedule(k.root)
+	k.lock.Unlock()
+
+	return k, nil
 }
 
 func init() {
-	if err := kv.Register("memory", New, nil, nil); err != nil {
+	if err := kv.Register("memory", New, nil, []string{"snapshot", "snapshot-interval"}); err != nil {
 		panic("failed to register memory KV driver")
 	}
 }
@@ -1,9 +1,14 @@
 package memory
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
 )
 
 func Test_Memory(t *testing.T) {
@@ -16,3 +21,235 @@ func Test_Memory(t *testing.T) {
 
 	kv.KVTester(t, k)
 }
+
+func Test_MemoryTree(t *testing.T) {
+	k, _ := New(nil)
+	m := k.(*KV)
+
+	ctx := context.Background()
+
+	for _, key := range []string{"/app/b", "/app/c/d", "/app/a"} {
+		m.Set(ctx, key, []byte(key))
+	}
+
+	node, err := m.Get(ctx, "/app")
+	if err != nil {
+		t.Fatalf("Get() returned error: %s", err)
+	}
+
+	if len(node.Children) != 3 || node.Children[0].Key != "app/a" || node.Children[2].Key != "app/c" {
+		t.Errorf("Get() did not return sorted children: %v", node.Children)
+	}
+
+	if len(node.Children[2].Children) != 0 {
+		t.Errorf("Get() should not return grandchildren: %v", node.Children[2])
+	}
+
+	if node, err := m.RGet(ctx, "/app"); err != nil || len(node.Children[2].Children) != 1 {
+		t.Errorf("RGet() returned invalid node: %v, %v", node, err)
+	}
+
+	if err := m.Set(ctx, "/app/c", []byte("x")); err == nil {
+		t.Errorf("Set() of a directory should fail")
+	}
+
+	if err := m.CAS(ctx, "/app/a", nil, []byte("x")); !errors.Is(err, kv.ErrCompareFailed) {
+		t.Errorf("CAS() of existing key with nil compare should fail: %v", err)
+	}
+
+	if err := m.CAS(ctx, "/app/a", []byte("/app/a"), []byte("x")); err != nil {
+		t.Errorf("CAS() returned error: %s", err)
+	}
+
+	if err := m.CAS(ctx, "/app/c", []byte("x"), []byte("x")); !errors.Is(err, kv.ErrCompareFailed) {
+		t.Errorf("CAS() of a directory should fail: %v", err)
+	}
+
+	if _, err := m.Get(ctx, "/app/a/x"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get() below a value should fail with ErrNotFound: %v", err)
+	}
+}
+
+func Test_MemoryMoveCopy(t *testing.T) {
+	k, _ := New(nil)
+	m := k.(*KV)
+
+	ctx := context.Background()
+
+	m.Set(ctx, "/app/config/db", []byte("postgres"))
+	m.SetTTL(ctx, "/app/config/session", []byte("1"), time.Hour)
+
+	if err := m.Copy(ctx, "/app/config", "/backup/config"); err != nil {
+		t.Errorf("Copy() returned error: %s", err)
+	}
+
+	if err := m.Move(ctx, "/app", "/moved/app"); err != nil {
+		t.Errorf("Move() returned error: %s", err)
+	}
+
+	if _, err := m.Get(ctx, "/app"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Move() did not remove the source: %v", err)
+	}
+
+	for _, key := range []string{"/backup/config/db", "/moved/app/config/db"} {
+		if node, err := m.Get(ctx, key); err != nil || string(node.Value) != "postgres" || node.Key != sanatizePath(key) {
+			t.Errorf("Get() returned invalid node for %s: %v, %v", key, node, err)
+		}
+	}
+
+	if node, _ := m.lookup("/backup/config/session"); node == nil || node.timer == nil {
+		t.Errorf("Copy() did not keep the TTL")
+	}
+
+	for _, c := range []struct{ from, to string }{
+		{"/moved", "/moved/app/x"},
+		{"/moved/app", "/backup/config"},
+		{"/missing", "/x"},
+		{"/moved/app", "/backup/config/db/x"},
+	} {
+		if err := m.Move(ctx, c.from, c.to); err == nil {
+			t.Errorf("Move() from %s to %s should fail", c.from, c.to)
+		}
+	}
+
+	if node, err := m.RGet(ctx, "/moved/app"); err != nil || len(node.Children) != 1 || len(node.Children[0].Children) != 2 {
+		t.Errorf("failed Move() modified the tree: %v, %v", node, err)
+	}
+}
+
+func Test_MemoryTTL(t *testing.T) {
+	k, _ := New(nil)
+	m := k.(*KV)
+
+	ctx := context.Background()
+
+	if err := m.SetTTL(ctx, "/ttl/a", []byte("1"), 20*time.Millisecond); err != nil {
+		t.Errorf("SetTTL() returned error: %s", err)
+	}
+
+	m.SetTTL(ctx, "/ttl/b", []byte("2"), 20*time.Millisecond)
+
+	// setting the value again removes the TTL
+	m.Set(ctx, "/ttl/b", []byte("3"))
+
+	if err := m.SetTTL(ctx, "/ttl/c", []byte("x"), 0); err == nil {
+		t.Errorf("SetTTL() with invalid TTL should fail")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := m.Get(ctx, "/ttl/a"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get() of expired key should fail with ErrNotFound: %v", err)
+	}
+
+	if node, err := m.Get(ctx, "/ttl/b"); err != nil || string(node.Value) != "3" {
+		t.Errorf("Set() did not remove the TTL: %v, %v", node, err)
+	}
+}
+
+func Test_MemoryCASTTL(t *testing.T) {
+	k, _ := New(nil)
+	m := k.(*KV)
+
+	ctx := context.Background()
+
+	if err := m.CASTTL(ctx, "/lock", nil, []byte("a"), 20*time.Millisecond); err != nil {
+		t.Errorf("CASTTL() returned error: %s", err)
+	}
+
+	if err := m.CASTTL(ctx, "/lock", nil, []byte("b"), 20*time.Millisecond); !errors.Is(err, kv.ErrCompareFailed) {
+		t.Errorf("CASTTL() of existing key should fail with ErrCompareFailed: %v", err)
+	}
+
+	// refreshing the TTL keeps the key alive
+	time.Sleep(10 * time.Millisecond)
+
+	if err := m.CASTTL(ctx, "/lock", []byte("a"), []byte("a"), 50*time.Millisecond); err != nil {
+		t.Errorf("CASTTL() returned error: %s", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if node, err := m.Get(ctx, "/lock"); err != nil || string(node.Value) != "a" {
+		t.Errorf("CASTTL() did not refresh the TTL: %v, %v", node, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := m.Get(ctx, "/lock"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get() of expired key should fail with ErrNotFound: %v", err)
+	}
+
+	if err := m.CASTTL(ctx, "/lock", nil, []byte("c"), 0); err == nil {
+		t.Errorf("CASTTL() with invalid TTL should fail")
+	}
+}
+
+// newBenchKV returns a memory KV with n values in a single directory
+func newBenchKV(b *testing.B, n int) *KV {
+	k, _ := New(nil)
+	m := k.(*KV)
+
+	ctx := context.Background()
+
+	for i := 0; i < n; i++ {
+		m.Set(ctx, fmt.Sprintf("/wide/key-%d", i), []byte("value"))
+	}
+
+	b.ResetTimer()
+
+	return m
+}
+
+func Benchmark_MemoryGetWide(b *testing.B) {
+	m := newBenchKV(b, 10000)
+	ctx := context.Background()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := m.Get(ctx, fmt.Sprintf("/wide/key-%d", i%10000)); err != nil {
+			b.Fatalf("Get() returned error: %s", err)
+		}
+	}
+}
+
+func Benchmark_MemoryGetDeep(b *testing.B) {
+	m := newBenchKV(b, 0)
+	ctx := context.Background()
+
+	key := strings.Repeat("/level", 32) + "/key"
+	m.Set(ctx, key, []byte("value"))
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := m.Get(ctx, key); err != nil {
+			b.Fatalf("Get() returned error: %s", err)
+		}
+	}
+}
+
+func Benchmark_MemorySetWide(b *testing.B) {
+	m := newBenchKV(b, 10000)
+	ctx := context.Background()
+
+	for i := 0; i < b.N; i++ {
+		if err := m.Set(ctx, fmt.Sprintf("/wide/key-%d", i%10000), []byte("value")); err != nil {
+			b.Fatalf("Set() returned error: %s", err)
+		}
+	}
+}
+
+func Benchmark_MemoryDeleteWide(b *testing.B) {
+	m := newBenchKV(b, 10000)
+	ctx := context.Background()
+
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("/wide/key-%d", i%10000)
+
+		if err := m.Delete(ctx, key); err != nil {
+			b.Fatalf("Delete() returned error: %s", err)
+		}
+
+		m.Set(ctx, key, []byte("value"))
+	}
+}
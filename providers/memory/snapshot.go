@@ -0,0 +1,414 @@
+package memory
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultSnapshotInterval is used if snapshot-interval is not configured
+const defaultSnapshotInterval = time.Minute
+
+// snapshotVersion is the version of the snapshot file format
+const snapshotVersion = 1
+
+const (
+	opSet    = "set"
+	opDelete = "delete"
+	opDir    = "dir"
+	opMove   = "move"
+	opCopy   = "copy"
+)
+
+// header is the first line of a snapshot file
+type header struct {
+	Version int    `json:"version"`
+	Seq     uint64 `json:"seq"`
+}
+
+// record is a single line of a snapshot file or the log. Snapshot files only
+// contain set and dir records. Seq holds the revision of the modification for
+// log records and the revision of the value for snapshot records
+type record struct {
+	Seq     uint64     `json:"seq,omitempty"`
+	Op      string     `json:"op"`
+	Key     string     `json:"key"`
+	Target  string     `json:"target,omitempty"`
+	Value   []byte     `json:"value,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// snapshot persists a tree using a snapshot file holding the complete tree and
+// an append-only log (<path>.log) of all modifications since the snapshot has
+// been written. Compaction atomically replaces the snapshot file and truncates
+// the log. Both files contain one JSON object per line.
+//
+// The log is not synced after every write, so a crash of the operating system
+// may lose the most recent modifications. Crashes of the process do not.
+type snapshot struct {
+	path string
+
+	// lock serializes compactions. Appends are serialized by the lock of the
+	// KV
+	lock sync.Mutex
+	log  *os.File
+
+	// size holds the size of the log and last its size before the most
+	// recent record has been appended
+	size int64
+	last int64
+
+	// seq holds the sequence number of the last logged modification and
+	// compacted the one included in the snapshot file
+	seq       uint64
+	compacted uint64
+
+	stop sync.Once
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// openSnapshot loads the snapshot and log at p into k and starts compacting
+// every interval. Compaction is only done on close if interval is zero
+func openSnapshot(k *KV, p string, interval time.Duration) (*snapshot, error) {
+	s := &snapshot{
+		path: p,
+		done: make(chan struct{}),
+	}
+
+	if err := s.load(k); err != nil {
+		return nil, fmt.Errorf("failed to load snapshot %q: %s", p, err)
+	}
+
+	log, err := os.OpenFile(s.logPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := log.Stat()
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+
+	s.log = log
+	s.size = info.Size()
+
+	if interval > 0 {
+		s.wg.Add(1)
+		go s.run(k, interval)
+	}
+
+	return s, nil
+}
+
+func (s *snapshot) logPath() string {
+	return s.path + ".log"
+}
+
+// readLines calls fn for every complete line of the file at p and returns the
+// offset after the last complete line. A missing file is treated as empty
+func readLines(p string, fn func([]byte) error) (int64, error) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	var offset int64
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// a trailing line without newline is the result of an interrupted
+			// write and ignored
+			return offset, nil
+		} else if err != nil {
+			return offset, err
+		}
+
+		if err := fn(line); err != nil {
+			return offset, err
+		}
+
+		offset += int64(len(line))
+	}
+}
+
+// apply applies a snapshot or log record to the tree of k. Expiration timers
+// are started once loading is complete
+func (k *KV) apply(r record) error {
+	var err error
+
+	switch r.Op {
+	case opSet:
+		var expires time.Time
+		if r.Expires != nil {
+			expires = *r.Expires
+		}
+
+		_, err = k.set(r.Key, r.Value, r.Seq, expires)
+	case opDelete:
+		_, err = k.delete(r.Key)
+	case opMove:
+		_, err = k.move(r.Key, r.Target, r.Seq)
+	case opCopy:
+		_, err = k.copy(r.Key, r.Target, r.Seq)
+	case opDir:
+		var node *Node
+		if node, err = k.create(r.Key, true); err == nil && !node.IsDir {
+			err = fmt.Errorf("cannot create directory %q: is a value", r.Key)
+		}
+	default:
+		err = fmt.Errorf("unknown operation %q", r.Op)
+	}
+
+	return err
+}
+
+// load restores the tree from the snapshot file and replays the log
+func (s *snapshot) load(k *KV) error {
+	var hdr *header
+
+	_, err := readLines(s.path, func(line []byte) error {
+		if hdr == nil {
+			hdr = &header{}
+			if err := json.Unmarshal(line, hdr); err != nil {
+				return err
+			}
+
+			if hdr.Version != snapshotVersion {
+				return fmt.Errorf("unsupported snapshot version %d", hdr.Version)
+			}
+
+			return nil
+		}
+
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+
+		return k.apply(r)
+	})
+	if err != nil {
+		return err
+	}
+
+	if hdr != nil {
+		s.seq = hdr.Seq
+		s.compacted = hdr.Seq
+	}
+
+	offset, err := readLines(s.logPath(), func(line []byte) error {
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+
+		// the log may still contain modifications already included in the
+		// snapshot if compaction has been interrupted
+		if r.Seq <= s.compacted {
+			return nil
+		}
+
+		if err := k.apply(r); err != nil {
+			return fmt.Errorf("failed to replay log: %s", err)
+		}
+
+		s.seq = r.Seq
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// drop incomplete records so new ones are appended to a valid log
+	if info, err := os.Stat(s.logPath()); err == nil && info.Size() > offset {
+		return os.Truncate(s.logPath(), offset)
+	}
+
+	return nil
+}
+
+// append logs the modification r. r.Seq must be higher than the sequence of
+// all logged modifications. It must be called with the lock of the KV held
+func (s *snapshot) append(r record) error {
+	if s == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+
+	if _, err := s.log.Write(data); err != nil {
+		// drop a partially written record so later ones are not appended to
+		// it. If this fails too, loading ignores the incomplete line only if
+		// nothing is appended afterwards
+		if terr := s.log.Truncate(s.size); terr != nil {
+			return fmt.Errorf("failed to write snapshot log: %s (%s)", err, terr)
+		}
+
+		return fmt.Errorf("failed to write snapshot log: %s", err)
+	}
+
+	s.last = s.size
+	s.size += int64(len(data))
+	s.seq = r.Seq
+	return nil
+}
+
+// revert removes the record written by the last call to append, e.g. because
+// applying it failed. It must be called with the lock of the KV held
+func (s *snapshot) revert() error {
+	if s == nil {
+		return nil
+	}
+
+	if err := s.log.Truncate(s.last); err != nil {
+		return fmt.Errorf("failed to revert snapshot log: %s", err)
+	}
+
+	s.size = s.last
+	s.seq--
+	return nil
+}
+
+// compact writes the tree of k to the snapshot file and truncates the log
+func (s *snapshot) compact(k *KV) error {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.seq == s.compacted {
+		if _, err := os.Stat(s.path); err == nil {
+			return nil
+		}
+	}
+
+	tmp := s.path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	err = enc.Encode(header{
+		Version: snapshotVersion,
+		Seq:     s.seq,
+	})
+
+	if err == nil {
+		err = k.root.walk(func(n *Node) error {
+			switch {
+			case n == k.root:
+				return nil
+			case !n.IsDir:
+				r := record{
+					Seq:   n.Revision,
+					Op:    opSet,
+					Key:   n.Key,
+					Value: n.Value,
+				}
+
+				if !n.expires.IsZero() {
+					r.Expires = &n.expires
+				}
+
+				return enc.Encode(r)
+			case len(n.children) == 0:
+				// empty directories are not implied by any value
+				return enc.Encode(record{Op: opDir, Key: n.Key})
+			}
+
+			return nil
+		})
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot %q: %s", s.path, err)
+	}
+
+	s.compacted = s.seq
+
+	// all logged modifications are part of the snapshot now
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+
+	s.size = 0
+	s.last = 0
+	return nil
+}
+
+func (s *snapshot) run(k *KV, interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// failed compactions are retried on the next tick. The log still
+			// holds all modifications in the meantime
+			s.compact(k)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// close stops periodic compaction, writes a final snapshot and closes the log
+func (s *snapshot) close(k *KV) error {
+	if s == nil {
+		return nil
+	}
+
+	s.stop.Do(func() {
+		close(s.done)
+	})
+	s.wg.Wait()
+
+	err := s.compact(k)
+
+	if cerr := s.log.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
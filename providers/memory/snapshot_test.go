@@ -0,0 +1,270 @@
+package memory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+func newSnapshotKV(t *testing.T, p, interval string) *KV {
+	k, err := New(map[string]string{
+		"snapshot":          p,
+		"snapshot-interval": interval,
+	})
+	if err != nil {
+		t.Fatalf("failed to create memory KV: %s", err)
+	}
+
+	return k.(*KV)
+}
+
+func Test_MemorySnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokv-memory")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "snapshot")
+	ctx := context.Background()
+
+	k := newSnapshotKV(t, p, "0")
+
+	k.Set(ctx, "/app/name", []byte("gokv"))
+	k.Set(ctx, "/app/version", []byte("1"))
+	k.Set(ctx, "/tmp/a", []byte("a"))
+	k.Delete(ctx, "/tmp/a")
+
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close() returned error: %s", err)
+	}
+
+	if info, err := os.Stat(p + ".log"); err != nil || info.Size() != 0 {
+		t.Errorf("Close() did not compact the log: %v", err)
+	}
+
+	k = newSnapshotKV(t, p, "0")
+
+	if node, err := k.Get(ctx, "/app/name"); err != nil || string(node.Value) != "gokv" {
+		t.Errorf("Get() returned invalid node after reload: %v, %v", node, err)
+	}
+
+	if node, err := k.Get(ctx, "/tmp"); err != nil || !node.IsDir || len(node.Children) != 0 {
+		t.Errorf("empty directory has not been restored: %v, %v", node, err)
+	}
+
+	// modifications are logged until the next compaction, so they survive
+	// without calling Close
+	k.Set(ctx, "/app/version", []byte("2"))
+	k.Delete(ctx, "/app/name")
+
+	// simulate an interrupted write
+	f, _ := os.OpenFile(p+".log", os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"seq":99,"op":"set","key":"app/bro`)
+	f.Close()
+
+	k = newSnapshotKV(t, p, "0")
+
+	if node, err := k.Get(ctx, "/app/version"); err != nil || string(node.Value) != "2" {
+		t.Errorf("Get() returned invalid node after replaying log: %v, %v", node, err)
+	}
+
+	if _, err := k.Get(ctx, "/app/name"); err == nil {
+		t.Errorf("Get() of deleted key should fail after replaying log")
+	}
+
+	k.Set(ctx, "/app/name", []byte("again"))
+
+	k = newSnapshotKV(t, p, "0")
+
+	if node, err := k.Get(ctx, "/app/name"); err != nil || string(node.Value) != "again" {
+		t.Errorf("Get() returned invalid node after truncating log: %v, %v", node, err)
+	}
+
+	if _, err := New(map[string]string{"snapshot": p, "snapshot-interval": "soon"}); err == nil {
+		t.Errorf("New() with invalid snapshot-interval should fail")
+	}
+}
+
+func Test_MemorySnapshotInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokv-memory")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "snapshot")
+	ctx := context.Background()
+
+	k := newSnapshotKV(t, p, "10ms")
+	defer k.Close()
+
+	k.Set(ctx, "/a", []byte("1"))
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		data, _ := ioutil.ReadFile(p)
+		info, _ := os.Stat(p + ".log")
+
+		if len(data) > 0 && info != nil && info.Size() == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("snapshot has not been written periodically")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if node, err := newSnapshotKV(t, p, "0").Get(ctx, "/a"); err != nil || string(node.Value) != "1" {
+		t.Errorf("Get() returned invalid node from periodic snapshot: %v, %v", node, err)
+	}
+}
+
+func Test_MemorySnapshotOps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokv-memory")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "snapshot")
+	ctx := context.Background()
+
+	k := newSnapshotKV(t, p, "0")
+
+	k.Set(ctx, "/app/config/db", []byte("postgres"))
+	k.Move(ctx, "/app", "/moved")
+	k.Copy(ctx, "/moved", "/copied")
+	k.SetTTL(ctx, "/session", []byte("1"), time.Hour)
+
+	check := func(stage string, k *KV) {
+		for _, key := range []string{"/moved/config/db", "/copied/config/db", "/session"} {
+			if _, err := k.Get(ctx, key); err != nil {
+				t.Errorf("%s: Get() of %s returned error: %s", stage, key, err)
+			}
+		}
+
+		if _, err := k.Get(ctx, "/app"); err == nil {
+			t.Errorf("%s: moved key still exists", stage)
+		}
+
+		k.lock.RLock()
+		defer k.lock.RUnlock()
+
+		if node, _ := k.lookup("/session"); node == nil || node.timer == nil {
+			t.Errorf("%s: TTL has not been restored", stage)
+		}
+	}
+
+	// replay the log
+	reloaded := newSnapshotKV(t, p, "0")
+	check("log", reloaded)
+
+	if node, _ := reloaded.Get(ctx, "/session"); node.Revision != 4 {
+		t.Errorf("revision has not been restored from the log: %d", node.Revision)
+	}
+
+	k.SetTTL(ctx, "/short", []byte("1"), 50*time.Millisecond)
+	k.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// load the snapshot; the short TTL expires right after loading
+	reloaded = newSnapshotKV(t, p, "0")
+	check("snapshot", reloaded)
+
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := reloaded.Get(ctx, "/short"); err == nil {
+		t.Errorf("elapsed TTL did not expire after loading the snapshot")
+	}
+
+	if node, err := reloaded.Get(ctx, "/moved/config/db"); err != nil || node.Revision != 2 {
+		t.Errorf("revision of value has not been restored: %v, %v", node, err)
+	}
+
+	reloaded.Set(ctx, "/next", []byte("1"))
+
+	if node, _ := reloaded.Get(ctx, "/next"); node.Revision != 7 {
+		t.Errorf("revisions do not continue after loading the snapshot: %d", node.Revision)
+	}
+}
+
+func Test_MemorySnapshotLogFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokv-memory")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "snapshot")
+	ctx := context.Background()
+
+	k := newSnapshotKV(t, p, "0")
+
+	k.Set(ctx, "/a", []byte("1"))
+
+	// a rejected modification must have failed to apply as well
+	if err := k.Set(ctx, "/a/b", []byte("2")); err == nil {
+		t.Fatalf("Set() below a value should fail")
+	}
+
+	events, err := k.WatchEvents(ctx, "/", kv.WatchOptions{Recursive: true})
+	if err != nil {
+		t.Fatalf("WatchEvents() returned error: %s", err)
+	}
+
+	// writes to a read-only log fail like writes to a full disk
+	log := k.snapshot.log
+	if k.snapshot.log, err = os.Open(p + ".log"); err != nil {
+		t.Fatalf("failed to open log: %s", err)
+	}
+
+	if err := k.Set(ctx, "/b", []byte("2")); err == nil {
+		t.Errorf("Set() should fail if the log cannot be written")
+	}
+
+	if err := k.Delete(ctx, "/a"); err == nil {
+		t.Errorf("Delete() should fail if the log cannot be written")
+	}
+
+	if _, err := k.Get(ctx, "/b"); err == nil {
+		t.Errorf("failed Set() is visible")
+	}
+
+	if _, err := k.Get(ctx, "/a"); err != nil {
+		t.Errorf("failed Delete() is visible: %s", err)
+	}
+
+	select {
+	case ev := <-events:
+		t.Errorf("failed modification has been reported: %v", ev)
+	default:
+	}
+
+	k.snapshot.log.Close()
+	k.snapshot.log = log
+
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close() returned error: %s", err)
+	}
+
+	k = newSnapshotKV(t, p, "0")
+	defer k.Close()
+
+	if node, err := k.Get(ctx, "/a"); err != nil || string(node.Value) != "1" {
+		t.Errorf("Get() returned invalid node after reload: %v, %v", node, err)
+	}
+
+	if _, err := k.Get(ctx, "/b"); err == nil {
+		t.Errorf("failed Set() has been persisted")
+	}
+}
@@ -0,0 +1,154 @@
+package memory
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+// watchBuffer is the number of events buffered per watcher. Watchers falling
+// behind by more events are closed so they cannot block writers
+const watchBuffer = 128
+
+// historySize is the number of recent events kept for resuming watches
+const historySize = 1024
+
+// watcher is a single subscriber of WatchEvents
+type watcher struct {
+	key       string
+	recursive bool
+
+	ch   chan kv.Event
+	done chan struct{}
+}
+
+// matches returns true if ev should be reported to w
+func (w *watcher) matches(ev kv.Event) bool {
+	p := ev.Node.Key
+
+	if p == w.key || (w.recursive && (w.key == "" || strings.HasPrefix(p, w.key+"/"))) {
+		return true
+	}
+
+	// deleting a parent directory also deletes the watched key
+	switch ev.Type {
+	case kv.EventDelete, kv.EventExpire:
+		return strings.HasPrefix(w.key, p+"/")
+	}
+
+	return false
+}
+
+// unwatch removes w and closes its channel. The lock must be held
+func (k *KV) unwatch(w *watcher) {
+	if _, ok := k.watchers[w]; !ok {
+		return
+	}
+
+	delete(k.watchers, w)
+	close(w.ch)
+	close(w.done)
+}
+
+// notify assigns the current revision to events, keeps them for resuming
+// watches and passes them to all matching watchers. The lock must be held
+func (k *KV) notify(events ...kv.Event) {
+	for _, ev := range events {
+		ev.Revision = k.revision
+		k.history = append(k.history, ev)
+
+		for w := range k.watchers {
+			if !w.matches(ev) {
+				continue
+			}
+
+			select {
+			case w.ch <- ev:
+			default:
+				// the watcher does not keep up; closing it tells the
+				// consumer that events have been missed
+				k.unwatch(w)
+			}
+		}
+	}
+
+	// only drop complete revisions so resuming never misses a part of one
+	for len(k.history) > historySize {
+		k.compacted = k.history[0].Revision
+
+		for len(k.history) > 0 && k.history[0].Revision == k.compacted {
+			k.history = k.history[1:]
+		}
+	}
+}
+
+// WatchEvents streams changes of key until the context is done. Every
+// watcher buffers a limited number of events; if the consumer falls behind
+// the channel is closed. The most recent events are kept so watches can be
+// resumed using WatchOptions.AfterRevision
+func (k *KV) WatchEvents(ctx context.Context, key string, opts kv.WatchOptions) (<-chan kv.Event, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	w := &watcher{
+		key:       sanatizePath(key),
+		recursive: opts.Recursive,
+		done:      make(chan struct{}),
+	}
+
+	var backlog []kv.Event
+
+	if opts.AfterRevision > 0 && opts.AfterRevision < k.revision {
+		if opts.AfterRevision < k.compacted {
+			return nil, fmt.Errorf("revision %d: %w", opts.AfterRevision, kv.ErrCompacted)
+		}
+
+		for _, ev := range k.history {
+			if ev.Revision > opts.AfterRevision && w.matches(ev) {
+				backlog = append(backlog, ev)
+			}
+		}
+	}
+
+	w.ch = make(chan kv.Event, watchBuffer+len(backlog))
+	for _, ev := range backlog {
+		w.ch <- ev
+	}
+
+	k.watchers[w] = struct{}{}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			k.lock.Lock()
+			k.unwatch(w)
+			k.lock.Unlock()
+		case <-w.done:
+		}
+	}()
+
+	return w.ch, nil
+}
+
+// Watch blocks until key or any key below it changes and returns the updated
+// node. If key has been deleted an error wrapping kv.ErrNotFound is returned
+func (k *KV) Watch(ctx context.Context, key string) (*kv.Node, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events, err := k.WatchEvents(ctx, key, kv.WatchOptions{Recursive: true})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := <-events; !ok {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("watch on %q failed", sanatizePath(key))
+	}
+
+	return k.Get(ctx, key)
+}
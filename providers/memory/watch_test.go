@@ -0,0 +1,165 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+func Test_MemoryWatch(t *testing.T) {
+	k, _ := New(nil)
+	m := k.(*KV)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m.Set(ctx, "/app/name", []byte("gokv"))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		m.Set(ctx, "/other", []byte("1"))
+		m.Set(ctx, "/app/version", []byte("1"))
+	}()
+
+	node, err := m.Watch(ctx, "/app")
+	if err != nil {
+		t.Fatalf("Watch() returned error: %s", err)
+	}
+
+	if len(node.Children) != 2 {
+		t.Errorf("Watch() returned invalid node: %v", node)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		m.Delete(ctx, "/app")
+	}()
+
+	if _, err := m.Watch(ctx, "/app/name"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Watch() of key with deleted parent should fail: %v", err)
+	}
+
+	cctx, ccancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer ccancel()
+
+	if _, err := m.Watch(cctx, "/app"); err != context.DeadlineExceeded {
+		t.Errorf("Watch() did not return after the context is done: %v", err)
+	}
+}
+
+// next returns the next event or fails the test
+func next(t *testing.T, events <-chan kv.Event) kv.Event {
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatalf("event channel has been closed")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for event")
+	}
+
+	return kv.Event{}
+}
+
+func Test_MemoryWatchEvents(t *testing.T) {
+	k, _ := New(nil)
+	m := k.(*KV)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	all, err := m.WatchEvents(ctx, "/app", kv.WatchOptions{Recursive: true})
+	if err != nil {
+		t.Fatalf("WatchEvents() returned error: %s", err)
+	}
+
+	single, _ := m.WatchEvents(ctx, "/app/name", kv.WatchOptions{})
+
+	m.Set(ctx, "/app/name", []byte("gokv"))
+	m.CAS(ctx, "/app/name", []byte("gokv"), []byte("kv"))
+	m.Set(ctx, "/app/dir/a", []byte("1"))
+	m.Move(ctx, "/app/dir", "/app/moved")
+	m.SetTTL(ctx, "/app/ttl", []byte("1"), 10*time.Millisecond)
+
+	expected := []struct {
+		typ kv.EventType
+		key string
+		rev uint64
+	}{
+		{kv.EventSet, "app/name", 1},
+		{kv.EventCompareAndSwap, "app/name", 2},
+		{kv.EventSet, "app/dir/a", 3},
+		{kv.EventDelete, "app/dir", 4},
+		{kv.EventSet, "app/moved/a", 4},
+		{kv.EventSet, "app/ttl", 5},
+		{kv.EventExpire, "app/ttl", 6},
+	}
+
+	for _, e := range expected {
+		ev := next(t, all)
+		if ev.Type != e.typ || ev.Node.Key != e.key || ev.Revision != e.rev {
+			t.Errorf("WatchEvents() returned unexpected event: %v, expected %v", ev, e)
+		}
+	}
+
+	if ev := next(t, single); ev.Type != kv.EventSet || string(ev.Node.Value) != "gokv" || ev.Node.Revision != 1 {
+		t.Errorf("WatchEvents() returned unexpected event: %v", ev)
+	}
+
+	if ev := next(t, single); ev.Type != kv.EventCompareAndSwap || string(ev.Node.Value) != "kv" {
+		t.Errorf("WatchEvents() returned unexpected event: %v", ev)
+	}
+
+	// resuming replays all events after the given revision
+	resumed, err := m.WatchEvents(ctx, "/app/moved", kv.WatchOptions{Recursive: true, AfterRevision: 3})
+	if err != nil {
+		t.Fatalf("WatchEvents() returned error: %s", err)
+	}
+
+	if ev := next(t, resumed); ev.Node.Key != "app/moved/a" || ev.Revision != 4 {
+		t.Errorf("WatchEvents() did not resume: %v", ev)
+	}
+
+	cancel()
+
+	if _, ok := <-all; ok {
+		t.Errorf("WatchEvents() did not close the channel after the context is done")
+	}
+}
+
+func Test_MemoryWatchLimits(t *testing.T) {
+	k, _ := New(nil)
+	m := k.(*KV)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	slow, _ := m.WatchEvents(ctx, "/", kv.WatchOptions{Recursive: true})
+
+	for i := 0; i < historySize+2; i++ {
+		m.Set(ctx, fmt.Sprintf("/key-%d", i%10), []byte("x"))
+	}
+
+	// the slow consumer gets the buffered events and is closed afterwards
+	var n int
+	for range slow {
+		n++
+	}
+
+	if n != watchBuffer {
+		t.Errorf("slow watcher received %d events instead of %d", n, watchBuffer)
+	}
+
+	if _, err := m.WatchEvents(ctx, "/", kv.WatchOptions{AfterRevision: 1}); !errors.Is(err, kv.ErrCompacted) {
+		t.Errorf("WatchEvents() resuming from a compacted revision should fail with ErrCompacted: %v", err)
+	}
+
+	if _, err := m.WatchEvents(ctx, "/", kv.WatchOptions{AfterRevision: 2}); err != nil {
+		t.Errorf("WatchEvents() resuming from the oldest kept revision failed: %s", err)
+	}
+}
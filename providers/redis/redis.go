@@ -0,0 +1,280 @@
+// Package redis implements a gokv provider for Redis. As Redis uses a flat
+// keyspace, directories are emulated using per-directory child indexes.
+package redis
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+// defaultPrefix is used to namespace all keys if no prefix is configured
+const defaultPrefix = "gokv"
+
+type KV struct {
+	cli    *redis.Client
+	prefix string
+	db     int
+}
+
+func sanatizePath(key string) string {
+	return strings.Trim(key, "/")
+}
+
+func (r *KV) valueKey(p string) string {
+	return r.prefix + ":v:" + p
+}
+
+func (r *KV) dirKey(p string) string {
+	return r.prefix + ":d:" + p
+}
+
+// convertError maps errors returned by Lua scripts to gokv errors
+func convertError(key string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch {
+	case strings.Contains(err.Error(), errCASFailed):
+		return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+	case strings.Contains(err.Error(), errNotFound):
+		return fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	}
+
+	return err
+}
+
+// readDir returns a directory node for p including its children. depth limits
+// the number of levels to include (-1 means unlimited). Children that expired
+// but are still listed in the index are skipped
+func (r *KV) readDir(cli *redis.Client, p string, depth int) (*kv.Node, error) {
+	node := &kv.Node{
+		Key:   p,
+		IsDir: true,
+	}
+
+	if depth == 0 {
+		return node, nil
+	}
+
+	names, err := cli.ZRange(r.dirKey(p), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		return node, nil
+	}
+
+	values := make([]*redis.StringCmd, len(names))
+	dirs := make([]*redis.IntCmd, len(names))
+
+	pipe := cli.Pipeline()
+	for i, name := range names {
+		childPath := path.Join(p, name)
+		values[i] = pipe.Get(r.valueKey(childPath))
+		dirs[i] = pipe.Exists(r.dirKey(childPath))
+	}
+
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for i, name := range names {
+		childPath := path.Join(p, name)
+
+		if value, err := values[i].Bytes(); err == nil {
+			child := kv.Node{
+				Key: childPath,
+			}
+
+			if len(value) > 0 {
+				child.Value = value
+			}
+
+			node.Children = append(node.Children, child)
+			continue
+		} else if err != redis.Nil {
+			return nil, err
+		}
+
+		if dirs[i].Val() == 0 {
+			// stale index entry of an expired value
+			continue
+		}
+
+		child, err := r.readDir(cli, childPath, depth-1)
+		if err != nil {
+			return nil, err
+		}
+
+		node.Children = append(node.Children, *child)
+	}
+
+	return node, nil
+}
+
+func (r *KV) get(ctx context.Context, key string, depth int) (*kv.Node, error) {
+	cli := r.cli.WithContext(ctx)
+	key = sanatizePath(key)
+
+	if key != "" {
+		value, err := cli.Get(r.valueKey(key)).Bytes()
+		if err == nil {
+			node := &kv.Node{
+				Key: key,
+			}
+
+			if len(value) > 0 {
+				node.Value = value
+			}
+
+			return node, nil
+		} else if err != redis.Nil {
+			return nil, err
+		}
+
+		exists, err := cli.Exists(r.dirKey(key)).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		if exists == 0 {
+			return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+		}
+	}
+
+	return r.readDir(cli, key, depth)
+}
+
+func (r *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
+	return r.get(ctx, key, 1)
+}
+
+func (r *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	return r.get(ctx, key, -1)
+}
+
+func (r *KV) set(ctx context.Context, key string, value []byte, ttl time.Duration, mode string, compare []byte) error {
+	key = sanatizePath(key)
+	if key == "" {
+		return fmt.Errorf("cannot set root directory")
+	}
+
+	err := setScript.Run(r.cli.WithContext(ctx), nil,
+		r.prefix, key, value, int64(ttl/time.Millisecond), mode, compare).Err()
+
+	return convertError(key, err)
+}
+
+func (r *KV) Set(ctx context.Context, key string, value []byte) error {
+	return r.set(ctx, key, value, 0, "", nil)
+}
+
+// SetTTL sets key to value and lets Redis expire it after ttl. Expired values
+// are removed from their directory index lazily
+func (r *KV) SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl < time.Millisecond {
+		return fmt.Errorf("invalid TTL %s", ttl)
+	}
+
+	return r.set(ctx, key, value, ttl, "", nil)
+}
+
+// CAS sets key to value if its current value matches compare. If compare is
+// nil the key must not exist
+func (r *KV) CAS(ctx context.Context, key string, compare, value []byte) error {
+	if compare == nil {
+		return r.set(ctx, key, value, 0, "absent", nil)
+	}
+
+	return r.set(ctx, key, value, 0, "equal", compare)
+}
+
+func (r *KV) Delete(ctx context.Context, key string) error {
+	key = sanatizePath(key)
+	if key == "" {
+		return fmt.Errorf("cannot delete root directory")
+	}
+
+	err := deleteScript.Run(r.cli.WithContext(ctx), nil, r.prefix, key).Err()
+
+	return convertError(key, err)
+}
+
+// Watch blocks until key changes and returns the updated node. If key has been
+// deleted an error wrapping kv.ErrNotFound is returned.
+//
+// Watch relies on Redis keyspace notifications which must be enabled on the
+// server (e.g. notify-keyspace-events "Kgz$x")
+func (r *KV) Watch(ctx context.Context, key string) (*kv.Node, error) {
+	key = sanatizePath(key)
+
+	channel := fmt.Sprintf("__keyspace@%d__:", r.db)
+
+	pubsub := r.cli.Subscribe(channel+r.valueKey(key), channel+r.dirKey(key))
+	defer pubsub.Close()
+
+	// wait for the subscription to be confirmed
+	if _, err := pubsub.Receive(); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-pubsub.Channel():
+		return r.Get(ctx, key)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close closes the connection to Redis
+func (r *KV) Close() error {
+	return r.cli.Close()
+}
+
+func New(params map[string]string) (kv.Provider, error) {
+	var db int
+
+	if v := params["db"]; v != "" {
+		var err error
+		if db, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid db %q: %s", v, err)
+		}
+	}
+
+	prefix := params["prefix"]
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+
+	cli := redis.NewClient(&redis.Options{
+		Addr:     params["endpoint"],
+		Password: params["password"],
+		DB:       db,
+	})
+
+	if err := cli.Ping().Err(); err != nil {
+		cli.Close()
+		return nil, err
+	}
+
+	return &KV{
+		cli:    cli,
+		prefix: prefix,
+		db:     db,
+	}, nil
+}
+
+func init() {
+	if err := kv.Register("redis", New, []string{"endpoint"}, []string{"password", "db", "prefix"}); err != nil {
+		panic("failed to register redis KV driver")
+	}
+}
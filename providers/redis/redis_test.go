@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+func newTestKV(t *testing.T) (*KV, *miniredis.Miniredis) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("failed to start miniredis: %s", err)
+	}
+
+	k, err := New(map[string]string{
+		"endpoint": m.Addr(),
+	})
+	if err != nil {
+		m.Close()
+		t.Fatalf("failed to create redis KV: %s", err)
+	}
+
+	return k.(*KV), m
+}
+
+func Test_Redis(t *testing.T) {
+	k, m := newTestKV(t)
+	defer m.Close()
+	defer k.Close()
+
+	kv.KVTester(t, k)
+}
+
+func Test_RedisTTL(t *testing.T) {
+	k, m := newTestKV(t)
+	defer m.Close()
+	defer k.Close()
+
+	ctx := context.Background()
+
+	if err := k.SetTTL(ctx, "/ttl/a", []byte("1"), time.Minute); err != nil {
+		t.Errorf("SetTTL() returned error: %s", err)
+	}
+
+	k.Set(ctx, "/ttl/b", []byte("2"))
+
+	m.FastForward(2 * time.Minute)
+
+	if _, err := k.Get(ctx, "/ttl/a"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get() of expired key should fail with ErrNotFound: %v", err)
+	}
+
+	if node, err := k.Get(ctx, "/ttl"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	} else if len(node.Children) != 1 || node.Children[0].Key != "ttl/b" {
+		t.Errorf("Get() returned expired children: %v", node.Children)
+	}
+}
+
+func Test_RedisWatch(t *testing.T) {
+	k, m := newTestKV(t)
+	defer m.Close()
+	defer k.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	channel := "__keyspace@0__:gokv:v:watch"
+
+	result := make(chan *kv.Node, 1)
+	go func() {
+		node, err := k.Watch(ctx, "/watch")
+		if err != nil {
+			t.Errorf("Watch() returned error: %s", err)
+		}
+		result <- node
+	}()
+
+	for m.PubSubNumSub(channel)[channel] == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("Watch() did not subscribe to %s", channel)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// miniredis does not support keyspace notifications so we publish the
+	// event ourself
+	k.Set(ctx, "/watch", []byte("1"))
+	m.Publish(channel, "set")
+
+	if node := <-result; node == nil {
+		t.Errorf("Watch() returned no node")
+	} else if string(node.Value) != "1" {
+		t.Errorf("Watch() returned invalid value: %q", node.Value)
+	}
+}
@@ -0,0 +1,110 @@
+package redis
+
+import "github.com/go-redis/redis"
+
+// Redis does not know about directories. Values are stored as plain strings
+// under <prefix>:v:<path> while each directory keeps a sorted set of child
+// names under <prefix>:d:<path> (score 0, so children are sorted
+// lexicographically). The root directory uses <prefix>:d: as its index.
+//
+// All modifications are implemented as Lua scripts so updating values and the
+// directory indexes happens atomically. The scripts derive the keys they touch
+// from ARGV (a recursive delete only learns them while walking the indexes),
+// so they cannot be declared in KEYS. This is fine for a single Redis server
+// (including replicas behind Sentinel) but not supported by Redis Cluster.
+
+// errCASFailed is returned by scripts if a compare-and-swap failed
+const errCASFailed = "CASFAILED"
+
+// errNotFound is returned by scripts if a key does not exist
+const errNotFound = "NOTFOUND"
+
+// setScript sets a value and adds it to all parent directory indexes.
+//
+// ARGV: prefix, path, value, ttl (milliseconds, 0 to disable), mode
+// ("", "absent" or "equal") and compare (only used for mode "equal")
+var setScript = redis.NewScript(`
+local prefix, path, value, ttl, mode, compare = ARGV[1], ARGV[2], ARGV[3], tonumber(ARGV[4]), ARGV[5], ARGV[6]
+local vkey = prefix .. ":v:" .. path
+
+if redis.call("EXISTS", prefix .. ":d:" .. path) == 1 then
+	return redis.error_reply("cannot set " .. path .. ": is a directory")
+end
+
+local parts = {}
+for part in string.gmatch(path, "[^/]+") do
+	table.insert(parts, part)
+end
+
+local parent = ""
+for i = 1, #parts - 1 do
+	if parent == "" then parent = parts[i] else parent = parent .. "/" .. parts[i] end
+
+	if redis.call("EXISTS", prefix .. ":v:" .. parent) == 1 then
+		return redis.error_reply("cannot create " .. path .. ": " .. parent .. " is not a directory")
+	end
+end
+
+if mode == "absent" then
+	if redis.call("EXISTS", vkey) == 1 then
+		return redis.error_reply("` + errCASFailed + `")
+	end
+elseif mode == "equal" then
+	if redis.call("GET", vkey) ~= compare then
+		return redis.error_reply("` + errCASFailed + `")
+	end
+end
+
+if ttl > 0 then
+	redis.call("SET", vkey, value, "PX", ttl)
+else
+	redis.call("SET", vkey, value)
+end
+
+parent = ""
+for i = 1, #parts do
+	redis.call("ZADD", prefix .. ":d:" .. parent, 0, parts[i])
+	if parent == "" then parent = parts[i] else parent = parent .. "/" .. parts[i] end
+end
+
+return "OK"
+`)
+
+// deleteScript recursively deletes a value or directory and removes it from
+// its parent index. Parent directories that become empty are removed as well.
+//
+// ARGV: prefix, path
+var deleteScript = redis.NewScript(`
+local prefix, path = ARGV[1], ARGV[2]
+
+local function remove(p)
+	local n = redis.call("DEL", prefix .. ":v:" .. p)
+	local dkey = prefix .. ":d:" .. p
+
+	for _, child in ipairs(redis.call("ZRANGE", dkey, 0, -1)) do
+		n = n + remove(p .. "/" .. child)
+	end
+
+	return n + redis.call("DEL", dkey)
+end
+
+if remove(path) == 0 then
+	return redis.error_reply("` + errNotFound + `")
+end
+
+local child = path
+while child ~= "" do
+	local parent = string.match(child, "^(.*)/[^/]*$") or ""
+	local name = string.match(child, "([^/]+)$")
+
+	redis.call("ZREM", prefix .. ":d:" .. parent, name)
+
+	if parent == "" or redis.call("EXISTS", prefix .. ":d:" .. parent) == 1 then
+		break
+	end
+
+	child = parent
+end
+
+return "OK"
+`)
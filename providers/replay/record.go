@@ -0,0 +1,265 @@
+package replay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+// Entry represents a single recorded operation including its result
+type Entry struct {
+	// Op holds the name of the operation (get, rget, set, setttl, delete, cas,
+	// casttl, txn, watch, watchevents, move, copy, lock, unlock)
+	Op string `json:"op"`
+
+	// Key holds the key passed to the operation
+	Key string `json:"key"`
+
+	// Target holds the destination key for move and copy operations
+	Target string `json:"target,omitempty"`
+
+	// Value holds the value passed to set, setttl, cas and casttl operations
+	Value []byte `json:"value,omitempty"`
+
+	// Compare holds the value to compare for cas and casttl operations
+	Compare []byte `json:"compare,omitempty"`
+
+	// TTL holds the time-to-live passed to setttl and casttl operations
+	TTL time.Duration `json:"ttl,omitempty"`
+
+	// Ops holds the operations passed to txn operations
+	Ops []kv.Op `json:"ops,omitempty"`
+
+	// Options holds the options passed to watchevents operations
+	Options *kv.WatchOptions `json:"options,omitempty"`
+
+	// Node holds the node returned by the operation, if any
+	Node *kv.Node `json:"node,omitempty"`
+
+	// Error holds the error message returned by the operation, if any
+	Error string `json:"error,omitempty"`
+
+	// ErrorKind names the sentinel error of the package kv (e.g. not_found)
+	// wrapped by Error, so replayed errors match using errors.Is
+	ErrorKind string `json:"error_kind,omitempty"`
+}
+
+// errorKinds maps the names used in ErrorKind to sentinel errors
+var errorKinds = map[string]error{
+	"not_found":      kv.ErrNotFound,
+	"compare_failed": kv.ErrCompareFailed,
+	"read_only":      kv.ErrReadOnly,
+	"compacted":      kv.ErrCompacted,
+	"not_supported":  kv.ErrNotSupported,
+}
+
+// replayedError is a recorded error wrapping the recorded sentinel error
+type replayedError struct {
+	msg string
+	err error
+}
+
+func (e *replayedError) Error() string {
+	return e.msg
+}
+
+func (e *replayedError) Unwrap() error {
+	return e.err
+}
+
+// Recorder wraps a KV store and records every operation and its result as a
+// JSON encoded Entry per line. The recorded stream can be served back using
+// a Replayer
+type Recorder struct {
+	lock sync.Mutex
+
+	store kv.KV
+	enc   *json.Encoder
+}
+
+// NewRecorder returns a new Recorder that forwards all operations to store and
+// writes the recorded entries to w
+func NewRecorder(store kv.KV, w io.Writer) *Recorder {
+	return &Recorder{
+		store: store,
+		enc:   json.NewEncoder(w),
+	}
+}
+
+func (r *Recorder) record(e Entry, err error) error {
+	if err != nil {
+		e.Error = err.Error()
+
+		for kind, sentinel := range errorKinds {
+			if errors.Is(err, sentinel) {
+				e.ErrorKind = kind
+			}
+		}
+	}
+
+	if encErr := r.enc.Encode(e); encErr != nil {
+		return fmt.Errorf("failed to record %s %q: %s", e.Op, e.Key, encErr)
+	}
+
+	return err
+}
+
+func (r *Recorder) Get(ctx context.Context, key string) (*kv.Node, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	node, err := r.store.Get(ctx, key)
+
+	return node, r.record(Entry{Op: "get", Key: key, Node: node}, err)
+}
+
+func (r *Recorder) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	node, err := r.store.RGet(ctx, key)
+
+	return node, r.record(Entry{Op: "rget", Key: key, Node: node}, err)
+}
+
+func (r *Recorder) Set(ctx context.Context, key string, value []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.store.Set(ctx, key, value)
+
+	return r.record(Entry{Op: "set", Key: key, Value: value}, err)
+}
+
+func (r *Recorder) SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.store.SetTTL(ctx, key, value, ttl)
+
+	return r.record(Entry{Op: "setttl", Key: key, Value: value, TTL: ttl}, err)
+}
+
+func (r *Recorder) Delete(ctx context.Context, key string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.store.Delete(ctx, key)
+
+	return r.record(Entry{Op: "delete", Key: key}, err)
+}
+
+func (r *Recorder) CAS(ctx context.Context, key string, compare, value []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.store.CAS(ctx, key, compare, value)
+
+	return r.record(Entry{Op: "cas", Key: key, Compare: compare, Value: value}, err)
+}
+
+func (r *Recorder) CASTTL(ctx context.Context, key string, compare, value []byte, ttl time.Duration) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.store.CASTTL(ctx, key, compare, value, ttl)
+
+	return r.record(Entry{Op: "casttl", Key: key, Compare: compare, Value: value, TTL: ttl}, err)
+}
+
+// Watch forwards to the underlying store. Note that the recorder lock is not
+// held while waiting for changes so other operations may be recorded in the
+// meantime
+func (r *Recorder) Watch(ctx context.Context, key string) (*kv.Node, error) {
+	node, err := r.store.Watch(ctx, key)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return node, r.record(Entry{Op: "watch", Key: key, Node: node}, err)
+}
+
+// WatchEvents forwards to the underlying store. Only the call itself is
+// recorded, events received afterwards are not
+func (r *Recorder) WatchEvents(ctx context.Context, key string, opts kv.WatchOptions) (<-chan kv.Event, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ch, err := r.store.WatchEvents(ctx, key, opts)
+
+	return ch, r.record(Entry{Op: "watchevents", Key: key, Options: &opts}, err)
+}
+
+func (r *Recorder) Txn(ctx context.Context, ops []kv.Op) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.store.Txn(ctx, ops)
+
+	return r.record(Entry{Op: "txn", Ops: ops}, err)
+}
+
+func (r *Recorder) Move(ctx context.Context, keyOld, keyNew string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.store.Move(ctx, keyOld, keyNew)
+
+	return r.record(Entry{Op: "move", Key: keyOld, Target: keyNew}, err)
+}
+
+func (r *Recorder) Copy(ctx context.Context, keyOld, keyNew string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.store.Copy(ctx, keyOld, keyNew)
+
+	return r.record(Entry{Op: "copy", Key: keyOld, Target: keyNew}, err)
+}
+
+// Close closes the underlying store. Closing is not recorded
+func (r *Recorder) Close() error {
+	return r.store.Close()
+}
+
+// Lock acquires the lock on the underlying store. Unlocking the returned lock
+// is recorded as well
+func (r *Recorder) Lock(ctx context.Context, key string) (kv.Lock, error) {
+	l, err := r.store.Lock(ctx, key)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if recErr := r.record(Entry{Op: "lock", Key: key}, err); recErr != nil {
+		// the caller cannot release a lock it did not receive
+		if err == nil {
+			l.Unlock(ctx)
+		}
+
+		return nil, recErr
+	}
+
+	return &recordedLock{Lock: l, key: key, r: r}, nil
+}
+
+type recordedLock struct {
+	kv.Lock
+
+	key string
+	r   *Recorder
+}
+
+func (l *recordedLock) Unlock(ctx context.Context) error {
+	l.r.lock.Lock()
+	defer l.r.lock.Unlock()
+
+	err := l.Lock.Unlock(ctx)
+
+	return l.r.record(Entry{Op: "unlock", Key: l.key}, err)
+}
@@ -0,0 +1,216 @@
+// Package replay provides a recording decorator for KV stores and a replay
+// provider serving recorded operations back. It allows to record tests once
+// against a real KV database and replay them offline afterwards.
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+// Replayer serves recorded entries back in the order they have been recorded.
+// Any operation that does not match the next recorded entry fails
+type Replayer struct {
+	lock sync.Mutex
+
+	entries []Entry
+	pos     int
+}
+
+// NewReplayer reads all recorded entries from r and returns a new Replayer
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	var entries []Entry
+
+	dec := json.NewDecoder(r)
+	for {
+		var e Entry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to load recording: %s", err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	return &Replayer{
+		entries: entries,
+	}, nil
+}
+
+// Remaining returns the number of recorded entries that have not yet been
+// replayed
+func (r *Replayer) Remaining() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return len(r.entries) - r.pos
+}
+
+func (r *Replayer) next(call Entry) (*kv.Node, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.pos >= len(r.entries) {
+		return nil, fmt.Errorf("unexpected call %s %q: recording exhausted", call.Op, call.Key)
+	}
+
+	e := r.entries[r.pos]
+
+	if e.Op != call.Op ||
+		e.Key != call.Key ||
+		e.Target != call.Target ||
+		e.TTL != call.TTL ||
+		!bytes.Equal(e.Value, call.Value) ||
+		!bytes.Equal(e.Compare, call.Compare) ||
+		!reflect.DeepEqual(e.Options, call.Options) ||
+		!equalOps(e.Ops, call.Ops) {
+		return nil, fmt.Errorf("unexpected call %s %q: expected %s %q (entry %d)", call.Op, call.Key, e.Op, e.Key, r.pos)
+	}
+
+	r.pos++
+
+	if e.Error != "" {
+		return nil, &replayedError{msg: e.Error, err: errorKinds[e.ErrorKind]}
+	}
+
+	if e.Node == nil {
+		return nil, nil
+	}
+
+	node := *e.Node
+	return &node, nil
+}
+
+func equalOps(a, b []kv.Op) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Type != b[i].Type || a[i].Key != b[i].Key || !bytes.Equal(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *Replayer) Get(ctx context.Context, key string) (*kv.Node, error) {
+	return r.next(Entry{Op: "get", Key: key})
+}
+
+func (r *Replayer) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	return r.next(Entry{Op: "rget", Key: key})
+}
+
+func (r *Replayer) Set(ctx context.Context, key string, value []byte) error {
+	_, err := r.next(Entry{Op: "set", Key: key, Value: value})
+	return err
+}
+
+func (r *Replayer) SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := r.next(Entry{Op: "setttl", Key: key, Value: value, TTL: ttl})
+	return err
+}
+
+func (r *Replayer) Delete(ctx context.Context, key string) error {
+	_, err := r.next(Entry{Op: "delete", Key: key})
+	return err
+}
+
+func (r *Replayer) CAS(ctx context.Context, key string, compare, value []byte) error {
+	_, err := r.next(Entry{Op: "cas", Key: key, Compare: compare, Value: value})
+	return err
+}
+
+func (r *Replayer) CASTTL(ctx context.Context, key string, compare, value []byte, ttl time.Duration) error {
+	_, err := r.next(Entry{Op: "casttl", Key: key, Compare: compare, Value: value, TTL: ttl})
+	return err
+}
+
+func (r *Replayer) Watch(ctx context.Context, key string) (*kv.Node, error) {
+	return r.next(Entry{Op: "watch", Key: key})
+}
+
+// WatchEvents replays a recorded watch. As events are not recorded, the
+// returned channel is closed once the context is done without delivering any
+// event
+func (r *Replayer) WatchEvents(ctx context.Context, key string, opts kv.WatchOptions) (<-chan kv.Event, error) {
+	if _, err := r.next(Entry{Op: "watchevents", Key: key, Options: &opts}); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan kv.Event)
+
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+
+	return ch, nil
+}
+
+func (r *Replayer) Txn(ctx context.Context, ops []kv.Op) error {
+	_, err := r.next(Entry{Op: "txn", Ops: ops})
+	return err
+}
+
+func (r *Replayer) Move(ctx context.Context, keyOld, keyNew string) error {
+	_, err := r.next(Entry{Op: "move", Key: keyOld, Target: keyNew})
+	return err
+}
+
+func (r *Replayer) Copy(ctx context.Context, keyOld, keyNew string) error {
+	_, err := r.next(Entry{Op: "copy", Key: keyOld, Target: keyNew})
+	return err
+}
+
+// Lock replays a recorded lock operation. The returned lock is never lost
+func (r *Replayer) Lock(ctx context.Context, key string) (kv.Lock, error) {
+	if _, err := r.next(Entry{Op: "lock", Key: key}); err != nil {
+		return nil, err
+	}
+
+	return &replayedLock{key: key, r: r}, nil
+}
+
+type replayedLock struct {
+	key string
+	r   *Replayer
+}
+
+func (l *replayedLock) Lost() <-chan struct{} {
+	return nil
+}
+
+func (l *replayedLock) Unlock(ctx context.Context) error {
+	_, err := l.r.next(Entry{Op: "unlock", Key: l.key})
+	return err
+}
+
+// New creates a new Replayer serving the recording stored in params["file"]
+func New(params map[string]string) (kv.Provider, error) {
+	f, err := os.Open(params["file"])
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return NewReplayer(f)
+}
+
+func init() {
+	if err := kv.Register("replay", New, []string{"file"}, nil); err != nil {
+		panic("failed to register replay KV driver")
+	}
+}
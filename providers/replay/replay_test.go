@@ -0,0 +1,152 @@
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/nethack42/gokv"
+	_ "github.com/nethack42/gokv/providers/memory"
+	"golang.org/x/net/context"
+)
+
+func Test_RecordReplay(t *testing.T) {
+	store, err := kv.Open("memory", nil)
+	if err != nil {
+		t.Errorf("failed to open memory KV: %s", err)
+		t.FailNow()
+	}
+
+	var buf bytes.Buffer
+
+	kv.KVTester(t, NewRecorder(store, &buf))
+
+	if buf.Len() == 0 {
+		t.Errorf("recorder did not record any operation")
+		t.FailNow()
+	}
+
+	r, err := NewReplayer(&buf)
+	if err != nil {
+		t.Errorf("failed to load recording: %s", err)
+		t.FailNow()
+	}
+
+	kv.KVTester(t, r)
+
+	if n := r.Remaining(); n != 0 {
+		t.Errorf("replay did not consume all recorded entries: %d remaining", n)
+	}
+}
+
+func Test_ReplaySentinelErrors(t *testing.T) {
+	store, err := kv.Open("memory", nil)
+	if err != nil {
+		t.Fatalf("failed to open memory KV: %s", err)
+	}
+
+	ctx := context.Background()
+
+	check := func(store kv.Provider) {
+		if _, err := store.Get(ctx, "missing"); !errors.Is(err, kv.ErrNotFound) {
+			t.Errorf("Get() of missing key returned %v", err)
+		}
+
+		if err := store.CAS(ctx, "missing", []byte("x"), []byte("y")); !errors.Is(err, kv.ErrCompareFailed) {
+			t.Errorf("CAS() of missing key returned %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+
+	check(NewRecorder(store, &buf))
+
+	r, err := NewReplayer(&buf)
+	if err != nil {
+		t.Fatalf("failed to load recording: %s", err)
+	}
+
+	check(r)
+}
+
+func Test_ReplayUnexpected(t *testing.T) {
+	store, err := kv.Open("memory", nil)
+	if err != nil {
+		t.Errorf("failed to open memory KV: %s", err)
+		t.FailNow()
+	}
+
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	rec := NewRecorder(store, &buf)
+
+	rec.Set(ctx, "/a", []byte("1"))
+	rec.Get(ctx, "/a")
+
+	r, err := NewReplayer(&buf)
+	if err != nil {
+		t.Errorf("failed to load recording: %s", err)
+		t.FailNow()
+	}
+
+	if err := r.Set(ctx, "/a", []byte("2")); err == nil {
+		t.Errorf("Set() with a different value should fail")
+	}
+
+	if err := r.Set(ctx, "/a", []byte("1")); err != nil {
+		t.Errorf("Set() returned error: %s", err)
+	}
+
+	if node, err := r.Get(ctx, "/a"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	} else if string(node.Value) != "1" {
+		t.Errorf("Get() returned invalid value: %q", node.Value)
+	}
+
+	if _, err := r.Get(ctx, "/a"); err == nil {
+		t.Errorf("Get() beyond the recording should fail")
+	}
+}
+
+// lockStore hands out locks counting how often they are released
+type lockStore struct {
+	kv.KV
+
+	unlocked int
+}
+
+func (s *lockStore) Lock(ctx context.Context, key string) (kv.Lock, error) {
+	return &countedLock{s}, nil
+}
+
+type countedLock struct {
+	s *lockStore
+}
+
+func (l *countedLock) Lost() <-chan struct{} {
+	return nil
+}
+
+func (l *countedLock) Unlock(ctx context.Context) error {
+	l.s.unlocked++
+	return nil
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func Test_RecordLockFailure(t *testing.T) {
+	store := &lockStore{}
+
+	if _, err := NewRecorder(store, failingWriter{}).Lock(context.Background(), "/lock"); err == nil {
+		t.Errorf("Lock() should fail if it cannot be recorded")
+	}
+
+	if store.unlocked != 1 {
+		t.Errorf("lock that could not be recorded was not released")
+	}
+}
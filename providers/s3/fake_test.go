@@ -0,0 +1,340 @@
+package s3
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fakeObject struct {
+	data     []byte
+	etag     string
+	modified time.Time
+}
+
+// fakeS3 implements the parts of the S3 API used by the provider for a single
+// path-style bucket
+type fakeS3 struct {
+	lock    sync.Mutex
+	bucket  string
+	objects map[string]*fakeObject
+
+	// lists counts the number of list requests
+	lists int
+}
+
+func newFakeS3(bucket string) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		bucket:  bucket,
+		objects: make(map[string]*fakeObject),
+	}
+
+	return f, httptest.NewServer(f)
+}
+
+type fakeError struct {
+	XMLName    xml.Name `xml:"Error"`
+	Code       string   `xml:"Code"`
+	Message    string   `xml:"Message"`
+	Key        string   `xml:"Key,omitempty"`
+	BucketName string   `xml:"BucketName"`
+	RequestID  string   `xml:"RequestId"`
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, r *http.Request, status int, code, key string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+
+	if r.Method != "HEAD" {
+		xml.NewEncoder(w).Encode(fakeError{
+			Code:       code,
+			Message:    code,
+			Key:        key,
+			BucketName: f.bucket,
+			RequestID:  "fake",
+		})
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+
+	bucket, key := path, ""
+	if idx := strings.Index(path, "/"); idx >= 0 {
+		bucket, key = path[:idx], path[idx+1:]
+	}
+
+	if bucket != f.bucket {
+		f.error(w, r, http.StatusNotFound, "NoSuchBucket", "")
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == "GET" && query["location"] != nil:
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+
+	case key == "" && r.Method == "GET":
+		f.list(w, r)
+
+	case key == "" && r.Method == "POST" && query["delete"] != nil:
+		f.deleteMultiple(w, r)
+
+	case key != "" && (r.Method == "GET" || r.Method == "HEAD"):
+		obj, ok := f.objects[key]
+		if !ok {
+			f.error(w, r, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("Last-Modified", obj.modified.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+
+		if r.Method == "GET" {
+			w.Write(obj.data)
+		}
+
+	case key != "" && r.Method == "PUT":
+		data, err := readPayload(r)
+		if err != nil {
+			f.error(w, r, http.StatusBadRequest, "IncompleteBody", key)
+			return
+		}
+
+		obj, ok := f.objects[key]
+
+		if match := r.Header.Get("If-Match"); match != "" && (!ok || match != obj.etag) {
+			f.error(w, r, http.StatusPreconditionFailed, "PreconditionFailed", key)
+			return
+		}
+
+		if r.Header.Get("If-None-Match") == "*" && ok {
+			f.error(w, r, http.StatusPreconditionFailed, "PreconditionFailed", key)
+			return
+		}
+
+		sum := md5.Sum(data)
+		obj = &fakeObject{
+			data:     data,
+			etag:     `"` + hex.EncodeToString(sum[:]) + `"`,
+			modified: time.Now().UTC(),
+		}
+		f.objects[key] = obj
+
+		w.Header().Set("ETag", obj.etag)
+		w.WriteHeader(http.StatusOK)
+
+	case key != "" && r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		f.error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", key)
+	}
+}
+
+// readPayload reads the request body and decodes aws-chunked payloads used
+// for streaming signatures
+func readPayload(r *http.Request) ([]byte, error) {
+	sha := r.Header.Get("X-Amz-Content-Sha256")
+	if !strings.HasPrefix(sha, "STREAMING-") && !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return ioutil.ReadAll(r.Body)
+	}
+
+	var data []byte
+	reader := bufio.NewReader(r.Body)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		if size == 0 {
+			// ignore trailing headers
+			return data, nil
+		}
+
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+
+		data = append(data, chunk...)
+
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+type fakeContent struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type fakePrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type fakeListResult struct {
+	XMLName               xml.Name      `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string        `xml:"Name"`
+	Prefix                string        `xml:"Prefix"`
+	Delimiter             string        `xml:"Delimiter,omitempty"`
+	MaxKeys               int           `xml:"MaxKeys"`
+	KeyCount              int           `xml:"KeyCount"`
+	IsTruncated           bool          `xml:"IsTruncated"`
+	ContinuationToken     string        `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string        `xml:"NextContinuationToken,omitempty"`
+	Contents              []fakeContent `xml:"Contents"`
+	CommonPrefixes        []fakePrefix  `xml:"CommonPrefixes"`
+}
+
+// list implements ListObjectsV2 including pagination. The lock must be held
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	delim := query.Get("delimiter")
+
+	maxKeys := 1000
+	if v, err := strconv.Atoi(query.Get("max-keys")); err == nil && v > 0 && v < maxKeys {
+		maxKeys = v
+	}
+
+	after := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		after = token
+	}
+
+	f.lists++
+
+	// collect all entries, grouping keys by delimiter
+	var entries []string
+	prefixes := make(map[string]bool)
+
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if delim != "" {
+			if idx := strings.Index(key[len(prefix):], delim); idx >= 0 {
+				p := key[:len(prefix)+idx+len(delim)]
+				if !prefixes[p] {
+					prefixes[p] = true
+					entries = append(entries, p)
+				}
+				continue
+			}
+		}
+
+		entries = append(entries, key)
+	}
+
+	sort.Strings(entries)
+
+	res := fakeListResult{
+		Name:              f.bucket,
+		Prefix:            prefix,
+		Delimiter:         delim,
+		MaxKeys:           maxKeys,
+		ContinuationToken: query.Get("continuation-token"),
+	}
+
+	for _, entry := range entries {
+		if entry <= after {
+			continue
+		}
+
+		if res.KeyCount == maxKeys {
+			res.IsTruncated = true
+			break
+		}
+
+		if prefixes[entry] {
+			res.CommonPrefixes = append(res.CommonPrefixes, fakePrefix{Prefix: entry})
+		} else {
+			obj := f.objects[entry]
+			res.Contents = append(res.Contents, fakeContent{
+				Key:          entry,
+				LastModified: obj.modified.Format(time.RFC3339),
+				ETag:         obj.etag,
+				Size:         len(obj.data),
+				StorageClass: "STANDARD",
+			})
+		}
+
+		res.KeyCount++
+		res.NextContinuationToken = entry
+	}
+
+	if !res.IsTruncated {
+		res.NextContinuationToken = ""
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+type fakeDeleteRequest struct {
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type fakeDeleteResult struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+	Deleted []struct {
+		Key string `xml:"Key"`
+	} `xml:"Deleted"`
+}
+
+// deleteMultiple implements DeleteObjects. The lock must be held
+func (f *fakeS3) deleteMultiple(w http.ResponseWriter, r *http.Request) {
+	var req fakeDeleteRequest
+
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.error(w, r, http.StatusBadRequest, "MalformedXML", "")
+		return
+	}
+
+	var res fakeDeleteResult
+
+	for _, obj := range req.Objects {
+		delete(f.objects, obj.Key)
+		res.Deleted = append(res.Deleted, struct {
+			Key string `xml:"Key"`
+		}{obj.Key})
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,477 @@
+// Package s3 implements a gokv provider for Amazon S3 and S3-compatible
+// object storages. Keys are mapped to objects while directories are derived
+// from delimiter-based listings.
+package s3
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/nethack42/gokv"
+	"github.com/nethack42/gokv/internal/nodetree"
+	"golang.org/x/net/context"
+)
+
+// delimiter separates directories within object keys
+const delimiter = "/"
+
+// maxConcurrentReads limits the number of objects downloaded in parallel when
+// reading directories
+const maxConcurrentReads = 16
+
+type KV struct {
+	cli    *minio.Client
+	bucket string
+	prefix string
+
+	// pageSize limits the number of keys returned by a single list request
+	pageSize int
+}
+
+func sanatizePath(key string) string {
+	return strings.Trim(key, "/")
+}
+
+// object returns the object key for key
+func (s *KV) object(key string) string {
+	return s.prefix + key
+}
+
+// dirPrefix returns the object key prefix of all keys below key
+func (s *KV) dirPrefix(key string) string {
+	if key == "" {
+		return s.prefix
+	}
+
+	return s.prefix + key + delimiter
+}
+
+func isNotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+func isPreconditionFailed(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.StatusCode == http.StatusPreconditionFailed || resp.Code == "PreconditionFailed"
+}
+
+// read returns the content and ETag of the object stored for key. It returns
+// a nil value if the object does not exist
+func (s *KV) read(ctx context.Context, key string) ([]byte, *minio.ObjectInfo, error) {
+	obj, err := s.cli.GetObject(ctx, s.bucket, s.object(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer obj.Close()
+
+	info, err := obj.Stat()
+	if isNotFound(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	value, err := ioutil.ReadAll(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return value, &info, nil
+}
+
+// exists checks if an object is stored for key
+func (s *KV) exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.cli.StatObject(ctx, s.bucket, s.object(key), minio.StatObjectOptions{})
+	if isNotFound(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// list returns all objects below key. If recursive is false, directories are
+// returned as common prefixes with a trailing delimiter
+func (s *KV) list(ctx context.Context, key string, recursive bool) ([]minio.ObjectInfo, error) {
+	var objects []minio.ObjectInfo
+
+	// the listing is paginated transparently by the client
+	for obj := range s.cli.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.dirPrefix(key),
+		Recursive: recursive,
+		MaxKeys:   s.pageSize,
+	}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+
+		objects = append(objects, obj)
+	}
+
+	return objects, nil
+}
+
+// isDir checks if there is at least one object below key
+func (s *KV) isDir(ctx context.Context, key string) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for obj := range s.cli.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:  s.dirPrefix(key),
+		MaxKeys: 1,
+	}) {
+		if obj.Err != nil {
+			return false, obj.Err
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (s *KV) get(ctx context.Context, key string, recursive bool) (*kv.Node, error) {
+	key = sanatizePath(key)
+
+	if key != "" {
+		value, info, err := s.read(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if info != nil {
+			node := &kv.Node{
+				Key:     key,
+				Updated: &info.LastModified,
+			}
+
+			if len(value) > 0 {
+				node.Value = value
+			}
+
+			return node, nil
+		}
+	}
+
+	objects, err := s.list(ctx, key, recursive)
+	if err != nil {
+		return nil, err
+	}
+
+	if key != "" && len(objects) == 0 {
+		return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	}
+
+	root := nodetree.New(key)
+
+	prefix := s.dirPrefix(key)
+
+	var files []file
+
+	for _, obj := range objects {
+		rel := strings.TrimPrefix(obj.Key, prefix)
+
+		// keys with a trailing delimiter are common prefixes or folder
+		// markers created by other clients (e.g. web consoles)
+		folder := strings.HasSuffix(rel, delimiter)
+
+		rel = strings.Trim(rel, delimiter)
+		if rel == "" {
+			continue
+		}
+
+		parts := strings.Split(rel, delimiter)
+		cur := root
+
+		for i, part := range parts {
+			last := i == len(parts)-1
+			cur = cur.Child(part, !last || folder)
+		}
+
+		if !folder {
+			files = append(files, file{cur, strings.TrimPrefix(obj.Key, s.prefix)})
+		}
+	}
+
+	if err := s.readFiles(ctx, files); err != nil {
+		return nil, err
+	}
+
+	node := root.Convert(-1)
+	return &node, nil
+}
+
+// file is an object whose content is loaded into a tree node
+type file struct {
+	tree *nodetree.Tree
+	key  string
+}
+
+// readFiles downloads the values of files with up to maxConcurrentReads
+// parallel requests and stops at the first error
+func (s *KV) readFiles(ctx context.Context, files []file) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+
+	sem := make(chan struct{}, maxConcurrentReads)
+
+	for _, f := range files {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(f file) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			value, info, err := s.read(ctx, f.key)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+
+			if info == nil {
+				// deleted concurrently
+				return
+			}
+
+			f.tree.Node.Updated = &info.LastModified
+
+			if len(value) > 0 {
+				f.tree.Node.Value = value
+			}
+		}(f)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	return ctx.Err()
+}
+
+func (s *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
+	return s.get(ctx, key, false)
+}
+
+func (s *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	return s.get(ctx, key, true)
+}
+
+// checkHierarchy ensures that none of the parents of key is an object and key
+// itself is not a directory
+func (s *KV) checkHierarchy(ctx context.Context, key string) error {
+	if key == "" {
+		return fmt.Errorf("cannot set root directory")
+	}
+
+	parts := strings.Split(key, "/")
+
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], "/")
+
+		ok, err := s.exists(ctx, parent)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			return fmt.Errorf("cannot create %q: %q is not a directory", key, parent)
+		}
+	}
+
+	if dir, err := s.isDir(ctx, key); err != nil {
+		return err
+	} else if dir {
+		return fmt.Errorf("cannot set %q: is a directory", key)
+	}
+
+	return nil
+}
+
+func (s *KV) put(ctx context.Context, key string, value []byte, opts minio.PutObjectOptions) error {
+	if opts.ContentType == "" {
+		opts.ContentType = "application/octet-stream"
+	}
+
+	_, err := s.cli.PutObject(ctx, s.bucket, s.object(key), bytes.NewReader(value), int64(len(value)), opts)
+	return err
+}
+
+func (s *KV) Set(ctx context.Context, key string, value []byte) error {
+	key = sanatizePath(key)
+
+	if err := s.checkHierarchy(ctx, key); err != nil {
+		return err
+	}
+
+	return s.put(ctx, key, value, minio.PutObjectOptions{})
+}
+
+// CAS sets key to value if its current value matches compare. If compare is
+// nil the key must not exist. The check-and-set is performed using
+// conditional writes based on the object ETag (If-Match / If-None-Match)
+func (s *KV) CAS(ctx context.Context, key string, compare, value []byte) error {
+	key = sanatizePath(key)
+
+	if err := s.checkHierarchy(ctx, key); err != nil {
+		return err
+	}
+
+	opts := minio.PutObjectOptions{}
+
+	if compare == nil {
+		opts.SetMatchETagExcept("*")
+	} else {
+		current, info, err := s.read(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		if info == nil || !bytes.Equal(current, compare) {
+			return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+		}
+
+		opts.SetMatchETag(info.ETag)
+	}
+
+	err := s.put(ctx, key, value, opts)
+	if isPreconditionFailed(err) {
+		return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+	}
+
+	return err
+}
+
+// Delete deletes the object stored for key. If key is a directory, all
+// objects below it are deleted
+func (s *KV) Delete(ctx context.Context, key string) error {
+	key = sanatizePath(key)
+	if key == "" {
+		return fmt.Errorf("cannot delete root directory")
+	}
+
+	ok, err := s.exists(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		return s.cli.RemoveObject(ctx, s.bucket, s.object(key), minio.RemoveObjectOptions{})
+	}
+
+	objects, err := s.list(ctx, key, true)
+	if err != nil {
+		return err
+	}
+
+	if len(objects) == 0 {
+		return fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	}
+
+	ch := make(chan minio.ObjectInfo, len(objects))
+	for _, obj := range objects {
+		ch <- obj
+	}
+	close(ch)
+
+	for res := range s.cli.RemoveObjects(ctx, s.bucket, ch, minio.RemoveObjectsOptions{}) {
+		if res.Err != nil {
+			return res.Err
+		}
+	}
+
+	return nil
+}
+
+func New(params map[string]string) (kv.Provider, error) {
+	endpoint, err := url.Parse(params["endpoint"])
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q: missing scheme or host", params["endpoint"])
+	}
+
+	creds := credentials.NewStaticV4(params["access-key"], params["secret-key"], params["session-token"])
+	if params["access-key"] == "" {
+		creds = credentials.NewEnvAWS()
+	}
+
+	lookup := minio.BucketLookupAuto
+
+	switch params["bucket-lookup"] {
+	case "", "auto":
+	case "path":
+		lookup = minio.BucketLookupPath
+	case "dns":
+		lookup = minio.BucketLookupDNS
+	default:
+		return nil, fmt.Errorf("invalid bucket-lookup %q", params["bucket-lookup"])
+	}
+
+	pageSize := 0
+	if v := params["page-size"]; v != "" {
+		if pageSize, err = strconv.Atoi(v); err != nil || pageSize < 1 || pageSize > 1000 {
+			return nil, fmt.Errorf("invalid page-size %q", v)
+		}
+	}
+
+	cli, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:        creds,
+		Secure:       endpoint.Scheme == "https",
+		Region:       params["region"],
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Trim(params["prefix"], "/")
+	if prefix != "" {
+		prefix += delimiter
+	}
+
+	return &KV{
+		cli:      cli,
+		bucket:   params["bucket"],
+		prefix:   prefix,
+		pageSize: pageSize,
+	}, nil
+}
+
+func init() {
+	optional := []string{"access-key", "secret-key", "session-token", "region", "prefix", "bucket-lookup", "page-size"}
+
+	if err := kv.Register("s3", New, []string{"endpoint", "bucket"}, optional); err != nil {
+		panic("failed to register s3 KV driver")
+	}
+}
@@ -0,0 +1,147 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+func newTestKV(t *testing.T, params map[string]string) (*KV, *fakeS3, func()) {
+	f, srv := newFakeS3("gokv")
+
+	p := map[string]string{
+		"endpoint":   srv.URL,
+		"bucket":     "gokv",
+		"access-key": "access",
+		"secret-key": "secret",
+		"region":     "us-east-1",
+	}
+
+	for k, v := range params {
+		p[k] = v
+	}
+
+	s, err := New(p)
+	if err != nil {
+		srv.Close()
+		t.Errorf("failed to create s3 KV: %s", err)
+		t.FailNow()
+	}
+
+	return s.(*KV), f, srv.Close
+}
+
+func Test_S3(t *testing.T) {
+	s, _, stop := newTestKV(t, nil)
+	defer stop()
+
+	kv.KVTester(t, s)
+}
+
+func Test_S3RGet(t *testing.T) {
+	s, f, stop := newTestKV(t, map[string]string{
+		"prefix":    "configs",
+		"page-size": "2",
+	})
+	defer stop()
+
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		s.Set(ctx, fmt.Sprintf("/app/nodes/%d", i), []byte("node"))
+	}
+
+	s.Set(ctx, "/app/config/db", []byte("postgres"))
+
+	// folder markers are created by other clients
+	s.put(ctx, "app/empty/", nil, minio.PutObjectOptions{})
+
+	if _, ok := f.objects["configs/app/config/db"]; !ok {
+		t.Errorf("Set() did not honour the prefix")
+	}
+
+	f.lists = 0
+
+	node, err := s.RGet(ctx, "/app")
+	if err != nil {
+		t.Errorf("RGet() returned error: %s", err)
+		t.FailNow()
+	}
+
+	// 7 objects with a page size of 2 require 4 list requests
+	if f.lists != 4 {
+		t.Errorf("RGet() did not paginate the listing: %d requests", f.lists)
+	}
+
+	if !node.IsDir || len(node.Children) != 3 {
+		t.Errorf("RGet() returned invalid node: %v", node)
+		t.FailNow()
+	}
+
+	if c := node.Children[0]; c.Key != "app/config" || !c.IsDir || len(c.Children) != 1 || string(c.Children[0].Value) != "postgres" {
+		t.Errorf("RGet() returned invalid child: %v", c)
+	}
+
+	if c := node.Children[1]; c.Key != "app/empty" || !c.IsDir || len(c.Children) != 0 {
+		t.Errorf("RGet() returned invalid child: %v", c)
+	}
+
+	if c := node.Children[2]; c.Key != "app/nodes" || len(c.Children) != 5 {
+		t.Errorf("RGet() returned invalid child: %v", c)
+	}
+
+	if node, err := s.Get(ctx, "/app"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	} else if len(node.Children) != 3 || len(node.Children[0].Children) != 0 || !node.Children[2].IsDir {
+		t.Errorf("Get() returned invalid node: %v", node)
+	}
+
+	if err := s.Set(ctx, "/app/config/db/host", []byte("x")); err == nil {
+		t.Errorf("Set() below a value should fail")
+	}
+
+	if err := s.Set(ctx, "/app/config", []byte("x")); err == nil {
+		t.Errorf("Set() of a directory should fail")
+	}
+
+	if err := s.Delete(ctx, "/app/nodes"); err != nil {
+		t.Errorf("Delete() returned error: %s", err)
+	}
+
+	if _, err := s.Get(ctx, "/app/nodes"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Delete() did not delete all objects below /app/nodes: %v", err)
+	}
+}
+
+func Test_S3CAS(t *testing.T) {
+	s, _, stop := newTestKV(t, nil)
+	defer stop()
+
+	ctx := context.Background()
+
+	// writes conditioned on an outdated ETag must fail
+	opts := minio.PutObjectOptions{}
+	opts.SetMatchETag(`"outdated"`)
+
+	if err := s.put(ctx, "cas", []byte("4"), opts); !isPreconditionFailed(err) {
+		t.Errorf("put() with outdated ETag should fail: %v", err)
+	}
+}
+
+func Test_S3InvalidOptions(t *testing.T) {
+	invalid := []map[string]string{
+		{"endpoint": "localhost:9000", "bucket": "gokv"},
+		{"endpoint": "http://localhost:9000", "bucket": "gokv", "bucket-lookup": "virtual"},
+		{"endpoint": "http://localhost:9000", "bucket": "gokv", "page-size": "0"},
+	}
+
+	for _, params := range invalid {
+		if _, err := New(params); err == nil {
+			t.Errorf("New() should fail for %v", params)
+		}
+	}
+}
@@ -0,0 +1,545 @@
+// Package sql implements a gokv provider on top of database/sql. Nodes are
+// stored as rows of a single table holding the path, the parent path, the
+// value and the revision of each node. Directories are stored as rows with a
+// NULL value.
+package sql
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultDriver = "sqlite"
+	defaultTable  = "gokv"
+)
+
+// tableName restricts table names as they are used within SQL statements
+var tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type KV struct {
+	db    *sql.DB
+	table string
+
+	// numbered is set for drivers using numbered placeholders ($1, $2, ...)
+	numbered bool
+}
+
+// migration describes a single schema change. Migrations are applied in order
+// and recorded within the <table>_migrations table
+type migration func(table, blob string) []string
+
+var migrations = []migration{
+	// 1: node table
+	func(table, blob string) []string {
+		return []string{
+			`CREATE TABLE ` + table + ` (
+				path VARCHAR(1024) NOT NULL PRIMARY KEY,
+				parent VARCHAR(1024) NOT NULL,
+				value ` + blob + `,
+				revision BIGINT NOT NULL
+			)`,
+			`CREATE INDEX ` + table + `_parent ON ` + table + ` (parent)`,
+		}
+	},
+
+	// 2: global revision counter and timestamps
+	func(table, blob string) []string {
+		return []string{
+			`CREATE TABLE ` + table + `_revision (revision BIGINT NOT NULL)`,
+			`INSERT INTO ` + table + `_revision (revision) SELECT COALESCE(MAX(revision), 0) FROM ` + table,
+			`ALTER TABLE ` + table + ` ADD COLUMN created BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE ` + table + ` ADD COLUMN updated BIGINT NOT NULL DEFAULT 0`,
+		}
+	},
+}
+
+func sanatizePath(key string) string {
+	return strings.Trim(key, "/")
+}
+
+func parentOf(key string) string {
+	if idx := strings.LastIndex(key, "/"); idx >= 0 {
+		return key[:idx]
+	}
+
+	return ""
+}
+
+// query is implemented by *sql.DB and *sql.Tx
+type query interface {
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+}
+
+// rebind replaces ? placeholders for drivers using numbered placeholders
+func (s *KV) rebind(q string) string {
+	if !s.numbered {
+		return q
+	}
+
+	var buf strings.Builder
+	n := 0
+
+	for _, c := range q {
+		if c == '?' {
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+
+		buf.WriteRune(c)
+	}
+
+	return buf.String()
+}
+
+// migrate applies all pending migrations
+func (s *KV) migrate(ctx context.Context, blob string) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+s.table+`_migrations (version INTEGER NOT NULL PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	var version int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM `+s.table+`_migrations`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		for _, stmt := range migrations[i](s.table, blob) {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d failed: %s", i+1, err)
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO `+s.table+`_migrations (version) VALUES (?)`), i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// row represents a single node within the table
+type row struct {
+	path     string
+	parent   string
+	value    []byte
+	revision uint64
+	created  int64
+	updated  int64
+}
+
+func (r *row) isDir() bool {
+	return r.value == nil
+}
+
+func (r *row) node() kv.Node {
+	node := kv.Node{
+		Key:      r.path,
+		IsDir:    r.isDir(),
+		Revision: r.revision,
+	}
+
+	if len(r.value) > 0 {
+		node.Value = r.value
+	}
+
+	if r.created != 0 {
+		created := time.Unix(0, r.created)
+		node.Created = &created
+	}
+
+	if r.updated != 0 {
+		updated := time.Unix(0, r.updated)
+		node.Updated = &updated
+	}
+
+	return node
+}
+
+const columns = `path, parent, value, revision, created, updated`
+
+func (s *KV) rows(ctx context.Context, q query, where string, args ...interface{}) ([]*row, error) {
+	res, err := q.QueryContext(ctx, s.rebind(`SELECT `+columns+` FROM `+s.table+` WHERE `+where+` ORDER BY path`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var rows []*row
+
+	for res.Next() {
+		r := &row{}
+		if err := res.Scan(&r.path, &r.parent, &r.value, &r.revision, &r.created, &r.updated); err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, r)
+	}
+
+	return rows, res.Err()
+}
+
+// lookup returns the row stored for key or nil if it does not exist
+func (s *KV) lookup(ctx context.Context, q query, key string) (*row, error) {
+	rows, err := s.rows(ctx, q, `path = ?`, key)
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+
+	return rows[0], nil
+}
+
+// descendants returns the condition and arguments matching all rows below key
+func descendants(key string) (string, []interface{}) {
+	if key == "" {
+		return `path <> ''`, nil
+	}
+
+	// LIKE is avoided as it is case-insensitive for some databases and
+	// requires escaping. SUBSTR counts characters instead of bytes, so a
+	// range is used instead: '0' is the byte following '/'
+	return `path > ? AND path < ?`, []interface{}{key + "/", key + "0"}
+}
+
+func (s *KV) get(ctx context.Context, key string, recursive bool) (*kv.Node, error) {
+	key = sanatizePath(key)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	r := &row{}
+
+	if key != "" {
+		if r, err = s.lookup(ctx, tx, key); err != nil {
+			return nil, err
+		} else if r == nil {
+			return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+		}
+	}
+
+	node := r.node()
+	if !node.IsDir {
+		return &node, nil
+	}
+
+	var rows []*row
+
+	if recursive {
+		where, args := descendants(key)
+		rows, err = s.rows(ctx, tx, where, args...)
+	} else {
+		rows, err = s.rows(ctx, tx, `parent = ? AND path <> ''`, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// link all rows to their parents. Rows are ordered by path so children
+	// are sorted as well
+	children := make(map[string][]*row)
+	for _, c := range rows {
+		children[c.parent] = append(children[c.parent], c)
+	}
+
+	var build func(r *row) kv.Node
+	build = func(r *row) kv.Node {
+		n := r.node()
+
+		for _, c := range children[r.path] {
+			n.Children = append(n.Children, build(c))
+		}
+
+		return n
+	}
+
+	node = build(r)
+
+	return &node, nil
+}
+
+func (s *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
+	return s.get(ctx, key, false)
+}
+
+func (s *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	return s.get(ctx, key, true)
+}
+
+// nextRevision increments and returns the global revision counter
+func (s *KV) nextRevision(ctx context.Context, tx *sql.Tx) (uint64, error) {
+	if _, err := tx.ExecContext(ctx, `UPDATE `+s.table+`_revision SET revision = revision + 1`); err != nil {
+		return 0, err
+	}
+
+	var rev uint64
+	err := tx.QueryRowContext(ctx, `SELECT revision FROM `+s.table+`_revision`).Scan(&rev)
+
+	return rev, err
+}
+
+// set stores value at key with revision rev creating all parent directories
+func (s *KV) set(ctx context.Context, tx *sql.Tx, key string, value []byte, rev uint64) error {
+	if key == "" {
+		return fmt.Errorf("cannot set root directory")
+	}
+
+	now := time.Now().UnixNano()
+
+	// a nil value marks directories
+	if value == nil {
+		value = []byte{}
+	}
+
+	parts := strings.Split(key, "/")
+
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], "/")
+
+		r, err := s.lookup(ctx, tx, parent)
+		if err != nil {
+			return err
+		}
+
+		if r == nil {
+			_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO `+s.table+` (`+columns+`) VALUES (?, ?, NULL, ?, ?, ?)`),
+				parent, parentOf(parent), rev, now, now)
+			if err != nil {
+				return err
+			}
+		} else if !r.isDir() {
+			return fmt.Errorf("cannot create %q: %q is not a directory", key, parent)
+		}
+	}
+
+	r, err := s.lookup(ctx, tx, key)
+	switch {
+	case err != nil:
+		return err
+
+	case r == nil:
+		_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO `+s.table+` (`+columns+`) VALUES (?, ?, ?, ?, ?, ?)`),
+			key, parentOf(key), value, rev, now, now)
+
+	case r.isDir():
+		return fmt.Errorf("cannot set %q: is a directory", key)
+
+	default:
+		_, err = tx.ExecContext(ctx, s.rebind(`UPDATE `+s.table+` SET value = ?, revision = ?, updated = ? WHERE path = ?`),
+			value, rev, now, key)
+	}
+
+	return err
+}
+
+// remove deletes key and all nodes below it. It returns false if key does not
+// exist
+func (s *KV) remove(ctx context.Context, tx *sql.Tx, key string) (bool, error) {
+	if key == "" {
+		return false, fmt.Errorf("cannot delete root directory")
+	}
+
+	where, args := descendants(key)
+
+	res, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM `+s.table+` WHERE path = ? OR `+where), append([]interface{}{key}, args...)...)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// compare checks if the current value of key matches value. A nil value
+// requires the key to not exist
+func (s *KV) compare(ctx context.Context, tx *sql.Tx, key string, value []byte) error {
+	r, err := s.lookup(ctx, tx, key)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case r == nil:
+		if value == nil {
+			return nil
+		}
+	case value != nil && !r.isDir() && bytes.Equal(r.value, value):
+		return nil
+	}
+
+	return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+}
+
+// update runs fn within a transaction and commits it if fn succeeds. The
+// revision counter is incremented first: its row lock serializes all
+// modifications, so reads within fn cannot be changed by concurrent writers
+// before the transaction commits
+func (s *KV) update(ctx context.Context, fn func(tx *sql.Tx, rev uint64) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	rev, err := s.nextRevision(ctx, tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := fn(tx, rev); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *KV) Set(ctx context.Context, key string, value []byte) error {
+	key = sanatizePath(key)
+
+	return s.update(ctx, func(tx *sql.Tx, rev uint64) error {
+		return s.set(ctx, tx, key, value, rev)
+	})
+}
+
+func (s *KV) Delete(ctx context.Context, key string) error {
+	key = sanatizePath(key)
+
+	return s.update(ctx, func(tx *sql.Tx, rev uint64) error {
+		ok, err := s.remove(ctx, tx, key)
+		if err == nil && !ok {
+			err = fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+		}
+
+		return err
+	})
+}
+
+// CAS sets key to value if its current value matches compare. If compare is
+// nil the key must not exist. The comparison and update are executed within a
+// single SQL transaction
+func (s *KV) CAS(ctx context.Context, key string, compare, value []byte) error {
+	key = sanatizePath(key)
+
+	return s.update(ctx, func(tx *sql.Tx, rev uint64) error {
+		if err := s.compare(ctx, tx, key, compare); err != nil {
+			return err
+		}
+
+		return s.set(ctx, tx, key, value, rev)
+	})
+}
+
+// Txn executes all operations within a single SQL transaction. All compare
+// operations are evaluated before any change is applied
+func (s *KV) Txn(ctx context.Context, ops []kv.Op) error {
+	return s.update(ctx, func(tx *sql.Tx, rev uint64) error {
+		for _, op := range ops {
+			if op.Type == kv.OpCompare {
+				if err := s.compare(ctx, tx, sanatizePath(op.Key), op.Value); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, op := range ops {
+			key := sanatizePath(op.Key)
+
+			switch op.Type {
+			case kv.OpSet:
+				if err := s.set(ctx, tx, key, op.Value, rev); err != nil {
+					return err
+				}
+			case kv.OpDelete:
+				if _, err := s.remove(ctx, tx, key); err != nil {
+					return err
+				}
+			case kv.OpCompare:
+			default:
+				return fmt.Errorf("unsupported operation %q", op.Type)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Close closes the underlying database
+func (s *KV) Close() error {
+	return s.db.Close()
+}
+
+func New(params map[string]string) (kv.Provider, error) {
+	driver := params["driver"]
+	if driver == "" {
+		driver = defaultDriver
+	}
+
+	table := params["table"]
+	if table == "" {
+		table = defaultTable
+	}
+
+	if !tableName.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+
+	db, err := sql.Open(driver, params["dsn"])
+	if err != nil {
+		return nil, err
+	}
+
+	s := &KV{
+		db:    db,
+		table: table,
+	}
+
+	blob := "BLOB"
+
+	switch driver {
+	case "postgres", "pgx":
+		s.numbered = true
+		blob = "BYTEA"
+	case "sqlite", "sqlite3":
+		// SQLite only supports a single writer. Using a single connection
+		// avoids SQLITE_BUSY errors and allows in-memory databases
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := s.migrate(context.Background(), blob); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func init() {
+	if err := kv.Register("sql", New, []string{"dsn"}, []string{"driver", "table"}); err != nil {
+		panic("failed to register sql KV driver")
+	}
+}
@@ -0,0 +1,253 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+func newTestKV(t *testing.T) (*KV, string, func()) {
+	dir, err := ioutil.TempDir("", "gokv-sql")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+
+	dsn := filepath.Join(dir, "gokv.db")
+
+	k, err := New(map[string]string{
+		"dsn": dsn,
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to create sql KV: %s", err)
+	}
+
+	s := k.(*KV)
+
+	return s, dsn, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_SQL(t *testing.T) {
+	s, _, cleanup := newTestKV(t)
+	defer cleanup()
+
+	kv.KVTester(t, s)
+}
+
+func Test_SQLRGet(t *testing.T) {
+	s, _, cleanup := newTestKV(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	s.Set(ctx, "/app/config/db", []byte("postgres"))
+	s.Set(ctx, "/app/config/pool", []byte("10"))
+	s.Set(ctx, "/app/users/paz", []byte("1"))
+	s.Set(ctx, "/app-other", []byte("x"))
+	s.Set(ctx, "/App/config", []byte("x"))
+
+	node, err := s.RGet(ctx, "/app")
+	if err != nil {
+		t.Fatalf("RGet() returned error: %s", err)
+	}
+
+	if !node.IsDir || len(node.Children) != 2 {
+		t.Fatalf("RGet() returned invalid node: %v", node)
+	}
+
+	if c := node.Children[0]; c.Key != "app/config" || !c.IsDir || len(c.Children) != 2 || string(c.Children[0].Value) != "postgres" {
+		t.Errorf("RGet() returned invalid child: %v", c)
+	}
+
+	if c := node.Children[1]; c.Key != "app/users" || len(c.Children) != 1 || c.Children[0].Key != "app/users/paz" {
+		t.Errorf("RGet() returned invalid child: %v", c)
+	}
+
+	if node, err := s.Get(ctx, "/app"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	} else if len(node.Children) != 2 || len(node.Children[0].Children) != 0 {
+		t.Errorf("Get() should not return grandchildren: %v", node)
+	}
+
+	if node, err := s.RGet(ctx, "/"); err != nil {
+		t.Errorf("RGet() of root returned error: %s", err)
+	} else if len(node.Children) != 3 {
+		t.Errorf("RGet() of root returned invalid node: %v", node)
+	}
+
+	if err := s.Set(ctx, "/app/config/db/host", []byte("x")); err == nil {
+		t.Errorf("Set() below a value should fail")
+	}
+
+	if err := s.Set(ctx, "/app/config", []byte("x")); err == nil {
+		t.Errorf("Set() of a directory should fail")
+	}
+
+	if err := s.Delete(ctx, "/app"); err != nil {
+		t.Errorf("Delete() returned error: %s", err)
+	}
+
+	if _, err := s.Get(ctx, "/app/config/db"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Delete() did not delete all nodes below /app: %v", err)
+	}
+
+	if _, err := s.Get(ctx, "/app-other"); err != nil {
+		t.Errorf("Delete() deleted sibling: %v", err)
+	}
+}
+
+func Test_SQLNonASCII(t *testing.T) {
+	s, _, cleanup := newTestKV(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	s.Set(ctx, "/über/a", []byte("1"))
+	s.Set(ctx, "/über/b/c", []byte("2"))
+	s.Set(ctx, "/übera", []byte("3"))
+
+	node, err := s.RGet(ctx, "/über")
+	if err != nil {
+		t.Fatalf("RGet() returned error: %s", err)
+	}
+
+	if len(node.Children) != 2 || node.Children[0].Key != "über/a" || len(node.Children[1].Children) != 1 {
+		t.Errorf("RGet() returned invalid node: %v", node)
+	}
+
+	if err := s.Delete(ctx, "/über"); err != nil {
+		t.Errorf("Delete() returned error: %s", err)
+	}
+
+	if node, err := s.RGet(ctx, "/"); err != nil {
+		t.Errorf("RGet() of root returned error: %s", err)
+	} else if len(node.Children) != 1 || node.Children[0].Key != "übera" {
+		t.Errorf("Delete() left nodes below /über: %v", node)
+	}
+}
+
+func Test_SQLTxn(t *testing.T) {
+	s, _, cleanup := newTestKV(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	s.Set(ctx, "/cas", []byte("1"))
+
+	if err := s.CAS(ctx, "/cas", []byte("1"), []byte("3")); err != nil {
+		t.Errorf("CAS() returned error: %s", err)
+	}
+
+	node, err := s.Get(ctx, "/cas")
+	if err != nil {
+		t.Fatalf("Get() returned error: %s", err)
+	} else if string(node.Value) != "3" || node.Revision != 2 || node.Created == nil || node.Updated == nil {
+		t.Errorf("Get() returned invalid node after CAS: %v", node)
+	}
+
+	err = s.Txn(ctx, []kv.Op{
+		{Type: kv.OpCompare, Key: "/cas", Value: []byte("3")},
+		{Type: kv.OpSet, Key: "/txn/a", Value: []byte("a")},
+		{Type: kv.OpDelete, Key: "/cas"},
+	})
+	if err != nil {
+		t.Errorf("Txn() returned error: %s", err)
+	}
+
+	if _, err := s.Get(ctx, "/cas"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Txn() did not delete /cas: %v", err)
+	}
+
+	err = s.Txn(ctx, []kv.Op{
+		{Type: kv.OpSet, Key: "/txn/b", Value: []byte("b")},
+		{Type: kv.OpCompare, Key: "/txn/a", Value: []byte("b")},
+	})
+	if !errors.Is(err, kv.ErrCompareFailed) {
+		t.Errorf("Txn() with failing compare should fail: %v", err)
+	}
+
+	// a failing operation rolls back the whole transaction
+	err = s.Txn(ctx, []kv.Op{
+		{Type: kv.OpSet, Key: "/txn/b", Value: []byte("b")},
+		{Type: kv.OpSet, Key: "/txn/a/c", Value: []byte("c")},
+	})
+	if err == nil {
+		t.Errorf("Txn() with failing set should fail")
+	}
+
+	if _, err := s.Get(ctx, "/txn/b"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("failed Txn() must not apply any operation: %v", err)
+	}
+}
+
+func Test_SQLMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokv-sql")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dsn := filepath.Join(dir, "gokv.db")
+
+	// create a database using the first schema version only
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+
+	stmts := append(migrations[0]("gokv", "BLOB"),
+		`CREATE TABLE gokv_migrations (version INTEGER NOT NULL PRIMARY KEY)`,
+		`INSERT INTO gokv_migrations (version) VALUES (1)`,
+		`INSERT INTO gokv (path, parent, value, revision) VALUES ('a', '', NULL, 7)`,
+		`INSERT INTO gokv (path, parent, value, revision) VALUES ('a/b', 'a', X'31', 7)`,
+	)
+
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("failed to prepare database: %s", err)
+		}
+	}
+	db.Close()
+
+	k, err := New(map[string]string{
+		"dsn": dsn,
+	})
+	if err != nil {
+		t.Fatalf("New() failed to migrate database: %s", err)
+	}
+	defer k.(*KV).Close()
+
+	ctx := context.Background()
+
+	if node, err := k.Get(ctx, "/a/b"); err != nil || string(node.Value) != "1" || node.Revision != 7 {
+		t.Errorf("Get() returned invalid node after migration: %v, %v", node, err)
+	}
+
+	// the revision counter continues after existing revisions
+	k.Set(ctx, "/a/c", []byte("2"))
+
+	if node, err := k.Get(ctx, "/a/c"); err != nil || node.Revision != 8 {
+		t.Errorf("Get() returned invalid revision after migration: %v, %v", node, err)
+	}
+
+	var version int
+	k.(*KV).db.QueryRow(`SELECT MAX(version) FROM gokv_migrations`).Scan(&version)
+
+	if version != len(migrations) {
+		t.Errorf("New() did not apply all migrations: version %d", version)
+	}
+
+	if _, err := New(map[string]string{"dsn": dsn, "table": "gokv; DROP TABLE gokv"}); err == nil {
+		t.Errorf("New() with invalid table name should fail")
+	}
+}
@@ -0,0 +1,310 @@
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fakeVersion struct {
+	data      map[string]interface{}
+	created   time.Time
+	deleted   time.Time
+	destroyed bool
+}
+
+type fakeSecret struct {
+	created  time.Time
+	versions []*fakeVersion
+}
+
+// fakeVault implements the parts of the Vault KV v2 and AppRole HTTP API used
+// by the provider. The KV v2 engine is mounted at secret/
+type fakeVault struct {
+	lock    sync.Mutex
+	secrets map[string]*fakeSecret
+
+	// tokens holds all valid client tokens
+	tokens map[string]bool
+
+	// roles maps AppRole role IDs to secret IDs
+	roles map[string]string
+}
+
+func newFakeVault() (*fakeVault, *httptest.Server) {
+	f := &fakeVault{
+		secrets: make(map[string]*fakeSecret),
+		tokens:  map[string]bool{"root": true},
+		roles:   make(map[string]string),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/approle/login", f.handleLogin)
+	mux.HandleFunc("/v1/secret/data/", f.handleData)
+	mux.HandleFunc("/v1/secret/metadata/", f.handleMetadata)
+
+	return f, httptest.NewServer(mux)
+}
+
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func replyError(w http.ResponseWriter, status int, msg ...string) {
+	if msg == nil {
+		msg = []string{}
+	}
+
+	reply(w, status, map[string]interface{}{"errors": msg})
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(time.RFC3339Nano)
+}
+
+func (v *fakeVersion) metadata(version int) map[string]interface{} {
+	return map[string]interface{}{
+		"version":       version,
+		"created_time":  formatTime(v.created),
+		"deletion_time": formatTime(v.deleted),
+		"destroyed":     v.destroyed,
+	}
+}
+
+// authorized checks the client token of r. The lock must be held
+func (f *fakeVault) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if !f.tokens[r.Header.Get("X-Vault-Token")] {
+		replyError(w, http.StatusForbidden, "permission denied")
+		return false
+	}
+
+	return true
+}
+
+func (f *fakeVault) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RoleID   string `json:"role_id"`
+		SecretID string `json:"secret_id"`
+	}
+
+	json.NewDecoder(r.Body).Decode(&req)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if secretID, ok := f.roles[req.RoleID]; !ok || secretID != req.SecretID {
+		replyError(w, http.StatusBadRequest, "invalid role or secret ID")
+		return
+	}
+
+	token := "approle-" + req.RoleID
+	f.tokens[token] = true
+
+	reply(w, http.StatusOK, map[string]interface{}{
+		"auth": map[string]interface{}{
+			"client_token": token,
+			"policies":     []string{"default"},
+		},
+	})
+}
+
+func (f *fakeVault) handleData(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if !f.authorized(w, r) {
+		return
+	}
+
+	secret := f.secrets[key]
+
+	switch r.Method {
+	case "GET":
+		if secret == nil {
+			replyError(w, http.StatusNotFound)
+			return
+		}
+
+		version := len(secret.versions)
+		if v := r.URL.Query().Get("version"); v != "" {
+			version, _ = strconv.Atoi(v)
+		}
+
+		if version < 1 || version > len(secret.versions) {
+			replyError(w, http.StatusNotFound)
+			return
+		}
+
+		v := secret.versions[version-1]
+
+		status := http.StatusOK
+		var data interface{} = v.data
+
+		if !v.deleted.IsZero() || v.destroyed {
+			status = http.StatusNotFound
+			data = nil
+		}
+
+		reply(w, status, map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     data,
+				"metadata": v.metadata(version),
+			},
+		})
+
+	case "PUT", "POST":
+		var req struct {
+			Data    map[string]interface{} `json:"data"`
+			Options map[string]interface{} `json:"options"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			replyError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		current := 0
+		if secret != nil {
+			current = len(secret.versions)
+		}
+
+		if cas, ok := req.Options["cas"].(float64); ok && int(cas) != current {
+			replyError(w, http.StatusBadRequest, "check-and-set parameter did not match the current version")
+			return
+		}
+
+		if secret == nil {
+			secret = &fakeSecret{created: time.Now()}
+			f.secrets[key] = secret
+		}
+
+		v := &fakeVersion{
+			data:    req.Data,
+			created: time.Now(),
+		}
+		secret.versions = append(secret.versions, v)
+
+		reply(w, http.StatusOK, map[string]interface{}{
+			"data": v.metadata(len(secret.versions)),
+		})
+
+	case "DELETE":
+		// soft-deletes the latest version
+		if secret != nil {
+			secret.versions[len(secret.versions)-1].deleted = time.Now()
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// list returns the entries directly below key. The lock must be held
+func (f *fakeVault) list(key string) []string {
+	prefix := ""
+	if key != "" {
+		prefix = strings.TrimSuffix(key, "/") + "/"
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+
+	for path := range f.secrets {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+
+		name := strings.TrimPrefix(path, prefix)
+		if idx := strings.Index(name, "/"); idx >= 0 {
+			name = name[:idx+1]
+		}
+
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (f *fakeVault) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/")
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if !f.authorized(w, r) {
+		return
+	}
+
+	if r.Method == "LIST" || (r.Method == "GET" && r.URL.Query().Get("list") == "true") {
+		names := f.list(key)
+		if len(names) == 0 {
+			replyError(w, http.StatusNotFound)
+			return
+		}
+
+		reply(w, http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{
+				"keys": names,
+			},
+		})
+		return
+	}
+
+	secret := f.secrets[key]
+
+	switch r.Method {
+	case "GET":
+		if secret == nil {
+			replyError(w, http.StatusNotFound)
+			return
+		}
+
+		versions := make(map[string]interface{})
+		for i, v := range secret.versions {
+			versions[strconv.Itoa(i+1)] = v.metadata(i + 1)
+		}
+
+		latest := secret.versions[len(secret.versions)-1]
+
+		reply(w, http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{
+				"cas_required":         false,
+				"created_time":         formatTime(secret.created),
+				"current_version":      len(secret.versions),
+				"delete_version_after": "0s",
+				"max_versions":         0,
+				"oldest_version":       1,
+				"updated_time":         formatTime(latest.created),
+				"custom_metadata":      nil,
+				"versions":             versions,
+			},
+		})
+
+	case "DELETE":
+		delete(f.secrets, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
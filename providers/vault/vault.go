@@ -0,0 +1,509 @@
+// Package vault implements a gokv provider for the HashiCorp Vault KV v2
+// secrets engine.
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+// defaultMount is used if no mount is configured
+const defaultMount = "secret"
+
+// defaultField is used if no field is configured
+const defaultField = "value"
+
+// defaultAppRoleMount is used if no approle-mount is configured
+const defaultAppRoleMount = "approle"
+
+type KV struct {
+	cli   *api.Client
+	kv    *api.KVv2
+	mount string
+	field string
+}
+
+func sanatizePath(key string) string {
+	return strings.Trim(key, "/")
+}
+
+func child(key, name string) string {
+	if key == "" {
+		return name
+	}
+
+	return key + "/" + name
+}
+
+// decode converts secret data to a node value. If the secret only contains
+// the configured field, its value is used. Otherwise the JSON encoding of the
+// whole secret data is returned
+func (v *KV) decode(data map[string]interface{}) []byte {
+	if s, ok := data[v.field].(string); ok && len(data) == 1 {
+		return []byte(s)
+	}
+
+	value, _ := json.Marshal(data)
+	return value
+}
+
+// read returns the latest version of key or nil if it does not exist or has
+// been deleted
+func (v *KV) read(ctx context.Context, key string) (*api.KVSecret, error) {
+	if key == "" {
+		return nil, nil
+	}
+
+	secret, err := v.kv.Get(ctx, key)
+	if errors.Is(err, api.ErrSecretNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// the latest version has been deleted but not destroyed
+	if secret.Data == nil {
+		return nil, nil
+	}
+
+	return secret, nil
+}
+
+// list returns the names of all entries below key. Directories carry a
+// trailing slash
+func (v *KV) list(ctx context.Context, key string) ([]string, error) {
+	secret, err := v.cli.Logical().ListWithContext(ctx, v.mount+"/metadata/"+key)
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+
+	raw, _ := secret.Data["keys"].([]interface{})
+
+	var names []string
+	for _, name := range raw {
+		if s, ok := name.(string); ok {
+			names = append(names, s)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (v *KV) convert(key string, secret *api.KVSecret) *kv.Node {
+	node := &kv.Node{
+		Key:   key,
+		Value: v.decode(secret.Data),
+	}
+
+	if m := secret.VersionMetadata; m != nil {
+		created := m.CreatedTime
+		node.Updated = &created
+		node.Revision = uint64(m.Version)
+	}
+
+	return node
+}
+
+// get reads key including depth levels of children (-1 means unlimited)
+func (v *KV) get(ctx context.Context, key string, depth int) (*kv.Node, error) {
+	secret, err := v.read(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if secret != nil {
+		return v.convert(key, secret), nil
+	}
+
+	names, err := v.list(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if key != "" && len(names) == 0 {
+		return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	}
+
+	node := &kv.Node{
+		Key:   key,
+		IsDir: true,
+	}
+
+	if depth == 0 {
+		return node, nil
+	}
+
+	for _, name := range names {
+		// a secret and a folder may share the same name in which case the
+		// secret takes precedence
+		if strings.HasSuffix(name, "/") && contains(names, strings.TrimSuffix(name, "/")) {
+			continue
+		}
+
+		c, err := v.get(ctx, child(key, strings.TrimSuffix(name, "/")), depth-1)
+		if errors.Is(err, kv.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		node.Children = append(node.Children, *c)
+	}
+
+	return node, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (v *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
+	return v.get(ctx, sanatizePath(key), 1)
+}
+
+func (v *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	return v.get(ctx, sanatizePath(key), -1)
+}
+
+// checkHierarchy ensures that none of the parents of key is a secret and key
+// itself is not a directory
+func (v *KV) checkHierarchy(ctx context.Context, key string) error {
+	if key == "" {
+		return fmt.Errorf("cannot set root directory")
+	}
+
+	parts := strings.Split(key, "/")
+
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], "/")
+
+		secret, err := v.read(ctx, parent)
+		if err != nil {
+			return err
+		}
+
+		if secret != nil {
+			return fmt.Errorf("cannot create %q: %q is not a directory", key, parent)
+		}
+	}
+
+	names, err := v.list(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if len(names) > 0 {
+		return fmt.Errorf("cannot set %q: is a directory", key)
+	}
+
+	return nil
+}
+
+func (v *KV) put(ctx context.Context, key string, value []byte, opts ...api.KVOption) error {
+	_, err := v.kv.Put(ctx, key, map[string]interface{}{
+		v.field: string(value),
+	}, opts...)
+
+	return err
+}
+
+func (v *KV) Set(ctx context.Context, key string, value []byte) error {
+	key = sanatizePath(key)
+
+	if err := v.checkHierarchy(ctx, key); err != nil {
+		return err
+	}
+
+	return v.put(ctx, key, value)
+}
+
+// isCASMismatch checks if err has been caused by a failed check-and-set
+func isCASMismatch(err error) bool {
+	var respErr *api.ResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+
+	for _, msg := range respErr.Errors {
+		if strings.Contains(msg, "check-and-set") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CAS sets key to value if its current value matches compare. If compare is
+// nil the key must not exist. The check-and-set is performed using the KV v2
+// cas option
+func (v *KV) CAS(ctx context.Context, key string, compare, value []byte) error {
+	key = sanatizePath(key)
+
+	if err := v.checkHierarchy(ctx, key); err != nil {
+		return err
+	}
+
+	version := 0
+
+	secret, err := v.read(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if compare == nil {
+		if secret != nil {
+			return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+		}
+
+		// deleted versions still count for check-and-set
+		if m, err := v.kv.GetMetadata(ctx, key); err == nil {
+			version = m.CurrentVersion
+		} else if !errors.Is(err, api.ErrSecretNotFound) {
+			return err
+		}
+	} else {
+		if secret == nil || !bytes.Equal(v.decode(secret.Data), compare) {
+			return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+		}
+
+		version = secret.VersionMetadata.Version
+	}
+
+	err = v.put(ctx, key, value, api.WithCheckAndSet(version))
+	if isCASMismatch(err) {
+		return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+	}
+
+	return err
+}
+
+// deleteTree permanently deletes all secrets below key
+func (v *KV) deleteTree(ctx context.Context, key string) error {
+	names, err := v.list(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			err = v.deleteTree(ctx, child(key, strings.TrimSuffix(name, "/")))
+		} else {
+			err = v.kv.DeleteMetadata(ctx, child(key, name))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete permanently deletes key including all of its versions. If key is a
+// directory, all secrets below it are deleted
+func (v *KV) Delete(ctx context.Context, key string) error {
+	key = sanatizePath(key)
+	if key == "" {
+		return fmt.Errorf("cannot delete root directory")
+	}
+
+	secret, err := v.read(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if secret != nil {
+		return v.kv.DeleteMetadata(ctx, key)
+	}
+
+	names, err := v.list(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		return fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	}
+
+	return v.deleteTree(ctx, key)
+}
+
+// Versions returns all versions of key, starting with the most recent one.
+// Version IDs are the KV v2 version numbers; soft-deleted and destroyed
+// versions are marked as deleted
+func (v *KV) Versions(ctx context.Context, key string) ([]kv.Version, error) {
+	key = sanatizePath(key)
+
+	list, err := v.kv.GetVersionsAsList(ctx, key)
+	if errors.Is(err, api.ErrSecretNotFound) {
+		return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+
+	versions := make([]kv.Version, 0, len(list))
+
+	for i := len(list) - 1; i >= 0; i-- {
+		m := list[i]
+
+		versions = append(versions, kv.Version{
+			ID:      strconv.Itoa(m.Version),
+			Created: m.CreatedTime,
+			Deleted: m.Destroyed || !m.DeletionTime.IsZero(),
+		})
+	}
+
+	return versions, nil
+}
+
+// readVersion returns the given version of key. Deleted versions are reported
+// as not found
+func (v *KV) readVersion(ctx context.Context, key, version string) (*api.KVSecret, error) {
+	n, err := strconv.Atoi(version)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid version %q", version)
+	}
+
+	secret, err := v.kv.GetVersion(ctx, key, n)
+	if errors.Is(err, api.ErrSecretNotFound) {
+		return nil, fmt.Errorf("%q version %d: %w", key, n, kv.ErrNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if secret.Data == nil {
+		return nil, fmt.Errorf("%q version %d has been deleted: %w", key, n, kv.ErrNotFound)
+	}
+
+	return secret, nil
+}
+
+// GetVersion returns the given version of key. Node.Revision holds the
+// version number
+func (v *KV) GetVersion(ctx context.Context, key, version string) (*kv.Node, error) {
+	key = sanatizePath(key)
+
+	secret, err := v.readVersion(ctx, key, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.convert(key, secret), nil
+}
+
+// RestoreVersion writes the data of the given version as new version of key.
+// Deleted versions cannot be restored
+func (v *KV) RestoreVersion(ctx context.Context, key, version string) error {
+	key = sanatizePath(key)
+
+	secret, err := v.readVersion(ctx, key, version)
+	if err != nil {
+		return err
+	}
+
+	_, err = v.kv.Put(ctx, key, secret.Data)
+	return err
+}
+
+// loginAppRole authenticates using the AppRole auth method and returns the
+// client token
+func loginAppRole(cli *api.Client, mount, roleID, secretID string) (string, error) {
+	secret, err := cli.Logical().Write("auth/"+mount+"/login", map[string]interface{}{
+		"role_id":   roleID,
+		"secret_id": secretID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return "", fmt.Errorf("approle login did not return a token")
+	}
+
+	return secret.Auth.ClientToken, nil
+}
+
+func New(params map[string]string) (kv.Provider, error) {
+	config := api.DefaultConfig()
+	if config.Error != nil {
+		return nil, config.Error
+	}
+
+	if v := params["address"]; v != "" {
+		config.Address = v
+	}
+
+	cli, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if v := params["namespace"]; v != "" {
+		cli.SetNamespace(v)
+	}
+
+	if v := params["token"]; v != "" {
+		cli.SetToken(v)
+	}
+
+	if roleID := params["role-id"]; roleID != "" {
+		mount := params["approle-mount"]
+		if mount == "" {
+			mount = defaultAppRoleMount
+		}
+
+		token, err := loginAppRole(cli, strings.Trim(mount, "/"), roleID, params["secret-id"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to login using approle: %s", err)
+		}
+
+		cli.SetToken(token)
+	}
+
+	mount := strings.Trim(params["mount"], "/")
+	if mount == "" {
+		mount = defaultMount
+	}
+
+	field := params["field"]
+	if field == "" {
+		field = defaultField
+	}
+
+	return &KV{
+		cli:   cli,
+		kv:    cli.KVv2(mount),
+		mount: mount,
+		field: field,
+	}, nil
+}
+
+func init() {
+	optional := []string{"address", "token", "role-id", "secret-id", "approle-mount", "namespace", "mount", "field"}
+
+	if err := kv.Register("vault", New, nil, optional); err != nil {
+		panic("failed to register vault KV driver")
+	}
+}
@@ -0,0 +1,263 @@
+package vault
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+func Test_Vault(t *testing.T) {
+	_, srv := newFakeVault()
+	defer srv.Close()
+
+	k, err := New(map[string]string{
+		"address": srv.URL,
+		"token":   "root",
+	})
+
+	if err != nil {
+		t.Errorf("failed to create vault KV: %s", err)
+		t.FailNow()
+	}
+
+	kv.KVTester(t, k)
+}
+
+func Test_VaultRGet(t *testing.T) {
+	_, srv := newFakeVault()
+	defer srv.Close()
+
+	k, err := New(map[string]string{
+		"address": srv.URL,
+		"token":   "root",
+	})
+
+	if err != nil {
+		t.Errorf("failed to create vault KV: %s", err)
+		t.FailNow()
+	}
+
+	ctx := context.Background()
+	v := k.(*KV)
+
+	v.Set(ctx, "/app/config/db", []byte("postgres"))
+	v.Set(ctx, "/app/users/paz", []byte("1"))
+
+	// secrets written by other clients may contain multiple fields
+	v.kv.Put(ctx, "app/tls", map[string]interface{}{
+		"cert": "c",
+		"key":  "k",
+	})
+
+	node, err := v.RGet(ctx, "/app")
+	if err != nil {
+		t.Errorf("RGet() returned error: %s", err)
+		t.FailNow()
+	}
+
+	if !node.IsDir || len(node.Children) != 3 {
+		t.Errorf("RGet() returned invalid node: %v", node)
+		t.FailNow()
+	}
+
+	if c := node.Children[0]; c.Key != "app/config" || !c.IsDir || len(c.Children) != 1 || string(c.Children[0].Value) != "postgres" {
+		t.Errorf("RGet() returned invalid child: %v", c)
+	}
+
+	if c := node.Children[1]; c.Key != "app/tls" || string(c.Value) != `{"cert":"c","key":"k"}` {
+		t.Errorf("RGet() returned invalid child: %v", c)
+	}
+
+	if node, err := v.Get(ctx, "/app"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	} else if len(node.Children[0].Children) != 0 {
+		t.Errorf("Get() should not return grandchildren: %v", node.Children[0])
+	}
+
+	if err := v.Set(ctx, "/app/config/db/host", []byte("x")); err == nil {
+		t.Errorf("Set() below a value should fail")
+	}
+
+	if err := v.Set(ctx, "/app/config", []byte("x")); err == nil {
+		t.Errorf("Set() of a directory should fail")
+	}
+
+	if err := v.Delete(ctx, "/app"); err != nil {
+		t.Errorf("Delete() returned error: %s", err)
+	}
+
+	if _, err := v.Get(ctx, "/app"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Delete() did not delete all secrets below /app: %v", err)
+	}
+}
+
+func Test_VaultCAS(t *testing.T) {
+	_, srv := newFakeVault()
+	defer srv.Close()
+
+	k, err := New(map[string]string{
+		"address": srv.URL,
+		"token":   "root",
+	})
+
+	if err != nil {
+		t.Errorf("failed to create vault KV: %s", err)
+		t.FailNow()
+	}
+
+	ctx := context.Background()
+
+	k.Set(ctx, "/cas", []byte("1"))
+
+	if err := k.CAS(ctx, "/cas", []byte("1"), []byte("3")); err != nil {
+		t.Errorf("CAS() returned error: %s", err)
+	}
+
+	if node, err := k.Get(ctx, "/cas"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	} else if node.Revision != 2 {
+		t.Errorf("Get() returned invalid node after CAS: %v", node)
+	}
+
+	// a version written in between makes the check-and-set fail
+	v := k.(*KV)
+	if err := v.put(ctx, "cas", []byte("4")); err != nil {
+		t.Errorf("put() returned error: %s", err)
+	}
+
+	if err := v.put(ctx, "cas", []byte("5"), api.WithCheckAndSet(2)); !isCASMismatch(err) {
+		t.Errorf("put() with outdated version should fail: %v", err)
+	}
+}
+
+func Test_VaultVersions(t *testing.T) {
+	_, srv := newFakeVault()
+	defer srv.Close()
+
+	k, err := New(map[string]string{
+		"address": srv.URL,
+		"token":   "root",
+	})
+
+	if err != nil {
+		t.Errorf("failed to create vault KV: %s", err)
+		t.FailNow()
+	}
+
+	ctx := context.Background()
+	v := k.(*KV)
+
+	store, err := kv.Open("vault", map[string]string{
+		"address": srv.URL,
+		"token":   "root",
+	})
+	if err != nil {
+		t.Fatalf("failed to open vault KV: %s", err)
+	}
+
+	v.Set(ctx, "/db/password", []byte("a"))
+	v.Set(ctx, "/db/password", []byte("b"))
+	v.Set(ctx, "/db/password", []byte("c"))
+
+	// soft-delete the latest version
+	v.cli.Logical().DeleteWithContext(ctx, "secret/data/db/password")
+
+	if _, err := v.Get(ctx, "/db/password"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get() of a deleted version should fail: %v", err)
+	}
+
+	// versions are accessible through kv.Open
+	versions, err := store.Versions(ctx, "/db/password")
+	if err != nil {
+		t.Errorf("Versions() returned error: %s", err)
+		t.FailNow()
+	}
+
+	if len(versions) != 3 || versions[0].ID != "3" || !versions[0].Deleted || versions[1].Deleted {
+		t.Errorf("Versions() returned invalid versions: %v", versions)
+	}
+
+	if node, err := store.GetVersion(ctx, "/db/password", "2"); err != nil {
+		t.Errorf("GetVersion() returned error: %s", err)
+	} else if string(node.Value) != "b" || node.Revision != 2 {
+		t.Errorf("GetVersion() returned invalid node: %v", node)
+	}
+
+	if _, err := store.GetVersion(ctx, "/db/password", "3"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("GetVersion() of a deleted version should fail: %v", err)
+	}
+
+	if _, err := store.GetVersion(ctx, "/db/password", "latest"); err == nil {
+		t.Errorf("GetVersion() of an invalid version should fail")
+	}
+
+	if err := store.RestoreVersion(ctx, "/db/password", "1"); err != nil {
+		t.Errorf("RestoreVersion() returned error: %s", err)
+	}
+
+	if node, err := store.Get(ctx, "/db/password"); err != nil || string(node.Value) != "a" || node.Revision != 4 {
+		t.Errorf("RestoreVersion() did not restore the value: %v, %v", node, err)
+	}
+
+	if err := store.RestoreVersion(ctx, "/db/password", "3"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("RestoreVersion() of a deleted version should fail: %v", err)
+	}
+
+	// CAS with nil compare must take deleted versions into account
+	v.cli.Logical().DeleteWithContext(ctx, "secret/data/db/password")
+
+	if err := v.CAS(ctx, "/db/password", nil, []byte("d")); err != nil {
+		t.Errorf("CAS() of deleted key returned error: %s", err)
+	}
+
+	if _, err := v.Versions(ctx, "/does/not/exist"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Versions() of non-existent key should fail: %v", err)
+	}
+}
+
+func Test_VaultAuth(t *testing.T) {
+	f, srv := newFakeVault()
+	defer srv.Close()
+
+	f.roles["my-role"] = "my-secret"
+
+	ctx := context.Background()
+
+	k, err := New(map[string]string{
+		"address":   srv.URL,
+		"role-id":   "my-role",
+		"secret-id": "my-secret",
+	})
+	if err != nil {
+		t.Errorf("New() with approle returned error: %s", err)
+		t.FailNow()
+	}
+
+	if err := k.Set(ctx, "/auth", []byte("1")); err != nil {
+		t.Errorf("Set() returned error: %s", err)
+	}
+
+	if _, err := New(map[string]string{
+		"address":   srv.URL,
+		"role-id":   "my-role",
+		"secret-id": "wrong",
+	}); err == nil {
+		t.Errorf("New() with invalid secret-id should fail")
+	}
+
+	k, err = New(map[string]string{
+		"address": srv.URL,
+		"token":   "invalid",
+	})
+	if err != nil {
+		t.Errorf("failed to create vault KV: %s", err)
+		t.FailNow()
+	}
+
+	if _, err := k.Get(ctx, "/auth"); err == nil || errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Get() with invalid token should fail: %v", err)
+	}
+}
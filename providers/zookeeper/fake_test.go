@@ -0,0 +1,259 @@
+package zookeeper
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// fakeSession is used as owner of ephemeral znodes
+const fakeSession = 1
+
+type fakeZNode struct {
+	data     []byte
+	stat     zk.Stat
+	children map[string]bool
+}
+
+// fakeZK implements an in-process ZooKeeper server holding the znode tree of
+// a single session. It implements the conn interface
+type fakeZK struct {
+	lock  sync.Mutex
+	nodes map[string]*fakeZNode
+	zxid  int64
+
+	// dataWatches fire on creation, modification and deletion of a znode
+	dataWatches map[string][]chan zk.Event
+
+	// childWatches fire on changes of the children of a znode
+	childWatches map[string][]chan zk.Event
+}
+
+func newFakeZK() *fakeZK {
+	return &fakeZK{
+		nodes: map[string]*fakeZNode{
+			"/": {children: make(map[string]bool)},
+		},
+		dataWatches:  make(map[string][]chan zk.Event),
+		childWatches: make(map[string][]chan zk.Event),
+	}
+}
+
+// fire triggers and removes all watches of znode in watches. The lock must
+// be held
+func fire(watches map[string][]chan zk.Event, znode string, typ zk.EventType) {
+	for _, ch := range watches[znode] {
+		ch <- zk.Event{
+			Type:  typ,
+			State: zk.StateHasSession,
+			Path:  znode,
+		}
+	}
+
+	delete(watches, znode)
+}
+
+func (f *fakeZK) watch(watches map[string][]chan zk.Event, znode string) <-chan zk.Event {
+	ch := make(chan zk.Event, 1)
+	watches[znode] = append(watches[znode], ch)
+
+	return ch
+}
+
+func (f *fakeZK) stat(znode string) *zk.Stat {
+	n := f.nodes[znode]
+
+	stat := n.stat
+	stat.NumChildren = int32(len(n.children))
+	stat.DataLength = int32(len(n.data))
+
+	return &stat
+}
+
+func (f *fakeZK) Get(znode string) ([]byte, *zk.Stat, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n, ok := f.nodes[znode]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+
+	return append([]byte(nil), n.data...), f.stat(znode), nil
+}
+
+func (f *fakeZK) Children(znode string) ([]string, *zk.Stat, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n, ok := f.nodes[znode]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+
+	// ZooKeeper does not return children in any particular order
+	var names []string
+	for name := range n.children {
+		names = append(names, name)
+	}
+
+	return names, f.stat(znode), nil
+}
+
+func (f *fakeZK) ChildrenW(znode string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	names, stat, err := f.Children(znode)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return names, stat, f.watch(f.childWatches, znode), nil
+}
+
+func (f *fakeZK) Exists(znode string) (bool, *zk.Stat, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.nodes[znode]; !ok {
+		return false, nil, nil
+	}
+
+	return true, f.stat(znode), nil
+}
+
+func (f *fakeZK) ExistsW(znode string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	ch := f.watch(f.dataWatches, znode)
+
+	if _, ok := f.nodes[znode]; !ok {
+		return false, nil, ch, nil
+	}
+
+	return true, f.stat(znode), ch, nil
+}
+
+func (f *fakeZK) Create(znode string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.nodes[znode]; ok {
+		return "", zk.ErrNodeExists
+	}
+
+	parent, ok := f.nodes[path.Dir(znode)]
+	if !ok {
+		return "", zk.ErrNoNode
+	}
+
+	if parent.stat.EphemeralOwner != 0 {
+		return "", zk.ErrNoChildrenForEphemerals
+	}
+
+	f.zxid++
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	n := &fakeZNode{
+		data:     append([]byte(nil), data...),
+		children: make(map[string]bool),
+		stat: zk.Stat{
+			Czxid: f.zxid,
+			Mzxid: f.zxid,
+			Ctime: now,
+			Mtime: now,
+		},
+	}
+
+	if flags&zk.FlagEphemeral != 0 {
+		n.stat.EphemeralOwner = fakeSession
+	}
+
+	f.nodes[znode] = n
+	parent.children[path.Base(znode)] = true
+
+	fire(f.dataWatches, znode, zk.EventNodeCreated)
+	fire(f.childWatches, path.Dir(znode), zk.EventNodeChildrenChanged)
+
+	return znode, nil
+}
+
+func (f *fakeZK) Set(znode string, data []byte, version int32) (*zk.Stat, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n, ok := f.nodes[znode]
+	if !ok {
+		return nil, zk.ErrNoNode
+	}
+
+	if version != -1 && version != n.stat.Version {
+		return nil, zk.ErrBadVersion
+	}
+
+	f.zxid++
+
+	n.data = append([]byte(nil), data...)
+	n.stat.Version++
+	n.stat.Mzxid = f.zxid
+	n.stat.Mtime = time.Now().UnixNano() / int64(time.Millisecond)
+
+	fire(f.dataWatches, znode, zk.EventNodeDataChanged)
+
+	return f.stat(znode), nil
+}
+
+// remove deletes znode. The lock must be held
+func (f *fakeZK) remove(znode string) {
+	delete(f.nodes, znode)
+	delete(f.nodes[path.Dir(znode)].children, path.Base(znode))
+
+	f.zxid++
+
+	fire(f.dataWatches, znode, zk.EventNodeDeleted)
+	fire(f.childWatches, znode, zk.EventNodeDeleted)
+	fire(f.childWatches, path.Dir(znode), zk.EventNodeChildrenChanged)
+}
+
+func (f *fakeZK) Delete(znode string, version int32) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n, ok := f.nodes[znode]
+	if !ok {
+		return zk.ErrNoNode
+	}
+
+	if version != -1 && version != n.stat.Version {
+		return zk.ErrBadVersion
+	}
+
+	if len(n.children) > 0 {
+		return zk.ErrNotEmpty
+	}
+
+	f.remove(znode)
+
+	return nil
+}
+
+// expireSession deletes all ephemeral znodes as ZooKeeper does once a
+// session expires
+func (f *fakeZK) expireSession() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for znode, n := range f.nodes {
+		if n.stat.EphemeralOwner == fakeSession {
+			f.remove(znode)
+		}
+	}
+}
+
+func (f *fakeZK) Close() {
+	f.expireSession()
+}
@@ -0,0 +1,532 @@
+// Package zookeeper implements a gokv provider for Apache ZooKeeper.
+//
+// ZooKeeper znodes may hold data and children at the same time. gokv maps
+// every znode with at least one child to a directory (ignoring its data) and
+// every znode without children to a value. Parent znodes are created
+// implicitly without data and removed again once their last child has been
+// deleted.
+package zookeeper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+// defaultRoot is used as root znode if no root is configured
+const defaultRoot = "/gokv"
+
+// defaultSessionTimeout is used if no session-timeout is configured
+const defaultSessionTimeout = 10 * time.Second
+
+// conn contains the methods of *zk.Conn used by the provider
+type conn interface {
+	Get(path string) ([]byte, *zk.Stat, error)
+	Children(path string) ([]string, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	Exists(path string) (bool, *zk.Stat, error)
+	ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Set(path string, data []byte, version int32) (*zk.Stat, error)
+	Delete(path string, version int32) error
+	Close()
+}
+
+type KV struct {
+	conn conn
+	root string
+	acl  []zk.ACL
+
+	// timers holds pending expiry timers of values set using SetTTL
+	timersLock sync.Mutex
+	timers     map[string]*time.Timer
+}
+
+func sanatizePath(key string) string {
+	return strings.Trim(key, "/")
+}
+
+// znode returns the znode path for key
+func (z *KV) znode(key string) string {
+	if key == "" {
+		return z.root
+	}
+
+	return z.root + "/" + key
+}
+
+// child returns the gokv key of the child name of key
+func child(key, name string) string {
+	if key == "" {
+		return name
+	}
+
+	return key + "/" + name
+}
+
+func millis(ms int64) *time.Time {
+	t := time.Unix(0, ms*int64(time.Millisecond))
+	return &t
+}
+
+// node reads key including depth levels of children (-1 means unlimited)
+func (z *KV) node(key string, depth int) (*kv.Node, error) {
+	data, stat, err := z.conn.Get(z.znode(key))
+	if err == zk.ErrNoNode {
+		return nil, fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+
+	node := &kv.Node{
+		Key:      key,
+		IsDir:    key == "" || stat.NumChildren > 0,
+		Created:  millis(stat.Ctime),
+		Updated:  millis(stat.Mtime),
+		Revision: uint64(stat.Mzxid),
+	}
+
+	if !node.IsDir {
+		if len(data) > 0 {
+			node.Value = data
+		}
+
+		return node, nil
+	}
+
+	if depth == 0 {
+		return node, nil
+	}
+
+	names, _, err := z.conn.Children(z.znode(key))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		c, err := z.node(child(key, name), depth-1)
+		if errors.Is(err, kv.ErrNotFound) {
+			// deleted concurrently
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		node.Children = append(node.Children, *c)
+	}
+
+	return node, nil
+}
+
+func (z *KV) Get(ctx context.Context, key string) (*kv.Node, error) {
+	return z.node(sanatizePath(key), 1)
+}
+
+func (z *KV) RGet(ctx context.Context, key string) (*kv.Node, error) {
+	return z.node(sanatizePath(key), -1)
+}
+
+// createParents creates all missing parent znodes of key and ensures none of
+// the existing ones is a value
+func (z *KV) createParents(key string) error {
+	parts := strings.Split(key, "/")
+
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], "/")
+
+		ok, stat, err := z.conn.Exists(z.znode(parent))
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			if stat.NumChildren == 0 {
+				return fmt.Errorf("cannot create %q: %q is not a directory", key, parent)
+			}
+			continue
+		}
+
+		if _, err := z.conn.Create(z.znode(parent), nil, 0, z.acl); err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeParents deletes all empty parent directories of key
+func (z *KV) removeParents(key string) {
+	for key = path.Dir(key); key != "." && key != ""; key = path.Dir(key) {
+		_, stat, err := z.conn.Get(z.znode(key))
+		if err != nil || stat.NumChildren > 0 || stat.DataLength > 0 {
+			return
+		}
+
+		// the version check ensures the znode has not been modified in between
+		if err := z.conn.Delete(z.znode(key), stat.Version); err != nil {
+			return
+		}
+	}
+}
+
+// set creates or updates the value of key using flags for newly created
+// znodes
+func (z *KV) set(key string, value []byte, flags int32) error {
+	if key == "" {
+		return fmt.Errorf("cannot set root directory")
+	}
+
+	if err := z.createParents(key); err != nil {
+		return err
+	}
+
+	ok, stat, err := z.conn.Exists(z.znode(key))
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		if stat.NumChildren > 0 {
+			return fmt.Errorf("cannot set %q: is a directory", key)
+		}
+
+		// ephemeral znodes need to be re-created to change their lifetime
+		if (stat.EphemeralOwner != 0) == (flags&zk.FlagEphemeral != 0) {
+			_, err := z.conn.Set(z.znode(key), value, stat.Version)
+			return err
+		}
+
+		if err := z.conn.Delete(z.znode(key), stat.Version); err != nil {
+			return err
+		}
+	}
+
+	_, err = z.conn.Create(z.znode(key), value, flags, z.acl)
+	return err
+}
+
+func (z *KV) Set(ctx context.Context, key string, value []byte) error {
+	key = sanatizePath(key)
+	z.stopTimer(key)
+
+	return z.set(key, value, 0)
+}
+
+// SetTTL stores value in an ephemeral znode that is deleted after ttl. As
+// ephemeral znodes are bound to the ZooKeeper session, the value is also
+// deleted once the session ends (e.g. when the provider is closed)
+func (z *KV) SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	key = sanatizePath(key)
+	z.stopTimer(key)
+
+	if err := z.set(key, value, zk.FlagEphemeral); err != nil {
+		return err
+	}
+
+	_, stat, err := z.conn.Get(z.znode(key))
+	if err != nil {
+		return err
+	}
+
+	created, version := stat.Czxid, stat.Version
+
+	z.timersLock.Lock()
+	defer z.timersLock.Unlock()
+
+	var timer *time.Timer
+
+	timer = time.AfterFunc(ttl, func() {
+		z.timersLock.Lock()
+		if z.timers[key] == timer {
+			delete(z.timers, key)
+		}
+		z.timersLock.Unlock()
+
+		// only delete the value if it has not been re-created or modified in
+		// between
+		_, stat, err := z.conn.Get(z.znode(key))
+		if err != nil || stat.Czxid != created {
+			return
+		}
+
+		if err := z.conn.Delete(z.znode(key), version); err == nil {
+			z.removeParents(key)
+		}
+	})
+
+	z.timers[key] = timer
+
+	return nil
+}
+
+// stopTimer cancels the pending expiry of key, if any
+func (z *KV) stopTimer(key string) {
+	z.timersLock.Lock()
+	defer z.timersLock.Unlock()
+
+	if t, ok := z.timers[key]; ok {
+		t.Stop()
+		delete(z.timers, key)
+	}
+}
+
+// deleteTree deletes znode and all znodes below it
+func (z *KV) deleteTree(znode string) error {
+	names, _, err := z.conn.Children(znode)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := z.deleteTree(znode + "/" + name); err != nil && err != zk.ErrNoNode {
+			return err
+		}
+	}
+
+	return z.conn.Delete(znode, -1)
+}
+
+func (z *KV) Delete(ctx context.Context, key string) error {
+	key = sanatizePath(key)
+	if key == "" {
+		return fmt.Errorf("cannot delete root directory")
+	}
+
+	z.stopTimer(key)
+
+	err := z.deleteTree(z.znode(key))
+	if err == zk.ErrNoNode {
+		return fmt.Errorf("%q: %w", key, kv.ErrNotFound)
+	} else if err != nil {
+		return err
+	}
+
+	z.removeParents(key)
+
+	return nil
+}
+
+// CAS sets key to value if its current value matches compare. If compare is
+// nil the key must not exist. The check-and-set is performed using the znode
+// version
+func (z *KV) CAS(ctx context.Context, key string, compare, value []byte) error {
+	key = sanatizePath(key)
+	if key == "" {
+		return fmt.Errorf("cannot set root directory")
+	}
+
+	if compare == nil {
+		if err := z.createParents(key); err != nil {
+			return err
+		}
+
+		_, err := z.conn.Create(z.znode(key), value, 0, z.acl)
+		if err == zk.ErrNodeExists {
+			return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+		}
+
+		return err
+	}
+
+	data, stat, err := z.conn.Get(z.znode(key))
+	if err == zk.ErrNoNode {
+		return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+	} else if err != nil {
+		return err
+	}
+
+	if stat.NumChildren > 0 || !bytes.Equal(data, compare) {
+		return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+	}
+
+	// like Set, values with a TTL are re-created as persistent znodes. The
+	// expiry is only cancelled once the value has been replaced
+	if stat.EphemeralOwner != 0 {
+		err = z.conn.Delete(z.znode(key), stat.Version)
+		if err == nil {
+			_, err = z.conn.Create(z.znode(key), value, 0, z.acl)
+		}
+	} else {
+		_, err = z.conn.Set(z.znode(key), value, stat.Version)
+	}
+
+	if err == zk.ErrBadVersion || err == zk.ErrNoNode || err == zk.ErrNodeExists {
+		return fmt.Errorf("%q: %w", key, kv.ErrCompareFailed)
+	} else if err != nil {
+		return err
+	}
+
+	z.stopTimer(key)
+
+	return nil
+}
+
+// watchTree registers ZooKeeper watches on znode and all znodes below it.
+// Watches fire on data changes, creation and deletion of znodes and changes
+// of their children
+func (z *KV) watchTree(znode string) ([]<-chan zk.Event, error) {
+	ok, stat, ch, err := z.conn.ExistsW(znode)
+	if err != nil {
+		return nil, err
+	}
+
+	watches := []<-chan zk.Event{ch}
+
+	if !ok || stat.NumChildren == 0 && znode != z.root {
+		return watches, nil
+	}
+
+	names, _, ch, err := z.conn.ChildrenW(znode)
+	if err == zk.ErrNoNode {
+		// deleted in between, the exists watch has already fired
+		return watches, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	watches = append(watches, ch)
+
+	for _, name := range names {
+		w, err := z.watchTree(znode + "/" + name)
+		if err != nil {
+			return nil, err
+		}
+
+		watches = append(watches, w...)
+	}
+
+	return watches, nil
+}
+
+// Watch blocks until key or any key below it changes and returns the updated
+// node. If key has been deleted an error wrapping kv.ErrNotFound is returned.
+// Changes are detected using ZooKeeper watches
+func (z *KV) Watch(ctx context.Context, key string) (*kv.Node, error) {
+	key = sanatizePath(key)
+
+	watches, err := z.watchTree(z.znode(key))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fired := make(chan zk.Event, 1)
+
+	for _, w := range watches {
+		go func(w <-chan zk.Event) {
+			select {
+			case ev := <-w:
+				select {
+				case fired <- ev:
+				default:
+				}
+			case <-ctx.Done():
+			}
+		}(w)
+	}
+
+	select {
+	case ev := <-fired:
+		if ev.Err != nil {
+			return nil, ev.Err
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return z.Get(ctx, key)
+}
+
+// Close stops all pending expiry timers and closes the ZooKeeper session.
+// All values set using SetTTL are deleted by ZooKeeper
+func (z *KV) Close() error {
+	z.timersLock.Lock()
+	for key, t := range z.timers {
+		t.Stop()
+		delete(z.timers, key)
+	}
+	z.timersLock.Unlock()
+
+	z.conn.Close()
+
+	return nil
+}
+
+// newKV creates a new provider using c and ensures the root znode exists
+func newKV(c conn, root string) (*KV, error) {
+	z := &KV{
+		conn:   c,
+		root:   root,
+		acl:    zk.WorldACL(zk.PermAll),
+		timers: make(map[string]*time.Timer),
+	}
+
+	parts := strings.Split(strings.TrimPrefix(root, "/"), "/")
+
+	for i := range parts {
+		znode := "/" + strings.Join(parts[:i+1], "/")
+
+		if _, err := c.Create(znode, nil, 0, z.acl); err != nil && err != zk.ErrNodeExists {
+			return nil, fmt.Errorf("failed to create root %s: %s", znode, err)
+		}
+	}
+
+	return z, nil
+}
+
+func New(params map[string]string) (kv.Provider, error) {
+	timeout := defaultSessionTimeout
+
+	if v := params["session-timeout"]; v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid session-timeout %q: %s", v, err)
+		}
+	}
+
+	root := "/" + strings.Trim(params["root"], "/")
+	if root == "/" {
+		root = defaultRoot
+	}
+
+	c, _, err := zk.Connect(strings.Split(params["servers"], ","), timeout, zk.WithLogInfo(false))
+	if err != nil {
+		return nil, err
+	}
+
+	if v := params["digest"]; v != "" {
+		if err := c.AddAuth("digest", []byte(v)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	z, err := newKV(c, root)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return z, nil
+}
+
+func init() {
+	optional := []string{"root", "session-timeout", "digest"}
+
+	if err := kv.Register("zookeeper", New, []string{"servers"}, optional); err != nil {
+		panic("failed to register zookeeper KV driver")
+	}
+}
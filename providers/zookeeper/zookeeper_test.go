@@ -0,0 +1,249 @@
+package zookeeper
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+func newTestKV(t *testing.T) (*KV, *fakeZK) {
+	f := newFakeZK()
+
+	z, err := newKV(f, defaultRoot)
+	if err != nil {
+		t.Errorf("failed to create zookeeper KV: %s", err)
+		t.FailNow()
+	}
+
+	return z, f
+}
+
+func Test_ZooKeeper(t *testing.T) {
+	z, _ := newTestKV(t)
+
+	kv.KVTester(t, z)
+}
+
+func Test_ZooKeeperDirs(t *testing.T) {
+	z, f := newTestKV(t)
+	ctx := context.Background()
+
+	z.Set(ctx, "/app/config/db", []byte("postgres"))
+	z.Set(ctx, "/app/users/paz", []byte("1"))
+
+	// znodes with data and children are reported as directories
+	f.Set("/gokv/app", []byte("ignored"), -1)
+
+	node, err := z.RGet(ctx, "/app")
+	if err != nil {
+		t.Errorf("RGet() returned error: %s", err)
+		t.FailNow()
+	}
+
+	if !node.IsDir || node.Value != nil || len(node.Children) != 2 {
+		t.Errorf("RGet() returned invalid node: %v", node)
+		t.FailNow()
+	}
+
+	if c := node.Children[0]; c.Key != "app/config" || !c.IsDir || len(c.Children) != 1 || string(c.Children[0].Value) != "postgres" {
+		t.Errorf("RGet() returned invalid child: %v", c)
+	}
+
+	if node, err := z.Get(ctx, "/app"); err != nil {
+		t.Errorf("Get() returned error: %s", err)
+	} else if len(node.Children[0].Children) != 0 {
+		t.Errorf("Get() should not return grandchildren: %v", node.Children[0])
+	}
+
+	if err := z.Set(ctx, "/app/config/db/host", []byte("x")); err == nil {
+		t.Errorf("Set() below a value should fail")
+	}
+
+	if err := z.Set(ctx, "/app/config", []byte("x")); err == nil {
+		t.Errorf("Set() of a directory should fail")
+	}
+
+	// empty parents are removed with their last child
+	z.Delete(ctx, "/app/users/paz")
+
+	if ok, _, _ := f.Exists("/gokv/app/users"); ok {
+		t.Errorf("Delete() did not remove the empty parent directory")
+	}
+
+	if ok, _, _ := f.Exists("/gokv/app"); !ok {
+		t.Errorf("Delete() removed a parent directory that is not empty")
+	}
+}
+
+func Test_ZooKeeperTTL(t *testing.T) {
+	z, f := newTestKV(t)
+	ctx := context.Background()
+
+	if err := z.SetTTL(ctx, "/ttl/a", []byte("1"), 50*time.Millisecond); err != nil {
+		t.Errorf("SetTTL() returned error: %s", err)
+	}
+
+	if _, stat, err := f.Get("/gokv/ttl/a"); err != nil || stat.EphemeralOwner == 0 {
+		t.Errorf("SetTTL() did not create an ephemeral znode: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if _, err := z.Get(ctx, "/ttl/a"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("value did not expire: %v", err)
+	}
+
+	if _, err := z.Get(ctx, "/ttl"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("expiry did not remove the empty parent directory: %v", err)
+	}
+
+	z.timersLock.Lock()
+	if len(z.timers) != 0 {
+		t.Errorf("expired timers are kept: %v", z.timers)
+	}
+	z.timersLock.Unlock()
+
+	// setting a value without TTL cancels the expiry
+	z.SetTTL(ctx, "/ttl/b", []byte("1"), 50*time.Millisecond)
+	z.Set(ctx, "/ttl/b", []byte("2"))
+
+	time.Sleep(200 * time.Millisecond)
+
+	if _, err := z.Get(ctx, "/ttl/b"); err != nil {
+		t.Errorf("Set() did not cancel the expiry: %v", err)
+	}
+
+	// ephemeral znodes are deleted once the session ends
+	z.SetTTL(ctx, "/ttl/c", []byte("1"), time.Hour)
+	f.expireSession()
+
+	if _, err := z.Get(ctx, "/ttl/c"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("value did not expire with the session: %v", err)
+	}
+}
+
+// racingConn modifies every znode read using Get, as if another client
+// changed it right after
+type racingConn struct {
+	*fakeZK
+}
+
+func (r *racingConn) Get(znode string) ([]byte, *zk.Stat, error) {
+	data, stat, err := r.fakeZK.Get(znode)
+	if err == nil {
+		r.fakeZK.Set(znode, data, -1)
+	}
+
+	return data, stat, err
+}
+
+func Test_ZooKeeperCASTTL(t *testing.T) {
+	z, f := newTestKV(t)
+	ctx := context.Background()
+
+	// a CAS losing against a concurrent write keeps the expiry
+	z.SetTTL(ctx, "/ttl/a", []byte("1"), time.Hour)
+
+	z.conn = &racingConn{f}
+	if err := z.CAS(ctx, "/ttl/a", []byte("1"), []byte("2")); !errors.Is(err, kv.ErrCompareFailed) {
+		t.Errorf("CAS() against a concurrent write returned unexpected error: %v", err)
+	}
+	z.conn = f
+
+	z.timersLock.Lock()
+	if len(z.timers) != 1 {
+		t.Errorf("failed CAS() cancelled the expiry: %v", z.timers)
+	}
+	z.timersLock.Unlock()
+
+	// a successful CAS removes the TTL like Set does
+	z.SetTTL(ctx, "/ttl/b", []byte("1"), 50*time.Millisecond)
+
+	if err := z.CAS(ctx, "/ttl/b", []byte("1"), []byte("2")); err != nil {
+		t.Errorf("CAS() returned error: %s", err)
+	}
+
+	if _, stat, err := f.Get("/gokv/ttl/b"); err != nil || stat.EphemeralOwner != 0 {
+		t.Errorf("CAS() did not create a persistent znode: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	f.expireSession()
+
+	if value, err := z.Get(ctx, "/ttl/b"); err != nil || string(value.Value) != "2" {
+		t.Errorf("value swapped using CAS() expired: %v", err)
+	}
+}
+
+func Test_ZooKeeperWatch(t *testing.T) {
+	z, _ := newTestKV(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	z.Set(ctx, "/watch/a/b", []byte("1"))
+	z.Set(ctx, "/watchother", []byte("1"))
+
+	result := make(chan *kv.Node, 1)
+	go func() {
+		node, err := z.Watch(ctx, "/watch")
+		if err != nil {
+			t.Errorf("Watch() returned error: %s", err)
+		}
+		result <- node
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// changes to other keys must not trigger the watch
+	z.Set(ctx, "/watchother", []byte("2"))
+
+	select {
+	case <-result:
+		t.Errorf("Watch() returned on a change of a different key")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// changes deep within the tree trigger the watch
+	z.Set(ctx, "/watch/a/b", []byte("2"))
+
+	if node := <-result; node == nil || node.Key != "watch" || !node.IsDir {
+		t.Errorf("Watch() returned invalid node: %v", node)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := z.Watch(ctx, "/watch/a/b")
+		errs <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	z.Delete(ctx, "/watch")
+
+	if err := <-errs; !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("Watch() of a deleted key should return ErrNotFound: %v", err)
+	}
+}
+
+func Test_ZooKeeperRoot(t *testing.T) {
+	f := newFakeZK()
+
+	z, err := newKV(f, "/services/config")
+	if err != nil {
+		t.Errorf("newKV() returned error: %s", err)
+		t.FailNow()
+	}
+
+	if ok, _, _ := f.Exists("/services/config"); !ok {
+		t.Errorf("newKV() did not create the root znode")
+	}
+
+	// the root is a directory even if empty
+	if node, err := z.Get(context.Background(), "/"); err != nil || !node.IsDir {
+		t.Errorf("Get() of the root returned invalid node: %v, %v", node, err)
+	}
+}
@@ -0,0 +1,337 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v3"
+)
+
+// Access is a level of access granted on a path
+type Access int
+
+// Access levels; every level includes the ones below
+const (
+	AccessNone Access = iota
+
+	// AccessRead allows to get and watch keys and to dump subtrees
+	AccessRead
+
+	// AccessWrite allows to set and delete single keys
+	AccessWrite
+
+	// AccessAdmin allows operations on whole subtrees: recursive deletes,
+	// moving, copying and restoring
+	AccessAdmin
+)
+
+var accessNames = map[Access]string{
+	AccessNone:  "none",
+	AccessRead:  "read",
+	AccessWrite: "write",
+	AccessAdmin: "admin",
+}
+
+func (a Access) String() string {
+	return accessNames[a]
+}
+
+// UnmarshalYAML parses access levels by name
+func (a *Access) UnmarshalYAML(value *yaml.Node) error {
+	for level, name := range accessNames {
+		if value.Value == name {
+			*a = level
+			return nil
+		}
+	}
+
+	return fmt.Errorf("line %d: unknown access %q", value.Line, value.Value)
+}
+
+// Anonymous is the identity of requests without credentials. Grants of an
+// identity with this name apply to everyone
+const Anonymous = "anonymous"
+
+// Identity is a single entry of a policy file
+type Identity struct {
+	// Tokens authenticate the identity using an "Authorization: Bearer"
+	// header. Tokens may be stored hashed as "sha256:<hex>"
+	Tokens []string `yaml:"tokens"`
+
+	// Grants maps path globs to the access granted. A * matches a single
+	// path segment, ** any number of segments
+	Grants map[string]Access `yaml:"grants"`
+}
+
+// Policy authenticates requests and decides which identity may access which
+// paths. Clients are either identified by a token or by a client certificate
+// whose common name is the name of the identity
+type Policy struct {
+	Identities map[string]Identity `yaml:"identities"`
+
+	// tokens maps sha256 hashes of tokens to identities
+	tokens map[string]string
+}
+
+// ParsePolicy parses a YAML (or JSON) policy:
+//
+//	identities:
+//	  deploy:
+//	    tokens: ["sha256:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"]
+//	    grants:
+//	      app/**: write
+//	  ops:
+//	    grants:
+//	      "**": admin
+//	  anonymous:
+//	    grants:
+//	      public/**: read
+func ParsePolicy(data []byte) (*Policy, error) {
+	var p Policy
+
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("invalid policy: %s", err)
+	}
+
+	p.tokens = make(map[string]string)
+
+	for name, id := range p.Identities {
+		for pattern := range id.Grants {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid glob %q of %q: %s", pattern, name, err)
+			}
+		}
+
+		for _, token := range id.Tokens {
+			hash := strings.TrimPrefix(token, "sha256:")
+			if hash == token {
+				hash = hashToken(token)
+			}
+
+			if token == "" || len(hash) != sha256.Size*2 {
+				return nil, fmt.Errorf("invalid token of %q", name)
+			}
+
+			if other, ok := p.tokens[strings.ToLower(hash)]; ok {
+				return nil, fmt.Errorf("token of %q is also used by %q", name, other)
+			}
+
+			p.tokens[strings.ToLower(hash)] = name
+		}
+	}
+
+	return &p, nil
+}
+
+// LoadPolicy reads a policy file, see ParsePolicy
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePolicy(data)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken returns the token passed in the Authorization header or, for
+// browsers which cannot set headers on every request, the gokv_token cookie.
+// Clients only supporting basic auth, like etcd clients, pass the token as
+// password. Other authorization schemes are returned as is and thus rejected
+func bearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+			return strings.TrimSpace(header[7:])
+		}
+		if _, password, ok := r.BasicAuth(); ok && password != "" {
+			return password
+		}
+		return header
+	}
+
+	if c, err := r.Cookie("gokv_token"); err == nil {
+		if token, err := url.PathUnescape(c.Value); err == nil {
+			return token
+		}
+	}
+
+	return ""
+}
+
+// Authenticate returns the identity of a request. Tokens take precedence
+// over client certificates; requests without credentials are Anonymous
+func (p *Policy) Authenticate(r *http.Request) (string, error) {
+	if token := bearerToken(r); token != "" {
+		if name, ok := p.tokens[hashToken(token)]; ok {
+			return name, nil
+		}
+
+		return "", fmt.Errorf("invalid token")
+	}
+
+	// only certificates verified against the client CA are trusted
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+
+		if _, ok := p.Identities[cert.Subject.CommonName]; ok {
+			return cert.Subject.CommonName, nil
+		}
+
+		return "", fmt.Errorf("unknown certificate %q", cert.Subject.CommonName)
+	}
+
+	return Anonymous, nil
+}
+
+// Allowed returns true if identity has at least the requested access on key.
+// If tree is true access is required on all keys below key as well
+func (p *Policy) Allowed(identity, key string, access Access, tree bool) bool {
+	segments := splitPath(key)
+
+	// providers may interpret these, so they could escape granted paths
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." || segment == "**" {
+			return false
+		}
+	}
+
+	if tree {
+		segments = append(segments, "**")
+	}
+
+	for _, name := range []string{identity, Anonymous} {
+		for pattern, granted := range p.Identities[name].Grants {
+			if granted >= access && matchGlob(splitPath(pattern), segments) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/ ")
+	if p == "" {
+		return nil
+	}
+
+	return strings.Split(p, "/")
+}
+
+// matchGlob matches key segments against pattern segments. A ** segment in
+// key stands for any descendant and is only matched by ** in the pattern
+func matchGlob(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(key); i++ {
+			if matchGlob(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(key) == 0 || key[0] == "**" {
+		return false
+	}
+
+	if ok, _ := path.Match(pattern[0], key[0]); !ok {
+		return false
+	}
+
+	return matchGlob(pattern[1:], key[1:])
+}
+
+type identityKey struct{}
+
+// authenticate stores the identity of the request in its context. Requests
+// with invalid credentials are rejected
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if s.Policy == nil {
+		return r, true
+	}
+
+	identity, err := s.Policy.Authenticate(r)
+	if err != nil {
+		s.logf("denied %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, err)
+		writeError(w, errorf(http.StatusUnauthorized, "%s", err))
+		return r, false
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)), true
+}
+
+// authorize checks if the identity of the request has access on key (and all
+// keys below if tree is set) before the store is accessed
+func (s *Server) authorize(r *http.Request, key string, access Access, tree bool) error {
+	if s.Policy == nil {
+		return nil
+	}
+
+	identity, _ := r.Context().Value(identityKey{}).(string)
+
+	if s.Policy.Allowed(identity, key, access, tree) {
+		return nil
+	}
+
+	scope := "/" + strings.Trim(key, "/")
+	if tree {
+		scope = path.Join(scope, "**")
+	}
+
+	s.logf("denied %s %s from %s: %q has no %s access on %s", r.Method, r.URL.Path, r.RemoteAddr, identity, access, scope)
+
+	if identity == Anonymous {
+		return errorf(http.StatusUnauthorized, "authentication required")
+	}
+
+	return errorf(http.StatusForbidden, "%s access on %s denied", access, scope)
+}
+
+// readable removes all children from node the identity of the request may
+// not read. Read access on a directory does not include the keys below it, so
+// directory reads would leak their values otherwise
+func (s *Server) readable(r *http.Request, node *kv.Node) *kv.Node {
+	if s.Policy == nil || !node.IsDir {
+		return node
+	}
+
+	identity, _ := r.Context().Value(identityKey{}).(string)
+
+	res := *node
+	res.Children = nil
+
+	for i := range node.Children {
+		if s.Policy.Allowed(identity, node.Children[i].Key, AccessRead, false) {
+			res.Children = append(res.Children, *s.readable(r, &node.Children[i]))
+		}
+	}
+
+	return &res
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Log != nil {
+		s.Log.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
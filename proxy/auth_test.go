@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+const testPolicy = `
+identities:
+  deploy:
+    tokens: ["deploy-token"]
+    grants:
+      app/**: write
+      shared/*: read
+  ops:
+    tokens: ["sha256:` + "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b" + `"]
+    grants:
+      "**": admin
+  viewer:
+    tokens: ["viewer-token"]
+    grants:
+      config: read
+      config/public: read
+  anonymous:
+    grants:
+      public/**: read
+`
+
+func Test_ProxyPolicy(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("ParsePolicy() returned error: %s", err)
+	}
+
+	cases := []struct {
+		identity string
+		key      string
+		access   Access
+		tree     bool
+		allowed  bool
+	}{
+		{"deploy", "/app/config/db", AccessWrite, false, true},
+		{"deploy", "app", AccessRead, true, true},
+		{"deploy", "app", AccessAdmin, true, false},
+		{"deploy", "/apps/db", AccessRead, false, false},
+		{"deploy", "shared/x", AccessRead, false, true},
+		{"deploy", "shared/x", AccessWrite, false, false},
+		{"deploy", "shared", AccessRead, true, false},
+		{"deploy", "shared/x/y", AccessRead, false, false},
+		{"deploy", "app/../secret", AccessWrite, false, false},
+		{"deploy", "public/readme", AccessRead, false, true},
+		{"ops", "", AccessAdmin, true, true},
+		{Anonymous, "public", AccessRead, true, true},
+		{Anonymous, "public/readme", AccessWrite, false, false},
+		{Anonymous, "app/name", AccessRead, false, false},
+		{"unknown", "app/name", AccessRead, false, false},
+	}
+
+	for _, c := range cases {
+		if allowed := p.Allowed(c.identity, c.key, c.access, c.tree); allowed != c.allowed {
+			t.Errorf("Allowed(%q, %q, %s, %v) returned %v", c.identity, c.key, c.access, c.tree, allowed)
+		}
+	}
+
+	invalid := []string{
+		"identities: {a: {grants: {x: everything}}}",
+		"identities: {a: {grants: {'[': read}}}",
+		"identities: {a: {tokens: ['sha256:abc']}}",
+		"identities: {a: {tokens: ['x']}, b: {tokens: ['x']}}",
+		"identities: [",
+	}
+
+	for _, data := range invalid {
+		if _, err := ParsePolicy([]byte(data)); err == nil {
+			t.Errorf("ParsePolicy(%q) should fail", data)
+		}
+	}
+}
+
+func newAuthServer(t *testing.T) (*Server, *bytes.Buffer) {
+	store, err := kv.Open("memory", nil)
+	if err != nil {
+		t.Fatalf("failed to open memory KV: %s", err)
+	}
+
+	s := New(store)
+
+	if s.Policy, err = ParsePolicy([]byte(testPolicy)); err != nil {
+		t.Fatalf("ParsePolicy() returned error: %s", err)
+	}
+
+	buf := new(bytes.Buffer)
+	s.Log = log.New(buf, "", 0)
+
+	return s, buf
+}
+
+func Test_ProxyAuth(t *testing.T) {
+	s, logs := newAuthServer(t)
+	defer s.store.Close()
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	deploy := map[string]string{"Authorization": "Bearer deploy-token"}
+	ops := map[string]string{"Authorization": "Bearer secret"}
+
+	cases := []struct {
+		method string
+		path   string
+		header map[string]string
+		status int
+	}{
+		{"PUT", "/v1/kv/app/name", deploy, http.StatusNoContent},
+		{"PUT", "/v1/kv/public/readme", ops, http.StatusNoContent},
+		{"GET", "/v1/kv/app/name", deploy, http.StatusOK},
+		{"GET", "/v1/kv/public?recursive", nil, http.StatusOK},
+		{"GET", "/v1/kv/app/name", nil, http.StatusUnauthorized},
+		{"GET", "/v1/kv/app/name", map[string]string{"Authorization": "Bearer wrong"}, http.StatusUnauthorized},
+		{"GET", "/v1/kv/app/name", map[string]string{"Cookie": "gokv_token=deploy-token"}, http.StatusOK},
+		{"PUT", "/v1/kv/public/readme", deploy, http.StatusForbidden},
+		{"GET", "/v1/kv/?recursive", deploy, http.StatusForbidden},
+		{"GET", "/v1/dump/app", deploy, http.StatusOK},
+		{"POST", "/v1/copy/app?to=/public/app", deploy, http.StatusForbidden},
+		{"POST", "/v1/copy/public?to=/app/public", deploy, http.StatusForbidden},
+		{"POST", "/v1/copy/app?to=/copy", ops, http.StatusNoContent},
+		{"POST", "/v1/restore/app", deploy, http.StatusForbidden},
+		{"GET", "/v1/watch/app?recursive&after=soon", nil, http.StatusBadRequest},
+		{"GET", "/v1/watch/app?recursive", nil, http.StatusUnauthorized},
+		{"DELETE", "/v1/kv/app?recursive", deploy, http.StatusForbidden},
+		{"DELETE", "/v1/kv/app/name", deploy, http.StatusNoContent},
+		{"DELETE", "/v1/kv/app?recursive", ops, http.StatusNoContent},
+		{"GET", "/", nil, http.StatusOK},
+	}
+
+	for _, c := range cases {
+		if res, body := do(t, c.method, srv.URL+c.path, "", c.header); res.StatusCode != c.status {
+			t.Errorf("%s %s returned %s instead of %d: %s", c.method, c.path, res.Status, c.status, body)
+		}
+	}
+
+	if res, _ := do(t, "GET", srv.URL+"/v1/kv/app/name", "", nil); res.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("unauthenticated request did not return WWW-Authenticate")
+	}
+
+	if !strings.Contains(logs.String(), `denied PUT /v1/kv/public/readme from`) || !strings.Contains(logs.String(), `"deploy" has no write access on /public/readme`) {
+		t.Errorf("denied request has not been logged:\n%s", logs)
+	}
+}
+
+func Test_ProxyAuthDirectory(t *testing.T) {
+	s, _ := newAuthServer(t)
+	defer s.store.Close()
+
+	s.EtcdV2 = true
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	for _, key := range []string{"config/public", "config/secret"} {
+		if err := s.store.Set(context.Background(), key, []byte(key)); err != nil {
+			t.Fatalf("Set(%q) returned error: %s", key, err)
+		}
+	}
+
+	viewer := map[string]string{"Authorization": "Bearer viewer-token"}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.store.Set(context.Background(), "config/secret", []byte("changed"))
+	}()
+
+	// children without read access are neither listed nor returned
+	for _, path := range []string{"/v1/kv/config", "/v1/kv/config?wait", "/v2/keys/config"} {
+		res, body := do(t, "GET", srv.URL+path, "", viewer)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("GET %s returned %s: %s", path, res.Status, body)
+		}
+
+		if !strings.Contains(body, "config/public") || strings.Contains(body, "secret") || strings.Contains(body, "changed") {
+			t.Errorf("GET %s returned children without read access: %s", path, body)
+		}
+	}
+
+	if res, body := do(t, "GET", srv.URL+"/v1/kv/config?recursive", "", viewer); res.StatusCode != http.StatusForbidden {
+		t.Errorf("recursive GET returned %s: %s", res.Status, body)
+	}
+}
+
+// newCertificate creates a certificate signed by parent (or self-signed)
+func newCertificate(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := tmpl, interface{}(key)
+
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	leaf, _ := x509.ParseCertificate(der)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+func Test_ProxyAuthCertificate(t *testing.T) {
+	s, _ := newAuthServer(t)
+	defer s.store.Close()
+
+	ca := newCertificate(t, "gokv CA", nil)
+	other := newCertificate(t, "other CA", nil)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	srv := httptest.NewUnstartedServer(s)
+	srv.TLS = &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(cert *tls.Certificate) int {
+		client := srv.Client()
+
+		if cert != nil {
+			transport := client.Transport.(*http.Transport).Clone()
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+			client = &http.Client{Transport: transport}
+		}
+
+		res, err := client.Get(srv.URL + "/v1/kv/?recursive")
+		if err != nil {
+			// the handshake fails for certificates of unknown CAs
+			return 0
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	if code := get(nil); code != http.StatusUnauthorized {
+		t.Errorf("request without certificate returned %d", code)
+	}
+
+	opsCert := newCertificate(t, "ops", &ca)
+	if code := get(&opsCert); code != http.StatusOK {
+		t.Errorf("request with valid certificate returned %d", code)
+	}
+
+	unknown := newCertificate(t, "nobody", &ca)
+	if code := get(&unknown); code != http.StatusUnauthorized {
+		t.Errorf("request with certificate of unknown identity returned %d", code)
+	}
+
+	forged := newCertificate(t, "ops", &other)
+	if code := get(&forged); code == http.StatusOK {
+		t.Errorf("certificate of untrusted CA has been accepted")
+	}
+}
@@ -0,0 +1,660 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+// etcdKeysPrefix is the URL prefix of the etcd v2 keys API
+const etcdKeysPrefix = "/v2/keys/"
+
+// etcdVersion is reported to etcd clients checking the server version
+const etcdVersion = "2.3.8"
+
+// Error codes of the etcd v2 API
+const (
+	etcdKeyNotFound      = 100
+	etcdTestFailed       = 101
+	etcdNotFile          = 102
+	etcdNotDir           = 104
+	etcdNodeExist        = 105
+	etcdRootReadOnly     = 107
+	etcdDirNotEmpty      = 108
+	etcdUnauthorized     = 110
+	etcdInvalidField     = 209
+	etcdRaftInternal     = 300
+	etcdEventIndexClean  = 401
+	etcdMethodNotAllowed = 405
+)
+
+var etcdMessages = map[int]string{
+	etcdKeyNotFound:      "Key not found",
+	etcdTestFailed:       "Compare failed",
+	etcdNotFile:          "Not a file",
+	etcdNotDir:           "Not a directory",
+	etcdNodeExist:        "Key already exists",
+	etcdRootReadOnly:     "Root is read only",
+	etcdDirNotEmpty:      "Directory not empty",
+	etcdUnauthorized:     "The request requires user authentication",
+	etcdInvalidField:     "Invalid field",
+	etcdRaftInternal:     "Raft Internal Error",
+	etcdEventIndexClean:  "The event in requested index is outdated and cleared",
+	etcdMethodNotAllowed: "Method not allowed",
+}
+
+var etcdStatus = map[int]int{
+	etcdKeyNotFound:      http.StatusNotFound,
+	etcdTestFailed:       http.StatusPreconditionFailed,
+	etcdNotFile:          http.StatusForbidden,
+	etcdNotDir:           http.StatusForbidden,
+	etcdNodeExist:        http.StatusPreconditionFailed,
+	etcdRootReadOnly:     http.StatusForbidden,
+	etcdDirNotEmpty:      http.StatusForbidden,
+	etcdUnauthorized:     http.StatusUnauthorized,
+	etcdInvalidField:     http.StatusBadRequest,
+	etcdRaftInternal:     http.StatusInternalServerError,
+	etcdEventIndexClean:  http.StatusBadRequest,
+	etcdMethodNotAllowed: http.StatusMethodNotAllowed,
+}
+
+// etcdError is an error in the format of the etcd v2 API
+type etcdError struct {
+	Code    int    `json:"errorCode"`
+	Message string `json:"message"`
+	Cause   string `json:"cause,omitempty"`
+	Index   uint64 `json:"index"`
+}
+
+func (e *etcdError) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Message, e.Cause)
+}
+
+func newEtcdError(code int, cause string) *etcdError {
+	return &etcdError{
+		Code:    code,
+		Message: etcdMessages[code],
+		Cause:   cause,
+	}
+}
+
+// etcdNode is a node in the format of the etcd v2 API
+type etcdNode struct {
+	Key           string      `json:"key"`
+	Value         *string     `json:"value,omitempty"`
+	Dir           bool        `json:"dir,omitempty"`
+	Nodes         []*etcdNode `json:"nodes,omitempty"`
+	ModifiedIndex uint64      `json:"modifiedIndex"`
+	CreatedIndex  uint64      `json:"createdIndex"`
+}
+
+// etcdResponse is the response of the etcd v2 keys API
+type etcdResponse struct {
+	Action   string    `json:"action"`
+	Node     *etcdNode `json:"node"`
+	PrevNode *etcdNode `json:"prevNode,omitempty"`
+}
+
+// etcdKey returns key in the format used by etcd
+func etcdKey(key string) string {
+	return "/" + strings.Trim(key, "/")
+}
+
+// newEtcdNode converts n. Children are included up to the given depth, or
+// all of them if depth is negative; etcd reports them sorted by key.
+// Providers do not report the index a key has been created at, so the
+// modified index is used instead
+func newEtcdNode(n *kv.Node, depth int) *etcdNode {
+	res := &etcdNode{
+		Key:           etcdKey(n.Key),
+		Dir:           n.IsDir,
+		ModifiedIndex: n.Revision,
+		CreatedIndex:  n.Revision,
+	}
+
+	if !n.IsDir {
+		value := string(n.Value)
+		res.Value = &value
+		return res
+	}
+
+	if depth != 0 {
+		for i := range n.Children {
+			res.Nodes = append(res.Nodes, newEtcdNode(&n.Children[i], depth-1))
+		}
+
+		sort.Slice(res.Nodes, func(i, j int) bool {
+			return res.Nodes[i].Key < res.Nodes[j].Key
+		})
+	}
+
+	return res
+}
+
+// maxIndex returns the highest index of n and its children
+func (n *etcdNode) maxIndex() uint64 {
+	index := n.ModifiedIndex
+
+	for _, child := range n.Nodes {
+		if i := child.maxIndex(); i > index {
+			index = i
+		}
+	}
+
+	return index
+}
+
+// observeIndex records the highest index seen. gokv has no notion of a
+// global index, so X-Etcd-Index reports the highest revision seen so far
+func (s *Server) observeIndex(index uint64) uint64 {
+	for {
+		current := atomic.LoadUint64(&s.etcdIndex)
+		if index <= current || atomic.CompareAndSwapUint64(&s.etcdIndex, current, index) {
+			return atomic.LoadUint64(&s.etcdIndex)
+		}
+	}
+}
+
+func (s *Server) writeEtcd(w http.ResponseWriter, code int, res *etcdResponse) {
+	index := s.observeIndex(res.Node.maxIndex())
+	if res.PrevNode != nil {
+		index = s.observeIndex(res.PrevNode.ModifiedIndex)
+	}
+
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(index, 10))
+	writeJSON(w, code, res)
+}
+
+// writeEtcdError converts err to an etcd error
+func (s *Server) writeEtcdError(w http.ResponseWriter, key string, err error) {
+	var eerr *etcdError
+	var serr *statusError
+
+	switch {
+	case errors.As(err, &eerr):
+	case errors.As(err, &serr):
+		switch serr.code {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			eerr = newEtcdError(etcdUnauthorized, serr.msg)
+		case http.StatusMethodNotAllowed:
+			eerr = newEtcdError(etcdMethodNotAllowed, serr.msg)
+		default:
+			eerr = newEtcdError(etcdInvalidField, serr.msg)
+		}
+	case errors.Is(err, kv.ErrNotFound):
+		eerr = newEtcdError(etcdKeyNotFound, etcdKey(key))
+	case errors.Is(err, kv.ErrCompareFailed):
+		eerr = newEtcdError(etcdTestFailed, etcdKey(key))
+	case errors.Is(err, kv.ErrCompacted):
+		eerr = newEtcdError(etcdEventIndexClean, err.Error())
+	case errors.Is(err, kv.ErrReadOnly):
+		eerr = newEtcdError(etcdRootReadOnly, err.Error())
+	default:
+		eerr = newEtcdError(etcdRaftInternal, err.Error())
+	}
+
+	eerr.Index = atomic.LoadUint64(&s.etcdIndex)
+
+	code := etcdStatus[eerr.Code]
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gokv"`)
+	}
+
+	w.Header().Set("X-Etcd-Index", strconv.FormatUint(eerr.Index, 10))
+	writeJSON(w, code, eerr)
+}
+
+// etcdBool parses a boolean form field. The second return value is false if
+// the field has not been passed
+func etcdBool(r *http.Request, name string) (bool, bool, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return false, false, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, false, newEtcdError(etcdInvalidField, fmt.Sprintf("invalid value for %q", name))
+	}
+
+	return b, true, nil
+}
+
+// etcdOnly returns a handler serving h only if the etcd v2 API is enabled
+func (s *Server) etcdOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.EtcdV2 {
+			writeError(w, errorf(http.StatusNotFound, "%s not found", r.URL.Path))
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+func (s *Server) handleEtcdVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"etcdserver":  etcdVersion,
+		"etcdcluster": "2.3.0",
+	})
+}
+
+func (s *Server) handleEtcdHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"health": "true",
+	})
+}
+
+// clientURL returns the URL the client used to reach the proxy
+func clientURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+
+	return "http://" + r.Host
+}
+
+// handleEtcdMachines lists the proxy itself as the only cluster member so
+// clients synchronizing the member list keep using it
+func (s *Server) handleEtcdMachines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(clientURL(r)))
+}
+
+func (s *Server) handleEtcdMembers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"members": []map[string]interface{}{{
+			"id":         "gokv",
+			"name":       "gokv",
+			"peerURLs":   []string{},
+			"clientURLs": []string{clientURL(r)},
+		}},
+	})
+}
+
+func (s *Server) handleEtcdKeys(w http.ResponseWriter, r *http.Request) {
+	key := strings.Trim(strings.TrimPrefix(r.URL.Path, etcdKeysPrefix), "/")
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxValueSize)
+
+	var err error
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		err = s.etcdGet(w, r, key)
+	case http.MethodPut:
+		err = s.etcdPut(w, r, key)
+	case http.MethodDelete:
+		err = s.etcdDelete(w, r, key)
+	default:
+		// in-order keys (POST) are not supported
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		err = newEtcdError(etcdMethodNotAllowed, r.Method)
+	}
+
+	if err != nil {
+		s.writeEtcdError(w, key, err)
+	}
+}
+
+func (s *Server) etcdGet(w http.ResponseWriter, r *http.Request, key string) error {
+	recursive, _, err := etcdBool(r, "recursive")
+	if err != nil {
+		return err
+	}
+
+	wait, _, err := etcdBool(r, "wait")
+	if err != nil {
+		return err
+	}
+
+	if err := s.authorize(r, key, AccessRead, recursive); err != nil {
+		return err
+	}
+
+	if wait {
+		return s.etcdWait(w, r, key, recursive)
+	}
+
+	var node *kv.Node
+
+	if recursive {
+		node, err = s.store.RGet(r.Context(), key)
+	} else {
+		node, err = s.store.Get(r.Context(), key)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	node = s.readable(r, node)
+
+	depth := 1
+	if recursive {
+		depth = -1
+	}
+
+	s.writeEtcd(w, http.StatusOK, &etcdResponse{
+		Action: "get",
+		Node:   newEtcdNode(node, depth),
+	})
+
+	return nil
+}
+
+// etcdActions maps event types to etcd actions
+var etcdActions = map[kv.EventType]string{
+	kv.EventSet:            "set",
+	kv.EventDelete:         "delete",
+	kv.EventExpire:         "expire",
+	kv.EventCompareAndSwap: "compareAndSwap",
+}
+
+// etcdWait blocks until key changes and returns the change. Like etcd, a
+// waitIndex returns the first change at or after the given index
+func (s *Server) etcdWait(w http.ResponseWriter, r *http.Request, key string, recursive bool) error {
+	opts := kv.WatchOptions{
+		Recursive: recursive,
+	}
+
+	if v := r.FormValue("waitIndex"); v != "" {
+		index, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return newEtcdError(etcdInvalidField, "invalid value for \"waitIndex\"")
+		}
+
+		if index > 0 {
+			opts.AfterRevision = index - 1
+		}
+	}
+
+	events, err := s.store.WatchEvents(r.Context(), key, opts)
+	if err != nil {
+		return err
+	}
+
+	ev, ok := <-events
+	if !ok {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("watch on %q failed", etcdKey(key))
+	}
+
+	node := &etcdNode{
+		Key:           etcdKey(ev.Node.Key),
+		Dir:           ev.Node.IsDir,
+		ModifiedIndex: ev.Revision,
+		CreatedIndex:  ev.Revision,
+	}
+
+	if ev.Type == kv.EventSet || ev.Type == kv.EventCompareAndSwap {
+		value := string(ev.Node.Value)
+		node.Value = &value
+	}
+
+	s.writeEtcd(w, http.StatusOK, &etcdResponse{
+		Action: etcdActions[ev.Type],
+		Node:   node,
+	})
+
+	return nil
+}
+
+// etcdPut sets key. Conditions (prevExist, prevValue and prevIndex) are
+// checked using CAS on the value; prevIndex is compared before and is thus
+// not atomic. Conditional requests with a ttl require the store to support
+// CASTTL
+func (s *Server) etcdPut(w http.ResponseWriter, r *http.Request, key string) error {
+	if key == "" {
+		return newEtcdError(etcdRootReadOnly, "/")
+	}
+
+	if err := s.authorize(r, key, AccessWrite, false); err != nil {
+		return err
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return newEtcdError(etcdInvalidField, err.Error())
+	}
+
+	if dir, _, err := etcdBool(r, "dir"); err != nil {
+		return err
+	} else if dir {
+		return newEtcdError(etcdInvalidField, "creating directories is not supported, they are created implicitly")
+	}
+
+	prevExist, checkExist, err := etcdBool(r, "prevExist")
+	if err != nil {
+		return err
+	}
+
+	refresh, _, err := etcdBool(r, "refresh")
+	if err != nil {
+		return err
+	}
+
+	var ttl time.Duration
+	if v := r.FormValue("ttl"); v != "" {
+		seconds, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || seconds == 0 {
+			return newEtcdError(etcdInvalidField, "invalid value for \"ttl\"")
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	var prevIndex uint64
+	if v := r.FormValue("prevIndex"); v != "" {
+		if prevIndex, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return newEtcdError(etcdInvalidField, "invalid value for \"prevIndex\"")
+		}
+	}
+
+	_, checkValue := r.Form["prevValue"]
+	prevValue := r.FormValue("prevValue")
+
+	// refreshing requires the key to exist anyway
+	if refresh && checkExist && prevExist {
+		checkExist = false
+	}
+
+	ctx := r.Context()
+
+	prev, err := s.store.Get(ctx, key)
+	if errors.Is(err, kv.ErrNotFound) {
+		prev = nil
+	} else if err != nil {
+		return err
+	} else if prev.IsDir {
+		return newEtcdError(etcdNotFile, etcdKey(key))
+	}
+
+	value := []byte(r.FormValue("value"))
+
+	if refresh {
+		if prev == nil {
+			return newEtcdError(etcdKeyNotFound, etcdKey(key))
+		}
+		if ttl == 0 {
+			return newEtcdError(etcdInvalidField, "refresh requires a ttl")
+		}
+		value = prev.Value
+	}
+
+	action := "set"
+
+	switch {
+	case checkExist && !prevExist:
+		if prev != nil {
+			return newEtcdError(etcdNodeExist, etcdKey(key))
+		}
+
+		action = "create"
+		if err = s.swap(ctx, key, nil, value, ttl); errors.Is(err, kv.ErrCompareFailed) {
+			return newEtcdError(etcdNodeExist, etcdKey(key))
+		}
+	case checkValue || prevIndex != 0:
+		if prev == nil {
+			return newEtcdError(etcdKeyNotFound, etcdKey(key))
+		}
+
+		if checkValue && string(prev.Value) != prevValue {
+			return newEtcdError(etcdTestFailed, fmt.Sprintf("[%s != %s]", prevValue, prev.Value))
+		}
+
+		if prevIndex != 0 && prev.Revision != prevIndex {
+			return newEtcdError(etcdTestFailed, fmt.Sprintf("[%d != %d]", prevIndex, prev.Revision))
+		}
+
+		action = "compareAndSwap"
+		err = s.cas(ctx, key, prev.Value, value, ttl)
+	case checkExist && prevExist:
+		if prev == nil {
+			return newEtcdError(etcdKeyNotFound, etcdKey(key))
+		}
+
+		action = "update"
+		err = s.cas(ctx, key, prev.Value, value, ttl)
+	case ttl > 0:
+		err = s.store.SetTTL(ctx, key, value, ttl)
+	default:
+		err = s.store.Set(ctx, key, value)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	node, err := s.store.Get(ctx, key)
+	if err != nil {
+		// the key has been modified concurrently
+		node = &kv.Node{Key: key, Value: value}
+	}
+
+	res := &etcdResponse{
+		Action: action,
+		Node:   newEtcdNode(node, 0),
+	}
+
+	code := http.StatusCreated
+	if prev != nil {
+		res.PrevNode = newEtcdNode(prev, 0)
+		code = http.StatusOK
+	}
+
+	s.writeEtcd(w, code, res)
+	return nil
+}
+
+// cas swaps the value of key. A nil compare value would require the key to
+// not exist, so empty values are compared as such
+func (s *Server) cas(ctx context.Context, key string, compare, value []byte, ttl time.Duration) error {
+	if compare == nil {
+		compare = []byte{}
+	}
+
+	return s.swap(ctx, key, compare, value, ttl)
+}
+
+// swap performs a CAS on key which expires after ttl unless ttl is zero
+func (s *Server) swap(ctx context.Context, key string, compare, value []byte, ttl time.Duration) error {
+	if ttl == 0 {
+		return s.store.CAS(ctx, key, compare, value)
+	}
+
+	err := s.store.CASTTL(ctx, key, compare, value, ttl)
+	if errors.Is(err, kv.ErrNotSupported) {
+		return newEtcdError(etcdInvalidField, "ttl cannot be used with conditions by this store")
+	}
+
+	return err
+}
+
+// etcdDelete deletes key. prevValue is compared atomically if the store
+// supports Txn; prevIndex is compared before and is thus not atomic
+func (s *Server) etcdDelete(w http.ResponseWriter, r *http.Request, key string) error {
+	if key == "" {
+		return newEtcdError(etcdRootReadOnly, "/")
+	}
+
+	recursive, _, err := etcdBool(r, "recursive")
+	if err != nil {
+		return err
+	}
+
+	dir, _, err := etcdBool(r, "dir")
+	if err != nil {
+		return err
+	}
+
+	access := AccessWrite
+	if recursive {
+		access = AccessAdmin
+	}
+
+	if err := s.authorize(r, key, access, recursive); err != nil {
+		return err
+	}
+
+	prev, err := s.store.Get(r.Context(), key)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case prev.IsDir && !dir && !recursive:
+		return newEtcdError(etcdNotFile, etcdKey(key))
+	case prev.IsDir && !recursive && len(prev.Children) > 0:
+		return newEtcdError(etcdDirNotEmpty, etcdKey(key))
+	case !prev.IsDir && dir:
+		return newEtcdError(etcdNotDir, etcdKey(key))
+	}
+
+	action := "delete"
+
+	_, checkValue := r.URL.Query()["prevValue"]
+	prevIndex := r.URL.Query().Get("prevIndex")
+
+	if checkValue || prevIndex != "" {
+		if prev.IsDir {
+			return newEtcdError(etcdNotFile, etcdKey(key))
+		}
+
+		if v := r.URL.Query().Get("prevValue"); checkValue && string(prev.Value) != v {
+			return newEtcdError(etcdTestFailed, fmt.Sprintf("[%s != %s]", v, prev.Value))
+		}
+
+		if prevIndex != "" && prevIndex != strconv.FormatUint(prev.Revision, 10) {
+			return newEtcdError(etcdTestFailed, fmt.Sprintf("[%s != %d]", prevIndex, prev.Revision))
+		}
+
+		action = "compareAndDelete"
+		err = s.deleteIf(r.Context(), key, prev.Value)
+	} else {
+		err = s.store.Delete(r.Context(), key)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.writeEtcd(w, http.StatusOK, &etcdResponse{
+		Action: action,
+		Node: &etcdNode{
+			Key: etcdKey(key),
+			Dir: prev.IsDir,
+		},
+		PrevNode: newEtcdNode(prev, 0),
+	})
+
+	return nil
+}
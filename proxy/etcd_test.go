@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+func newEtcdServer(t *testing.T) (*httptest.Server, kv.KV) {
+	store, err := kv.Open("memory", nil)
+	if err != nil {
+		t.Fatalf("failed to open memory KV: %s", err)
+	}
+
+	s := New(store)
+	s.EtcdV2 = true
+
+	return httptest.NewServer(s), store
+}
+
+var form = map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+
+func Test_ProxyEtcdKeys(t *testing.T) {
+	srv, store := newEtcdServer(t)
+	defer srv.Close()
+	defer store.Close()
+
+	var res etcdResponse
+	var eerr etcdError
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		action string
+		code   int
+	}{
+		{"PUT", "/v2/keys/app/name", "value=gokv", http.StatusCreated, "set", 0},
+		{"PUT", "/v2/keys/app/name", "value=other", http.StatusOK, "set", 0},
+		{"PUT", "/v2/keys/app/name", "value=x&prevExist=false", http.StatusPreconditionFailed, "", etcdNodeExist},
+		{"PUT", "/v2/keys/app/port", "value=80&prevExist=false", http.StatusCreated, "create", 0},
+		{"PUT", "/v2/keys/app/host", "value=x&prevExist=true", http.StatusNotFound, "", etcdKeyNotFound},
+		{"PUT", "/v2/keys/app/port", "value=81&prevExist=true", http.StatusOK, "update", 0},
+		{"PUT", "/v2/keys/app/port", "value=82&prevValue=80", http.StatusPreconditionFailed, "", etcdTestFailed},
+		{"PUT", "/v2/keys/app/port", "value=82&prevValue=81", http.StatusOK, "compareAndSwap", 0},
+		{"PUT", "/v2/keys/app/port", "value=83&prevIndex=1", http.StatusPreconditionFailed, "", etcdTestFailed},
+		{"PUT", "/v2/keys/app", "value=x", http.StatusForbidden, "", etcdNotFile},
+		{"PUT", "/v2/keys/app/dir", "dir=true", http.StatusBadRequest, "", etcdInvalidField},
+		{"PUT", "/v2/keys/", "value=x", http.StatusForbidden, "", etcdRootReadOnly},
+		{"PUT", "/v2/keys/app/port", "value=x&ttl=soon", http.StatusBadRequest, "", etcdInvalidField},
+		{"PUT", "/v2/keys/app/port", "value=82&ttl=60&prevValue=82", http.StatusOK, "compareAndSwap", 0},
+		{"PUT", "/v2/keys/app/port", "value=82&ttl=60&prevExist=true", http.StatusOK, "update", 0},
+		{"PUT", "/v2/keys/app/port", "ttl=60&refresh=true&prevExist=true", http.StatusOK, "set", 0},
+		{"PUT", "/v2/keys/app/lock", "value=a&ttl=60&prevExist=false", http.StatusCreated, "create", 0},
+		{"PUT", "/v2/keys/app/lock", "value=b&ttl=60&prevExist=false", http.StatusPreconditionFailed, "", etcdNodeExist},
+		{"POST", "/v2/keys/queue", "value=x", http.StatusMethodNotAllowed, "", etcdMethodNotAllowed},
+		{"GET", "/v2/keys/app/name", "", http.StatusOK, "get", 0},
+		{"GET", "/v2/keys/missing", "", http.StatusNotFound, "", etcdKeyNotFound},
+		{"DELETE", "/v2/keys/app", "", http.StatusForbidden, "", etcdNotFile},
+		{"DELETE", "/v2/keys/app?dir=true", "", http.StatusForbidden, "", etcdDirNotEmpty},
+		{"DELETE", "/v2/keys/app/name?dir=true", "", http.StatusForbidden, "", etcdNotDir},
+		{"DELETE", "/v2/keys/app/name?prevValue=gokv", "", http.StatusPreconditionFailed, "", etcdTestFailed},
+		{"DELETE", "/v2/keys/app/name?prevValue=other", "", http.StatusOK, "compareAndDelete", 0},
+		{"DELETE", "/v2/keys/app/name", "", http.StatusNotFound, "", etcdKeyNotFound},
+	}
+
+	for _, c := range cases {
+		r, body := do(t, c.method, srv.URL+c.path, c.body, form)
+		if r.StatusCode != c.status {
+			t.Errorf("%s %s (%s) returned %s instead of %d: %s", c.method, c.path, c.body, r.Status, c.status, body)
+			continue
+		}
+
+		if r.Header.Get("X-Etcd-Index") == "" {
+			t.Errorf("%s %s did not return X-Etcd-Index", c.method, c.path)
+		}
+
+		if c.code != 0 {
+			eerr = etcdError{}
+			if err := json.Unmarshal([]byte(body), &eerr); err != nil || eerr.Code != c.code {
+				t.Errorf("%s %s (%s) returned error %d instead of %d: %s", c.method, c.path, c.body, eerr.Code, c.code, body)
+			}
+			continue
+		}
+
+		res = etcdResponse{}
+		if err := json.Unmarshal([]byte(body), &res); err != nil || res.Action != c.action {
+			t.Errorf("%s %s (%s) returned action %q instead of %q: %s", c.method, c.path, c.body, res.Action, c.action, body)
+		}
+	}
+
+	// prevIndex compares against the modified index of the key
+	_, body := do(t, "GET", srv.URL+"/v2/keys/app/port", "", nil)
+	res = etcdResponse{}
+	json.Unmarshal([]byte(body), &res)
+
+	if res.Node == nil || res.Node.Value == nil || *res.Node.Value != "82" {
+		t.Fatalf("GET returned unexpected node: %s", body)
+	}
+
+	index := strconv.FormatUint(res.Node.ModifiedIndex, 10)
+	if r, body := do(t, "PUT", srv.URL+"/v2/keys/app/port", "value=83&prevIndex="+index, form); r.StatusCode != http.StatusOK {
+		t.Errorf("PUT with prevIndex returned %s: %s", r.Status, body)
+	}
+
+	if r, body := do(t, "DELETE", srv.URL+"/v2/keys/app?recursive=true", "", nil); r.StatusCode != http.StatusOK {
+		t.Errorf("recursive DELETE returned %s: %s", r.Status, body)
+	}
+
+	if _, err := store.Get(context.Background(), "app/port"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("recursive DELETE did not remove app/port: %v", err)
+	}
+}
+
+// noCASTTL hides CASTTL of the wrapped store
+type noCASTTL struct {
+	kv.KV
+}
+
+func (noCASTTL) CASTTL(context.Context, string, []byte, []byte, time.Duration) error {
+	return fmt.Errorf("CASTTL %w", kv.ErrNotSupported)
+}
+
+func Test_ProxyEtcdTTL(t *testing.T) {
+	store, err := kv.Open("memory", nil)
+	if err != nil {
+		t.Fatalf("failed to open memory KV: %s", err)
+	}
+	defer store.Close()
+
+	s := New(store)
+	s.EtcdV2 = true
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// a key created with a ttl expires
+	if r, body := do(t, "PUT", srv.URL+"/v2/keys/lock", "value=a&ttl=1&prevExist=false", form); r.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT with ttl and prevExist returned %s: %s", r.Status, body)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	if _, err := store.Get(context.Background(), "lock"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("key created with ttl did not expire: %v", err)
+	}
+
+	// stores without CASTTL reject conditional writes with a ttl
+	s = New(noCASTTL{store})
+	s.EtcdV2 = true
+
+	srv = httptest.NewServer(s)
+	defer srv.Close()
+
+	r, body := do(t, "PUT", srv.URL+"/v2/keys/lock", "value=a&ttl=1&prevExist=false", form)
+
+	var eerr etcdError
+	if json.Unmarshal([]byte(body), &eerr); r.StatusCode != http.StatusBadRequest || eerr.Code != etcdInvalidField {
+		t.Errorf("PUT with ttl and prevExist returned %s: %s", r.Status, body)
+	}
+
+	if _, err := store.Get(context.Background(), "lock"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("rejected PUT created the key: %v", err)
+	}
+}
+
+func Test_ProxyEtcdRecursive(t *testing.T) {
+	srv, store := newEtcdServer(t)
+	defer srv.Close()
+	defer store.Close()
+
+	for _, key := range []string{"app/b/c", "app/a", "app/b/d"} {
+		if err := store.Set(context.Background(), key, []byte(key)); err != nil {
+			t.Fatalf("Set(%q) returned error: %s", key, err)
+		}
+	}
+
+	var res etcdResponse
+
+	_, body := do(t, "GET", srv.URL+"/v2/keys/app", "", nil)
+	if err := json.Unmarshal([]byte(body), &res); err != nil || !res.Node.Dir || len(res.Node.Nodes) != 2 {
+		t.Fatalf("GET of directory returned unexpected node: %s", body)
+	}
+
+	if a, b := res.Node.Nodes[0], res.Node.Nodes[1]; a.Key != "/app/a" || b.Key != "/app/b" || !b.Dir || len(b.Nodes) != 0 {
+		t.Errorf("GET of directory returned unexpected children: %s", body)
+	}
+
+	res = etcdResponse{}
+	_, body = do(t, "GET", srv.URL+"/v2/keys/app?recursive=true&sorted=true", "", nil)
+	if err := json.Unmarshal([]byte(body), &res); err != nil || len(res.Node.Nodes) != 2 {
+		t.Fatalf("recursive GET returned unexpected node: %s", body)
+	}
+
+	if b := res.Node.Nodes[1]; len(b.Nodes) != 2 || b.Nodes[0].Key != "/app/b/c" || *b.Nodes[1].Value != "app/b/d" {
+		t.Errorf("recursive GET returned unexpected children: %s", body)
+	}
+}
+
+func Test_ProxyEtcdWait(t *testing.T) {
+	srv, store := newEtcdServer(t)
+	defer srv.Close()
+	defer store.Close()
+
+	if err := store.Set(context.Background(), "app/name", []byte("gokv")); err != nil {
+		t.Fatalf("Set() returned error: %s", err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		store.Set(context.Background(), "app/port", []byte("80"))
+	}()
+
+	var res etcdResponse
+
+	r, body := do(t, "GET", srv.URL+"/v2/keys/app?wait=true&recursive=true", "", nil)
+	if err := json.Unmarshal([]byte(body), &res); err != nil || r.StatusCode != http.StatusOK {
+		t.Fatalf("wait returned %s: %s", r.Status, body)
+	}
+
+	if res.Action != "set" || res.Node.Key != "/app/port" || *res.Node.Value != "80" {
+		t.Fatalf("wait returned unexpected response: %s", body)
+	}
+
+	// waiting from an earlier index returns past changes right away
+	index := strconv.FormatUint(res.Node.ModifiedIndex, 10)
+
+	res = etcdResponse{}
+	_, body = do(t, "GET", srv.URL+"/v2/keys/app/port?wait=true&waitIndex="+index, "", nil)
+	if err := json.Unmarshal([]byte(body), &res); err != nil || res.Node.Key != "/app/port" || res.Node.ModifiedIndex == 0 {
+		t.Errorf("wait with waitIndex returned unexpected response: %s", body)
+	}
+}
+
+func Test_ProxyEtcdDisabled(t *testing.T) {
+	srv, store := newTestServer(t)
+	defer srv.Close()
+	defer store.Close()
+
+	for _, path := range []string{"/v2/keys/app", "/version"} {
+		if r, _ := do(t, "GET", srv.URL+path, "", nil); r.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s returned %s although the etcd API is disabled", path, r.Status)
+		}
+	}
+}
+
+func Test_ProxyEtcdAuth(t *testing.T) {
+	s, _ := newAuthServer(t)
+	defer s.store.Close()
+
+	s.EtcdV2 = true
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	put := func(user, password, key string) int {
+		req, _ := http.NewRequest("PUT", srv.URL+"/v2/keys/"+key+"?value=x", nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("PUT failed: %s", err)
+		}
+		r.Body.Close()
+
+		return r.StatusCode
+	}
+
+	if code := put("deploy", "deploy-token", "app/name"); code != http.StatusCreated {
+		t.Errorf("PUT with basic auth returned %d", code)
+	}
+
+	if code := put("deploy", "deploy-token", "public/name"); code != http.StatusUnauthorized {
+		t.Errorf("PUT outside of grants returned %d", code)
+	}
+
+	if code := put("", "", "app/name"); code != http.StatusUnauthorized {
+		t.Errorf("PUT without credentials returned %d", code)
+	}
+}
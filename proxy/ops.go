@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/nethack42/gokv"
+	"gopkg.in/yaml.v3"
+)
+
+// handleTransfer returns a handler moving or copying the key below prefix to
+// the key passed in the "to" query parameter
+func (s *Server) handleTransfer(prefix string, copy bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeError(w, errorf(http.StatusMethodNotAllowed, "method %s not allowed", r.Method))
+			return
+		}
+
+		key := strings.TrimPrefix(r.URL.Path, prefix)
+
+		to := r.URL.Query().Get("to")
+		if strings.Trim(to, "/ ") == "" {
+			writeError(w, errorf(http.StatusBadRequest, "missing destination"))
+			return
+		}
+
+		// moving removes the source, copying only reads it
+		access := AccessAdmin
+		if copy {
+			access = AccessRead
+		}
+
+		err := s.authorize(r, key, access, true)
+		if err == nil {
+			err = s.authorize(r, to, AccessAdmin, true)
+		}
+
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if copy {
+			err = s.store.Copy(r.Context(), key, to)
+		} else {
+			err = s.store.Move(r.Context(), key, to)
+		}
+
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// relativeNode strips prefix from the keys of n and all its children. This
+// is the format used by `gokv backup`
+func relativeNode(n Node, prefix string) Node {
+	n.Key = strings.TrimPrefix(n.Key, prefix)
+
+	for i, child := range n.Children {
+		n.Children[i] = relativeNode(child, prefix)
+	}
+
+	return n
+}
+
+// handleDump returns the subtree below the requested key in the format of
+// `gokv backup`
+func (s *Server) handleDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, errorf(http.StatusMethodNotAllowed, "method %s not allowed", r.Method))
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, dumpPrefix)
+
+	if err := s.authorize(r, key, AccessRead, true); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	node, err := s.store.RGet(r.Context(), key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	name := "root"
+	if node.Key != "" {
+		name = strings.Replace(node.Key, "/", "_", -1)
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".json"))
+	writeJSON(w, http.StatusOK, relativeNode(NewNode(*node), node.Key))
+}
+
+// handleRestore stores all values of a dump created by handleDump (or
+// `gokv backup`) below the requested key
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		writeError(w, errorf(http.StatusMethodNotAllowed, "method %s not allowed", r.Method))
+		return
+	}
+
+	prefix := strings.Trim(strings.TrimPrefix(r.URL.Path, restorePrefix), "/ ")
+
+	if err := s.authorize(r, prefix, AccessAdmin, true); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var tree Node
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxValueSize)).Decode(&tree); err != nil {
+		writeError(w, errorf(http.StatusBadRequest, "invalid dump: %s", err))
+		return
+	}
+
+	if err := s.restore(r, tree, prefix); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) restore(r *http.Request, n Node, prefix string) error {
+	if n.IsDir {
+		for _, child := range n.Children {
+			if err := s.restore(r, child, prefix); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	value, err := n.Bytes()
+	if err != nil {
+		return errorf(http.StatusBadRequest, "invalid value of %q: %s", n.Key, err)
+	}
+
+	key := prefix + "/" + strings.Trim(n.Key, "/")
+
+	// keys of the dump must not escape the prefix
+	if err := s.authorize(r, key, AccessAdmin, false); err != nil {
+		return err
+	}
+
+	return s.store.Set(r.Context(), key, value)
+}
+
+// handleValidate checks the syntax of the request body. The format is passed
+// using the "format" query parameter and may either be json or yaml
+func (s *Server) handleValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, errorf(http.StatusMethodNotAllowed, "method %s not allowed", r.Method))
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+	if err != nil {
+		writeError(w, errorf(http.StatusRequestEntityTooLarge, "failed to read value: %s", err))
+		return
+	}
+
+	var v interface{}
+
+	switch r.URL.Query().Get("format") {
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(body))
+		if err = dec.Decode(&v); err == nil && dec.More() {
+			err = fmt.Errorf("unexpected data after JSON value")
+		}
+	case "yaml":
+		err = yaml.Unmarshal(body, &v)
+	default:
+		writeError(w, errorf(http.StatusBadRequest, "unknown format %q", r.URL.Query().Get("format")))
+		return
+	}
+
+	if err != nil {
+		writeError(w, errorf(http.StatusUnprocessableEntity, "%s", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// wait blocks until key changes, returning the updated node. Nodes are
+// retrieved recursively if requested
+func (s *Server) wait(r *http.Request, key string) (*kv.Node, error) {
+	node, err := s.store.Watch(r.Context(), key)
+	if err != nil || !flag(r, "recursive") {
+		return node, err
+	}
+
+	return s.store.RGet(r.Context(), key)
+}
@@ -0,0 +1,526 @@
+// Package proxy exposes a gokv store through an HTTP REST API so services
+// that cannot link the library are able to access it.
+//
+// Nodes are available below /v1/kv/<path>:
+//
+//	GET    /v1/kv/<path>[?recursive][&wait][&encoding=raw]
+//	PUT    /v1/kv/<path>[?ttl=<duration>][&encoding=json]
+//	DELETE /v1/kv/<path>[?recursive]
+//
+// GET returns the JSON representation of a node (see Node) or, using
+// encoding=raw, the plain value. PUT stores the request body as value unless
+// encoding=json is passed, in which case the body is a JSON encoded Node.
+// Passing wait blocks until the node changes before returning it.
+//
+// Values are tagged using their revision (or a hash of the value for
+// providers not supporting revisions) which is returned in the ETag header.
+// Passing the tag in an If-Match header makes PUT and DELETE conditional;
+// If-None-Match: * only creates keys that do not exist yet.
+//
+// If-Match is checked before the store is modified. PUT then swaps the value
+// atomically, so only a concurrent write of the same value is not detected.
+// DELETE compares the value and deletes the key within a single Txn; for
+// providers without Txn the check is advisory and DELETE may remove a key
+// modified in between. If-None-Match: * is atomic.
+//
+// Further endpoints, mainly used by the Web UI served at /, are:
+//
+//	POST /v1/move/<path>?to=<path>
+//	POST /v1/copy/<path>?to=<path>
+//	GET  /v1/dump/<path>
+//	POST /v1/restore/<path>
+//	POST /v1/validate?format=<json|yaml>
+//
+// Dumps use the same format as `gokv backup` and can be restored using
+// `gokv restore` and vice versa.
+//
+// Changes are streamed by
+//
+//	GET  /v1/watch/<path>[?recursive][&after=<revision>]
+//
+// either as server-sent events or, if the client requests an upgrade, as
+// WebSocket messages (see Event). Passing the revision of the last event
+// received resumes a watch, as long as the provider still knows it.
+//
+// If Server.EtcdV2 is set, the etcd v2 keys API is served below /v2/keys so
+// tools written for etcd can use any provider. Revisions are reported as
+// etcd indexes; in-order keys and creating empty directories are not
+// supported.
+package proxy
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+)
+
+// maxValueSize limits the size of request bodies
+const maxValueSize = 32 << 20
+
+// URL prefixes of the API endpoints
+const (
+	kvPrefix      = "/v1/kv/"
+	movePrefix    = "/v1/move/"
+	copyPrefix    = "/v1/copy/"
+	dumpPrefix    = "/v1/dump/"
+	restorePrefix = "/v1/restore/"
+	watchPrefix   = "/v1/watch/"
+)
+
+// Node is the JSON representation of a kv.Node. Values that are not valid
+// UTF-8 are returned base64 encoded in ValueBase64 instead of Value
+type Node struct {
+	Key         string     `json:"key"`
+	IsDir       bool       `json:"dir,omitempty"`
+	Value       string     `json:"value,omitempty"`
+	ValueBase64 string     `json:"value_base64,omitempty"`
+	Revision    uint64     `json:"revision,omitempty"`
+	Created     *time.Time `json:"created,omitempty"`
+	Updated     *time.Time `json:"updated,omitempty"`
+	Children    []Node     `json:"childs,omitempty"`
+}
+
+// NewNode converts n to its JSON representation
+func NewNode(n kv.Node) Node {
+	res := Node{
+		Key:      n.Key,
+		IsDir:    n.IsDir,
+		Revision: n.Revision,
+		Created:  n.Created,
+		Updated:  n.Updated,
+	}
+
+	if utf8.Valid(n.Value) {
+		res.Value = string(n.Value)
+	} else {
+		res.ValueBase64 = base64.StdEncoding.EncodeToString(n.Value)
+	}
+
+	for _, child := range n.Children {
+		res.Children = append(res.Children, NewNode(child))
+	}
+
+	return res
+}
+
+// Bytes returns the value of n
+func (n Node) Bytes() ([]byte, error) {
+	if n.ValueBase64 != "" {
+		return base64.StdEncoding.DecodeString(n.ValueBase64)
+	}
+
+	return []byte(n.Value), nil
+}
+
+// Server serves the REST API for a single store
+type Server struct {
+	// Heartbeat is the interval of heartbeats sent on watch streams so
+	// clients and intermediate proxies do not consider them dead
+	Heartbeat time.Duration
+
+	// WatchBuffer is the number of events queued per watch stream. Clients
+	// falling further behind are disconnected
+	WatchBuffer int
+
+	// WriteTimeout limits the time to send a single event to a watch stream
+	WriteTimeout time.Duration
+
+	// Policy authenticates and authorizes requests. If nil, all requests
+	// are allowed
+	Policy *Policy
+
+	// Log receives denied requests. If nil, the standard logger is used
+	Log *log.Logger
+
+	// EtcdV2 enables the etcd v2 compatible API below /v2/keys
+	EtcdV2 bool
+
+	store kv.KV
+	mux   *http.ServeMux
+
+	// etcdIndex is the highest revision reported by the etcd v2 API
+	etcdIndex uint64
+}
+
+// New returns a new Server for store
+func New(store kv.KV) *Server {
+	s := &Server{
+		Heartbeat:    defaultHeartbeat,
+		WatchBuffer:  defaultWatchBuffer,
+		WriteTimeout: defaultWriteTimeout,
+		store:        store,
+		mux:          http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc(kvPrefix, s.handleKV)
+	s.mux.HandleFunc(movePrefix, s.handleTransfer(movePrefix, false))
+	s.mux.HandleFunc(copyPrefix, s.handleTransfer(copyPrefix, true))
+	s.mux.HandleFunc(dumpPrefix, s.handleDump)
+	s.mux.HandleFunc(restorePrefix, s.handleRestore)
+	s.mux.HandleFunc(watchPrefix, s.handleWatch)
+	s.mux.HandleFunc("/v1/validate", s.handleValidate)
+	s.mux.HandleFunc(etcdKeysPrefix, s.etcdOnly(s.handleEtcdKeys))
+	s.mux.HandleFunc("/v2/machines", s.etcdOnly(s.handleEtcdMachines))
+	s.mux.HandleFunc("/v2/members", s.etcdOnly(s.handleEtcdMembers))
+	s.mux.HandleFunc("/version", s.etcdOnly(s.handleEtcdVersion))
+	s.mux.HandleFunc("/health", s.etcdOnly(s.handleEtcdHealth))
+	s.mux.HandleFunc("/", s.handleUI)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the UI does not contain any data and has to be available to ask for
+	// credentials
+	if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+		var ok bool
+		if r, ok = s.authenticate(w, r); !ok {
+			return
+		}
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// ETag returns the entity tag of a value node. The revision is used if the
+// provider reports one, a hash of the value otherwise
+func ETag(n *kv.Node) string {
+	if n.Revision != 0 {
+		return strconv.Quote(strconv.FormatUint(n.Revision, 10))
+	}
+
+	sum := sha1.Sum(n.Value)
+	return strconv.Quote("sha1-" + hex.EncodeToString(sum[:]))
+}
+
+// matchETag returns true if any of the tags in header matches n
+func matchETag(header string, n *kv.Node) bool {
+	tag := ETag(n)
+
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// flag returns true if the query parameter name is present and not false
+func flag(r *http.Request, name string) bool {
+	values, ok := r.URL.Query()[name]
+	if !ok {
+		return false
+	}
+
+	if len(values) == 0 || values[0] == "" {
+		return true
+	}
+
+	v, err := strconv.ParseBool(values[0])
+	return err == nil && v
+}
+
+// statusError is an error carrying an HTTP status code
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+func errorf(code int, format string, args ...interface{}) error {
+	return &statusError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// status maps errors returned by the store to HTTP status codes
+func status(err error) int {
+	var serr *statusError
+
+	switch {
+	case errors.As(err, &serr):
+		return serr.code
+	case errors.Is(err, kv.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, kv.ErrCompareFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, kv.ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, kv.ErrCompacted):
+		return http.StatusGone
+	}
+
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := status(err)
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gokv"`)
+	}
+
+	writeJSON(w, code, map[string]string{
+		"error": err.Error(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handleKV(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, kvPrefix)
+
+	var err error
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		err = s.get(w, r, key)
+	case http.MethodPut:
+		err = s.put(w, r, key)
+	case http.MethodDelete:
+		err = s.delete(w, r, key)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		err = errorf(http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, key string) error {
+	if err := s.authorize(r, key, AccessRead, flag(r, "recursive")); err != nil {
+		return err
+	}
+
+	var node *kv.Node
+	var err error
+
+	switch {
+	case flag(r, "wait"):
+		node, err = s.wait(r, key)
+	case flag(r, "recursive"):
+		node, err = s.store.RGet(r.Context(), key)
+	default:
+		node, err = s.store.Get(r.Context(), key)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	node = s.readable(r, node)
+
+	if !node.IsDir {
+		w.Header().Set("ETag", ETag(node))
+	}
+
+	switch r.URL.Query().Get("encoding") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, NewNode(*node))
+	case "raw":
+		if node.IsDir {
+			return errorf(http.StatusBadRequest, "%q is a directory", node.Key)
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(node.Value)
+	default:
+		return errorf(http.StatusBadRequest, "unknown encoding %q", r.URL.Query().Get("encoding"))
+	}
+
+	return nil
+}
+
+// readValue returns the value passed in the request body
+func readValue(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxValueSize))
+	if err != nil {
+		return nil, errorf(http.StatusRequestEntityTooLarge, "failed to read value: %s", err)
+	}
+
+	switch r.URL.Query().Get("encoding") {
+	case "", "raw":
+		return body, nil
+	case "json":
+		var n Node
+		if err := json.Unmarshal(body, &n); err != nil {
+			return nil, errorf(http.StatusBadRequest, "invalid node: %s", err)
+		}
+
+		value, err := n.Bytes()
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "invalid value: %s", err)
+		}
+
+		return value, nil
+	}
+
+	return nil, errorf(http.StatusBadRequest, "unknown encoding %q", r.URL.Query().Get("encoding"))
+}
+
+// precondition returns the current node if the request carries an If-Match
+// header matching it. Without If-Match nil is returned. The store may change
+// before the request is applied, so callers compare the returned value again
+// when modifying the store
+func (s *Server) precondition(r *http.Request, key string) (*kv.Node, error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil, nil
+	}
+
+	node, err := s.store.Get(r.Context(), key)
+	if errors.Is(err, kv.ErrNotFound) {
+		return nil, errorf(http.StatusPreconditionFailed, "%q does not exist", key)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if node.IsDir || !matchETag(header, node) {
+		return nil, errorf(http.StatusPreconditionFailed, "%q has been modified", key)
+	}
+
+	return node, nil
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, key string) error {
+	if err := s.authorize(r, key, AccessWrite, false); err != nil {
+		return err
+	}
+
+	value, err := readValue(r)
+	if err != nil {
+		return err
+	}
+
+	var ttl time.Duration
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		if ttl, err = time.ParseDuration(v); err != nil || ttl <= 0 {
+			return errorf(http.StatusBadRequest, "invalid ttl %q", v)
+		}
+	}
+
+	conditional := r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+	if ttl > 0 && conditional {
+		return errorf(http.StatusBadRequest, "ttl cannot be used with conditional requests")
+	}
+
+	ctx := r.Context()
+
+	switch {
+	case r.Header.Get("If-None-Match") == "*":
+		err = s.store.CAS(ctx, key, nil, value)
+	case r.Header.Get("If-None-Match") != "":
+		return errorf(http.StatusBadRequest, "If-None-Match only supports *")
+	case r.Header.Get("If-Match") != "":
+		var node *kv.Node
+		if node, err = s.precondition(r, key); err != nil {
+			return err
+		}
+
+		// a nil compare value would require the key to not exist
+		compare := node.Value
+		if compare == nil {
+			compare = []byte{}
+		}
+
+		err = s.store.CAS(ctx, key, compare, value)
+	case ttl > 0:
+		err = s.store.SetTTL(ctx, key, value, ttl)
+	default:
+		err = s.store.Set(ctx, key, value)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// delete deletes key. Directories are only deleted if recursive is set
+func (s *Server) delete(w http.ResponseWriter, r *http.Request, key string) error {
+	recursive := flag(r, "recursive")
+
+	access := AccessWrite
+	if recursive {
+		access = AccessAdmin
+	}
+
+	if err := s.authorize(r, key, access, recursive); err != nil {
+		return err
+	}
+
+	node, err := s.precondition(r, key)
+	if err != nil {
+		return err
+	}
+
+	if node != nil {
+		if err := s.deleteIf(r.Context(), key, node.Value); err != nil {
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if !recursive {
+		node, err := s.store.Get(r.Context(), key)
+		if err != nil {
+			return err
+		}
+
+		if node.IsDir {
+			return errorf(http.StatusConflict, "%q is a directory, use recursive to delete it", node.Key)
+		}
+	}
+
+	if err := s.store.Delete(r.Context(), key); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// deleteIf deletes key if its value still equals value. Providers without
+// Txn cannot compare and delete atomically, so the key is deleted without
+// comparing again
+func (s *Server) deleteIf(ctx context.Context, key string, value []byte) error {
+	// a nil compare value would require the key to not exist
+	if value == nil {
+		value = []byte{}
+	}
+
+	err := s.store.Txn(ctx, []kv.Op{
+		{Type: kv.OpCompare, Key: key, Value: value},
+		{Type: kv.OpDelete, Key: key},
+	})
+	if errors.Is(err, kv.ErrNotSupported) {
+		return s.store.Delete(ctx, key)
+	}
+
+	return err
+}
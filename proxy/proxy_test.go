@@ -0,0 +1,402 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nethack42/gokv"
+	_ "github.com/nethack42/gokv/providers/memory"
+	"golang.org/x/net/context"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, kv.KV) {
+	store, err := kv.Open("memory", nil)
+	if err != nil {
+		t.Fatalf("failed to open memory KV: %s", err)
+	}
+
+	return httptest.NewServer(New(store)), store
+}
+
+// do performs a request and returns the response with its body
+func do(t *testing.T, method, url, body string, header map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %s", method, url, err)
+	}
+	defer res.Body.Close()
+
+	data, _ := ioutil.ReadAll(res.Body)
+
+	return res, string(data)
+}
+
+func Test_ProxyKV(t *testing.T) {
+	srv, store := newTestServer(t)
+	defer srv.Close()
+	defer store.Close()
+
+	url := srv.URL + "/v1/kv"
+
+	if res, _ := do(t, "PUT", url+"/app/name", "gokv", nil); res.StatusCode != http.StatusNoContent {
+		t.Errorf("PUT returned unexpected status: %s", res.Status)
+	}
+
+	do(t, "PUT", url+"/app/config/db", "postgres", nil)
+	do(t, "PUT", url+"/app/binary", "\xff\xfe", nil)
+
+	res, body := do(t, "GET", url+"/app/name", "", nil)
+	if res.StatusCode != http.StatusOK || res.Header.Get("ETag") != `"1"` {
+		t.Errorf("GET returned unexpected response: %s %v", res.Status, res.Header)
+	}
+
+	var node Node
+	if err := json.Unmarshal([]byte(body), &node); err != nil || node.Key != "app/name" || node.Value != "gokv" || node.Revision != 1 {
+		t.Errorf("GET returned invalid node: %s", body)
+	}
+
+	if _, body := do(t, "GET", url+"/app/name?encoding=raw", "", nil); body != "gokv" {
+		t.Errorf("GET returned invalid raw value: %q", body)
+	}
+
+	_, body = do(t, "GET", url+"/app/binary", "", nil)
+	node = Node{}
+	json.Unmarshal([]byte(body), &node)
+	if value, _ := node.Bytes(); string(value) != "\xff\xfe" || node.Value != "" {
+		t.Errorf("GET returned invalid binary value: %s", body)
+	}
+
+	_, body = do(t, "GET", url+"/app?recursive", "", nil)
+	node = Node{}
+	json.Unmarshal([]byte(body), &node)
+	if len(node.Children) != 3 || node.Children[1].Key != "app/config" || len(node.Children[1].Children) != 1 {
+		t.Errorf("GET returned invalid recursive node: %s", body)
+	}
+
+	_, body = do(t, "GET", url+"/app", "", nil)
+	node = Node{}
+	json.Unmarshal([]byte(body), &node)
+	if len(node.Children[1].Children) != 0 {
+		t.Errorf("GET without recursive returned grandchildren: %s", body)
+	}
+
+	if res, _ := do(t, "GET", url+"/app?encoding=raw", "", nil); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET of raw directory returned unexpected status: %s", res.Status)
+	}
+
+	if res, _ := do(t, "GET", url+"/missing", "", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of missing key returned unexpected status: %s", res.Status)
+	}
+
+	do(t, "PUT", url+"/app/json?encoding=json", `{"value_base64":"aGVsbG8="}`, nil)
+	if _, body := do(t, "GET", url+"/app/json?encoding=raw", "", nil); body != "hello" {
+		t.Errorf("PUT with JSON encoding stored invalid value: %q", body)
+	}
+
+	if res, _ := do(t, "DELETE", url+"/app", "", nil); res.StatusCode != http.StatusConflict {
+		t.Errorf("DELETE of directory without recursive returned unexpected status: %s", res.Status)
+	}
+
+	if res, _ := do(t, "DELETE", url+"/app?recursive=true", "", nil); res.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE returned unexpected status: %s", res.Status)
+	}
+
+	if res, _ := do(t, "GET", url+"/app/name", "", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("DELETE did not delete the directory: %s", res.Status)
+	}
+
+	if res, _ := do(t, "POST", url+"/app", "", nil); res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST returned unexpected status: %s", res.Status)
+	}
+}
+
+func Test_ProxyCAS(t *testing.T) {
+	srv, store := newTestServer(t)
+	defer srv.Close()
+	defer store.Close()
+
+	url := srv.URL + "/v1/kv/cas"
+
+	create := map[string]string{"If-None-Match": "*"}
+
+	if res, _ := do(t, "PUT", url, "1", create); res.StatusCode != http.StatusNoContent {
+		t.Errorf("PUT with If-None-Match returned unexpected status: %s", res.Status)
+	}
+
+	if res, _ := do(t, "PUT", url, "2", create); res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PUT with If-None-Match of existing key returned unexpected status: %s", res.Status)
+	}
+
+	res, _ := do(t, "GET", url, "", nil)
+	tag := res.Header.Get("ETag")
+
+	do(t, "PUT", url, "3", nil)
+
+	if res, _ := do(t, "PUT", url, "4", map[string]string{"If-Match": tag}); res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PUT with outdated If-Match returned unexpected status: %s", res.Status)
+	}
+
+	res, _ = do(t, "GET", url, "", nil)
+	tag = res.Header.Get("ETag")
+
+	if res, _ := do(t, "PUT", url, "4", map[string]string{"If-Match": tag}); res.StatusCode != http.StatusNoContent {
+		t.Errorf("PUT with If-Match returned unexpected status: %s", res.Status)
+	}
+
+	if res, _ := do(t, "DELETE", url, "", map[string]string{"If-Match": tag}); res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("DELETE with outdated If-Match returned unexpected status: %s", res.Status)
+	}
+
+	if res, _ := do(t, "PUT", url+"?ttl=1m", "5", map[string]string{"If-Match": "*"}); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("conditional PUT with ttl returned unexpected status: %s", res.Status)
+	}
+
+	if res, _ := do(t, "DELETE", url, "", map[string]string{"If-Match": "*"}); res.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE with If-Match returned unexpected status: %s", res.Status)
+	}
+}
+
+// racingStore implements Txn on top of a store without native transactions.
+// Before executing a transaction it sets key to value, simulating a
+// concurrent write
+type racingStore struct {
+	kv.KV
+
+	lock  sync.Mutex
+	key   string
+	value []byte
+}
+
+func (s *racingStore) Txn(ctx context.Context, ops []kv.Op) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.key != "" {
+		s.KV.Set(ctx, s.key, s.value)
+	}
+
+	for _, op := range ops {
+		if op.Type != kv.OpCompare {
+			continue
+		}
+
+		if node, err := s.Get(ctx, op.Key); err != nil || !bytes.Equal(node.Value, op.Value) {
+			return kv.ErrCompareFailed
+		}
+	}
+
+	for _, op := range ops {
+		if op.Type == kv.OpDelete {
+			if err := s.Delete(ctx, op.Key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func Test_ProxyConditionalDelete(t *testing.T) {
+	store, err := kv.Open("memory", nil)
+	if err != nil {
+		t.Fatalf("failed to open memory KV: %s", err)
+	}
+	defer store.Close()
+
+	racing := &racingStore{KV: store}
+
+	s := New(racing)
+	s.EtcdV2 = true
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	store.Set(context.Background(), "a", []byte("1"))
+
+	res, _ := do(t, "GET", srv.URL+"/v1/kv/a", "", nil)
+	tag := res.Header.Get("ETag")
+
+	// the key is modified after the precondition has been checked
+	racing.key, racing.value = "a", []byte("2")
+
+	if res, _ := do(t, "DELETE", srv.URL+"/v1/kv/a", "", map[string]string{"If-Match": tag}); res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("DELETE with If-Match of a concurrently modified key returned unexpected status: %s", res.Status)
+	}
+
+	racing.value = []byte("3")
+
+	if res, _ := do(t, "DELETE", srv.URL+"/v2/keys/a?prevValue=2", "", nil); res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("DELETE with prevValue of a concurrently modified key returned unexpected status: %s", res.Status)
+	}
+
+	if node, err := store.Get(context.Background(), "a"); err != nil || string(node.Value) != "3" {
+		t.Errorf("conditional DELETE removed a concurrently modified key: %v, %v", node, err)
+	}
+
+	racing.key = ""
+
+	res, _ = do(t, "GET", srv.URL+"/v1/kv/a", "", nil)
+	tag = res.Header.Get("ETag")
+
+	if res, _ := do(t, "DELETE", srv.URL+"/v1/kv/a", "", map[string]string{"If-Match": tag}); res.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE with If-Match returned unexpected status: %s", res.Status)
+	}
+
+	if _, err := store.Get(context.Background(), "a"); !errors.Is(err, kv.ErrNotFound) {
+		t.Errorf("DELETE with If-Match did not delete the key: %v", err)
+	}
+}
+
+func Test_ProxyETag(t *testing.T) {
+	a := &kv.Node{Value: []byte("a")}
+	b := &kv.Node{Value: []byte("b")}
+
+	if ETag(a) == ETag(b) {
+		t.Errorf("ETag() returned the same tag for different values")
+	}
+
+	if !matchETag(`"x", W/`+ETag(a), a) || matchETag(ETag(a), b) {
+		t.Errorf("matchETag() returned invalid result")
+	}
+}
+
+func Test_ProxyOps(t *testing.T) {
+	srv, store := newTestServer(t)
+	defer srv.Close()
+	defer store.Close()
+
+	do(t, "PUT", srv.URL+"/v1/kv/app/config/db", "postgres", nil)
+	do(t, "PUT", srv.URL+"/v1/kv/app/name", "gokv", nil)
+
+	if res, _ := do(t, "POST", srv.URL+"/v1/copy/app?to=/copied", "", nil); res.StatusCode != http.StatusNoContent {
+		t.Errorf("copy returned unexpected status: %s", res.Status)
+	}
+
+	if res, _ := do(t, "POST", srv.URL+"/v1/move/copied/config?to=/moved", "", nil); res.StatusCode != http.StatusNoContent {
+		t.Errorf("move returned unexpected status: %s", res.Status)
+	}
+
+	if _, body := do(t, "GET", srv.URL+"/v1/kv/moved/db?encoding=raw", "", nil); body != "postgres" {
+		t.Errorf("move/copy stored invalid value: %q", body)
+	}
+
+	if res, _ := do(t, "POST", srv.URL+"/v1/move/app", "", nil); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("move without destination returned unexpected status: %s", res.Status)
+	}
+
+	res, dump := do(t, "GET", srv.URL+"/v1/dump/app", "", nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(res.Header.Get("Content-Disposition"), "app.json") {
+		t.Fatalf("dump returned unexpected response: %s %v", res.Status, res.Header)
+	}
+
+	var tree Node
+	if err := json.Unmarshal([]byte(dump), &tree); err != nil || tree.Key != "" || tree.Children[0].Children[0].Key != "/config/db" {
+		t.Errorf("dump returned invalid tree: %s", dump)
+	}
+
+	if res, _ := do(t, "POST", srv.URL+"/v1/restore/restored", dump, nil); res.StatusCode != http.StatusNoContent {
+		t.Errorf("restore returned unexpected status: %s", res.Status)
+	}
+
+	for key, value := range map[string]string{"restored/config/db": "postgres", "restored/name": "gokv"} {
+		if _, body := do(t, "GET", srv.URL+"/v1/kv/"+key+"?encoding=raw", "", nil); body != value {
+			t.Errorf("restore stored invalid value for %s: %q", key, body)
+		}
+	}
+
+	if res, _ := do(t, "POST", srv.URL+"/v1/restore/restored", "{", nil); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("restore of invalid dump returned unexpected status: %s", res.Status)
+	}
+}
+
+func Test_ProxyValidate(t *testing.T) {
+	srv, store := newTestServer(t)
+	defer srv.Close()
+	defer store.Close()
+
+	cases := []struct {
+		format string
+		value  string
+		status int
+	}{
+		{"json", `{"a": [1, 2]}`, http.StatusNoContent},
+		{"json", `{"a": }`, http.StatusUnprocessableEntity},
+		{"json", `{} {}`, http.StatusUnprocessableEntity},
+		{"yaml", "a:\n  - 1\n  - 2\n", http.StatusNoContent},
+		{"yaml", "a: [1, 2\n", http.StatusUnprocessableEntity},
+		{"xml", "<a/>", http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		if res, body := do(t, "POST", srv.URL+"/v1/validate?format="+c.format, c.value, nil); res.StatusCode != c.status {
+			t.Errorf("validating %s %q returned %s instead of %d: %s", c.format, c.value, res.Status, c.status, body)
+		}
+	}
+}
+
+func Test_ProxyWait(t *testing.T) {
+	srv, store := newTestServer(t)
+	defer srv.Close()
+	defer store.Close()
+
+	do(t, "PUT", srv.URL+"/v1/kv/app/name", "gokv", nil)
+
+	result := make(chan string)
+	go func() {
+		_, body := do(t, "GET", srv.URL+"/v1/kv/app?recursive&wait", "", nil)
+		result <- body
+	}()
+
+	// the watch has to be established before modifying the key
+	time.Sleep(100 * time.Millisecond)
+	do(t, "PUT", srv.URL+"/v1/kv/app/version", "1", nil)
+
+	select {
+	case body := <-result:
+		var node Node
+		if err := json.Unmarshal([]byte(body), &node); err != nil || len(node.Children) != 2 {
+			t.Errorf("wait returned invalid node: %s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("wait did not return after modification")
+	}
+}
+
+func Test_ProxyUI(t *testing.T) {
+	srv, store := newTestServer(t)
+	defer srv.Close()
+	defer store.Close()
+
+	res, body := do(t, "GET", srv.URL+"/", "", nil)
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") || !strings.Contains(body, "<title>gokv</title>") {
+		t.Errorf("GET / returned unexpected response: %s %v", res.Status, res.Header)
+	}
+
+	// the UI must not depend on external assets
+	for _, ref := range []string{"http://", "https://", "src=\"", "<link"} {
+		if strings.Contains(body, ref) {
+			t.Errorf("UI references external asset: %s", ref)
+		}
+	}
+
+	if res, _ := do(t, "GET", srv.URL+"/missing", "", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of unknown path returned unexpected status: %s", res.Status)
+	}
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// uiIndex is the single page Web UI. It is self-contained so the proxy works
+// without access to external assets
+//
+//go:embed ui/index.html
+var uiIndex []byte
+
+func (s *Server) handleUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+		writeError(w, errorf(http.StatusNotFound, "%s not found", r.URL.Path))
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, errorf(http.StatusMethodNotAllowed, "method %s not allowed", r.Method))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write(uiIndex)
+}
@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
+
+// Defaults for watch streams, see Server
+const (
+	defaultHeartbeat    = 15 * time.Second
+	defaultWatchBuffer  = 256
+	defaultWriteTimeout = 10 * time.Second
+)
+
+// Types of Event not related to a change
+const (
+	// EventHeartbeat is sent periodically on idle WebSocket streams. SSE
+	// streams use comments instead
+	EventHeartbeat = "heartbeat"
+
+	// EventError is the last event of a stream closed by the server, e.g.
+	// because the client did not keep up. The watch can be resumed using the
+	// revision of the last event received
+	EventError = "error"
+)
+
+// Event is the JSON representation of a kv.Event sent by watch streams
+type Event struct {
+	Type     string `json:"type"`
+	Revision uint64 `json:"revision,omitempty"`
+	Node     *Node  `json:"node,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// more is set if further events of the same revision follow
+	more bool
+}
+
+// eventStream writes events to a single client
+type eventStream interface {
+	send(Event) error
+	heartbeat() error
+}
+
+// sseStream sends events as server-sent events. The revision is used as event
+// ID so browsers resume automatically when reconnecting. It is only set on the
+// last event of a revision, resuming from it would skip the others
+type sseStream struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (s *sseStream) write(format string, args ...interface{}) error {
+	// not all writers support deadlines; the error is ignored in that case
+	s.rc.SetWriteDeadline(time.Now().Add(s.timeout))
+
+	if _, err := fmt.Fprintf(s.w, format, args...); err != nil {
+		return err
+	}
+
+	return s.rc.Flush()
+}
+
+func (s *sseStream) send(ev Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	if ev.Revision != 0 && !ev.more {
+		return s.write("id: %d\nevent: %s\ndata: %s\n\n", ev.Revision, ev.Type, data)
+	}
+
+	return s.write("event: %s\ndata: %s\n\n", ev.Type, data)
+}
+
+func (s *sseStream) heartbeat() error {
+	return s.write(": %s\n\n", EventHeartbeat)
+}
+
+// wsStream sends events as WebSocket text messages
+type wsStream struct {
+	ws      *websocket.Conn
+	timeout time.Duration
+}
+
+func (s *wsStream) send(ev Event) error {
+	s.ws.SetWriteDeadline(time.Now().Add(s.timeout))
+	return websocket.JSON.Send(s.ws, ev)
+}
+
+func (s *wsStream) heartbeat() error {
+	return s.send(Event{Type: EventHeartbeat})
+}
+
+// checkOrigin rejects WebSocket connections initiated by pages served from
+// other origins. Clients not sending an Origin header are accepted
+func checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != r.Host {
+		return fmt.Errorf("cross-origin request from %q", origin)
+	}
+
+	config.Origin = u
+	return nil
+}
+
+// watchOptions returns the options of a watch request. The revision to resume
+// after is taken from the "after" query parameter or the Last-Event-ID header
+// sent by reconnecting browsers
+func watchOptions(r *http.Request) (kv.WatchOptions, error) {
+	opts := kv.WatchOptions{
+		Recursive: flag(r, "recursive"),
+	}
+
+	after := r.URL.Query().Get("after")
+	if after == "" {
+		after = r.Header.Get("Last-Event-ID")
+	}
+
+	if after != "" {
+		rev, err := strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			return opts, errorf(http.StatusBadRequest, "invalid revision %q", after)
+		}
+		opts.AfterRevision = rev
+	}
+
+	return opts, nil
+}
+
+// handleWatch streams changes of the requested key. WebSocket is used if the
+// client asks for an upgrade, server-sent events otherwise
+func (s *Server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, errorf(http.StatusMethodNotAllowed, "method %s not allowed", r.Method))
+		return
+	}
+
+	opts, err := watchOptions(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, watchPrefix)
+
+	if err := s.authorize(r, key, AccessRead, opts.Recursive); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// the watch is established before responding so clients do not miss
+	// changes made right after connecting
+	events, err := s.store.WatchEvents(ctx, key, opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		srv := websocket.Server{
+			Handshake: checkOrigin,
+			Handler: func(ws *websocket.Conn) {
+				// hijacked connections do not cancel the request context,
+				// so reading is required to notice disconnects
+				go func() {
+					io.Copy(ioutil.Discard, ws)
+					cancel()
+				}()
+
+				s.stream(ctx, events, &wsStream{ws: ws, timeout: s.WriteTimeout})
+			},
+		}
+
+		srv.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	out := &sseStream{w: w, rc: http.NewResponseController(w), timeout: s.WriteTimeout}
+
+	// send the headers right away so clients know the watch is established
+	if err := out.heartbeat(); err != nil {
+		return
+	}
+
+	s.stream(ctx, events, out)
+}
+
+// stream passes events to out until the client disconnects. At most
+// WatchBuffer events are queued per client; if the client falls further
+// behind the stream is closed with an EventError
+func (s *Server) stream(ctx context.Context, events <-chan kv.Event, out eventStream) {
+	queue := make(chan Event, s.WatchBuffer)
+	overflow := make(chan struct{})
+
+	go func() {
+		defer close(queue)
+
+		ev, ok := <-events
+		for ok {
+			// several events can share a revision, e.g. both halves of a
+			// move. Providers emit them together, so peeking at the next
+			// event tells whether ev is the last one of its revision
+			var next kv.Event
+			peeked := false
+
+			select {
+			case next, ok = <-events:
+				peeked = ok
+			default:
+			}
+
+			node := NewNode(ev.Node)
+			out := Event{
+				Type:     string(ev.Type),
+				Revision: ev.Revision,
+				Node:     &node,
+				more:     peeked && ev.Revision != 0 && next.Revision == ev.Revision,
+			}
+
+			select {
+			case queue <- out:
+			default:
+				close(overflow)
+				return
+			}
+
+			if peeked {
+				ev = next
+			} else if ok {
+				ev, ok = <-events
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(s.Heartbeat)
+	defer heartbeat.Stop()
+
+	var last uint64
+
+	for {
+		select {
+		case ev, ok := <-queue:
+			if !ok {
+				reason := "watch closed by provider"
+
+				select {
+				case <-overflow:
+					reason = "client does not keep up"
+				default:
+					if ctx.Err() != nil {
+						return
+					}
+				}
+
+				out.send(Event{
+					Type:     EventError,
+					Revision: last,
+					Error:    reason,
+				})
+				return
+			}
+
+			if err := out.send(ev); err != nil {
+				return
+			}
+
+			if ev.Revision != 0 && !ev.more {
+				last = ev.Revision
+			}
+		case <-heartbeat.C:
+			if err := out.heartbeat(); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nethack42/gokv"
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
+
+// sseEvent is a single parsed server-sent event
+type sseEvent struct {
+	id    string
+	name  string
+	event Event
+}
+
+// readSSE parses server-sent events from r and passes them to the returned
+// channel. Comments are reported as events named by the comment
+func readSSE(r *bufio.Reader) <-chan sseEvent {
+	ch := make(chan sseEvent, 16)
+
+	go func() {
+		defer close(ch)
+
+		var ev sseEvent
+
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			line = strings.TrimRight(line, "\n")
+
+			switch {
+			case line == "":
+				if ev.name != "" {
+					ch <- ev
+				}
+				ev = sseEvent{}
+			case strings.HasPrefix(line, ": "):
+				ev.name = ":" + line[2:]
+			case strings.HasPrefix(line, "id: "):
+				ev.id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				ev.name = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(line[6:]), &ev.event)
+			}
+		}
+	}()
+
+	return ch
+}
+
+func watchSSE(t *testing.T, url string, header map[string]string) (*http.Response, <-chan sseEvent) {
+	req, _ := http.NewRequest("GET", url, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to watch %s: %s", url, err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return res, nil
+	}
+
+	events := readSSE(bufio.NewReader(res.Body))
+
+	// the stream starts with a heartbeat once the watch is established
+	if ev := <-events; ev.name != ":"+EventHeartbeat {
+		t.Fatalf("stream did not start with a heartbeat: %v", ev)
+	}
+
+	return res, events
+}
+
+func nextSSE(t *testing.T, events <-chan sseEvent) sseEvent {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for event")
+	}
+
+	return sseEvent{}
+}
+
+func Test_ProxyWatchSSE(t *testing.T) {
+	srv, store := newTestServer(t)
+	defer srv.Close()
+	defer store.Close()
+
+	res, events := watchSSE(t, srv.URL+"/v1/watch/app?recursive", nil)
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("watch returned unexpected content type %q", ct)
+	}
+
+	do(t, "PUT", srv.URL+"/v1/kv/app/name", "gokv", nil)
+	do(t, "PUT", srv.URL+"/v1/kv/other", "1", nil)
+	do(t, "DELETE", srv.URL+"/v1/kv/app/name", "", nil)
+
+	ev := nextSSE(t, events)
+	if ev.name != "set" || ev.id != "1" || ev.event.Node == nil || ev.event.Node.Key != "app/name" || ev.event.Node.Value != "gokv" {
+		t.Errorf("unexpected set event: %+v", ev)
+	}
+
+	if ev := nextSSE(t, events); ev.name != "delete" || ev.id != "3" || ev.event.Revision != 3 {
+		t.Errorf("unexpected delete event: %+v", ev)
+	}
+
+	// resume after the first event using Last-Event-ID like browsers do
+	res, events = watchSSE(t, srv.URL+"/v1/watch/app?recursive", map[string]string{"Last-Event-ID": "1"})
+	defer res.Body.Close()
+
+	if ev := nextSSE(t, events); ev.name != "delete" || ev.id != "3" {
+		t.Errorf("resumed watch returned unexpected event: %+v", ev)
+	}
+
+	if res, _ := do(t, "GET", srv.URL+"/v1/watch/app?after=soon", "", nil); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("watch with invalid revision returned unexpected status: %s", res.Status)
+	}
+}
+
+func Test_ProxyWatchSSERevision(t *testing.T) {
+	srv, store := newTestServer(t)
+	defer srv.Close()
+	defer store.Close()
+
+	res, events := watchSSE(t, srv.URL+"/v1/watch/app?recursive", nil)
+	defer res.Body.Close()
+
+	do(t, "PUT", srv.URL+"/v1/kv/app/a", "1", nil)
+
+	// a move emits a delete and a set sharing one revision, only the last
+	// of them may carry the ID
+	if err := store.Move(context.Background(), "app/a", "app/b"); err != nil {
+		t.Fatalf("failed to move key: %s", err)
+	}
+
+	if ev := nextSSE(t, events); ev.name != "set" || ev.id != "1" {
+		t.Errorf("unexpected set event: %+v", ev)
+	}
+
+	if ev := nextSSE(t, events); ev.name != "delete" || ev.id != "" || ev.event.Revision != 2 {
+		t.Errorf("delete of move has unexpected ID: %+v", ev)
+	}
+
+	if ev := nextSSE(t, events); ev.name != "set" || ev.id != "2" || ev.event.Node == nil || ev.event.Node.Key != "app/b" {
+		t.Errorf("set of move has unexpected ID: %+v", ev)
+	}
+}
+
+func Test_ProxyWatchCompacted(t *testing.T) {
+	store, err := kv.Open("memory", nil)
+	if err != nil {
+		t.Fatalf("failed to open memory KV: %s", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+
+	// push the first revisions out of the history kept by the provider
+	for i := 0; i < 2000; i++ {
+		store.Set(ctx, "/key", []byte("value"))
+	}
+
+	s := New(store)
+
+	req := httptest.NewRequest("GET", "/v1/watch/key?after=1", nil)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusGone {
+		t.Errorf("resuming a compacted revision returned %d instead of %d", rec.Code, http.StatusGone)
+	}
+}
+
+func Test_ProxyWatchWebSocket(t *testing.T) {
+	srv, store := newTestServer(t)
+	defer srv.Close()
+	defer store.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/watch/app?recursive"
+
+	if _, err := websocket.Dial(wsURL, "", "http://example.com"); err == nil {
+		t.Errorf("cross-origin WebSocket connection has been accepted")
+	}
+
+	ws, err := websocket.Dial(wsURL, "", srv.URL)
+	if err != nil {
+		t.Fatalf("failed to connect WebSocket: %s", err)
+	}
+	defer ws.Close()
+
+	do(t, "PUT", srv.URL+"/v1/kv/app/name", "gokv", nil)
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var ev Event
+	if err := websocket.JSON.Receive(ws, &ev); err != nil || ev.Type != "set" || ev.Revision != 1 || ev.Node.Value != "gokv" {
+		t.Errorf("unexpected event: %+v, %v", ev, err)
+	}
+}
+
+func Test_ProxyWatchHeartbeat(t *testing.T) {
+	store, err := kv.Open("memory", nil)
+	if err != nil {
+		t.Fatalf("failed to open memory KV: %s", err)
+	}
+	defer store.Close()
+
+	s := New(store)
+	s.Heartbeat = 10 * time.Millisecond
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	res, events := watchSSE(t, srv.URL+"/v1/watch/app", nil)
+	defer res.Body.Close()
+
+	if ev := nextSSE(t, events); ev.name != ":"+EventHeartbeat {
+		t.Errorf("expected heartbeat but got %+v", ev)
+	}
+}
+
+// blockingStream is an eventStream that does not accept events until
+// released
+type blockingStream struct {
+	sending chan struct{}
+	release chan struct{}
+	events  []Event
+}
+
+func (b *blockingStream) send(ev Event) error {
+	select {
+	case b.sending <- struct{}{}:
+	default:
+	}
+
+	<-b.release
+	b.events = append(b.events, ev)
+	return nil
+}
+
+func (b *blockingStream) heartbeat() error {
+	return errors.New("no heartbeats expected")
+}
+
+func Test_ProxyWatchBackpressure(t *testing.T) {
+	s := New(nil)
+	s.WatchBuffer = 4
+
+	events := make(chan kv.Event)
+	out := &blockingStream{sending: make(chan struct{}, 1), release: make(chan struct{})}
+
+	done := make(chan struct{})
+	go func() {
+		s.stream(context.Background(), events, out)
+		close(done)
+	}()
+
+	// one event is being sent, four are queued and the next one overflows
+	for i := 1; i <= 6; i++ {
+		select {
+		case events <- kv.Event{Type: kv.EventSet, Revision: uint64(i)}:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("stream did not accept event %d", i)
+		}
+
+		if i == 1 {
+			<-out.sending
+		}
+	}
+
+	// receiving the last event does not mean it has been queued yet
+	time.Sleep(100 * time.Millisecond)
+	close(out.release)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stream has not been closed after overflowing")
+	}
+
+	if len(out.events) != 6 {
+		t.Fatalf("stream sent %d instead of 6 events: %+v", len(out.events), out.events)
+	}
+
+	if last := out.events[5]; last.Type != EventError || last.Revision != 5 {
+		t.Errorf("stream did not end with an error event: %+v", last)
+	}
+}
@@ -1,6 +1,7 @@
 package kv
 
 import (
+	"errors"
 	"testing"
 
 	"golang.org/x/net/context"
@@ -13,6 +14,53 @@ func KVTester(t *testing.T, kv Provider) {
 func RunProviderTests(t *testing.T, kv Provider) {
 	flatTests(t, kv)
 	dirTests(t, kv)
+	casTests(t, kv)
+}
+
+// casTests checks CAS semantics and that providers return the sentinel errors
+// of this package
+func casTests(t *testing.T, kv Provider) {
+	ctx := context.Background()
+
+	kv.Delete(ctx, "/cas")
+
+	if _, err := kv.Get(ctx, "/cas"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("kv: (cas-tests) Get() of non-existent key should fail with ErrNotFound: %v", err)
+	}
+
+	if err := kv.CAS(ctx, "/cas", []byte("1"), []byte("2")); !errors.Is(err, ErrCompareFailed) {
+		t.Errorf("kv: (cas-tests) CAS() of non-existent key with compare value should fail with ErrCompareFailed: %v", err)
+	}
+
+	if err := kv.CAS(ctx, "/cas", nil, []byte("1")); err != nil {
+		t.Errorf("kv: (cas-tests) CAS() of non-existent key returned error: %s", err)
+	}
+
+	if err := kv.CAS(ctx, "/cas", nil, []byte("2")); !errors.Is(err, ErrCompareFailed) {
+		t.Errorf("kv: (cas-tests) CAS() of existing key with nil compare should fail with ErrCompareFailed: %v", err)
+	}
+
+	if err := kv.CAS(ctx, "/cas", []byte("2"), []byte("3")); !errors.Is(err, ErrCompareFailed) {
+		t.Errorf("kv: (cas-tests) CAS() with wrong compare value should fail with ErrCompareFailed: %v", err)
+	}
+
+	if err := kv.CAS(ctx, "/cas", []byte("1"), []byte("3")); err != nil {
+		t.Errorf("kv: (cas-tests) CAS() returned error: %s", err)
+	}
+
+	if node, err := kv.Get(ctx, "/cas"); err != nil {
+		t.Errorf("kv: (cas-tests) Get() returned error: %s", err)
+	} else if string(node.Value) != "3" {
+		t.Errorf("kv: (cas-tests) Get() returned invalid value after CAS: %q", node.Value)
+	}
+
+	if err := kv.Delete(ctx, "/cas"); err != nil {
+		t.Errorf("kv: (cas-tests) Delete() returned error: %s", err)
+	}
+
+	if _, err := kv.Get(ctx, "/cas"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("kv: (cas-tests) Get() of deleted key should fail with ErrNotFound: %v", err)
+	}
 }
 
 func dirTests(t *testing.T, kv Provider) {
@@ -1,7 +1,11 @@
 package kv
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -51,7 +55,67 @@ func (w *wrapper) Watch(ctx context.Context, key string) (*Node, error) {
 		return v.Watch(ctx, key)
 	}
 
-	return nil, fmt.Errorf("Watch not supported by provider")
+	return nil, fmt.Errorf("Watch %w", ErrNotSupported)
+}
+
+// WatchEvents falls back to calling Watch in a loop if the provider does not
+// support streaming events. Note that changes happening between two calls to
+// Watch may be missed in this case
+func (w *wrapper) WatchEvents(ctx context.Context, key string, opts WatchOptions) (<-chan Event, error) {
+	if v, ok := w.Provider.(EventWatcher); ok {
+		return v.WatchEvents(ctx, key, opts)
+	}
+
+	watcher, ok := w.Provider.(KeyWatcher)
+	if !ok {
+		return nil, fmt.Errorf("WatchEvents %w", ErrNotSupported)
+	}
+
+	if opts.AfterRevision != 0 {
+		return nil, fmt.Errorf("resuming watches %w", ErrNotSupported)
+	}
+
+	ch := make(chan Event)
+
+	go func() {
+		defer close(ch)
+
+		for {
+			var ev Event
+
+			node, err := watcher.Watch(ctx, key)
+			switch {
+			case errors.Is(err, ErrNotFound):
+				ev = Event{
+					Type: EventDelete,
+					Node: Node{Key: strings.Trim(key, "/")},
+				}
+			case err != nil:
+				return
+			default:
+				ev = Event{
+					Type: EventSet,
+					Node: *node,
+				}
+			}
+
+			select {
+			case ch <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (w *wrapper) Txn(ctx context.Context, ops []Op) error {
+	if v, ok := w.Provider.(Transactor); ok {
+		return v.Txn(ctx, ops)
+	}
+
+	return fmt.Errorf("Txn %w", ErrNotSupported)
 }
 
 func (w *wrapper) Move(ctx context.Context, keyOld, keyNew string) error {
@@ -59,7 +123,7 @@ func (w *wrapper) Move(ctx context.Context, keyOld, keyNew string) error {
 		return v.Move(ctx, keyOld, keyNew)
 	}
 
-	return fmt.Errorf("Move not supported by provider")
+	return fmt.Errorf("Move %w", ErrNotSupported)
 }
 
 func (w *wrapper) Copy(ctx context.Context, keyOld, keyNew string) error {
@@ -67,5 +131,63 @@ func (w *wrapper) Copy(ctx context.Context, keyOld, keyNew string) error {
 		return v.Copy(ctx, keyOld, keyNew)
 	}
 
-	return fmt.Errorf("Copy not supported by provider")
+	return fmt.Errorf("Copy %w", ErrNotSupported)
+}
+
+func (w *wrapper) SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if v, ok := w.Provider.(TTLSetter); ok {
+		return v.SetTTL(ctx, key, value, ttl)
+	}
+
+	return fmt.Errorf("SetTTL %w", ErrNotSupported)
+}
+
+func (w *wrapper) CASTTL(ctx context.Context, key string, compare, value []byte, ttl time.Duration) error {
+	if v, ok := w.Provider.(TTLSwapper); ok {
+		return v.CASTTL(ctx, key, compare, value, ttl)
+	}
+
+	return fmt.Errorf("CASTTL %w", ErrNotSupported)
+}
+
+func (w *wrapper) Lock(ctx context.Context, key string) (Lock, error) {
+	if v, ok := w.Provider.(Locker); ok {
+		return v.Lock(ctx, key)
+	}
+
+	return nil, fmt.Errorf("Lock %w", ErrNotSupported)
+}
+
+func (w *wrapper) Versions(ctx context.Context, key string) ([]Version, error) {
+	if v, ok := w.Provider.(Versioner); ok {
+		return v.Versions(ctx, key)
+	}
+
+	return nil, fmt.Errorf("Versions %w", ErrNotSupported)
+}
+
+func (w *wrapper) GetVersion(ctx context.Context, key, version string) (*Node, error) {
+	if v, ok := w.Provider.(Versioner); ok {
+		return v.GetVersion(ctx, key, version)
+	}
+
+	return nil, fmt.Errorf("GetVersion %w", ErrNotSupported)
+}
+
+func (w *wrapper) RestoreVersion(ctx context.Context, key, version string) error {
+	if v, ok := w.Provider.(Versioner); ok {
+		return v.RestoreVersion(ctx, key, version)
+	}
+
+	return fmt.Errorf("RestoreVersion %w", ErrNotSupported)
+}
+
+// Close closes the provider if it implements io.Closer. Providers without
+// resources to release are left untouched
+func (w *wrapper) Close() error {
+	if v, ok := w.Provider.(io.Closer); ok {
+		return v.Close()
+	}
+
+	return nil
 }